@@ -10,7 +10,7 @@ func (b *IngestBuffer) ServeHTTPPut(writer http.ResponseWriter, request *http.Re
 	scanner := bufio.NewScanner(request.Body)
 
 	for scanner.Scan() {
-		p, err := lineprotocol.Parse(scanner.Text())
+		p, err := lineprotocol.ParseStates(scanner.Text())
 
 		b.Mux.Lock()
 		if err == nil {
@@ -32,7 +32,7 @@ func (b *IngestBuffer) HandleTCP(conn net.Conn) error {
 	scanner := bufio.NewScanner(conn)
 
 	for scanner.Scan() {
-		p, err := lineprotocol.Parse(scanner.Text())
+		p, err := lineprotocol.ParseStates(scanner.Text())
 
 		b.Mux.Lock()
 		if err == nil {
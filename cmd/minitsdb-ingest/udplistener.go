@@ -34,7 +34,7 @@ func (b *IngestBuffer) ListenUDP(address string) error {
 }
 
 func (b *IngestBuffer) HandleUDP(line string) {
-	p, err := lineprotocol.Parse(line)
+	p, err := lineprotocol.ParseStates(line)
 
 	b.Mux.Lock()
 	if err == nil {
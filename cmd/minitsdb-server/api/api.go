@@ -18,12 +18,23 @@ type Config struct {
 	MaxPoints   int64
 }
 
-func Start(db *minitsdb.Database, conf Config, shutdown chan struct{}) {
+// Start serves the API until shutdown is closed
+// deletions, reloads, backups and promotions are passed to the main loop through their channels, as they modify the database
+func Start(db *minitsdb.Database, conf Config, shutdown chan struct{}, deletes chan<- DeleteRequest, reloads chan<- ReloadRequest, backups chan<- BackupRequest, promotions chan<- PromoteRequest) {
 	r := mux.NewRouter() // move this out of the if block when more handlers are added
 
 	r.Handle("/test", handleTest{})
 	r.Handle("/query", queryhandler.New(db))
 	r.Handle("/list", handleList{db: db})
+	r.Handle("/stats", handleStats{db: db})
+	r.Handle("/stats/cache", handleCacheStats{db: db})
+	r.Handle("/delete", handleDelete{requests: deletes}).Methods(http.MethodDelete, http.MethodPost)
+	r.Handle("/reload", handleReload{requests: reloads}).Methods(http.MethodPost)
+	r.Handle("/backup", handleBackup{requests: backups}).Methods(http.MethodGet)
+	r.Handle("/replication/series", handleReplicaSeries{db: db}).Methods(http.MethodGet)
+	r.Handle("/replication/bucket", handleReplicaBucket{db: db}).Methods(http.MethodGet)
+	r.Handle("/replication/blocks", handleReplicaBlocks{db: db}).Methods(http.MethodGet)
+	r.Handle("/replication/promote", handlePromote{requests: promotions}).Methods(http.MethodPost)
 
 	srv := &http.Server{
 		Addr:    conf.Address,
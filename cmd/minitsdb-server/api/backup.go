@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// ErrBackupFollower indicates that a backup was requested from a follower
+// replication rewrites data files in place, which snapshots hard link, so backups must be taken from the leader
+var ErrBackupFollower = errors.New("backups are not available while replicating a leader")
+
+// BackupRequest asks the main loop to flush all series and take a snapshot of the database
+type BackupRequest struct {
+	result chan backupResult
+}
+
+type backupResult struct {
+	snapshot minitsdb.Snapshot
+	err      error
+}
+
+// Execute takes the snapshot, must be called from the goroutine that inserts points into the database
+// the snapshot is passed to the HTTP handler that created the request, which streams and removes it
+func (r BackupRequest) Execute(db *minitsdb.Database) {
+	var result backupResult
+
+	result.snapshot, result.err = db.Snapshot()
+
+	if result.err != nil {
+		logrus.WithError(result.err).Error("Could not take snapshot")
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"series": result.snapshot.Series,
+			"files":  result.snapshot.Files,
+			"linked": result.snapshot.Linked,
+			"bytes":  result.snapshot.Bytes,
+		}).Info("Took snapshot")
+	}
+
+	r.result <- result
+}
+
+// Reject refuses the backup
+func (r BackupRequest) Reject(err error) {
+	r.result <- backupResult{err: err}
+}
+
+type handleBackup struct {
+	requests chan<- BackupRequest
+}
+
+func (h handleBackup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := BackupRequest{
+		result: make(chan backupResult, 1),
+	}
+
+	select {
+	case h.requests <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	// the snapshot is removed even if the client is gone
+	result := <-req.result
+
+	if result.err == ErrBackupFollower {
+		http.Error(w, result.err.Error(), http.StatusConflict)
+		return
+	} else if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.snapshot.Remove()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"minitsdb-%s.tar\"", time.Now().Format("20060102-150405")))
+
+	// the status was already sent, the client detects the error by the truncated archive
+	if err := result.snapshot.WriteTar(w); err != nil {
+		logrus.WithError(err).Warning("Could not send snapshot")
+	}
+}
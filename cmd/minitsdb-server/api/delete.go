@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb"
+	. "github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"net/http"
+)
+
+// DeleteRequest describes points or entire series to be removed from the database
+type DeleteRequest struct {
+	Series map[string]string
+	// Columns selects the columns whose values are removed, all points in the time range are removed if empty
+	Columns []map[string]string
+
+	TimeStart int64
+	TimeEnd   int64
+
+	// RemoveSeries deletes the matching series including their directories
+	RemoveSeries bool
+
+	result chan deleteResult
+}
+
+type deleteResultSeries struct {
+	Tags    map[string]string
+	Removed bool
+	Files   []minitsdb.Deletion
+}
+
+type deleteResult struct {
+	series []deleteResultSeries
+	err    error
+}
+
+func (r DeleteRequest) check() error {
+	if len(r.Series) == 0 {
+		return errors.New("series description missing")
+	}
+
+	if r.RemoveSeries {
+		if len(r.Columns) != 0 || r.TimeStart != 0 || r.TimeEnd != 0 {
+			return errors.New("columns and time range must be empty when removing series")
+		}
+		return nil
+	}
+
+	if r.TimeEnd < r.TimeStart {
+		return errors.New("invalid time range")
+	}
+
+	for _, c := range r.Columns {
+		if len(c) == 0 {
+			return errors.New("column description incomplete")
+		}
+	}
+
+	return nil
+}
+
+// Execute performs the deletion, must be called from the goroutine that inserts points into the database
+// the result is passed to the HTTP handler that created the request
+func (r DeleteRequest) Execute(db *minitsdb.Database) {
+	var result deleteResult
+
+	for _, s := range db.FindSeries(r.Series, true) {
+		series := deleteResultSeries{
+			Tags: s.Tags,
+		}
+
+		if r.RemoveSeries {
+			// series are matched by path, so the remaining pointers can still be used after db.Series was replaced
+			result.err = db.RemoveSeries(s)
+			series.Removed = result.err == nil
+		} else {
+			var columns []*minitsdb.Column
+			if len(r.Columns) != 0 {
+				columns = make([]*minitsdb.Column, 0)
+				for _, c := range r.Columns {
+					columns = append(columns, s.FindColumns(c, true)...)
+				}
+			}
+
+			if columns == nil || len(columns) > 0 {
+				series.Files, result.err = s.Delete(TimeRange{Start: r.TimeStart, End: r.TimeEnd}, columns)
+			}
+		}
+
+		result.series = append(result.series, series)
+
+		if result.err != nil {
+			break
+		}
+	}
+
+	for _, series := range result.series {
+		logrus.WithFields(logrus.Fields{
+			"series":  series.Tags,
+			"removed": series.Removed,
+			"files":   len(series.Files),
+			"range":   TimeRange{Start: r.TimeStart, End: r.TimeEnd},
+		}).Info("Deleted points")
+	}
+
+	r.result <- result
+}
+
+// Reject passes an error to the HTTP handler that created the request without deleting anything
+func (r DeleteRequest) Reject(err error) {
+	r.result <- deleteResult{err: err}
+}
+
+type handleDelete struct {
+	requests chan<- DeleteRequest
+}
+
+func (h handleDelete) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d := yaml.NewDecoder(r.Body)
+	d.SetStrict(true)
+
+	var req DeleteRequest
+
+	if err := d.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.result = make(chan deleteResult, 1)
+
+	select {
+	case h.requests <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	result := <-req.result
+
+	if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(result.series) == 0 {
+		http.Error(w, "no matching series found", http.StatusNotFound)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(result.series)
+}
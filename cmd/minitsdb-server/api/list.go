@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
 	"io"
 	"net/http"
 )
@@ -14,6 +15,12 @@ type handleList struct {
 type handleListColumn struct {
 	Tags     map[string]string
 	Decimals int
+	// Float is true if the column returns float values, which are not scaled by Decimals
+	Float bool
+	// States holds the labels of bool and enum columns, binary query results hold the index of the state
+	States []string
+	// Function is the name of the function queried when a query does not specify one
+	Function string
 }
 
 type handleListSeries struct {
@@ -37,9 +44,10 @@ func (h handleList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var matches []*minitsdb.Series
 
 	if filter == nil {
-		matches = make([]*minitsdb.Series, len(h.db.Series))
-		for i := range h.db.Series {
-			matches[i] = &h.db.Series[i]
+		list := h.db.SeriesList()
+		matches = make([]*minitsdb.Series, len(list))
+		for i := range list {
+			matches[i] = &list[i]
 		}
 	} else {
 		matches = h.db.FindSeries(filter, true)
@@ -55,6 +63,9 @@ func (h handleList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		for j, c := range s.Columns {
 			data[i].Columns[j].Tags = c.Tags
 			data[i].Columns[j].Decimals = c.Decimals
+			data[i].Columns[j].Float = c.Float
+			data[i].Columns[j].States = c.States
+			data[i].Columns[j].Function = downsampling.FunctionName(c.DefaultFunction)
 		}
 	}
 
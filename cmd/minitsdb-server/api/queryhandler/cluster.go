@@ -47,10 +47,12 @@ func (c *QueryCluster) Execute() error {
 		columns = append(columns, subQuery.Columns...)
 	}
 
-	query := c.Parameters.Series.Query(columns, c.Parameters.Range, c.Parameters.TimeStep)
+	// the data files are listed when the query is created, retention must not remove them before they are read
+	bucket := c.Parameters.Series.QueryBucket(c.Parameters.TimeStep)
+	bucket.Mux.RLock()
+	defer bucket.Mux.RUnlock()
 
-	query.Bucket.Mux.RLock()
-	defer query.Bucket.Mux.RUnlock()
+	query := bucket.Query(columns, c.Parameters.Range, c.Parameters.TimeStep)
 
 	defer func() {
 		for _, subQuery := range c.SubQueries {
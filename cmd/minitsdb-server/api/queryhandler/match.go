@@ -2,7 +2,6 @@ package queryhandler
 
 import (
 	"github.com/martin2250/minitsdb/minitsdb"
-	"github.com/martin2250/minitsdb/minitsdb/downsampling"
 )
 
 func queriesFromDescription(db *minitsdb.Database, desc queryDescription) ([]*SubQuery, error) {
@@ -40,7 +39,7 @@ func queriesFromDescription(db *minitsdb.Database, desc queryDescription) ([]*Su
 						qc.Function = column.DefaultFunction
 					} else {
 						var err error
-						qc.Function, err = downsampling.FindFunction(colspec.Function)
+						qc.Function, err = column.FindFunction(colspec.Function)
 						if err != nil {
 							return nil, err
 						}
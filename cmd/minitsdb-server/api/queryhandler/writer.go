@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
 	"github.com/martin2250/minitsdb/minitsdb/storage"
 	"io"
 	"math"
@@ -49,6 +50,23 @@ func (w *httpQueryResultWriter) WriteText(buffer storage.PointBuffer) error {
 	for i := range buffer.Values[0] {
 		line := make([]byte, 0, 100)
 		for j := range buffer.Values {
+			// values of columns that are not stored for this time are written as null
+			if buffer.Values[j][i] == storage.Missing {
+				line = append(line, "null "...)
+				continue
+			}
+			// states of bool and enum columns are written as their labels
+			if j > 0 && w.Columns[j-1].States() != nil {
+				line = append(line, w.Columns[j-1].Column.StateLabel(buffer.Values[j][i])...)
+				line = append(line, ' ')
+				continue
+			}
+			// float values are written as is, clients scale integers by the column decimals
+			if j > 0 && w.Columns[j-1].Float() {
+				line = strconv.AppendFloat(line, storage.ValueFloat(buffer.Values[j][i]), 'g', -1, 64)
+				line = append(line, ' ')
+				continue
+			}
 			line = strconv.AppendInt(line, buffer.Values[j][i], 10)
 			line = append(line, ' ')
 		}
@@ -84,9 +102,22 @@ func (w *httpQueryResultWriter) WriteBinary(buffer storage.PointBuffer) error {
 
 	for i, vals := range buffer.Values[1:] {
 		fac := math.Pow10(-w.Columns[i].Column.Decimals)
+		// counts are not scaled by the decimals of the column
+		if downsampling.CountsPoints(w.Columns[i].Function) {
+			fac = 1
+		}
 		fac *= w.Columns[i].Factor
+		float := w.Columns[i].Float()
 		valuesf := make([]float64, len(vals))
 		for j := range valuesf {
+			if vals[j] == storage.Missing {
+				valuesf[j] = math.NaN()
+				continue
+			}
+			if float {
+				valuesf[j] = storage.ValueFloat(vals[j]) * w.Columns[i].Factor
+				continue
+			}
 			valuesf[j] = float64(vals[j]) * fac
 		}
 		err = binary.Write(w.Writer, binary.LittleEndian, valuesf)
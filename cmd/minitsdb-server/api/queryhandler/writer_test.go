@@ -0,0 +1,94 @@
+package queryhandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteTextMissing(t *testing.T) {
+	var out bytes.Buffer
+
+	column := minitsdb.Column{Decimals: 1}
+
+	w := httpQueryResultWriter{
+		Writer: &out,
+		Mux:    &sync.Mutex{},
+		Columns: []minitsdb.QueryColumn{
+			{Column: &column, Function: downsampling.Mean},
+			{Column: &column, Function: downsampling.Count},
+		},
+	}
+
+	buffer := storage.PointBuffer{Values: [][]int64{{10, 20}, {storage.Missing, 15}, {3, 4}}}
+
+	if err := w.WriteText(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	if len(lines) != 3 || lines[1] != "10 null 3" || lines[2] != "20 15 4" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestWriteBinaryMissing(t *testing.T) {
+	var out bytes.Buffer
+
+	column := minitsdb.Column{Decimals: 1}
+
+	w := httpQueryResultWriter{
+		Writer: &out,
+		Mux:    &sync.Mutex{},
+		Columns: []minitsdb.QueryColumn{
+			{Column: &column, Function: downsampling.Mean, Factor: 1},
+			{Column: &column, Function: downsampling.Count, Factor: 1},
+		},
+		binary: true,
+	}
+
+	buffer := storage.PointBuffer{Values: [][]int64{{10, 20}, {storage.Missing, 15}, {3, 4}}}
+
+	if err := w.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	// the json header ends with a newline, the binary values follow
+	newline := bytes.IndexByte(out.Bytes(), '\n')
+
+	var header struct {
+		NumValues int
+		NumPoints int
+	}
+	if err := json.Unmarshal(out.Bytes()[:newline], &header); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.NumValues != 2 || header.NumPoints != 2 {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	times := make([]int64, 2)
+	values := make([]float64, 4)
+
+	r := bytes.NewReader(out.Bytes()[newline+1:])
+	if err := binary.Read(r, binary.LittleEndian, times); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, values); err != nil {
+		t.Fatal(err)
+	}
+
+	// missing values are NaN, values are scaled by the decimals and counts are not
+	if times[0] != 10 || times[1] != 20 || !math.IsNaN(values[0]) || values[1] != 1.5 || values[2] != 3 || values[3] != 4 {
+		t.Errorf("unexpected output %v %v", times, values)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// ReloadRequest asks the main loop to reload the series configuration of the database
+type ReloadRequest struct {
+	result chan reloadResult
+}
+
+type reloadResultSeries struct {
+	Path    string
+	Tags    map[string]string
+	Added   bool
+	Removed bool
+	Updated bool
+	Error   string `json:",omitempty"`
+}
+
+type reloadResult struct {
+	series []reloadResultSeries
+	err    error
+}
+
+// NewReloadRequest creates a request whose result is only logged, e.g. for reloads triggered by signals
+func NewReloadRequest() ReloadRequest {
+	return ReloadRequest{
+		result: make(chan reloadResult, 1),
+	}
+}
+
+// Execute performs the reload, must be called from the goroutine that inserts points into the database
+// the result is passed to the HTTP handler that created the request
+func (r ReloadRequest) Execute(db *minitsdb.Database) {
+	var result reloadResult
+
+	var reloads []minitsdb.Reload
+	reloads, result.err = db.Reload()
+
+	if result.err != nil {
+		logrus.WithError(result.err).Error("Could not reload series")
+	}
+
+	for _, reload := range reloads {
+		series := reloadResultSeries{
+			Path:    reload.Path,
+			Tags:    reload.Tags,
+			Added:   reload.Added,
+			Removed: reload.Removed,
+			Updated: reload.Updated,
+		}
+
+		entry := logrus.WithFields(logrus.Fields{
+			"series":  reload.Tags,
+			"path":    reload.Path,
+			"added":   reload.Added,
+			"removed": reload.Removed,
+			"updated": reload.Updated,
+		})
+
+		if reload.Err != nil {
+			series.Error = reload.Err.Error()
+			entry.WithError(reload.Err).Warning("Could not reload series")
+		} else {
+			entry.Info("Reloaded series")
+		}
+
+		result.series = append(result.series, series)
+	}
+
+	r.result <- result
+}
+
+// Reject passes an error to the HTTP handler that created the request without reloading
+func (r ReloadRequest) Reject(err error) {
+	logrus.WithError(err).Warning("Could not reload series")
+	r.result <- reloadResult{err: err}
+}
+
+type handleReload struct {
+	requests chan<- ReloadRequest
+}
+
+func (h handleReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := NewReloadRequest()
+
+	select {
+	case h.requests <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	result := <-req.result
+
+	if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(result.series)
+}
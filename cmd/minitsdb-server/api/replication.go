@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// ErrReadOnly indicates that a request modifies the database of a follower, which only replicates its leader
+var ErrReadOnly = errors.New("server is a read-only follower")
+
+// PromoteRequest asks the main loop to stop replicating and accept points as leader
+type PromoteRequest struct {
+	result chan error
+}
+
+// Execute flushes the replicated buffers of all series, must be called from the goroutine that inserts points
+// into the database after replication was stopped. The result is passed to the HTTP handler that created the request
+func (r PromoteRequest) Execute(db *minitsdb.Database) {
+	for i := range db.Series {
+		db.Series[i].FlushAll()
+	}
+
+	logrus.WithField("series", len(db.Series)).Info("Promoted to leader")
+
+	r.result <- nil
+}
+
+// Reject passes an error to the HTTP handler that created the request
+func (r PromoteRequest) Reject(err error) {
+	r.result <- err
+}
+
+type handlePromote struct {
+	requests chan<- PromoteRequest
+}
+
+func (h handlePromote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := PromoteRequest{
+		result: make(chan error, 1),
+	}
+
+	select {
+	case h.requests <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	if err := <-req.result; err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type handleReplicaSeries struct {
+	db *minitsdb.Database
+}
+
+func (h handleReplicaSeries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	replicas, err := h.db.Replicas()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(replicas)
+}
+
+// replicaBucket finds the bucket selected by the series and bucket parameters of a replication request
+func replicaBucket(db *minitsdb.Database, r *http.Request) (*minitsdb.Bucket, error) {
+	s := db.SeriesByDirectory(r.FormValue("series"))
+	if s == nil {
+		return nil, fmt.Errorf("series %s not found", r.FormValue("series"))
+	}
+
+	i, err := strconv.Atoi(r.FormValue("bucket"))
+	if err != nil || i < 0 || i >= len(s.Buckets) {
+		return nil, fmt.Errorf("invalid bucket %s", r.FormValue("bucket"))
+	}
+
+	return &s.Buckets[i], nil
+}
+
+type handleReplicaBucket struct {
+	db *minitsdb.Database
+}
+
+func (h handleReplicaBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := replicaBucket(h.db, r)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	replica, err := b.Replica()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(replica)
+}
+
+type handleReplicaBlocks struct {
+	db *minitsdb.Database
+}
+
+func (h handleReplicaBlocks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := replicaBucket(h.db, r)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	first, err := strconv.ParseInt(r.FormValue("first"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid first block", http.StatusBadRequest)
+		return
+	}
+
+	count, err := strconv.ParseInt(r.FormValue("count"), 10, 64)
+	if err != nil || count < 1 {
+		http.Error(w, "invalid block count", http.StatusBadRequest)
+		return
+	}
+
+	blocks, err := b.ReplicaBlocks(r.FormValue("file"), first, count)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	blocks.WriteTo(w)
+}
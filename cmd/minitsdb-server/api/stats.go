@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"net/http"
+	"time"
+)
+
+type handleStats struct {
+	db *minitsdb.Database
+}
+
+type handleStatsBucket struct {
+	TimeStep  int64
+	Retention int64
+	Files     int
+	Blocks    int64
+	// TimeStart is the start of the oldest file on disk
+	TimeStart *int64
+
+	ExpiredFiles  int
+	ExpiredBlocks int64
+	LastExpired   *time.Time
+}
+
+type handleStatsSeries struct {
+	Tags    map[string]string
+	Buckets []handleStatsBucket
+}
+
+func (h handleStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := h.db.SeriesList()
+	data := make([]handleStatsSeries, len(list))
+
+	for i := range list {
+		s := &list[i]
+		data[i].Tags = s.Tags
+		data[i].Buckets = make([]handleStatsBucket, len(s.Buckets))
+
+		for j := range s.Buckets {
+			b := &s.Buckets[j]
+			stats := &data[i].Buckets[j]
+
+			b.Mux.RLock()
+			stats.TimeStep = b.TimeStep
+			stats.Retention = b.Retention
+			stats.Files = len(b.DataFiles)
+			for _, df := range b.DataFiles {
+				stats.Blocks += df.Blocks
+			}
+			if len(b.DataFiles) > 0 {
+				timeStart := b.DataFiles[0].TimeStart
+				stats.TimeStart = &timeStart
+			}
+			stats.ExpiredFiles = b.Expired.Files
+			stats.ExpiredBlocks = b.Expired.Blocks
+			if b.Expired.Files > 0 {
+				last := b.Expired.Last
+				stats.LastExpired = &last
+			}
+			b.Mux.RUnlock()
+		}
+	}
+
+	// send data
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(data)
+}
+
+type handleCacheStats struct {
+	db *minitsdb.Database
+}
+
+func (h handleCacheStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(h.db.Cache.Stats())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// backfillQueue tracks the series with points older than their archived data
+// every backfill rewrites entire data files, so the points are collected over a longer interval.
+// The points are queued by the series, which keeps them in its write-ahead log until they are backfilled
+type backfillQueue struct {
+	pending map[*minitsdb.Series]bool
+	count   int
+	max     int
+}
+
+func newBackfillQueue(max int) *backfillQueue {
+	return &backfillQueue{
+		pending: make(map[*minitsdb.Series]bool),
+		max:     max,
+	}
+}
+
+// add queues a point, returns true once enough points were collected to backfill them early
+func (q *backfillQueue) add(s *minitsdb.Series, p storage.Point) (bool, error) {
+	if err := s.QueueBackfill(p); err != nil {
+		return false, err
+	}
+
+	q.pending[s] = true
+	q.count++
+
+	return q.count >= q.max, nil
+}
+
+// run inserts the queued points into the archived time ranges of their series and logs the rewritten data files
+// must be called before series are added or removed, as the queue holds pointers to series
+func (q *backfillQueue) run() {
+	for s := range q.pending {
+		backfills, err := s.RunBackfill()
+
+		for _, b := range backfills {
+			log.WithFields(log.Fields{
+				"path":   b.Path,
+				"before": b.BlocksBefore,
+				"after":  b.BlocksAfter,
+				"points": b.Points,
+			}).Info("Backfilled data file")
+		}
+
+		if err != nil {
+			log.WithError(err).WithField("series", s.Tags).Error("Failed to backfill points")
+		}
+
+		delete(q.pending, s)
+	}
+
+	q.count = 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// runCompaction periodically rewrites underfilled data files and compresses cold data files until shutdown is closed
+// runs in its own goroutine, as compacting large files takes a while
+func runCompaction(db *minitsdb.Database, conf confCompaction, confCompress confCompression, shutdown <-chan struct{}) {
+	var tickerCompact, tickerCompress <-chan time.Time
+
+	if conf.Interval > 0 {
+		ticker := time.NewTicker(conf.Interval)
+		defer ticker.Stop()
+		tickerCompact = ticker.C
+	}
+
+	if confCompress.Interval > 0 {
+		ticker := time.NewTicker(confCompress.Interval)
+		defer ticker.Stop()
+		tickerCompress = ticker.C
+	}
+
+	if tickerCompact == nil && tickerCompress == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-tickerCompact:
+			compact(db, conf)
+		case <-tickerCompress:
+			compress(db, confCompress)
+		}
+	}
+}
+
+// compact rewrites underfilled data files of all series
+func compact(db *minitsdb.Database, conf confCompaction) {
+	compactions, err := db.Compact(conf.Fill)
+
+	for _, c := range compactions {
+		log.WithFields(log.Fields{
+			"path":   c.Path,
+			"before": c.BlocksBefore,
+			"after":  c.BlocksAfter,
+			"points": c.Points,
+		}).Info("Compacted data file")
+	}
+
+	if err != nil {
+		log.WithError(err).Error("Failed to compact data files")
+	}
+}
+
+// compress packs cold data files of all series
+func compress(db *minitsdb.Database, conf confCompression) {
+	compressions, err := db.Compress(conf.Age)
+
+	for _, c := range compressions {
+		log.WithFields(log.Fields{
+			"path":   c.Path,
+			"blocks": c.Blocks,
+			"before": c.BytesBefore,
+			"after":  c.BytesAfter,
+		}).Info("Compressed data file")
+	}
+
+	if err != nil {
+		log.WithError(err).Error("Failed to compress data files")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/martin2250/minitsdb/cmd/minitsdb-server/api"
+	"github.com/martin2250/minitsdb/minitsdb"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"math"
@@ -15,6 +16,43 @@ type confIngest struct {
 	Buffer  int
 }
 
+type confCompaction struct {
+	// Interval is the time between checks for underfilled data files, zero (default) disables compaction
+	Interval time.Duration
+	// Fill is the fraction of used bytes below which a data file is compacted
+	Fill float64
+}
+
+type confCompression struct {
+	// Interval is the time between checks for cold data files, zero (default) disables compression
+	Interval time.Duration
+	// Age is the time between the end of a data file and the last point on disk before the file is compressed
+	Age time.Duration
+}
+
+type confBackfill struct {
+	// Interval is the time between backfills of points older than the archived data of their series
+	// every backfill rewrites the affected data files, so points are collected for the whole interval
+	Interval time.Duration
+	// MaxPoints is the number of collected points that triggers a backfill before the interval ends
+	MaxPoints int
+}
+
+type confCache struct {
+	// Size is the number of bytes of decoded values that are kept in memory for queries, zero disables the cache
+	Size int64
+}
+
+type confReplication struct {
+	// Leader is the API address of the server to replicate, e.g. http://192.168.2.91:8080
+	// if set, the server is a read-only follower until it is promoted through the API
+	Leader string
+	// Interval is the time between polls of the leader
+	Interval time.Duration
+	// Timeout limits every request to the leader
+	Timeout time.Duration
+}
+
 type Configuration struct {
 	DatabasePath string
 
@@ -24,6 +62,22 @@ type Configuration struct {
 
 	ShutdownTimeout time.Duration
 
+	// RetentionInterval is the time between checks for expired data files, zero disables expiry
+	RetentionInterval time.Duration
+
+	Compaction confCompaction
+
+	Compression confCompression
+
+	Backfill confBackfill
+
+	Cache confCache
+
+	Replication confReplication
+
+	// Templates create series for points that don't match any series
+	Templates []minitsdb.SeriesTemplate
+
 	Logging struct {
 		Telegram *struct {
 			AppName   string
@@ -43,7 +97,25 @@ var (
 		Ingest: confIngest{
 			Buffer: 1024,
 		},
-		ShutdownTimeout: 5 * time.Second,
+		ShutdownTimeout:   5 * time.Second,
+		RetentionInterval: 10 * time.Minute,
+		Compaction: confCompaction{
+			Fill: 0.8,
+		},
+		Compression: confCompression{
+			Age: 7 * 24 * time.Hour,
+		},
+		Backfill: confBackfill{
+			Interval:  1 * time.Minute,
+			MaxPoints: 100000,
+		},
+		Cache: confCache{
+			Size: minitsdb.DefaultCacheSize,
+		},
+		Replication: confReplication{
+			Interval: 10 * time.Second,
+			Timeout:  30 * time.Second,
+		},
 	}
 	ConfigNoConfig = Configuration{
 		DatabasePath: "",
@@ -56,7 +128,25 @@ var (
 		Ingest: confIngest{
 			Buffer: 16,
 		},
-		ShutdownTimeout: 5 * time.Second,
+		ShutdownTimeout:   5 * time.Second,
+		RetentionInterval: 10 * time.Minute,
+		Compaction: confCompaction{
+			Fill: 0.8,
+		},
+		Compression: confCompression{
+			Age: 7 * 24 * time.Hour,
+		},
+		Backfill: confBackfill{
+			Interval:  1 * time.Minute,
+			MaxPoints: 100000,
+		},
+		Cache: confCache{
+			Size: minitsdb.DefaultCacheSize,
+		},
+		Replication: confReplication{
+			Interval: 10 * time.Second,
+			Timeout:  30 * time.Second,
+		},
 	}
 )
 
@@ -78,6 +168,20 @@ func readConfigurationFile(confpath string) Configuration {
 		logrus.WithError(err).Fatal("could not parse configuration file")
 	}
 
+	for i, t := range conf.Templates {
+		if err := t.Check(); err != nil {
+			logrus.WithError(err).WithField("template", i).Fatal("invalid series template")
+		}
+	}
+
+	if conf.Replication.Leader != "" && conf.Replication.Interval <= 0 {
+		logrus.Fatal("replication interval must be positive")
+	}
+
+	if conf.Backfill.Interval <= 0 || conf.Backfill.MaxPoints <= 0 {
+		logrus.Fatal("backfill interval and maxpoints must be positive")
+	}
+
 	if !path.IsAbs(conf.DatabasePath) {
 		conf.DatabasePath = path.Join(path.Dir(confpath), conf.DatabasePath)
 	}
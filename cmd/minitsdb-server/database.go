@@ -5,7 +5,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func loadDatabase(dbpath string) minitsdb.Database {
+func loadDatabase(dbpath string, cacheSize int64) *minitsdb.Database {
 	log.WithField("path", dbpath).Info("Loading database")
 
 	db, err := minitsdb.NewDatabase(dbpath)
@@ -13,5 +13,7 @@ func loadDatabase(dbpath string) minitsdb.Database {
 		log.WithError(err).Fatal("Failed to load database")
 	}
 
+	db.Cache.SetSize(cacheSize)
+
 	return db
 }
@@ -35,7 +35,7 @@ func (h *HTTPHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 	}()
 
 	for scanner.Scan() {
-		point, err := lineprotocol.Parse(scanner.Text())
+		point, err := lineprotocol.ParseStates(scanner.Text())
 
 		if err != nil {
 			logrus.WithFields(logrus.Fields{"error": err, "remote": request.RemoteAddr}).Warning("http line protocol error")
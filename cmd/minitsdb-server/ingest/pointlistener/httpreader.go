@@ -24,7 +24,7 @@ func ingestRequest(sink chan<- lineprotocol.Point, address string, client *http.
 	n := 0
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
-		p, err := lineprotocol.Parse(scanner.Text())
+		p, err := lineprotocol.ParseStates(scanner.Text())
 		if err != nil {
 			continue
 		}
@@ -58,7 +58,7 @@ func (l *TCPListener) handleTCP(conn net.Conn) {
 	}()
 
 	for scanner.Scan() {
-		point, err := lineprotocol.Parse(scanner.Text())
+		point, err := lineprotocol.ParseStates(scanner.Text())
 
 		if err != nil {
 			logrus.WithFields(logrus.Fields{"error": err, "remote": conn.RemoteAddr}).Warning("tcp line protocol error")
@@ -30,7 +30,7 @@ func ListenUDP(sink chan<- lineprotocol.Point, address string) error {
 		}
 
 		go func(text string, sink chan<- lineprotocol.Point) {
-			p, err := lineprotocol.Parse(text)
+			p, err := lineprotocol.ParseStates(text)
 
 			if err == nil {
 				sink <- p
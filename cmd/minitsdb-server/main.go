@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"github.com/martin2250/minitsdb/cmd/minitsdb-server/api"
 	"github.com/martin2250/minitsdb/cmd/minitsdb-server/ingest/pointlistener"
+	"github.com/martin2250/minitsdb/minitsdb"
 	"github.com/martin2250/minitsdb/pkg/lineprotocol"
 	"github.com/sirupsen/logrus"
 	"log"
@@ -45,25 +47,73 @@ func main() {
 	go listenShutdown(shutdown, conf.ShutdownTimeout)
 
 	// database
-	db := loadDatabase(conf.DatabasePath)
+	db := loadDatabase(conf.DatabasePath, conf.Cache.Size)
 
 	// ingestion
 	ingestPoints := make(chan lineprotocol.Point, conf.Ingest.Buffer)
 
+	// deletions are executed by the main loop, so no points are inserted into the affected series meanwhile
+	deletes := make(chan api.DeleteRequest)
+
+	// the series configuration is reloaded by the main loop on SIGHUP or through the API
+	reloads := make(chan api.ReloadRequest)
+	go listenReload(reloads, shutdown)
+
+	// snapshots are taken by the main loop after flushing all series
+	backups := make(chan api.BackupRequest)
+
+	// followers only replicate their leader until they are promoted through the API
+	promotions := make(chan api.PromoteRequest)
+	promoted := make(chan struct{})
+
+	// the leader is polled by its own goroutine, the main loop applies the fetched series and blocks
+	replications := make(chan replicaRequest)
+
+	var replica *follower
+	if conf.Replication.Leader != "" {
+		replica = newFollower(conf.Replication)
+		logrus.WithField("leader", conf.Replication.Leader).Info("Replicating leader")
+		go replica.run(db, conf.Replication.Interval, replications, promoted, shutdown)
+	} else {
+		close(promoted)
+	}
+
 	// http
 	if conf.API.Address != "" {
-		go api.Start(&db, conf.API, shutdown)
+		go api.Start(db, conf.API, shutdown, deletes, reloads, backups, promotions)
 	}
 
+	// compaction and compression
+	go func() {
+		if waitPromotion(promoted, shutdown) {
+			runCompaction(db, conf.Compaction, conf.Compression, shutdown)
+		}
+	}()
+
 	// ingest
-	go pointlistener.ReadIngestServer(ingestPoints, conf.Ingest.Servers, shutdown)
+	go func() {
+		if waitPromotion(promoted, shutdown) {
+			pointlistener.ReadIngestServer(ingestPoints, conf.Ingest.Servers, shutdown)
+		} else {
+			close(ingestPoints)
+		}
+	}()
 
 	// debug/pprof interface todo: make optional
 	go func() {
 		log.Println(http.ListenAndServe(":6060", nil))
 	}()
 
-	timerTick := time.Tick(1 * time.Second)
+	var timerTick, timerRetention <-chan time.Time
+
+	if replica == nil {
+		timerTick = time.Tick(1 * time.Second)
+		timerRetention = time.Tick(conf.RetentionInterval)
+	}
+
+	// points older than the archived data of their series, followers don't ingest points
+	backfill := newBackfillQueue(conf.Backfill.MaxPoints)
+	timerBackfill := time.Tick(conf.Backfill.Interval)
 
 LoopMain:
 	for {
@@ -72,16 +122,91 @@ LoopMain:
 			db.Downsample()
 			db.FlushSeries()
 
+		case <-timerBackfill:
+			backfill.run()
+
+		case <-timerRetention:
+			expireFiles(db)
+
+		case req := <-replications:
+			// blocks fetched before the promotion are discarded
+			if replica == nil {
+				close(req.done)
+				continue
+			}
+			req.apply(db)
+
+		case req := <-promotions:
+			if replica == nil {
+				req.Reject(errors.New("server is not a follower"))
+				continue
+			}
+
+			// the replicated buffers are flushed before points are accepted
+			replica = nil
+			timerTick = time.Tick(1 * time.Second)
+			timerRetention = time.Tick(conf.RetentionInterval)
+			req.Execute(db)
+			close(promoted)
+
+		case req := <-deletes:
+			if replica != nil {
+				req.Reject(api.ErrReadOnly)
+				continue
+			}
+
+			// pending points hold pointers to series, which change when a series is removed
+			backfill.run()
+			req.Execute(db)
+
+		case req := <-reloads:
+			// followers take the series configuration from their leader
+			if replica != nil {
+				req.Reject(api.ErrReadOnly)
+				continue
+			}
+
+			// pending points hold pointers to series, which change when series are added or removed
+			backfill.run()
+			req.Execute(db)
+
+		case req := <-backups:
+			if replica != nil {
+				req.Reject(api.ErrBackupFollower)
+				continue
+			}
+
+			// pending points are written before the series are flushed
+			backfill.run()
+			req.Execute(db)
+
 		case point, ok := <-ingestPoints:
 			if !ok {
 				break LoopMain
 			}
 			s, p, err := db.AssociatePoint(point)
 
+			if err == minitsdb.ErrSeriesUnknown && len(conf.Templates) > 0 {
+				// pending points hold pointers to series, which change when a series is added
+				backfill.run()
+
+				if s, err = db.CreateSeries(point, conf.Templates); err == nil {
+					logrus.WithFields(logrus.Fields{"series": s.Tags, "path": s.Path}).Info("created series from template")
+					s, p, err = db.AssociatePoint(point)
+				}
+			}
+
 			if err == nil {
 				err = s.InsertPoint(p)
 			}
 
+			if err == minitsdb.ErrInsertAtEnd {
+				var full bool
+				if full, err = backfill.add(s, p); full {
+					backfill.run()
+				}
+			}
+
 			if err != nil {
 				logrus.WithError(err).WithField("point", point).Warning("Insert Failed")
 				continue
@@ -93,10 +218,15 @@ LoopMain:
 		}
 	}
 
-	logrus.Info("Flushing buffers")
+	backfill.run()
+
+	// the buffers of followers are replicated again after a restart
+	if replica == nil {
+		logrus.Info("Flushing buffers")
 
-	for _, s := range db.Series {
-		s.FlushAll()
+		for _, s := range db.Series {
+			s.FlushAll()
+		}
 	}
 
 	logrus.Info("Terminating")
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// follower replicates the series of a leader by polling its API
+type follower struct {
+	leader string
+	client http.Client
+}
+
+func newFollower(conf confReplication) *follower {
+	return &follower{
+		leader: strings.TrimSuffix(conf.Leader, "/"),
+		client: http.Client{
+			Timeout: conf.Timeout,
+		},
+	}
+}
+
+// get requests an endpoint of the leader and returns the response body
+func (f *follower) get(endpoint string, params url.Values) ([]byte, error) {
+	resp, err := f.client.Get(f.leader + endpoint + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+func (f *follower) getJSON(endpoint string, params url.Values, v interface{}) error {
+	body, err := f.get(endpoint, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// replicaRequest hands the state of the leader to the main loop, which applies it and closes done
+// series is applied first, buckets holds the blocks fetched for the series created by it
+type replicaRequest struct {
+	series  []minitsdb.ReplicaSeries
+	buckets []replicaBucket
+	done    chan struct{}
+}
+
+// replicaBucket holds the fetched blocks of bucket i of the series in directory name
+type replicaBucket struct {
+	series string
+	i      int
+	update minitsdb.ReplicaUpdate
+}
+
+// run replicates the leader every interval until the server is promoted or shut down
+// requests to the leader are made on this goroutine, the main loop only applies the results sent to requests
+func (f *follower) run(db *minitsdb.Database, interval time.Duration, requests chan<- replicaRequest, promoted, shutdown <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for f.replicate(db, requests, promoted, shutdown) {
+		select {
+		case <-ticker.C:
+		case <-promoted:
+			return
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// replicate fetches the series of the leader and the blocks of their buckets
+// returns false if the server was promoted or shut down meanwhile
+func (f *follower) replicate(db *minitsdb.Database, requests chan<- replicaRequest, promoted, shutdown <-chan struct{}) bool {
+	var replicas []minitsdb.ReplicaSeries
+
+	if err := f.getJSON("/replication/series", nil, &replicas); err != nil {
+		log.WithError(err).WithField("leader", f.leader).Warning("Could not list series of leader")
+		return true
+	}
+
+	if !send(requests, replicaRequest{series: replicas}, promoted, shutdown) {
+		return false
+	}
+
+	// the series were created by the main loop, their buckets are only read until the blocks are applied
+	var buckets []replicaBucket
+
+	list := db.SeriesList()
+
+	for i := range list {
+		s := &list[i]
+
+		for j := range s.Buckets {
+			params := url.Values{
+				"series": {path.Base(s.Path)},
+				"bucket": {strconv.Itoa(j)},
+			}
+
+			update, err := f.fetchBucket(&s.Buckets[j], params)
+
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{"series": s.Tags, "bucket": j}).Warning("Could not replicate bucket")
+				continue
+			}
+
+			buckets = append(buckets, replicaBucket{series: path.Base(s.Path), i: j, update: update})
+		}
+	}
+
+	return send(requests, replicaRequest{buckets: buckets}, promoted, shutdown)
+}
+
+func (f *follower) fetchBucket(b *minitsdb.Bucket, params url.Values) (minitsdb.ReplicaUpdate, error) {
+	var replica minitsdb.ReplicaBucket
+
+	if err := f.getJSON("/replication/bucket", params, &replica); err != nil {
+		return minitsdb.ReplicaUpdate{}, err
+	}
+
+	return b.FetchReplica(replica, func(name string, first, count int64) ([]byte, error) {
+		return f.get("/replication/blocks", url.Values{
+			"series": params["series"],
+			"bucket": params["bucket"],
+			"file":   {name},
+			"first":  {strconv.FormatInt(first, 10)},
+			"count":  {strconv.FormatInt(count, 10)},
+		})
+	})
+}
+
+// send passes req to the main loop and waits until it was applied, returns false if the server was promoted or shut down
+func send(requests chan<- replicaRequest, req replicaRequest, promoted, shutdown <-chan struct{}) bool {
+	req.done = make(chan struct{})
+
+	select {
+	case requests <- req:
+	case <-promoted:
+		return false
+	case <-shutdown:
+		return false
+	}
+
+	<-req.done
+	return true
+}
+
+// apply creates, updates and removes series and writes the fetched blocks, logs the changes
+// must be called from the main loop, as series are added and removed
+func (req replicaRequest) apply(db *minitsdb.Database) {
+	defer close(req.done)
+
+	if req.series != nil {
+		reloads, err := db.ApplyReplicas(req.series)
+
+		if err != nil {
+			log.WithError(err).Error("Could not replicate series")
+			return
+		}
+
+		for _, r := range reloads {
+			entry := log.WithFields(log.Fields{
+				"series":  r.Tags,
+				"path":    r.Path,
+				"added":   r.Added,
+				"removed": r.Removed,
+				"updated": r.Updated,
+			})
+
+			if r.Err != nil {
+				entry.WithError(r.Err).Warning("Could not replicate series")
+			} else {
+				entry.Info("Replicated series")
+			}
+		}
+	}
+
+	for _, rb := range req.buckets {
+		s := db.SeriesByDirectory(rb.series)
+
+		// the series was removed or reopened with fewer buckets after the blocks were fetched
+		if s == nil || rb.i >= len(s.Buckets) {
+			continue
+		}
+
+		written, err := s.ApplyReplica(rb.i, rb.update)
+
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"series": s.Tags, "bucket": rb.i}).Warning("Could not replicate bucket")
+		} else if written > 0 {
+			log.WithFields(log.Fields{"series": s.Tags, "bucket": rb.i, "blocks": written}).Debug("Replicated blocks")
+		}
+	}
+}
+
+// waitPromotion blocks until the server is promoted to leader or shut down
+// returns true if the server was promoted, servers that are not followers are promoted at startup
+func waitPromotion(promoted, shutdown <-chan struct{}) bool {
+	select {
+	case <-promoted:
+		return true
+	case <-shutdown:
+		return false
+	}
+}
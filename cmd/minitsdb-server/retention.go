@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// expireFiles deletes data files that exceed the retention of their bucket and logs them
+func expireFiles(db *minitsdb.Database) {
+	expired, err := db.Expire(time.Now())
+
+	for _, f := range expired {
+		log.WithFields(log.Fields{
+			"path":   f.Path,
+			"start":  time.Unix(f.TimeStart, 0),
+			"end":    time.Unix(f.TimeEnd, 0),
+			"blocks": f.Blocks,
+		}).Info("Expired data file")
+	}
+
+	if err != nil {
+		log.WithError(err).Error("Failed to expire data files")
+	}
+}
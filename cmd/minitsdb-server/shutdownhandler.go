@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/martin2250/minitsdb/cmd/minitsdb-server/api"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
@@ -23,6 +24,26 @@ func listenShutdown(shutdown chan<- struct{}, timeout time.Duration) {
 	log.Fatal("Graceful shutdown timed out")
 }
 
+// listenReload requests a reload of the series configuration whenever a SIGHUP signal is received
+func listenReload(reloads chan<- api.ReloadRequest, shutdown <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-sigs:
+			log.Info("Received reload signal")
+			select {
+			case reloads <- api.NewReloadRequest():
+			case <-shutdown:
+				return
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
 // shutdownOnError calls the function f, which should never return in normal operation
 // when it does, shutdownOnError logs the error and sends a shutdown signal
 // to the channel
@@ -0,0 +1,80 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var backupflags = struct {
+	address string
+	output  string
+}{}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Download a consistent backup from a running server",
+		Long: `
+This command asks a running server to flush all series and take a
+snapshot of the database, which is downloaded as a tar archive. The
+server is only blocked while the snapshot is taken, data files are hard
+linked where possible. The serve timeout of the API must be long enough
+to transfer the entire archive. Use the restore command to unpack it.
+Followers refuse backups, as replication rewrites their data files.`,
+		RunE: run,
+	}
+
+	cmd.InitDefaultHelpCmd()
+
+	cmd.Flags().StringVarP(&backupflags.address, "address", "a", "http://localhost:8080", "address of the server API")
+	cmd.Flags().StringVarP(&backupflags.output, "output", "o", "", "path of the archive to create")
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	if backupflags.output == "" {
+		return fmt.Errorf("output must be specified")
+	}
+
+	// an incomplete archive must not be mistaken for a backup
+	file, err := os.OpenFile(backupflags.output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	n, err := download(file)
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		os.Remove(backupflags.output)
+		return err
+	}
+
+	fmt.Printf("wrote %d bytes to %s\n", n, backupflags.output)
+
+	return nil
+}
+
+func download(w io.Writer) (int64, error) {
+	resp, err := http.Get(strings.TrimSuffix(backupflags.address, "/") + "/backup")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return io.Copy(w, resp.Body)
+}
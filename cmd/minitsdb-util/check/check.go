@@ -0,0 +1,70 @@
+package check
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/spf13/cobra"
+)
+
+var checkflags = struct {
+	database string
+	series   string
+	repair   bool
+}{}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check a database for inconsistencies",
+		Long: `
+This command verifies the data files of all series in a database
+directory. With --repair, leftover temporary files, partially written
+and corrupted blocks are removed, a backup of every modified data file
+is kept with the suffix .corrupt. The server must not be running.`,
+		RunE: run,
+	}
+
+	cmd.InitDefaultHelpCmd()
+
+	cmd.Flags().StringVarP(&checkflags.database, "database", "d", "", "path to database directory")
+	cmd.Flags().StringVarP(&checkflags.series, "series", "s", "", "path to a single series directory")
+	cmd.Flags().BoolVarP(&checkflags.repair, "repair", "r", false, "fix problems that can be repaired safely")
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	var report minitsdb.CheckReport
+	var err error
+
+	switch {
+	case checkflags.series != "":
+		err = minitsdb.CheckSeries(checkflags.series, checkflags.repair, &report)
+	case checkflags.database != "":
+		report, err = minitsdb.CheckDatabase(checkflags.database, checkflags.repair)
+	default:
+		return fmt.Errorf("either database or series must be specified")
+	}
+
+	for _, p := range report.Problems {
+		status := "PROBLEM"
+		if p.Repaired {
+			status = "REPAIRED"
+		}
+		fmt.Printf("%-8s %s: %s\n", status, p.Path, p.Description)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("checked %d series, %d buckets, %d files, %d blocks: %d problems, %d unrepaired\n",
+		report.Series, report.Buckets, report.Files, report.Blocks, len(report.Problems), report.Unrepaired())
+
+	if report.Unrepaired() > 0 {
+		cmd.SilenceUsage = true
+		return fmt.Errorf("database contains %d unrepaired problems", report.Unrepaired())
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package delete
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/spf13/cobra"
+	"math"
+	"os"
+	"strings"
+)
+
+var deleteflags = struct {
+	series  string
+	columns []string
+	first   int64
+	last    int64
+	remove  bool
+}{}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Remove points or an entire series",
+		Long: `
+This command removes all points in a time range from a series, or
+only the values of the selected columns. Affected data files are
+rewritten and the downsampled buckets are regenerated for the time
+range. With --remove, the entire series directory is deleted.
+Columns are selected by tags, e.g. --column name=power,phase=A.
+The server must not be running.`,
+		RunE: run,
+	}
+
+	cmd.InitDefaultHelpCmd()
+
+	cmd.Flags().StringVarP(&deleteflags.series, "series", "s", "", "path to series directory")
+	cmd.Flags().StringArrayVarP(&deleteflags.columns, "column", "c", nil, "tags of columns whose values are removed (default entire points)")
+	cmd.Flags().Int64VarP(&deleteflags.first, "first", "f", 0, "first time to remove")
+	cmd.Flags().Int64VarP(&deleteflags.last, "last", "l", math.MaxInt64, "last time to remove (default newest point)")
+	cmd.Flags().BoolVar(&deleteflags.remove, "remove", false, "delete the entire series")
+
+	return cmd
+}
+
+// parseTags parses a tag set of the format key=value,key=value
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %s", kv)
+		}
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, nil
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	if deleteflags.series == "" {
+		return fmt.Errorf("series must be specified")
+	}
+
+	if deleteflags.remove {
+		if _, err := os.Stat(deleteflags.series); err != nil {
+			return err
+		}
+		if _, err := minitsdb.LoadSeriesYamlConfig(deleteflags.series); err != nil {
+			return fmt.Errorf("%s is not a series directory: %v", deleteflags.series, err)
+		}
+		return os.RemoveAll(deleteflags.series)
+	}
+
+	series, err := minitsdb.OpenSeries(deleteflags.series)
+
+	if err != nil {
+		return err
+	}
+
+	if series.Log != nil {
+		defer series.Log.Close()
+	}
+
+	var columns []*minitsdb.Column
+
+	for _, c := range deleteflags.columns {
+		tags, err := parseTags(c)
+		if err != nil {
+			return err
+		}
+
+		matches := series.FindColumns(tags, false)
+		if len(matches) == 0 {
+			return fmt.Errorf("no column matches %s", c)
+		}
+
+		columns = append(columns, matches...)
+	}
+
+	deletions, err := series.Delete(types.TimeRange{Start: deleteflags.first, End: deleteflags.last}, columns)
+
+	for _, d := range deletions {
+		fmt.Printf("rewrote %s (%d points affected, %d -> %d blocks)\n", d.Path, d.Points, d.BlocksBefore, d.BlocksAfter)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	series.FlushAll()
+
+	return nil
+}
@@ -0,0 +1,532 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/martin2250/minitsdb/pkg/apiclient"
+	"github.com/martin2250/minitsdb/util"
+	"github.com/spf13/cobra"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var exportflags = struct {
+	database string
+	address  string
+	series   string
+	columns  []string
+	function string
+	bucket   int
+	step     string
+	first    string
+	last     string
+	format   string
+	time     string
+	output   string
+}{}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export points as CSV or JSON Lines",
+		Long: `
+This command writes the points of all series matching --series to a
+CSV or JSON Lines file. Series and columns are selected by tags like in
+queries, e.g. --series name=/sensor.*/ --column name=temp, values of
+the format /.../ are regular expressions. Points are read from a
+database directory while the server is not running, or queried from
+the API of a running server with --address. The database directory is
+not modified, points that are only in the write-ahead log are not
+exported. Column headers are built from the tags of the series and
+columns.`,
+		RunE: run,
+	}
+
+	cmd.InitDefaultHelpCmd()
+
+	cmd.Flags().StringVarP(&exportflags.database, "database", "d", "", "path to database directory")
+	cmd.Flags().StringVarP(&exportflags.address, "address", "a", "", "address of the server API, e.g. http://localhost:8080")
+	cmd.Flags().StringVarP(&exportflags.series, "series", "s", "", "tags of the series to export")
+	cmd.Flags().StringArrayVarP(&exportflags.columns, "column", "c", nil, "tags of the columns to export (default all columns)")
+	cmd.Flags().StringVar(&exportflags.function, "function", "", "function used to aggregate points (default function of column)")
+	cmd.Flags().IntVarP(&exportflags.bucket, "bucket", "b", -1, "export the points of a bucket, starting at 0 for the primary bucket (database only)")
+	cmd.Flags().StringVar(&exportflags.step, "step", "", "time between exported points, e.g. 10m (default time step of primary bucket)")
+	cmd.Flags().StringVarP(&exportflags.first, "first", "f", "", "first time to export, unix seconds or RFC3339 (default oldest point)")
+	cmd.Flags().StringVarP(&exportflags.last, "last", "l", "", "last time to export, unix seconds or RFC3339 (default now)")
+	cmd.Flags().StringVar(&exportflags.format, "format", "csv", "output format, csv or jsonl")
+	cmd.Flags().StringVar(&exportflags.time, "time", "iso", "format of timestamps, iso or epoch")
+	cmd.Flags().StringVarP(&exportflags.output, "output", "o", "", "path of the file to create (default stdout)")
+
+	return cmd
+}
+
+// table describes a series and the columns exported from it
+type table struct {
+	series  map[string]string
+	columns []map[string]string
+	// precision is the number of decimals of each column, -1 if values are written with as many digits as necessary
+	precision []int
+	// states holds the column of results that are states of bool or enum columns, nil for numbers
+	states []*minitsdb.Column
+}
+
+// columnFormat returns the precision of the results of a query column, and the column if the results are states
+func columnFormat(qc minitsdb.QueryColumn) (int, *minitsdb.Column) {
+	switch {
+	case qc.States() != nil:
+		return 0, qc.Column
+	case qc.Float():
+		return -1, nil
+	case downsampling.CountsPoints(qc.Function):
+		return 0, nil
+	default:
+		return qc.Column.Decimals, nil
+	}
+}
+
+// chunk holds consecutive points of a table, missing values are NaN
+type chunk struct {
+	table  int
+	times  []int64
+	values [][]float64
+}
+
+// writer formats the exported points
+type writer interface {
+	begin(tables []table) error
+	write(c chunk) error
+	end() error
+}
+
+// parseTags parses a tag set of the format key=value,key=value
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %s", kv)
+		}
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, nil
+}
+
+// parseTime parses unix seconds or RFC3339 timestamps, def is returned for empty strings
+func parseTime(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	if t, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+
+	return t.Unix(), nil
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	if (exportflags.database == "") == (exportflags.address == "") {
+		return fmt.Errorf("either database or address must be specified")
+	}
+
+	if exportflags.series == "" {
+		return fmt.Errorf("series must be specified")
+	}
+
+	seriesTags, err := parseTags(exportflags.series)
+	if err != nil {
+		return err
+	}
+
+	columnTags := make([]map[string]string, len(exportflags.columns))
+	for i, c := range exportflags.columns {
+		if columnTags[i], err = parseTags(c); err != nil {
+			return err
+		}
+	}
+
+	first, err := parseTime(exportflags.first, 0)
+	if err != nil {
+		return err
+	}
+
+	last, err := parseTime(exportflags.last, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	var step time.Duration
+	if exportflags.step != "" {
+		if step, err = util.ParseDuration(exportflags.step); err != nil {
+			return err
+		}
+		if step < time.Second {
+			return fmt.Errorf("step must be at least one second")
+		}
+	}
+
+	if exportflags.bucket >= 0 && step != 0 {
+		return fmt.Errorf("bucket and step can't be used together")
+	}
+
+	epoch := false
+	switch exportflags.time {
+	case "iso":
+	case "epoch":
+		epoch = true
+	default:
+		return fmt.Errorf("unknown time format %s", exportflags.time)
+	}
+
+	out := io.Writer(os.Stdout)
+
+	if exportflags.output != "" {
+		file, err := os.OpenFile(exportflags.output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	var w writer
+	switch exportflags.format {
+	case "csv":
+		w = newCSVWriter(out, epoch)
+	case "jsonl":
+		w = newJSONWriter(out, epoch)
+	default:
+		return fmt.Errorf("unknown format %s", exportflags.format)
+	}
+
+	timeRange := types.TimeRange{Start: first, End: last}
+
+	if exportflags.database != "" {
+		err = exportDatabase(w, seriesTags, columnTags, timeRange, int64(step/time.Second))
+	} else {
+		if exportflags.bucket >= 0 {
+			return fmt.Errorf("bucket can only be selected when reading a database")
+		}
+		err = exportAPI(w, seriesTags, columnTags, timeRange, step)
+	}
+
+	if err == nil {
+		err = w.end()
+	}
+
+	cmd.SilenceUsage = err != nil
+
+	return err
+}
+
+// queryColumns selects the columns of a series matching any of the tag sets, all columns if there are none
+func queryColumns(s *minitsdb.Series, columnTags []map[string]string) ([]minitsdb.QueryColumn, error) {
+	var columns []*minitsdb.Column
+
+	if len(columnTags) == 0 {
+		for i := range s.Columns {
+			columns = append(columns, &s.Columns[i])
+		}
+	} else {
+		for _, tags := range columnTags {
+			columns = append(columns, s.FindColumns(tags, true)...)
+		}
+	}
+
+	var queryColumns []minitsdb.QueryColumn
+
+	for _, c := range columns {
+		qc := minitsdb.QueryColumn{
+			Column:   c,
+			Function: c.DefaultFunction,
+			Factor:   1.0,
+		}
+
+		if exportflags.function != "" {
+			var err error
+			if qc.Function, err = c.FindFunction(exportflags.function); err != nil {
+				return nil, err
+			}
+		}
+
+		if c.Supports(qc.Function) {
+			queryColumns = append(queryColumns, qc)
+		}
+	}
+
+	return queryColumns, nil
+}
+
+// exportDatabase reads the points from a database directory without modifying it
+func exportDatabase(w writer, seriesTags map[string]string, columnTags []map[string]string, timeRange types.TimeRange, step int64) error {
+	db, err := minitsdb.NewDatabaseReadOnly(exportflags.database)
+	if err != nil {
+		return err
+	}
+
+	var tables []table
+	var queries []*minitsdb.Query
+	var columns [][]minitsdb.QueryColumn
+
+	for _, s := range db.FindSeries(seriesTags, true) {
+		qcs, err := queryColumns(s, columnTags)
+		if err != nil {
+			return err
+		}
+
+		if len(qcs) == 0 {
+			continue
+		}
+
+		t := table{
+			series:    s.Tags,
+			columns:   make([]map[string]string, len(qcs)),
+			precision: make([]int, len(qcs)),
+			states:    make([]*minitsdb.Column, len(qcs)),
+		}
+
+		for i, qc := range qcs {
+			t.columns[i] = qc.Column.Tags
+			t.precision[i], t.states[i] = columnFormat(qc)
+		}
+
+		var q *minitsdb.Query
+
+		switch {
+		case exportflags.bucket >= len(s.Buckets):
+			return fmt.Errorf("series %v has %d buckets", s.Tags, len(s.Buckets))
+		case exportflags.bucket >= 0:
+			b := &s.Buckets[exportflags.bucket]
+			q = b.Query(qcs, timeRange, b.TimeStep)
+		case step == 0:
+			q = s.Query(qcs, timeRange, s.Buckets[0].TimeStep)
+		default:
+			q = s.Query(qcs, timeRange, step)
+		}
+
+		tables = append(tables, t)
+		queries = append(queries, q)
+		columns = append(columns, qcs)
+	}
+
+	if len(tables) == 0 {
+		return fmt.Errorf("no matching series found")
+	}
+
+	if err := w.begin(tables); err != nil {
+		return err
+	}
+
+	for i, q := range queries {
+		for {
+			buffer, err := q.Next()
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if buffer.Len() == 0 {
+				continue
+			}
+
+			if err := w.write(scaleBuffer(i, buffer, columns[i])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// scaleBuffer converts the values of a query result to floats, integer values are divided by 10^decimals
+func scaleBuffer(index int, buffer storage.PointBuffer, columns []minitsdb.QueryColumn) chunk {
+	c := chunk{
+		table:  index,
+		times:  buffer.Values[0],
+		values: make([][]float64, len(columns)),
+	}
+
+	for i, qc := range columns {
+		factor := math.Pow10(-qc.Column.Decimals)
+		if downsampling.CountsPoints(qc.Function) {
+			factor = 1
+		}
+
+		c.values[i] = make([]float64, buffer.Len())
+
+		for j, v := range buffer.Values[i+1] {
+			switch {
+			case v == storage.Missing:
+				c.values[i][j] = math.NaN()
+			case qc.Float():
+				c.values[i][j] = storage.ValueFloat(v)
+			default:
+				c.values[i][j] = float64(v) * factor
+			}
+		}
+	}
+
+	return c
+}
+
+// exportAPI queries the points from a running server
+func exportAPI(w writer, seriesTags map[string]string, columnTags []map[string]string, timeRange types.TimeRange, step time.Duration) error {
+	client := apiclient.ApiClient{
+		Address:    strings.TrimSuffix(exportflags.address, "/") + "/query",
+		HttpClient: http.DefaultClient,
+	}
+
+	q := apiclient.Query{
+		Series:    seriesTags,
+		TimeStart: time.Unix(timeRange.Start, 0),
+		TimeEnd:   time.Unix(timeRange.End, 0),
+		TimeStep:  step,
+	}
+
+	// the server selects the primary bucket for steps below one second
+	if step == 0 {
+		q.TimeStep = time.Second
+	}
+
+	for _, tags := range columnTags {
+		q.Columns = append(q.Columns, apiclient.Column{Tags: tags, Function: exportflags.function})
+	}
+
+	if len(columnTags) == 0 && exportflags.function != "" {
+		q.Columns = []apiclient.Column{{Tags: map[string]string{}, Function: exportflags.function}}
+	}
+
+	result, err := client.Query(q)
+	if err != nil {
+		return err
+	}
+
+	columns, err := listColumns(seriesTags)
+	if err != nil {
+		return err
+	}
+
+	tables := make([]table, len(result.Series))
+
+	for i, s := range result.Series {
+		tables[i] = table{
+			series:    s.Tags,
+			columns:   s.Columns,
+			precision: make([]int, len(s.Columns)),
+			states:    make([]*minitsdb.Column, len(s.Columns)),
+		}
+
+		// the API returns scaled float values, which are rounded to the decimals of their column
+		for j, c := range s.Columns {
+			tables[i].precision[j] = -1
+
+			lc, ok := columns[tagLabel(s.Tags)+"/"+tagLabel(c)]
+			if !ok {
+				continue
+			}
+
+			qc := minitsdb.QueryColumn{
+				Column: &minitsdb.Column{
+					Decimals: lc.Decimals,
+					Float:    lc.Float,
+					States:   lc.States,
+				},
+			}
+
+			// the server queries the default function of the column when none is specified
+			function := exportflags.function
+			if function == "" {
+				function = lc.Function
+			}
+
+			// the server has already accepted the function
+			qc.Function, _ = qc.Column.FindFunction(function)
+
+			tables[i].precision[j], tables[i].states[j] = columnFormat(qc)
+		}
+	}
+
+	if err := w.begin(tables); err != nil {
+		return err
+	}
+
+	for {
+		c, err := result.ReadChunk()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := w.write(chunk{table: c.Index, times: c.Times, values: c.Values}); err != nil {
+			return err
+		}
+	}
+}
+
+// listColumn describes a column as returned by the list endpoint of the API
+type listColumn struct {
+	Tags     map[string]string
+	Decimals int
+	Float    bool
+	States   []string
+	Function string
+}
+
+// listColumns returns the columns of all series matching the tags,
+// identified by the labels of their series and column tags
+func listColumns(seriesTags map[string]string) (map[string]listColumn, error) {
+	filter, err := json.Marshal(seriesTags)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(strings.TrimSuffix(exportflags.address, "/")+"/list", "application/json", bytes.NewReader(filter))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned status code %d", resp.StatusCode)
+	}
+
+	var series []struct {
+		Tags    map[string]string
+		Columns []listColumn
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&series); err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]listColumn)
+
+	for _, s := range series {
+		for _, c := range s.Columns {
+			columns[tagLabel(s.Tags)+"/"+tagLabel(c.Tags)] = c
+		}
+	}
+
+	return columns, nil
+}
@@ -0,0 +1,163 @@
+package export
+
+import (
+	"bytes"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const testSeriesConfig = `
+tags:
+  name: power
+  room: kitchen
+flushinterval: 10s
+flushcount: 50
+forceflushcount: 100
+pointsfile: 1000
+buckets:
+  - factor: 1
+  - factor: 10
+columns:
+  - decimals: 1
+    tags:
+      name: voltage
+      phase: A
+  - decimals: 0
+    tags:
+      name: relay
+    type: bool
+`
+
+// createTestDatabase creates a database with one series holding points with times 0 to 19, the caller must remove the directory
+func createTestDatabase(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(path.Join(dir, "power"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "power", "series.yaml"), []byte(testSeriesConfig), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	s, err := minitsdb.OpenSeries(path.Join(dir, "power"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 20; i++ {
+		p := storage.Point{Values: []int64{i, 2300 + i, i % 2}}
+		if i == 1 {
+			p.Values[1] = storage.Missing
+		}
+
+		if err := s.InsertPoint(p); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	s.FlushAll()
+
+	return dir
+}
+
+func TestExportDatabase(t *testing.T) {
+	dir := createTestDatabase(t)
+	defer os.RemoveAll(dir)
+
+	exportflags.database = dir
+	exportflags.bucket = -1
+	exportflags.function = ""
+
+	timeRange := types.TimeRange{Start: 0, End: 2}
+
+	var csv bytes.Buffer
+	w := newCSVWriter(&csv, true)
+
+	if err := exportDatabase(w, map[string]string{"name": "power"}, nil, timeRange, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.end(); err != nil {
+		t.Fatal(err)
+	}
+
+	// missing values are empty, states are written as their labels
+	want := "time,\"voltage,phase=A\",relay\n0,230.0,false\n1,,true\n2,230.2,false\n"
+	if csv.String() != want {
+		t.Errorf("unexpected CSV output:\n%s", csv.String())
+	}
+
+	var jsonl bytes.Buffer
+	jw := newJSONWriter(&jsonl, false)
+
+	if err := exportDatabase(jw, map[string]string{"name": "power"}, []map[string]string{{"name": "voltage"}}, timeRange, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := jw.end(); err != nil {
+		t.Fatal(err)
+	}
+
+	want = `{"time":"1970-01-01T00:00:00Z","series":{"name":"power","room":"kitchen"},"values":{"voltage,phase=A":230.0}}
+{"time":"1970-01-01T00:00:01Z","series":{"name":"power","room":"kitchen"},"values":{"voltage,phase=A":null}}
+{"time":"1970-01-01T00:00:02Z","series":{"name":"power","room":"kitchen"},"values":{"voltage,phase=A":230.2}}
+`
+	if jsonl.String() != want {
+		t.Errorf("unexpected JSON Lines output:\n%s", jsonl.String())
+	}
+
+	if err := exportDatabase(w, map[string]string{"name": "other"}, nil, timeRange, 0); err == nil {
+		t.Error("expected error when no series matches")
+	}
+}
+
+func TestTagLabel(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{map[string]string{"name": "power"}, "power"},
+		{map[string]string{"phase": "A", "name": "power", "unit": "W"}, "power,phase=A,unit=W"},
+		{map[string]string{"room": "kitchen"}, "room=kitchen"},
+	}
+
+	for _, tt := range tests {
+		if got := tagLabel(tt.tags); got != tt.want {
+			t.Errorf("label of %v is %s, want %s", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"", 42, true},
+		{"1600000000", 1600000000, true},
+		{"2020-09-13T12:26:40Z", 1600000000, true},
+		{"2020-09-13T14:26:40+02:00", 1600000000, true},
+		{"yesterday", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTime(tt.s, 42)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: got %d, %v", tt.s, got, err)
+		}
+	}
+}
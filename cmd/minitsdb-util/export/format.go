@@ -0,0 +1,213 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagLabel builds a label from a tag set, the name tag is followed by all other tags in order of their keys
+// e.g. power,phase=A for the tags name=power and phase=A
+func tagLabel(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		if key != "name" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	if name, ok := tags["name"]; ok {
+		parts = append(parts, name)
+	}
+	for _, key := range keys {
+		parts = append(parts, key+"="+tags[key])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// columnLabels returns the header of every column of the tables
+// the label of the series is only prepended when points of multiple series are exported
+func columnLabels(tables []table) [][]string {
+	labels := make([][]string, len(tables))
+
+	for i, t := range tables {
+		labels[i] = make([]string, len(t.columns))
+
+		for j, c := range t.columns {
+			labels[i][j] = tagLabel(c)
+			if len(tables) > 1 {
+				labels[i][j] = tagLabel(t.series) + "/" + labels[i][j]
+			}
+		}
+	}
+
+	return labels
+}
+
+// formatValue formats a value with a fixed number of decimals, empty for missing values
+func formatValue(v float64, precision int) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', precision, 64)
+}
+
+// format formats a value of a column of the table, states are written as their labels
+func (t table) format(column int, v float64) string {
+	if t.states[column] != nil && !math.IsNaN(v) {
+		return t.states[column].StateLabel(int64(v))
+	}
+	return formatValue(v, t.precision[column])
+}
+
+func formatTime(t int64, epoch bool) string {
+	if epoch {
+		return strconv.FormatInt(t, 10)
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+// csvWriter writes a header with the labels of all columns of all tables,
+// rows only contain the values of the table the point belongs to
+type csvWriter struct {
+	w      *csv.Writer
+	epoch  bool
+	tables []table
+	// offsets holds the index of the first column of each table in a row
+	offsets []int
+	width   int
+}
+
+func newCSVWriter(w io.Writer, epoch bool) *csvWriter {
+	return &csvWriter{
+		w:     csv.NewWriter(w),
+		epoch: epoch,
+	}
+}
+
+func (w *csvWriter) begin(tables []table) error {
+	w.tables = tables
+	w.offsets = make([]int, len(tables))
+
+	header := []string{"time"}
+
+	for i, labels := range columnLabels(tables) {
+		w.offsets[i] = len(header)
+		header = append(header, labels...)
+	}
+
+	w.width = len(header)
+
+	return w.w.Write(header)
+}
+
+func (w *csvWriter) write(c chunk) error {
+	t := w.tables[c.table]
+	row := make([]string, w.width)
+
+	for i, ts := range c.times {
+		row[0] = formatTime(ts, w.epoch)
+
+		for j := range c.values {
+			row[w.offsets[c.table]+j] = t.format(j, c.values[j][i])
+		}
+
+		if err := w.w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *csvWriter) end() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// jsonWriter writes an object holding the time, series tags and values of every point on a separate line
+type jsonWriter struct {
+	w      *bufio.Writer
+	enc    *json.Encoder
+	epoch  bool
+	tables []table
+	labels [][]string
+}
+
+type jsonPoint struct {
+	Time   interface{}            `json:"time"`
+	Series map[string]string      `json:"series"`
+	Values map[string]interface{} `json:"values"`
+}
+
+func newJSONWriter(w io.Writer, epoch bool) *jsonWriter {
+	buffered := bufio.NewWriter(w)
+
+	return &jsonWriter{
+		w:     buffered,
+		enc:   json.NewEncoder(buffered),
+		epoch: epoch,
+	}
+}
+
+func (w *jsonWriter) begin(tables []table) error {
+	w.tables = tables
+	w.labels = make([][]string, len(tables))
+
+	// every line holds the series tags, so the labels of columns don't include them
+	for i, t := range tables {
+		w.labels[i] = make([]string, len(t.columns))
+		for j, c := range t.columns {
+			w.labels[i][j] = tagLabel(c)
+		}
+	}
+
+	return nil
+}
+
+func (w *jsonWriter) write(c chunk) error {
+	t := w.tables[c.table]
+
+	for i, ts := range c.times {
+		p := jsonPoint{
+			Series: t.series,
+			Values: make(map[string]interface{}, len(c.values)),
+		}
+
+		if w.epoch {
+			p.Time = ts
+		} else {
+			p.Time = formatTime(ts, false)
+		}
+
+		for j := range c.values {
+			switch v := t.format(j, c.values[j][i]); {
+			case v == "":
+				p.Values[w.labels[c.table][j]] = nil
+			case t.states[j] != nil:
+				p.Values[w.labels[c.table][j]] = v
+			default:
+				p.Values[w.labels[c.table][j]] = json.Number(v)
+			}
+		}
+
+		if err := w.enc.Encode(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *jsonWriter) end() error {
+	return w.w.Flush()
+}
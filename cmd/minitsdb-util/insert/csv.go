@@ -0,0 +1,164 @@
+package insert
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvFormat reads points from a CSV file with a header row, the first column holds the time
+// the other headers are mapped to the series columns by their tags
+type csvFormat struct {
+	series *minitsdb.Series
+	reader *csv.Reader
+	// columns holds the series column of every CSV column after the time
+	columns []*minitsdb.Column
+	skipped int
+}
+
+// parseLabel parses a column label, e.g. power,phase=A for the tags name=power and phase=A
+func parseLabel(label string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for i, part := range strings.Split(label, ",") {
+		part = strings.TrimSpace(part)
+
+		if kv := strings.SplitN(part, "=", 2); len(kv) == 2 && kv[0] != "" {
+			tags[kv[0]] = kv[1]
+		} else if i == 0 && part != "" {
+			tags["name"] = part
+		} else {
+			return nil, fmt.Errorf("invalid column label %s", label)
+		}
+	}
+
+	return tags, nil
+}
+
+// parseTime parses a unix timestamp or RFC3339 time
+func parseTime(text string) (int64, error) {
+	if t, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", text)
+	}
+
+	return t.Unix(), nil
+}
+
+func (f *csvFormat) Register(s *minitsdb.Series) error {
+	f.series = s
+	return nil
+}
+
+// readHeader maps the headers to the series columns, series columns without a header are missing in all points
+func (f *csvFormat) readHeader() error {
+	header, err := f.reader.Read()
+	if err == io.EOF {
+		return errors.New("csv file has no header")
+	} else if err != nil {
+		return err
+	}
+
+	if len(header) < 1 || strings.TrimSpace(header[0]) != "time" {
+		return errors.New("first csv column must be time")
+	}
+
+	f.columns = make([]*minitsdb.Column, len(header)-1)
+	used := make(map[*minitsdb.Column]bool)
+
+	for i, label := range header[1:] {
+		tags, err := parseLabel(label)
+		if err != nil {
+			return err
+		}
+
+		columns := f.series.FindColumns(tags, false)
+
+		if len(columns) == 0 {
+			return fmt.Errorf("csv column %s: %w", label, minitsdb.ErrColumnUnknown)
+		} else if len(columns) > 1 {
+			return fmt.Errorf("csv column %s: %w", label, minitsdb.ErrColumnAmbiguous)
+		} else if used[columns[0]] {
+			return fmt.Errorf("csv column %s: column used twice", label)
+		}
+
+		used[columns[0]] = true
+		f.columns[i] = columns[0]
+	}
+
+	return nil
+}
+
+func (f *csvFormat) Read(r io.Reader, n int) ([]storage.Point, error) {
+	if f.reader == nil {
+		f.reader = csv.NewReader(r)
+		f.reader.ReuseRecord = true
+
+		if err := f.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	points := make([]storage.Point, 0, n)
+
+	for len(points) < n {
+		record, err := f.reader.Read()
+		if err != nil {
+			return points, err
+		}
+
+		line, _ := f.reader.FieldPos(0)
+
+		values := make([]int64, f.series.PrimaryCount)
+		for i := range values {
+			values[i] = storage.Missing
+		}
+
+		values[0], err = parseTime(strings.TrimSpace(record[0]))
+		if err != nil {
+			return points, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		present := false
+
+		// empty cells are missing values
+		for i, c := range f.columns {
+			text := strings.TrimSpace(record[i+1])
+
+			if text == "" {
+				continue
+			}
+
+			values[c.IndexPrimary], err = c.ParseValue(text)
+			if err != nil {
+				return points, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			present = true
+		}
+
+		if !present {
+			f.skipped++
+			continue
+		}
+
+		points = append(points, storage.Point{Values: values})
+	}
+
+	return points, nil
+}
+
+// Skipped returns the number of rows without any values
+func (f *csvFormat) Skipped() int {
+	return f.skipped
+}
@@ -0,0 +1,137 @@
+package insert
+
+import (
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/pkg/lineprotocol"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTestPoints reads all points of input in chunks of n points
+func readTestPoints(format inputFormat, input string, n int) ([]storage.Point, error) {
+	r := strings.NewReader(input)
+	var points []storage.Point
+
+	for {
+		chunk, err := format.Read(r, n)
+		points = append(points, chunk...)
+
+		if err == io.EOF {
+			return points, nil
+		} else if err != nil {
+			return points, err
+		}
+	}
+}
+
+func TestCSVFormat(t *testing.T) {
+	s, dir := openTestSeries(t)
+	defer os.RemoveAll(dir)
+	defer s.Log.Close()
+
+	// columns in a different order than in the series, empty cells are missing values
+	input := "time, b ,name=a\n0,2,1\n1,,3\n2,,\n1970-01-01T00:00:03Z,4,\n"
+
+	format := &csvFormat{}
+	if err := format.Register(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := readTestPoints(format, input, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []storage.Point{
+		{Values: []int64{0, 1, 2}},
+		{Values: []int64{1, 3, storage.Missing}},
+		{Values: []int64{3, storage.Missing, 4}},
+	}
+
+	if !reflect.DeepEqual(points, want) || format.Skipped() != 1 {
+		t.Errorf("unexpected points %v, %d skipped", points, format.Skipped())
+	}
+
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"", nil},
+		{"a,b\n0,1\n", nil},
+		{"time,c\n", minitsdb.ErrColumnUnknown},
+		{"time,a,name=a\n", nil},
+		{"time,a\nyesterday,1\n", nil},
+		{"time,a\n0,x\n", nil},
+		{"time,a\n0,1e300\n", minitsdb.ErrValueRange},
+		{"time,a\n0,inf\n", minitsdb.ErrValueRange},
+	}
+
+	for _, tt := range tests {
+		format := &csvFormat{}
+		if err := format.Register(&s); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := readTestPoints(format, tt.input, 10)
+		if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("%q: expected error %v, got %v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestLineFormat(t *testing.T) {
+	s, dir := openTestSeries(t)
+	defer os.RemoveAll(dir)
+	defer s.Log.Close()
+
+	// comments, empty lines and points of other series are skipped
+	input := "# comment\nname:test|name:a 1|name:b 2|10\n\nname:other|name:a 1|11\nname:test|name:b 5|12\n"
+
+	format := &lineFormat{}
+	if err := format.Register(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := readTestPoints(format, input, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []storage.Point{
+		{Values: []int64{10, 1, 2}},
+		{Values: []int64{12, storage.Missing, 5}},
+	}
+
+	if !reflect.DeepEqual(points, want) || format.Skipped() != 1 {
+		t.Errorf("unexpected points %v, %d skipped", points, format.Skipped())
+	}
+
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"name:test|name:a 1|", nil},
+		{"name:test|name:a 1", nil},
+		{"name:test|name:c 1|10", minitsdb.ErrColumnUnknown},
+		{"name:test|name:a x|10", nil},
+		{"name:test|name:a 100000000000000000000|10", minitsdb.ErrValueRange},
+		{"name:test|name:a 1e3|10", lineprotocol.ErrInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		format := &lineFormat{}
+		if err := format.Register(&s); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := readTestPoints(format, tt.input, 10)
+		if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("%q: expected error %v, got %v", tt.input, tt.err, err)
+		}
+	}
+}
@@ -7,29 +7,34 @@ import (
 	"github.com/martin2250/minitsdb/minitsdb/storage"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io"
 	"io/ioutil"
 	"os"
-	"sort"
+	"path"
 )
 
 var insertflags = struct {
-	series string
-	input  string
-	format string
-	output string
-	buffer int
+	series   string
+	input    string
+	format   string
+	output   string
+	buffer   int
+	backfill int
 }{}
 
 type inputFormat interface {
-	// Register passes the input series' columns to the inputFormat
-	Register([]minitsdb.Column)
-	// Read reads the entire input file to RAM
-	Read(path string, progress func(p float32)) (storage.PointBuffer, error)
+	// Register passes the output series to the inputFormat, before any points are read
+	Register(s *minitsdb.Series) error
+	// Read reads up to n points from the input, returns io.EOF once all points were read
+	// the points are not necessarily sorted by time
+	Read(r io.Reader, n int) ([]storage.Point, error)
+	// Skipped returns the number of input points that don't belong to the series or hold no values
+	Skipped() int
 }
 
 var formats = map[string]inputFormat{
-	//"series": nil,
-	"line": nil,
+	"line": &lineFormat{},
+	"csv":  &csvFormat{},
 }
 
 func NewCommand() *cobra.Command {
@@ -38,7 +43,20 @@ func NewCommand() *cobra.Command {
 		Short: "Insert data into a series",
 		Long: `
 This command will insert data from another file format into the
-root bucket of a series.`,
+root bucket of a series. The output series is created with the
+configuration of the input series and must not exist or be empty.
+Points are read in chunks of the buffer size. Points older than
+the data already written are collected and merged into the data
+files once the backfill size is reached, every merge rewrites the
+affected data files, so sorted input is inserted fastest.
+
+Formats:
+  line  line protocol as accepted by the server, lines of other
+        series are skipped, omitted values are missing
+  csv   header row with "time" and a column label per series
+        column, e.g. "power,phase=A" for the tags name=power and
+        phase=A. times are unix timestamps or RFC3339, empty
+        cells and columns without header are missing`,
 		RunE: run,
 	}
 
@@ -46,9 +64,10 @@ root bucket of a series.`,
 
 	cmd.Flags().StringVarP(&insertflags.series, "series", "s", "", "path to input series directory")
 	cmd.Flags().StringVarP(&insertflags.input, "input", "i", "", "path to input file")
-	cmd.Flags().StringVarP(&insertflags.format, "format", "f", "", "input file format")
+	cmd.Flags().StringVarP(&insertflags.format, "format", "f", "", "input file format (line, csv)")
 	cmd.Flags().StringVarP(&insertflags.output, "output", "o", "", "path to output series directory")
 	cmd.Flags().IntVarP(&insertflags.buffer, "buffer", "b", 3000, "buffer size")
+	cmd.Flags().IntVar(&insertflags.backfill, "backfill", 100000, "number of out-of-order points collected before merging them into the data files")
 
 	return cmd
 }
@@ -57,15 +76,19 @@ func run(cmd *cobra.Command, args []string) error {
 	// check input series
 	if stat, err := os.Stat(insertflags.series); os.IsNotExist(err) {
 		return errors.New("series points to a nonexisting directory")
+	} else if err != nil {
+		return err
 	} else if !stat.IsDir() {
 		return errors.New("series points to a file")
 	}
 
 	// check output series
 	if stat, err := os.Stat(insertflags.output); os.IsNotExist(err) {
-		if err := os.MkdirAll(insertflags.output, 0600); err != nil {
+		if err := os.MkdirAll(insertflags.output, 0755); err != nil {
 			return err
 		}
+	} else if err != nil {
+		return err
 	} else if !stat.IsDir() {
 		return errors.New("output points to a file")
 	} else {
@@ -77,8 +100,11 @@ func run(cmd *cobra.Command, args []string) error {
 	}
 
 	// check input file
-	if stat, err := os.Stat(insertflags.input); os.IsNotExist(err) {
+	stat, err := os.Stat(insertflags.input)
+	if os.IsNotExist(err) {
 		return errors.New("input points to a nonexisting file")
+	} else if err != nil {
+		return err
 	} else if stat.IsDir() {
 		return errors.New("input points to a directory")
 	}
@@ -89,13 +115,20 @@ func run(cmd *cobra.Command, args []string) error {
 		return errors.New("unknown input format")
 	}
 
-	// open input series
-	logrus.Info("opening input series")
-	inputSeries, err := minitsdb.OpenSeries(insertflags.series)
+	if insertflags.buffer < 1 || insertflags.backfill < 1 {
+		return errors.New("buffer and backfill size must be positive")
+	}
+
+	// create output series from the configuration of the input series
+	config, err := ioutil.ReadFile(path.Join(insertflags.series, "series.yaml"))
 	if err != nil {
 		return err
 	}
 
+	if err := ioutil.WriteFile(path.Join(insertflags.output, "series.yaml"), config, 0644); err != nil {
+		return err
+	}
+
 	// open output series
 	logrus.Info("opening output series")
 	outputSeries, err := minitsdb.OpenSeries(insertflags.output)
@@ -103,48 +136,103 @@ func run(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	// points read before an error are written as well
+	defer func() {
+		outputSeries.FlushAll()
+
+		if outputSeries.Log != nil {
+			outputSeries.Log.Close()
+		}
+	}()
+
+	if err := format.Register(&outputSeries); err != nil {
+		return err
+	}
+
 	// read input file
-	format.Register(inputSeries.Columns)
-	data, err := format.Read(insertflags.input, func(p float32) {
-		fmt.Printf("%0.0f %% \r", p)
-	})
+	file, err := os.Open(insertflags.input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	input := &countingReader{r: file}
+
+	points, backfilled, err := insertPoints(format, input, stat.Size(), &outputSeries)
 	if err != nil {
 		return err
 	}
-	// sort
-	sort.Sort(sortPoints(data))
+
+	fmt.Printf("inserted %d points, rewrote %d data files\n", points, backfilled)
+
+	if skipped := format.Skipped(); skipped > 0 {
+		fmt.Printf("skipped %d points of other series or without values\n", skipped)
+	}
 
 	return nil
 }
 
-type sortPoints storage.PointBuffer
+// insertPoints reads all points from the input and inserts them into the series
+// points older than the data already written are collected and backfilled in batches
+// returns the number of points read and data files rewritten
+func insertPoints(format inputFormat, input *countingReader, size int64, s *minitsdb.Series) (points, backfilled int, err error) {
+	var pending []storage.Point
 
-func (s sortPoints) Len() int {
-	return len(s.Values[0])
-}
+	backfill := func() error {
+		backfills, err := s.Backfill(pending)
+		backfilled += len(backfills)
+		pending = pending[:0]
+		return err
+	}
 
-func (s sortPoints) Less(i int, j int) bool {
-	return s.Values[0][i] < s.Values[0][j]
-}
+	for {
+		chunk, errRead := format.Read(input, insertflags.buffer)
+
+		// the points read before an error are inserted as well
+		for _, p := range chunk {
+			// later points with the same time replace earlier ones, in the buffer and when backfilling
+			if err := s.InsertPoint(p); err == minitsdb.ErrInsertAtEnd {
+				pending = append(pending, p)
+			} else if err != nil {
+				return points, backfilled, err
+			}
+		}
+
+		s.Flush()
 
-func (s sortPoints) Swap(i int, j int) {
-	for k := range s.Values {
-		s.Values[k][i], s.Values[k][j] = s.Values[k][j], s.Values[k][i]
+		points += len(chunk)
+
+		if errRead != nil && errRead != io.EOF {
+			if err := backfill(); err != nil {
+				return points, backfilled, err
+			}
+			return points, backfilled, errRead
+		}
+
+		if len(pending) >= insertflags.backfill {
+			if err := backfill(); err != nil {
+				return points, backfilled, err
+			}
+		}
+
+		if size > 0 {
+			fmt.Printf("%0.0f %% \r", float32(input.n)*100/float32(size))
+		}
+
+		if errRead == io.EOF {
+			return points, backfilled, backfill()
+		}
 	}
 }
 
-//type sortPoints [][]int64
-//
-//func (s sortPoints) Len() int {
-//	return len(s[0])
-//}
-//
-//func (s sortPoints) Less(i int, j int) bool {
-//	return s[0][i] < s[0][j]
-//}
-//
-//func (s sortPoints) Swap(i int, j int) {
-//	for k := range s {
-//		s[k][i], s[k][j] = s[k][j], s[k][i]
-//	}
-//}
+// countingReader counts the bytes read from the input file to report progress
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,150 @@
+package insert
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testSeriesConfig = `
+tags:
+  name: test
+flushinterval: 10s
+flushcount: 50
+forceflushcount: 100
+pointsfile: 1000
+buckets:
+  - factor: 1
+  - factor: 10
+columns:
+  - decimals: 0
+    tags:
+      name: a
+  - decimals: 0
+    tags:
+      name: b
+wal:
+  sync: never
+`
+
+// openTestSeries creates a series in a temporary directory, the caller must remove the directory
+func openTestSeries(t *testing.T) (minitsdb.Series, string) {
+	dir, err := ioutil.TempDir("", "insert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), []byte(testSeriesConfig), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	s, err := minitsdb.OpenSeries(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, dir
+}
+
+// queryPrimary returns all points of the primary bucket
+func queryPrimary(t *testing.T, s *minitsdb.Series) storage.PointBuffer {
+	columns := make([]minitsdb.QueryColumn, len(s.Columns))
+	for i := range s.Columns {
+		columns[i] = minitsdb.QueryColumn{Column: &s.Columns[i], Function: downsampling.First}
+	}
+
+	query := s.Buckets[0].Query(columns, types.TimeRange{Start: 0, End: 1 << 40}, s.Buckets[0].TimeStep)
+	result := storage.NewPointBuffer(len(columns) + 1)
+
+	for {
+		buffer, err := query.Next()
+		if err == io.EOF {
+			return result
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		result.AppendBuffer(buffer)
+	}
+}
+
+func TestInsertPointsUnsorted(t *testing.T) {
+	s, dir := openTestSeries(t)
+	defer os.RemoveAll(dir)
+	defer s.Log.Close()
+
+	// blocks of 500 points in reverse order
+	var lines strings.Builder
+	for start := 4500; start >= 0; start -= 500 {
+		for i := start; i < start+500; i++ {
+			fmt.Fprintf(&lines, "name:test|name:a %d|name:b %d|%d\n", i, 2*i, i)
+		}
+	}
+
+	format := &lineFormat{}
+	if err := format.Register(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	insertflags.buffer = 300
+	insertflags.backfill = 100000
+
+	points, backfilled, err := insertPoints(format, &countingReader{r: strings.NewReader(lines.String())}, 0, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.FlushAll()
+
+	// the out-of-order points are merged once, so every data file is rewritten at most once
+	if points != 5000 || backfilled > len(s.Buckets[0].DataFiles)+len(s.Buckets[1].DataFiles) {
+		t.Errorf("inserted %d points, rewrote %d data files", points, backfilled)
+	}
+
+	result := queryPrimary(t, &s)
+
+	if result.Len() != 5000 {
+		t.Fatalf("expected 5000 points, got %d", result.Len())
+	}
+
+	for i := 0; i < result.Len(); i++ {
+		if result.Values[0][i] != int64(i) || result.Values[1][i] != int64(i) || result.Values[2][i] != int64(2*i) {
+			t.Fatalf("unexpected point %v", result.At(i))
+		}
+	}
+}
+
+func TestInsertPointsError(t *testing.T) {
+	s, dir := openTestSeries(t)
+	defer os.RemoveAll(dir)
+	defer s.Log.Close()
+
+	format := &lineFormat{}
+	if err := format.Register(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	insertflags.buffer = 300
+	insertflags.backfill = 100000
+
+	input := "name:test|name:a 1|name:b 2|20\nname:test|name:a 1|name:b 2|10\nname:test|name:a x|10\n"
+
+	points, _, err := insertPoints(format, &countingReader{r: strings.NewReader(input)}, 0, &s)
+	if err == nil {
+		t.Fatal("expected error for invalid value")
+	}
+
+	// the points read before the error are inserted
+	if points != 2 || queryPrimary(t, &s).Len() != 2 {
+		t.Errorf("expected 2 points before the error, got %d", points)
+	}
+}
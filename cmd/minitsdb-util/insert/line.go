@@ -0,0 +1,76 @@
+package insert
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/pkg/lineprotocol"
+	"io"
+	"strings"
+)
+
+// lineFormat reads points in line protocol, points of other series are skipped
+type lineFormat struct {
+	series  *minitsdb.Series
+	scanner *bufio.Scanner
+	line    int
+	skipped int
+}
+
+func (f *lineFormat) Register(s *minitsdb.Series) error {
+	f.series = s
+	return nil
+}
+
+func (f *lineFormat) Read(r io.Reader, n int) ([]storage.Point, error) {
+	if f.scanner == nil {
+		f.scanner = bufio.NewScanner(r)
+	}
+
+	points := make([]storage.Point, 0, n)
+
+	for len(points) < n {
+		if !f.scanner.Scan() {
+			if err := f.scanner.Err(); err != nil {
+				return points, err
+			}
+			return points, io.EOF
+		}
+
+		f.line++
+
+		text := strings.TrimSpace(f.scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// the time is optional for the server, but a point without time can't be inserted later
+		if strings.HasSuffix(text, "|") {
+			return points, fmt.Errorf("line %d: point has no time", f.line)
+		}
+
+		lp, err := lineprotocol.ParseStates(text)
+		if err != nil {
+			return points, fmt.Errorf("line %d: %w", f.line, err)
+		}
+
+		if !lineprotocol.MatchKVPs(lp.Series, f.series.Tags) {
+			f.skipped++
+			continue
+		}
+
+		p, err := f.series.ConvertPoint(lp)
+		if err != nil {
+			return points, fmt.Errorf("line %d: %w", f.line, err)
+		}
+
+		points = append(points, p)
+	}
+
+	return points, nil
+}
+
+func (f *lineFormat) Skipped() int {
+	return f.skipped
+}
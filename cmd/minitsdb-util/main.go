@@ -1,7 +1,13 @@
 package main
 
 import (
+	"github.com/martin2250/minitsdb/cmd/minitsdb-util/backup"
+	"github.com/martin2250/minitsdb/cmd/minitsdb-util/check"
+	"github.com/martin2250/minitsdb/cmd/minitsdb-util/delete"
+	"github.com/martin2250/minitsdb/cmd/minitsdb-util/export"
 	"github.com/martin2250/minitsdb/cmd/minitsdb-util/insert"
+	"github.com/martin2250/minitsdb/cmd/minitsdb-util/rebuild"
+	"github.com/martin2250/minitsdb/cmd/minitsdb-util/restore"
 	"github.com/spf13/cobra"
 )
 
@@ -13,7 +19,13 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.InitDefaultHelpCmd()
 
+	rootCmd.AddCommand(backup.NewCommand())
+	rootCmd.AddCommand(check.NewCommand())
+	rootCmd.AddCommand(delete.NewCommand())
+	rootCmd.AddCommand(export.NewCommand())
 	rootCmd.AddCommand(insert.NewCommand())
+	rootCmd.AddCommand(rebuild.NewCommand())
+	rootCmd.AddCommand(restore.NewCommand())
 }
 
 func main() {
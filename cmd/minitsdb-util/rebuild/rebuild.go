@@ -0,0 +1,63 @@
+package rebuild
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/spf13/cobra"
+)
+
+var rebuildflags = struct {
+	series string
+	first  int
+	last   int
+}{}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rebuild",
+		Short: "Regenerate downsampled buckets of a series",
+		Long: `
+This command downsamples the entire primary bucket of a series again
+and replaces the selected downsampled buckets with the result, e.g.
+after aggregations were changed. Buckets are numbered starting at 1
+for the first downsampled bucket. The server must not be running.`,
+		RunE: run,
+	}
+
+	cmd.InitDefaultHelpCmd()
+
+	cmd.Flags().StringVarP(&rebuildflags.series, "series", "s", "", "path to series directory")
+	cmd.Flags().IntVarP(&rebuildflags.first, "first", "f", 1, "first bucket to rebuild")
+	cmd.Flags().IntVarP(&rebuildflags.last, "last", "l", 0, "last bucket to rebuild (default last bucket of series)")
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	if rebuildflags.series == "" {
+		return fmt.Errorf("series must be specified")
+	}
+
+	series, err := minitsdb.OpenSeries(rebuildflags.series)
+
+	if err != nil {
+		return err
+	}
+
+	if series.Log != nil {
+		defer series.Log.Close()
+	}
+
+	last := rebuildflags.last
+	if last == 0 {
+		last = len(series.Buckets) - 1
+	}
+
+	rebuilds, err := series.Rebuild(rebuildflags.first, last)
+
+	for _, r := range rebuilds {
+		fmt.Printf("rebuilt %s with %d points in %d files, kept %d older points\n", r.Path, r.Points, r.Files, r.Kept)
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var restoreflags = struct {
+	input    string
+	database string
+}{}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a backup into a new database directory",
+		Long: `
+This command unpacks a tar archive created by the backup command into
+a new database directory. The archive is unpacked next to the target
+and checked for inconsistencies first, the target directory is only
+created if no problems were found. Existing directories are never
+overwritten.`,
+		RunE: run,
+	}
+
+	cmd.InitDefaultHelpCmd()
+
+	cmd.Flags().StringVarP(&restoreflags.input, "input", "i", "", "path of the archive")
+	cmd.Flags().StringVarP(&restoreflags.database, "database", "d", "", "path of the database directory to create")
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	if restoreflags.input == "" || restoreflags.database == "" {
+		return fmt.Errorf("input and database must be specified")
+	}
+
+	file, err := os.Open(restoreflags.input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := minitsdb.RestoreTar(file, restoreflags.database)
+
+	for _, p := range report.Problems {
+		fmt.Printf("PROBLEM  %s: %s\n", p.Path, p.Description)
+	}
+
+	if err != nil {
+		cmd.SilenceUsage = true
+		return err
+	}
+
+	fmt.Printf("restored %d series, %d buckets, %d files, %d blocks to %s\n",
+		report.Series, report.Buckets, report.Files, report.Blocks, restoreflags.database)
+
+	return nil
+}
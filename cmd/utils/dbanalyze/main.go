@@ -62,6 +62,7 @@ func main() {
 	check(err)
 
 	fmt.Printf(" number of blocks: %d\n", result.NumBlocks)
+	fmt.Printf("       block size: %s\n", formatFileSize(int64(result.BlockSize)))
 	fmt.Printf(" number of points: %d\n", result.NumPoints)
 	fmt.Printf("number of columns: %d\n", result.NumColumns)
 	fmt.Printf("   bits per value: %0.2f\n",
@@ -3,25 +3,20 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
-	"io"
 	"log"
-	"os"
 
-	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb"
 )
 
 var opts struct {
-	pathInput  string
-	pathOutput string
+	pathSeries string
 
-	sizeBuffer int
+	fill float64
 }
 
 func init() {
-	flag.StringVar(&opts.pathInput, "input", "../../data.base", "input file")
-	flag.StringVar(&opts.pathOutput, "output", "test.base", "output file")
-	flag.IntVar(&opts.sizeBuffer, "buffer", 5000, "number of points to buffer before trying to write a new block")
+	flag.StringVar(&opts.pathSeries, "series", "", "series directory")
+	flag.Float64Var(&opts.fill, "fill", 0.8, "compact files with a smaller fraction of used bytes")
 
 	flag.Parse()
 }
@@ -33,70 +28,28 @@ func check(err error) {
 }
 
 func main() {
-	fileInput, err := os.Open(opts.pathInput)
+	series, err := minitsdb.OpenSeries(opts.pathSeries)
 	check(err)
-	defer fileInput.Close()
 
-	fileOutput, err := os.Create(opts.pathOutput)
-	check(err)
-	defer fileOutput.Close()
-
-	_, values, err := storage.ReadBlock(fileInput)
-
-	if err != nil {
-		log.Fatalf("First Block damaged: %v\n", err)
+	if series.Log != nil {
+		defer series.Log.Close()
 	}
 
-	available := true
-	blockCounterInput := 0
-	blockCounterOutput := 0
-	pointCounter := 0
-
-	for available || len(values[0]) > 0 {
-		if available && len(values[0]) < opts.sizeBuffer {
-			blockCounterInput++
-			header, valuesNew, err := storage.ReadBlock(fileInput)
-
-			if err == io.EOF {
-				available = false
-				continue
-			} else if err != nil {
-				log.Printf("Error reading block #%d %v\n", blockCounterInput, err)
-				continue
-			}
-
-			if len(valuesNew) != len(values) {
-				log.Printf("Block #%d has different column count from previous, skipping (%d, %d)\n", blockCounterInput, len(valuesNew), len(values))
-				continue
-			}
-
-			for i, column := range valuesNew {
-				values[i] = append(values[i], column...)
-			}
+	// points replayed from the write-ahead log are written first, so the log can be reset
+	series.FlushAll()
 
-			pointCounter += int(header.NumPoints)
+	var blocksBefore, blocksAfter int64
 
-			continue
-		}
-
-		buffer, count, err := encoding.EncodeBlock(values)
-
-		if err != nil {
-			log.Fatalf("Error encoding block %v\n", err)
-		}
+	for i := range series.Buckets {
+		compactions, err := series.Buckets[i].Compact(opts.fill)
+		check(err)
 
-		n, err := buffer.WriteTo(fileOutput)
-
-		if n != 4096 || err != nil {
-			log.Fatalf("Error writing to output file (%d bytes written) %v\n", n, err)
-		}
-
-		for i := range values {
-			values[i] = values[i][count:]
+		for _, c := range compactions {
+			fmt.Printf("compacted %s from %d into %d blocks\n", c.Path, c.BlocksBefore, c.BlocksAfter)
+			blocksBefore += c.BlocksBefore
+			blocksAfter += c.BlocksAfter
 		}
-
-		blockCounterOutput++
 	}
 
-	fmt.Printf("Compacted %d points from %d into %d block\n", pointCounter, blockCounterInput, blockCounterOutput)
+	fmt.Printf("Compacted %d blocks into %d blocks\n", blocksBefore, blocksAfter)
 }
@@ -0,0 +1,361 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/martin2250/minitsdb/util"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Backfill describes a data file that was rewritten to include points inserted into an archived time range
+type Backfill struct {
+	Path         string
+	BlocksBefore int64
+	BlocksAfter  int64
+	Points       int64
+}
+
+// mergePoints merges two buffers sorted by time, points of add replace points of buffer with the same time
+func mergePoints(buffer, add storage.PointBuffer) storage.PointBuffer {
+	merged := storage.NewPointBuffer(buffer.Cols())
+
+	i, j := 0, 0
+	for i < buffer.Len() || j < add.Len() {
+		switch {
+		case j == add.Len() || (i < buffer.Len() && buffer.Values[0][i] < add.Values[0][j]):
+			merged.AppendPoint(buffer.At(i))
+			i++
+		case i == buffer.Len() || add.Values[0][j] < buffer.Values[0][i]:
+			merged.AppendPoint(add.At(j))
+			j++
+		default:
+			merged.AppendPoint(add.At(j))
+			i++
+			j++
+		}
+	}
+
+	return merged
+}
+
+// rewriteFile replaces a data file with the points returned by update, which receives the points stored in the file
+// if update returns false, the file is left unchanged. A file without points is removed
+// the reused last block is not passed to update and copied as is, so the next flush can still overwrite it
+// blocks of older schemas are rewritten with the current columns, the values of removed columns are lost
+// compressed files are rewritten uncompressed and compressed again once they are cold
+// must be called while holding the rewrite and bucket mutex
+func (b *Bucket) rewriteFile(df *storage.DataFile, created bool, update func(storage.PointBuffer) (storage.PointBuffer, bool)) (blocksBefore, blocksAfter int64, err error) {
+	buffer := storage.NewPointBuffer(len(b.Transformers))
+
+	var reused []byte
+
+	if !created {
+		blocksBefore = df.Blocks
+
+		buffer, err = b.ReadDataFile(df)
+		if err != nil {
+			return blocksBefore, blocksBefore, err
+		}
+
+		if b.OverwriteLast && df == b.DataFiles[len(b.DataFiles)-1] {
+			block, err := df.ReadBlock(df.Blocks - 1)
+			if err != nil {
+				return blocksBefore, blocksBefore, err
+			}
+			reused = block.Bytes()
+
+			buffer.TrimEnd(b.LastTimeOnDisk)
+		}
+	}
+
+	buffer, changed := update(buffer)
+
+	if !changed {
+		return blocksBefore, blocksBefore, nil
+	}
+
+	if buffer.Len() == 0 && reused == nil {
+		if !created {
+			if err := df.Remove(); err != nil && !os.IsNotExist(err) {
+				return blocksBefore, blocksBefore, err
+			}
+
+			b.cache.invalidateFile(df.Path)
+
+			if i := indexOfDataFile(b.DataFiles, df); i != -1 {
+				b.DataFiles = append(b.DataFiles[:i], b.DataFiles[i+1:]...)
+			}
+		}
+
+		return blocksBefore, 0, nil
+	}
+
+	blocksAfter, err = WriteDataFile(df.Path, buffer, b.Transformers, b.Schema, df.BlockSize, func(blocks int64) error {
+		if reused != nil {
+			file, err := os.OpenFile(df.Path+".tmp", os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+
+			_, err = file.Write(reused)
+			if err == nil {
+				err = file.Sync()
+			}
+			if errClose := file.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				return err
+			}
+
+			blocks++
+		}
+
+		if err := os.Rename(df.Path+".tmp", df.Path); err != nil {
+			return err
+		}
+
+		b.cache.invalidateFile(df.Path)
+
+		df.Blocks = blocks
+		df.Compressed = false
+		return nil
+	})
+
+	if err != nil {
+		return blocksBefore, blocksBefore, err
+	}
+
+	if reused != nil {
+		blocksAfter++
+	}
+
+	if created {
+		b.DataFiles = append(b.DataFiles, df)
+		b.sortFiles()
+	}
+
+	// the file may need to be compacted again
+	b.forgetChecked(df)
+
+	return blocksBefore, blocksAfter, nil
+}
+
+// merge inserts points sorted by time into the bucket, points that are already archived are merged into their data files
+// if dirty is set, the time steps of the next bucket that contain buffered points are marked as dirty
+// returns the rewritten data files and the times of the archived points
+func (b *Bucket) merge(points storage.PointBuffer, dirty bool) ([]Backfill, []int64, error) {
+	b.rewriteMux.Lock()
+	defer b.rewriteMux.Unlock()
+
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	// points that are not archived yet are inserted into the buffer as usual
+	archived := 0
+	for archived < points.Len() && points.Values[0][archived] <= b.LastTimeOnDisk {
+		archived++
+	}
+
+	for j := archived; j < points.Len(); j++ {
+		b.Buffer.InsertPoint(points.At(j))
+
+		if dirty && !b.Last {
+			b.Dirty[util.RoundDown(points.Values[0][j], b.Next.TimeStep)] = struct{}{}
+		}
+	}
+
+	var backfills []Backfill
+
+	times := points.Values[0][:archived]
+	for start := 0; start < len(times); {
+		df, created, count := b.GetStorageTime(times[start:])
+
+		filePoints := storage.NewPointBuffer(points.Cols())
+		for j := start; j < start+count; j++ {
+			filePoints.AppendPoint(points.At(j))
+		}
+
+		backfill := Backfill{
+			Path:   df.Path,
+			Points: int64(count),
+		}
+
+		var err error
+		backfill.BlocksBefore, backfill.BlocksAfter, err = b.rewriteFile(df, created, func(existing storage.PointBuffer) (storage.PointBuffer, bool) {
+			return mergePoints(existing, filePoints), true
+		})
+
+		if err != nil {
+			return backfills, times, err
+		}
+
+		backfills = append(backfills, backfill)
+		start += count
+	}
+
+	return backfills, times, nil
+}
+
+// downsampleSteps downsamples the points of bucket i-1 in the time steps of bucket i, including points on disk
+// steps must be in ascending order, so the downsampled points are sorted by time as well
+func (s *Series) downsampleSteps(i int, steps []types.TimeRange) (storage.PointBuffer, error) {
+	b := &s.Buckets[i-1]
+	downsampled := storage.NewPointBuffer(s.SecondaryCount)
+
+	for _, step := range steps {
+		query := b.Query(b.DownSampleColumns, step, b.Next.TimeStep)
+
+		for {
+			buffer, err := query.Next()
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return downsampled, err
+			}
+
+			downsampled.AppendBuffer(buffer)
+		}
+	}
+
+	return downsampled, nil
+}
+
+// backfillBucket inserts points sorted by time into bucket i, last is the time of the latest point inserted into
+// the bucket, including points inserted into the buffer before. The affected time steps of the next bucket
+// are downsampled again and backfilled recursively
+func (s *Series) backfillBucket(i int, points storage.PointBuffer, last int64) ([]Backfill, error) {
+	b := &s.Buckets[i]
+
+	backfills, times, err := b.merge(points, true)
+
+	if err != nil || b.Last {
+		return backfills, err
+	}
+
+	var steps []types.TimeRange
+	for _, t := range times {
+		step := types.TimeRangeFromPoint(t, b.Next.TimeStep)
+		if len(steps) == 0 || steps[len(steps)-1] != step {
+			steps = append(steps, step)
+		}
+	}
+
+	// time steps that only contain buffered points are downsampled using the dirty flags,
+	// except for the step holding the last archived point, the dirty flag only downsamples its buffered points
+	b.Mux.RLock()
+	lastTimeOnDisk := b.LastTimeOnDisk
+	b.Mux.RUnlock()
+
+	boundary := types.TimeRangeFromPoint(lastTimeOnDisk, b.Next.TimeStep)
+
+	if lastTimeOnDisk != math.MinInt64 && last >= boundary.Start && (len(steps) == 0 || steps[len(steps)-1] != boundary) {
+		steps = append(steps, boundary)
+	}
+
+	if len(steps) == 0 {
+		return backfills, nil
+	}
+
+	downsampled, err := s.downsampleSteps(i+1, steps)
+	if err != nil {
+		return backfills, err
+	}
+
+	b.Mux.Lock()
+	for _, step := range steps {
+		delete(b.Dirty, step.Start)
+	}
+	b.Mux.Unlock()
+
+	next, err := s.backfillBucket(i+1, downsampled, steps[len(steps)-1].Start)
+
+	return append(backfills, next...), err
+}
+
+// Backfill inserts points into the series, including points in time ranges that are already archived
+// archived points are merged into their data files, which are replaced via a temporary file,
+// points at the time of an existing point replace that point. The downsampled buckets are updated accordingly
+// backfilling rewrites entire data files, so points should be passed in large batches
+func (s *Series) Backfill(points []storage.Point) ([]Backfill, error) {
+	for _, p := range points {
+		if len(p.Values) != len(s.Columns)+1 {
+			return nil, ErrColumnMismatch
+		}
+	}
+
+	sorted := make([]storage.Point, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Values[0] < sorted[j].Values[0]
+	})
+
+	s.Buckets[0].Mux.RLock()
+	lastTimeOnDisk := s.Buckets[0].LastTimeOnDisk
+	s.Buckets[0].Mux.RUnlock()
+
+	archived := storage.NewPointBuffer(len(s.Columns) + 1)
+
+	for _, p := range sorted {
+		if p.Values[0] > lastTimeOnDisk {
+			// the write-ahead log only covers points that are not archived
+			if err := s.InsertPoint(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// later points with the same time take precedence, as with regular inserts
+		if l := archived.Len(); l > 0 && archived.Values[0][l-1] == p.Values[0] {
+			for i := range archived.Values {
+				archived.Values[i] = archived.Values[i][:l-1]
+			}
+		}
+
+		archived.AppendPoint(p)
+	}
+
+	if len(sorted) == 0 {
+		return nil, nil
+	}
+
+	return s.backfillBucket(0, archived, sorted[len(sorted)-1].Values[0])
+}
+
+// QueueBackfill queues a point older than the archived data of the series for the next RunBackfill
+// the point is appended to the write-ahead log, so it is backfilled when the series is opened again
+// Must be called from the goroutine that inserts points
+func (s *Series) QueueBackfill(p storage.Point) error {
+	if len(p.Values) != len(s.Columns)+1 {
+		return ErrColumnMismatch
+	}
+
+	if s.Log != nil {
+		if err := s.Log.Append(p); err != nil {
+			return err
+		}
+	}
+
+	s.backfill = append(s.backfill, p)
+
+	return nil
+}
+
+// RunBackfill backfills the queued points and removes them from the write-ahead log
+// the points are dropped if the backfill fails
+func (s *Series) RunBackfill() ([]Backfill, error) {
+	if len(s.backfill) == 0 {
+		return nil, nil
+	}
+
+	backfills, err := s.Backfill(s.backfill)
+
+	s.backfill = nil
+	s.resetLog()
+
+	return backfills, err
+}
@@ -0,0 +1,267 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/util"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testBuffer creates a point buffer from points
+func testBuffer(points ...[]int64) storage.PointBuffer {
+	buffer := storage.NewPointBuffer(len(points[0]))
+	for _, p := range points {
+		buffer.AppendPoint(storage.Point{Values: p})
+	}
+	return buffer
+}
+
+func TestMergePoints(t *testing.T) {
+	tests := []struct {
+		buffer, add, want storage.PointBuffer
+	}{
+		{
+			buffer: testBuffer([]int64{1, 10}, []int64{3, 30}),
+			add:    testBuffer([]int64{2, 20}, []int64{4, 40}),
+			want:   testBuffer([]int64{1, 10}, []int64{2, 20}, []int64{3, 30}, []int64{4, 40}),
+		},
+		{
+			buffer: testBuffer([]int64{1, 10}, []int64{2, 20}),
+			add:    testBuffer([]int64{2, 21}),
+			want:   testBuffer([]int64{1, 10}, []int64{2, 21}),
+		},
+		{
+			buffer: storage.NewPointBuffer(2),
+			add:    testBuffer([]int64{5, 50}),
+			want:   testBuffer([]int64{5, 50}),
+		},
+		{
+			buffer: testBuffer([]int64{5, 50}),
+			add:    storage.NewPointBuffer(2),
+			want:   testBuffer([]int64{5, 50}),
+		},
+	}
+
+	for i, tt := range tests {
+		got := mergePoints(tt.buffer, tt.add)
+		if !reflect.DeepEqual(got.Values, tt.want.Values) {
+			t.Errorf("test %d: got %v, want %v", i, got.Values, tt.want.Values)
+		}
+	}
+}
+
+func TestRewriteFile(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 2500)
+	s.FlushAll()
+
+	b := &s.Buckets[0]
+	b.rewriteMux.Lock()
+	defer b.rewriteMux.Unlock()
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	df := b.DataFiles[0]
+	files := len(b.DataFiles)
+
+	// an unchanged file is not written
+	before, after, err := b.rewriteFile(df, false, func(buffer storage.PointBuffer) (storage.PointBuffer, bool) {
+		if buffer.Len() != 1000 || buffer.Values[0][0] != 0 {
+			t.Errorf("unexpected points passed to update, %d points", buffer.Len())
+		}
+		return buffer, false
+	})
+
+	if err != nil || before != after || before != df.Blocks {
+		t.Errorf("unchanged rewrite returned %d, %d, %v", before, after, err)
+	}
+
+	// keep every second point
+	_, _, err = b.rewriteFile(df, false, func(buffer storage.PointBuffer) (storage.PointBuffer, bool) {
+		kept := storage.NewPointBuffer(buffer.Cols())
+		for i := 0; i < buffer.Len(); i += 2 {
+			kept.AppendPoint(buffer.At(i))
+		}
+		return kept, true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer, err := b.ReadDataFile(df)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buffer.Len() != 500 || buffer.Values[0][1] != 2 || buffer.Values[2][1] != 4 {
+		t.Errorf("unexpected points after rewrite, %d points", buffer.Len())
+	}
+
+	// a file without points is removed
+	_, after, err = b.rewriteFile(df, false, func(buffer storage.PointBuffer) (storage.PointBuffer, bool) {
+		return storage.NewPointBuffer(buffer.Cols()), true
+	})
+
+	if err != nil || after != 0 || len(b.DataFiles) != files-1 {
+		t.Errorf("empty rewrite returned %d blocks, %d files, %v", after, len(b.DataFiles), err)
+	}
+
+	if _, err := os.Stat(df.Path); !os.IsNotExist(err) {
+		t.Errorf("empty data file was not removed: %v", err)
+	}
+}
+
+func TestBucketMerge(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 2500)
+	s.Flush()
+
+	b := &s.Buckets[0]
+	last := b.LastTimeOnDisk
+	buffered := b.Buffer.Len()
+
+	points := testBuffer([]int64{10, -1, -2}, []int64{last, -3, -6}, []int64{last + 10000, 1, 2})
+
+	_, times, err := b.merge(points, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(times, []int64{10, last}) {
+		t.Errorf("unexpected archived times %v", times)
+	}
+
+	if b.Buffer.Len() != buffered+1 {
+		t.Errorf("expected the point after the last archived point in the buffer")
+	}
+
+	if _, ok := b.Dirty[util.RoundDown(last+10000, b.Next.TimeStep)]; !ok {
+		t.Error("time step of the buffered point not marked as dirty")
+	}
+
+	primary := queryTestBucket(t, &s, 0)
+	for i := 0; i < primary.Len(); i++ {
+		switch primary.Values[0][i] {
+		case 10:
+			if primary.Values[1][i] != -1 || primary.Values[2][i] != -2 {
+				t.Errorf("point at 10 was not replaced: %v", primary.At(i))
+			}
+		case last:
+			if primary.Values[1][i] != -3 || primary.Values[2][i] != -6 {
+				t.Errorf("point at %d was not replaced: %v", last, primary.At(i))
+			}
+		}
+	}
+}
+
+func TestSeriesBackfill(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	reference, dirReference := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirReference)
+
+	insertTestPoints(t, &reference, 0, 5000)
+	reference.FlushAll()
+
+	// insert every second point, then backfill the others in reverse order
+	var missing []storage.Point
+	for i := int64(0); i < 5000; i++ {
+		p := storage.Point{Values: []int64{i, i, 2 * i}}
+
+		if i%2 == 1 && i < 4000 {
+			missing = append([]storage.Point{p}, missing...)
+			continue
+		}
+
+		if err := s.InsertPoint(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Flush()
+	s.Buckets[0].DownsampleStartup()
+
+	// later points with the same time replace earlier ones
+	missing = append([]storage.Point{{Values: []int64{3, 100, 100}}}, missing...)
+
+	backfills, err := s.Backfill(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backfills) == 0 {
+		t.Error("no data files were rewritten")
+	}
+
+	s.FlushAll()
+
+	for i := range s.Buckets {
+		got, want := queryTestBucket(t, &s, i), queryTestBucket(t, &reference, i)
+
+		if !util.Compare2DInt64(got.Values, want.Values) {
+			t.Errorf("bucket %d differs from the reference series, %d and %d points", i, got.Len(), want.Len())
+		}
+	}
+
+	if _, err := s.Backfill([]storage.Point{{Values: []int64{1, 2}}}); err != ErrColumnMismatch {
+		t.Errorf("expected ErrColumnMismatch, got %v", err)
+	}
+}
+
+func TestQueueBackfill(t *testing.T) {
+	config := testSeriesConfig + "wal:\n  sync: never\n"
+
+	s, dir := openTestSeries(t, config)
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 2500)
+	s.Flush()
+
+	if err := s.QueueBackfill(storage.Point{Values: []int64{5, -1, -2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// queued points are kept in the log when it is reset after a flush
+	insertTestPoints(t, &s, 2500, 3000)
+	s.FlushAll()
+
+	if err := s.QueueBackfill(storage.Point{Values: []int64{1, 2}}); err != ErrColumnMismatch {
+		t.Errorf("expected ErrColumnMismatch, got %v", err)
+	}
+
+	s.Log.Close()
+
+	// the queued points are backfilled when the series is opened again
+	s, err := OpenSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Log.Close()
+
+	primary := queryTestBucket(t, &s, 0)
+	if primary.Len() != 3000 || primary.Values[1][5] != -1 || primary.Values[2][5] != -2 {
+		t.Errorf("queued point was not backfilled, %d points, %v", primary.Len(), primary.At(5))
+	}
+
+	if len(s.backfill) != 0 {
+		t.Errorf("%d points still queued after opening the series", len(s.backfill))
+	}
+
+	if err := s.QueueBackfill(storage.Point{Values: []int64{6, -3, -6}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if backfills, err := s.RunBackfill(); err != nil || len(backfills) == 0 {
+		t.Errorf("unexpected backfill %v, %v", backfills, err)
+	}
+
+	if primary := queryTestBucket(t, &s, 0); primary.Values[1][6] != -3 {
+		t.Errorf("queued point was not backfilled, %v", primary.At(6))
+	}
+}
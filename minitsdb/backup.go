@@ -0,0 +1,332 @@
+package minitsdb
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshot is a consistent copy of all series of a database, created by Database.Snapshot
+type Snapshot struct {
+	// Path is the temporary directory holding the copy, it is laid out like a database directory
+	Path string
+
+	Series int
+	Files  int
+	// Linked is the number of data files that were hard linked instead of copied
+	Linked int
+	// Bytes is the size of all data files in the snapshot
+	Bytes int64
+}
+
+// Snapshot flushes all series and creates a copy of the database in a temporary directory next to it
+// data files are hard linked where possible, as they are only replaced as a whole while the server is running.
+// The last file of each bucket is copied, since flushes write to it in place. Write-ahead logs and index files
+// are not part of the snapshot, all points were flushed and the index is rebuilt when it is missing.
+// Must be called from the goroutine that inserts points, the snapshot must be removed by the caller
+func (db *Database) Snapshot() (Snapshot, error) {
+	dbPath := path.Clean(db.Path)
+
+	dir, err := ioutil.TempDir(path.Dir(dbPath), path.Base(dbPath)+".snapshot")
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Path: dir}
+
+	for i := range db.Series {
+		s := &db.Series[i]
+
+		s.FlushAll()
+
+		if err := s.snapshot(path.Join(dir, path.Base(s.Path)), &snapshot); err != nil {
+			snapshot.Remove()
+			return Snapshot{}, fmt.Errorf("series %s: %w", s.Path, err)
+		}
+
+		// the flush forced out a partially filled block, it is reloaded like on startup and overwritten by the next flush
+		b := &s.Buckets[0]
+		if n := len(b.DataFiles); n > 0 {
+			if err := b.reuseLastBlock(int(b.DataFiles[n-1].BlockSize)); err != nil {
+				logrus.WithError(err).WithField("path", b.Path).Warning("could not reuse last block")
+			}
+		}
+
+		snapshot.Series++
+	}
+
+	return snapshot, nil
+}
+
+// snapshot copies the configuration and data files of a series to dir
+func (s *Series) snapshot(dir string, snapshot *Snapshot) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"series.yaml", schemaFile} {
+		// schema versions are only recorded once the columns of a series changed
+		if _, err := copyFile(path.Join(s.Path, name), path.Join(dir, name), -1); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for i := range s.Buckets {
+		if err := s.Buckets[i].snapshot(path.Join(dir, path.Base(s.Buckets[i].Path)), snapshot); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshot links or copies all data files of the bucket to dir
+// files are neither replaced nor written while the bucket is locked
+func (b *Bucket) snapshot(dir string, snapshot *Snapshot) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	b.rewriteMux.Lock()
+	defer b.rewriteMux.Unlock()
+
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+
+	for i, df := range b.DataFiles {
+		dst := path.Join(dir, path.Base(df.Path))
+
+		if i < len(b.DataFiles)-1 && os.Link(df.Path, dst) == nil {
+			info, err := os.Stat(dst)
+			if err != nil {
+				return err
+			}
+
+			snapshot.Files++
+			snapshot.Linked++
+			snapshot.Bytes += info.Size()
+			continue
+		}
+
+		// partially written blocks at the end of the file are not copied
+		size := df.Blocks * df.BlockSize
+		if df.Compressed {
+			size = -1
+		}
+
+		n, err := copyFile(df.Path, dst, size)
+		if err != nil {
+			return err
+		}
+
+		snapshot.Files++
+		snapshot.Bytes += n
+	}
+
+	return nil
+}
+
+// copyFile copies the first size bytes of src to a new file dst, the entire file if size is negative
+// returns the number of bytes copied
+func copyFile(src, dst string, size int64) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if size < 0 {
+		n, err = io.Copy(out, in)
+	} else {
+		n, err = io.CopyN(out, in, size)
+	}
+
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+
+	return n, err
+}
+
+// Remove deletes the snapshot directory
+func (s Snapshot) Remove() error {
+	return os.RemoveAll(s.Path)
+}
+
+// WriteTar writes the snapshot to w as a tar archive, paths are relative to the database directory
+func (s Snapshot) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(s.Path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || filePath == s.Path {
+			return err
+		}
+
+		name, err := filepath.Rel(s.Path, filePath)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.CopyN(tw, file, info.Size())
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// ErrInvalidArchive indicates that a tar archive does not contain a database snapshot
+var ErrInvalidArchive = errors.New("invalid database archive")
+
+// RestoreTar unpacks a database archive written by Snapshot.WriteTar into databasePath, which must not exist
+// the archive is unpacked into a temporary directory next to databasePath and checked with CheckDatabase,
+// it is only moved into place if the check finds no problems
+func RestoreTar(r io.Reader, databasePath string) (CheckReport, error) {
+	databasePath = path.Clean(databasePath)
+
+	if _, err := os.Stat(databasePath); !os.IsNotExist(err) {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", databasePath)
+		}
+		return CheckReport{}, err
+	}
+
+	dir, err := ioutil.TempDir(path.Dir(databasePath), path.Base(databasePath)+".restore")
+	if err != nil {
+		return CheckReport{}, err
+	}
+
+	report, err := restoreTar(r, dir)
+
+	if err == nil && report.Series == 0 {
+		err = fmt.Errorf("%w: no series found", ErrInvalidArchive)
+	}
+
+	if err == nil && len(report.Problems) > 0 {
+		err = fmt.Errorf("restored database contains %d problems", len(report.Problems))
+	}
+
+	if err == nil {
+		err = os.Rename(dir, databasePath)
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+
+	return report, err
+}
+
+// restoreTar unpacks an archive into dir and checks the database
+func restoreTar(r io.Reader, dir string) (CheckReport, error) {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return CheckReport{}, err
+		}
+
+		name, err := archivePath(header)
+		if err != nil {
+			return CheckReport{}, err
+		}
+
+		target := path.Join(dir, name)
+
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return CheckReport{}, err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return CheckReport{}, err
+		}
+
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return CheckReport{}, err
+		}
+
+		_, err = io.Copy(file, tr)
+
+		if errClose := file.Close(); err == nil {
+			err = errClose
+		}
+
+		if err != nil {
+			return CheckReport{}, err
+		}
+	}
+
+	return CheckDatabase(dir, false)
+}
+
+// archivePath checks that an archive entry is part of a database directory and returns its cleaned path
+// only series directories holding series.yaml and schema.yaml, and bucket directories holding data files are allowed
+func archivePath(header *tar.Header) (string, error) {
+	name := path.Clean(strings.TrimSuffix(header.Name, "/"))
+
+	if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("%w: illegal path %s", ErrInvalidArchive, header.Name)
+	}
+
+	parts := strings.Split(name, "/")
+
+	switch {
+	case header.Typeflag == tar.TypeDir && len(parts) <= 2:
+		return name, nil
+	case header.Typeflag != tar.TypeReg:
+	case len(parts) == 2 && (parts[1] == "series.yaml" || parts[1] == schemaFile):
+		return name, nil
+	case len(parts) == 3 && path.Ext(parts[2]) == ".mdb":
+		return name, nil
+	}
+
+	return "", fmt.Errorf("%w: unexpected entry %s", ErrInvalidArchive, header.Name)
+}
@@ -0,0 +1,195 @@
+package minitsdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := path.Join(dir, "db")
+
+	for _, name := range []string{"a", "b"} {
+		if err := os.MkdirAll(path.Join(dbPath, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		config := strings.Replace(testSeriesConfig, "name: test", "name: "+name, 1)
+		if err := ioutil.WriteFile(path.Join(dbPath, name, "series.yaml"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffered points are flushed by the snapshot
+	a := db.FindSeries(map[string]string{"name": "a"}, false)[0]
+	insertTestPoints(t, a, 0, 2550)
+	a.Flush()
+
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	err = snapshot.WriteTar(&archive)
+
+	if errRemove := snapshot.Remove(); err == nil {
+		err = errRemove
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.Series != 2 || snapshot.Files == 0 || snapshot.Linked == 0 {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	restoredPath := path.Join(dir, "restored")
+	data := archive.Bytes()
+
+	report, err := RestoreTar(bytes.NewReader(data), restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Series != 2 {
+		t.Errorf("restored %d series, want 2", report.Series)
+	}
+
+	restored, err := NewDatabase(restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := restored.SeriesList()
+	for i := range list {
+		compareTestSeries(t, &list[i], db.FindSeries(list[i].Tags, false)[0])
+	}
+
+	if _, err := RestoreTar(bytes.NewReader(data), restoredPath); err == nil {
+		t.Error("expected error when restoring into an existing directory")
+	}
+
+	// archives with entries outside of the database are refused and nothing is restored
+	var invalid bytes.Buffer
+	tw := tar.NewWriter(&invalid)
+	if err := tw.WriteHeader(&tar.Header{Name: "../a/series.yaml", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	invalidPath := path.Join(dir, "invalid")
+	if _, err := RestoreTar(&invalid, invalidPath); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("expected ErrInvalidArchive, got %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("unexpected files after refused restore %d", len(files))
+	}
+}
+
+func TestArchivePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeflag byte
+		ok       bool
+	}{
+		{"a/", tar.TypeDir, true},
+		{"a/primary/", tar.TypeDir, true},
+		{"a/series.yaml", tar.TypeReg, true},
+		{"a/" + schemaFile, tar.TypeReg, true},
+		{"a/primary/0.mdb", tar.TypeReg, true},
+		{"a/./primary/0.mdb", tar.TypeReg, true},
+		{"../a/series.yaml", tar.TypeReg, false},
+		{"a/../../series.yaml", tar.TypeReg, false},
+		{"/a/series.yaml", tar.TypeReg, false},
+		{"..", tar.TypeDir, false},
+		{"./", tar.TypeDir, false},
+		{"a/primary/x/", tar.TypeDir, false},
+		{"a/wal", tar.TypeReg, false},
+		{"a/primary/0.txt", tar.TypeReg, false},
+		{"a/primary/0.mdb", tar.TypeSymlink, false},
+	}
+
+	for _, tt := range tests {
+		_, err := archivePath(&tar.Header{Name: tt.name, Typeflag: tt.typeflag})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if err != nil && !errors.Is(err, ErrInvalidArchive) {
+			t.Errorf("%s: expected ErrInvalidArchive, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestSnapshotReuseLastBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := path.Join(dir, "db")
+
+	if err := os.MkdirAll(path.Join(dbPath, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dbPath, "a", "series.yaml"), []byte(testSeriesConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reference, dirReference := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirReference)
+
+	s := db.FindSeries(map[string]string{"name": "test"}, false)[0]
+
+	// every snapshot forces out a partially filled block
+	for i := int64(0); i < 5; i++ {
+		insertTestPoints(t, s, i*10, i*10+10)
+
+		snapshot, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot.Remove()
+
+		if !s.Buckets[0].OverwriteLast {
+			t.Fatal("last block was not reloaded after the snapshot")
+		}
+	}
+
+	s.FlushAll()
+
+	insertTestPoints(t, &reference, 0, 50)
+	reference.FlushAll()
+
+	if got, want := s.Buckets[0].DataFiles[0].Blocks, reference.Buckets[0].DataFiles[0].Blocks; got != want {
+		t.Errorf("snapshots left %d blocks, want %d", got, want)
+	}
+
+	compareTestSeries(t, s, &reference)
+}
@@ -2,7 +2,6 @@ package minitsdb
 
 import (
 	"bytes"
-	"fmt"
 	"github.com/martin2250/minitsdb/minitsdb/storage"
 	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
 	"github.com/martin2250/minitsdb/minitsdb/types"
@@ -29,6 +28,9 @@ type Bucket struct {
 	// number of points in a file
 	PointsPerFile int64
 
+	// BlockSize is the size of blocks in new data files, existing files keep their block size until compacted
+	BlockSize int64
+
 	DataFiles []*storage.DataFile
 
 	Path string
@@ -45,11 +47,36 @@ type Bucket struct {
 	// transformers include time and (for non-primary buckets) the count transformer
 	Transformers []encoding.Transformer
 
+	// Schema is the version of the series schema that new blocks are written with
+	Schema int
+	// layouts maps blocks of all schema versions to the current columns
+	layouts map[int]blockLayout
+
 	// keeps a list of time ranges (of the next bucket) that were modified since the last downsampling event
 	Dirty map[int64]struct{}
 
 	Buffer storage.PointBuffer
 
+	// Retention is the time in seconds after which data files are deleted, zero keeps files forever
+	Retention int64
+	// Expired holds statistics about the data files deleted because of the retention
+	Expired ExpiryStats
+
+	// compactChecked holds the number of blocks of data files at the time they were last checked for compaction
+	// it is guarded by checkedMux, as compaction runs in its own goroutine while the main loop rewrites files
+	compactChecked map[*storage.DataFile]int64
+	checkedMux     sync.Mutex
+
+	// cache holds recently queried blocks, it is shared by all buckets of the database
+	cache *BlockCache
+
+	// rewriteMux serializes compaction, compression, backfills and deletions, which all replace entire data files
+	rewriteMux sync.Mutex
+
+	// OverwriteLast is true when the buffer contains the points of the last block on disk,
+	// the next flush overwrites this block instead of appending a new one
+	OverwriteLast bool
+
 	LastFlush time.Time
 }
 
@@ -105,8 +132,15 @@ func (b *Bucket) DownsampleStartup() error {
 		logrus.Info("finished startup downsampling")
 	}()
 
+	timeStart := b.Next.LastTimeOnDisk
+
+	// points reloaded from a reused block don't need to be downsampled again
+	if l := b.Next.Buffer.Len(); l > 0 && b.Next.Buffer.Values[0][l-1] > timeStart {
+		timeStart = b.Next.Buffer.Values[0][l-1]
+	}
+
 	query := b.Query(b.DownSampleColumns, types.TimeRange{
-		Start: b.Next.LastTimeOnDisk + b.Next.TimeStep,
+		Start: timeStart + b.Next.TimeStep,
 		End:   math.MaxInt64 - b.Next.TimeStep*100,
 	}, b.Next.TimeStep)
 
@@ -119,7 +153,10 @@ func (b *Bucket) DownsampleStartup() error {
 			return err
 		}
 
+		// the buffer may be copied by other goroutines, e.g. for followers
+		b.Next.Mux.Lock()
 		b.Next.Buffer.AppendBuffer(buffer)
+		b.Next.Mux.Unlock()
 
 		// todo: don't hardcode this
 		if b.Next.Buffer.Len() > 400 {
@@ -130,7 +167,7 @@ func (b *Bucket) DownsampleStartup() error {
 
 // Flush writes the bucket's buffer content to disk
 // timeLimt sets the last time that may be written to disk
-// force allows the buffer to flush even if it would not fill an entire 4k block
+// force allows the buffer to flush even if it would not fill an entire block
 // returns true if points were actually written to disk
 func (b *Bucket) Flush(timeLimit int64, force bool) bool {
 	b.Downsample()
@@ -161,19 +198,20 @@ func (b *Bucket) Flush(timeLimit int64, force bool) bool {
 	}
 
 	// transform values
-	transformed := make([][]uint64, b.Buffer.Cols())
+	values := make([][]int64, b.Buffer.Cols())
+	for i := range values {
+		values[i] = b.Buffer.Values[i][:count]
+	}
 
-	for i, t := range b.Transformers {
-		var err error
-		transformed[i], err = t.Apply(b.Buffer.Values[i][:count])
-		if err != nil {
-			panic(err) // todo: make non-fatal
-		}
+	transformed, missing, err := transformValues(values, b.Transformers)
+
+	if err != nil {
+		panic(err) // todo: make non-fatal
 	}
 
 	// encode values
 	var block bytes.Buffer
-	header, err := encoding.EncodeBlock(&block, b.Buffer.Values[0][:count], transformed)
+	header, err := encoding.EncodeBlockSchema(&block, b.Schema, int(dataFile.BlockSize), b.Buffer.Values[0][:count], transformed, missing)
 
 	if err != nil {
 		panic(err) // todo: make non-fatal
@@ -184,13 +222,20 @@ func (b *Bucket) Flush(timeLimit int64, force bool) bool {
 		return false
 	}
 
+	// the first block written after reloading the last block from disk replaces that block
+	overwrite := b.OverwriteLast && !created
+
 	// write transformed values to file
-	err = dataFile.WriteBlock(block, false) // todo: fix overwrite and implement
+	err = dataFile.WriteBlock(block, overwrite)
 
 	if err != nil {
 		panic(err) // todo: make non-fatal
 	}
 
+	b.cache.invalidateBlock(dataFile.Path, dataFile.Blocks-1)
+
+	b.OverwriteLast = false
+
 	if created {
 		b.DataFiles = append(b.DataFiles, dataFile)
 		b.sortFiles()
@@ -210,7 +255,9 @@ func (b *Bucket) sortFiles() {
 	})
 }
 
-func (b *Bucket) loadFiles() error {
+// loadFiles lists the data files of the bucket
+// if readOnly is set, missing directories are not created and damaged files are not repaired
+func (b *Bucket) loadFiles(readOnly bool) error {
 	b.DataFiles = make([]*storage.DataFile, 0, 16)
 
 	// list database files
@@ -218,22 +265,51 @@ func (b *Bucket) loadFiles() error {
 
 	// create if not exists
 	if os.IsNotExist(err) {
-		err = os.Mkdir(b.Path, 0755)
+		if !readOnly {
+			err = os.Mkdir(b.Path, 0755)
+		}
 		return nil
 	} else if err != nil {
 		return err
 	}
 
 	for _, info := range fileInfos {
-		file, err := storage.OpenDataFile(path.Join(b.Path, info.Name()), info, b.TimeStep*b.PointsPerFile)
+		filePath := path.Join(b.Path, info.Name())
+
+		// skip backups of repaired files and other files without logging
+		if info.IsDir() || path.Ext(filePath) != ".mdb" {
+			continue
+		}
+
+		if readOnly {
+			b.openDataFile(filePath, info)
+			continue
+		}
+
+		// repair damage from crashes during writes
+		repair, err := storage.RecoverDataFile(filePath, b.TimeStep*b.PointsPerFile)
 
 		if err != nil {
-			// errors are non-fatal
-			fmt.Println(err.Error())
+			logrus.WithError(err).WithField("path", filePath).Error("could not recover data file")
 			continue
 		}
 
-		b.DataFiles = append(b.DataFiles, &file)
+		if repair.Modified() {
+			logrus.WithFields(logrus.Fields{
+				"path":      filePath,
+				"truncated": repair.TruncatedBytes,
+				"dropped":   repair.DroppedBlocks,
+				"reasons":   repair.Reasons,
+				"backup":    repair.CorruptPath,
+			}).Warning("repaired data file")
+
+			if info, err = os.Stat(filePath); err != nil {
+				logrus.WithError(err).WithField("path", filePath).Error("could not open data file")
+				continue
+			}
+		}
+
+		b.openDataFile(filePath, info)
 	}
 
 	// should already be sorted as ioutil returns list of files sorted
@@ -242,6 +318,18 @@ func (b *Bucket) loadFiles() error {
 	return nil
 }
 
+// openDataFile adds a data file to the bucket, errors are non-fatal
+func (b *Bucket) openDataFile(filePath string, info os.FileInfo) {
+	file, err := storage.OpenDataFile(filePath, info, b.TimeStep*b.PointsPerFile)
+
+	if err != nil {
+		logrus.WithError(err).WithField("path", filePath).Warning("skipping data file")
+		return
+	}
+
+	b.DataFiles = append(b.DataFiles, &file)
+}
+
 // checkTimeLast sets TimeLast from last block on disk
 func (b *Bucket) checkTimeLast() error {
 	b.LastTimeOnDisk = math.MinInt64
@@ -259,6 +347,7 @@ func (b *Bucket) checkTimeLast() error {
 	}
 
 	d := encoding.NewDecoder()
+	d.BlockSize = int(df.BlockSize)
 	d.SetReader(&buf)
 
 	// read last block header
@@ -273,28 +362,90 @@ func (b *Bucket) checkTimeLast() error {
 	return nil
 }
 
-func OpenBucket(basePath string, timeStep int64, pointsPerFile int64) (Bucket, error) {
-	b := Bucket{
+// reuseLastBlock loads the points of the last block on disk into the buffer
+// if the block uses fewer than reuseMax bytes, so they are rewritten together with new points
+// this keeps files dense when blocks are flushed before they are full, e.g. on shutdown
+// must be called after the transformers are set and while the buffer is empty, e.g. before any points are inserted
+func (b *Bucket) reuseLastBlock(reuseMax int) error {
+	if reuseMax == 0 || len(b.DataFiles) == 0 || b.Buffer.Len() != 0 {
+		return nil
+	}
+
+	df := b.DataFiles[len(b.DataFiles)-1]
+	buf, err := df.ReadBlock(df.Blocks - 1)
+
+	if err != nil {
+		return err
+	}
+
+	d := encoding.NewDecoder()
+	d.BlockSize = int(df.BlockSize)
+	d.SetReader(&buf)
+	d.Need = make([]bool, len(b.Transformers))
+	for i := range d.Need {
+		d.Need[i] = true
+	}
+
+	header, err := d.DecodeHeader()
+
+	if err != nil {
+		return err
+	}
+
+	// blocks of older schemas are left as they are
+	if header.BytesUsed >= reuseMax || !b.currentLayout(header.Schema) {
+		return nil
+	}
+
+	layout, err := b.headerLayout(header)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := d.DecodeBlock()
+
+	if err != nil {
+		return err
+	}
+
+	values, err := layout.revert(decoded, d.Missing, d.Need, header.NumPoints)
+	if err != nil {
+		return err
+	}
+
+	b.Mux.Lock()
+	b.Buffer.AppendBuffer(storage.PointBuffer{Values: values})
+	b.LastTimeOnDisk = header.TimeFirst - 1
+	b.OverwriteLast = true
+	b.Mux.Unlock()
+
+	return nil
+}
+
+func newBucket(basePath string, timeStep int64, pointsPerFile int64, blockSize int64) Bucket {
+	return Bucket{
 		LastTimeOnDisk: math.MinInt64,
 		TimeStep:       timeStep,
 		PointsPerFile:  pointsPerFile,
+		BlockSize:      blockSize,
 		Path:           path.Join(basePath, strconv.FormatInt(timeStep, 10)),
 		Dirty:          map[int64]struct{}{},
 	}
+}
 
-	err := b.loadFiles()
-
-	if err != nil {
-		return Bucket{}, err
+// open loads the data files of the bucket from disk
+func (b *Bucket) open() error {
+	if err := b.recoverRebuild(); err != nil {
+		return err
 	}
 
-	err = b.checkTimeLast()
+	err := b.loadFiles(false)
 
 	if err != nil {
-		return Bucket{}, err
+		return err
 	}
 
-	return b, nil
+	return b.checkTimeLast()
 }
 
 func (b *Bucket) getDataFile(fileTime int64) (file *storage.DataFile, created bool) {
@@ -306,7 +457,7 @@ func (b *Bucket) getDataFile(fileTime int64) (file *storage.DataFile, created bo
 		}
 	}
 
-	df := storage.NewDataFile(b.Path, fileTime, b.TimeStep*b.PointsPerFile)
+	df := storage.NewDataFile(b.Path, fileTime, b.TimeStep*b.PointsPerFile, b.BlockSize)
 
 	return df, true
 }
@@ -336,6 +487,8 @@ func (b *Bucket) WriteBlock(fileTime int64, buffer bytes.Buffer, overwrite bool)
 		return err
 	}
 
+	b.cache.invalidateBlock(dataFile.Path, dataFile.Blocks-1)
+
 	if created {
 		b.DataFiles = append(b.DataFiles, dataFile)
 		b.sortFiles()
@@ -0,0 +1,241 @@
+package minitsdb
+
+import (
+	"container/list"
+	"path"
+	"sync"
+)
+
+// DefaultCacheSize is the number of bytes of values held by the block cache of a database
+const DefaultCacheSize = 16 << 20
+
+// CacheStats describes the usage of a BlockCache since the database was opened
+type CacheStats struct {
+	// Hits and Misses count the blocks read by queries
+	Hits   int64
+	Misses int64
+	// Evictions counts the blocks removed to make room for others, Invalidations those removed because they were overwritten
+	Evictions     int64
+	Invalidations int64
+
+	// Blocks and Bytes describe the values currently held in the cache, Size is the limit of Bytes
+	Blocks int
+	Bytes  int64
+	Size   int64
+}
+
+// cacheKey identifies a block of a data file
+type cacheKey struct {
+	path  string
+	block int64
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// columns holds the reverted values of every column, nil for columns that were not decoded
+	columns [][]int64
+	bytes   int64
+}
+
+// BlockCache holds the reverted columns of recently read blocks, so repeated queries don't read and decode them again
+// it is shared by all buckets of a database, blocks must be invalidated while holding the bucket mutex whenever they are overwritten.
+// A nil cache is valid and caches nothing
+type BlockCache struct {
+	mux     sync.Mutex
+	size    int64
+	entries map[cacheKey]*list.Element
+	// recent holds the entries in order of their last use, starting with the most recent
+	recent list.List
+	stats  CacheStats
+}
+
+// NewBlockCache creates a cache that holds up to size bytes of values
+func NewBlockCache(size int64) *BlockCache {
+	return &BlockCache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// SetSize changes the number of bytes held by the cache, zero disables the cache
+func (c *BlockCache) SetSize(size int64) {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.size = size
+	c.evict()
+}
+
+// Stats returns the current usage of the cache
+func (c *BlockCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	stats := c.stats
+	stats.Blocks = len(c.entries)
+	stats.Size = c.size
+	return stats
+}
+
+// get returns the columns of a block, nil if any of the columns in need is not cached
+// the values must not be modified
+func (c *BlockCache) get(filePath string, block int64, need []int) [][]int64 {
+	if c == nil {
+		return nil
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.size == 0 {
+		return nil
+	}
+
+	elem, ok := c.entries[cacheKey{path: filePath, block: block}]
+
+	if ok {
+		e := elem.Value.(*cacheEntry)
+		values := make([][]int64, len(e.columns))
+
+		for _, i := range need {
+			if i >= len(e.columns) || e.columns[i] == nil {
+				ok = false
+				break
+			}
+			values[i] = e.columns[i]
+		}
+
+		if ok {
+			c.recent.MoveToFront(elem)
+			c.stats.Hits++
+			return values
+		}
+	}
+
+	c.stats.Misses++
+	return nil
+}
+
+// put adds the columns in need of a block to the cache, the values must not be modified afterwards
+func (c *BlockCache) put(filePath string, block int64, values [][]int64, need []int) {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.size == 0 {
+		return
+	}
+
+	key := cacheKey{path: filePath, block: block}
+
+	var e *cacheEntry
+
+	if elem, ok := c.entries[key]; ok && len(elem.Value.(*cacheEntry).columns) == len(values) {
+		e = elem.Value.(*cacheEntry)
+		c.recent.MoveToFront(elem)
+	} else {
+		if ok {
+			c.remove(elem)
+		}
+		e = &cacheEntry{key: key, columns: make([][]int64, len(values))}
+		c.entries[key] = c.recent.PushFront(e)
+	}
+
+	for _, i := range need {
+		if e.columns[i] == nil {
+			e.columns[i] = values[i]
+			e.bytes += 8 * int64(len(values[i]))
+			c.stats.Bytes += 8 * int64(len(values[i]))
+		}
+	}
+
+	c.evict()
+}
+
+// invalidateBlock removes a block that was overwritten or appended
+func (c *BlockCache) invalidateBlock(filePath string, block int64) {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.entries[cacheKey{path: filePath, block: block}]; ok {
+		c.remove(elem)
+		c.stats.Invalidations++
+	}
+}
+
+// invalidateFile removes all blocks of a data file that was replaced, truncated or deleted
+func (c *BlockCache) invalidateFile(filePath string) {
+	c.invalidateMatching(func(key cacheKey) bool {
+		return key.path == filePath
+	})
+}
+
+// invalidateBucket removes all blocks of the data files in a bucket directory
+func (c *BlockCache) invalidateBucket(bucketPath string) {
+	c.invalidateMatching(func(key cacheKey) bool {
+		return path.Dir(key.path) == path.Clean(bucketPath)
+	})
+}
+
+func (c *BlockCache) invalidateMatching(match func(key cacheKey) bool) {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for key, elem := range c.entries {
+		if match(key) {
+			c.remove(elem)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// evict removes the least recently used blocks until the cache fits its size, must be called while holding the mutex
+func (c *BlockCache) evict() {
+	for c.stats.Bytes > c.size && c.recent.Len() > 0 {
+		c.remove(c.recent.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops an entry, must be called while holding the mutex
+func (c *BlockCache) remove(elem *list.Element) {
+	e := c.recent.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.stats.Bytes -= e.bytes
+}
+
+// useCache makes all buckets of a series use the cache
+func (s *Series) useCache(c *BlockCache) {
+	for i := range s.Buckets {
+		s.Buckets[i].cache = c
+	}
+}
+
+// dropCache removes all blocks of the series from the cache, running queries are waited for
+func (s *Series) dropCache() {
+	for i := range s.Buckets {
+		b := &s.Buckets[i]
+		b.Mux.Lock()
+		b.cache.invalidateBucket(b.Path)
+		b.Mux.Unlock()
+	}
+}
@@ -0,0 +1,168 @@
+package minitsdb
+
+import (
+	"os"
+	"testing"
+)
+
+// testCacheValues returns cols columns of 10 values each, 80 bytes per column
+func testCacheValues(cols int) [][]int64 {
+	values := make([][]int64, cols)
+	for i := range values {
+		values[i] = make([]int64, 10)
+	}
+	return values
+}
+
+func TestBlockCacheEvict(t *testing.T) {
+	c := NewBlockCache(200)
+
+	c.put("bucket/a.mdb", 0, testCacheValues(1), []int{0})
+	c.put("bucket/a.mdb", 1, testCacheValues(1), []int{0})
+
+	// the first block was used last, so the second one is evicted
+	if c.get("bucket/a.mdb", 0, []int{0}) == nil {
+		t.Fatal("block 0 is not cached")
+	}
+
+	c.put("bucket/a.mdb", 2, testCacheValues(1), []int{0})
+
+	if c.get("bucket/a.mdb", 1, []int{0}) != nil {
+		t.Error("least recently used block was not evicted")
+	}
+
+	stats := c.Stats()
+	if stats.Blocks != 2 || stats.Bytes != 160 || stats.Evictions != 1 || stats.Size != 200 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// a smaller size evicts the least recently used blocks immediately
+	c.SetSize(100)
+
+	if c.get("bucket/a.mdb", 0, []int{0}) != nil || c.get("bucket/a.mdb", 2, []int{0}) == nil {
+		t.Error("SetSize did not evict the least recently used block")
+	}
+
+	c.SetSize(0)
+	c.put("bucket/a.mdb", 3, testCacheValues(1), []int{0})
+
+	stats = c.Stats()
+	if stats.Blocks != 0 || stats.Bytes != 0 || stats.Evictions != 3 {
+		t.Errorf("disabled cache holds blocks, stats %+v", stats)
+	}
+
+	if stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("expected 2 hits and 2 misses, got %+v", stats)
+	}
+
+	// a nil cache caches nothing
+	var nilCache *BlockCache
+	nilCache.put("bucket/a.mdb", 0, testCacheValues(1), []int{0})
+
+	if nilCache.get("bucket/a.mdb", 0, []int{0}) != nil || nilCache.Stats() != (CacheStats{}) {
+		t.Error("nil cache returned values")
+	}
+}
+
+func TestBlockCacheNeed(t *testing.T) {
+	c := NewBlockCache(DefaultCacheSize)
+
+	values := testCacheValues(3)
+	c.put("bucket/a.mdb", 0, values, []int{0, 2})
+
+	if got := c.get("bucket/a.mdb", 0, []int{2}); got == nil || got[0] != nil || len(got[2]) != 10 {
+		t.Errorf("unexpected partial hit %v", got)
+	}
+
+	// a query that needs a column that was not decoded reads the block again
+	if c.get("bucket/a.mdb", 0, []int{0, 1}) != nil {
+		t.Error("expected miss for column that was not cached")
+	}
+
+	c.put("bucket/a.mdb", 0, values, []int{1})
+
+	if c.get("bucket/a.mdb", 0, []int{0, 1, 2}) == nil {
+		t.Error("column added to cached block is missing")
+	}
+
+	stats := c.Stats()
+	if stats.Blocks != 1 || stats.Bytes != 240 || stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBlockCacheInvalidate(t *testing.T) {
+	c := NewBlockCache(DefaultCacheSize)
+
+	for _, p := range []string{"db/a/0/x.mdb", "db/a/0/y.mdb", "db/a/1/x.mdb"} {
+		c.put(p, 0, testCacheValues(1), []int{0})
+		c.put(p, 1, testCacheValues(1), []int{0})
+	}
+
+	c.invalidateBlock("db/a/0/x.mdb", 1)
+	c.invalidateBlock("db/a/0/x.mdb", 5)
+
+	if c.get("db/a/0/x.mdb", 1, []int{0}) != nil || c.get("db/a/0/x.mdb", 0, []int{0}) == nil {
+		t.Error("invalidateBlock removed the wrong blocks")
+	}
+
+	c.invalidateFile("db/a/0/y.mdb")
+
+	if c.get("db/a/0/y.mdb", 0, []int{0}) != nil {
+		t.Error("invalidateFile kept a block of the file")
+	}
+
+	c.invalidateBucket("db/a/0/")
+
+	if c.get("db/a/0/x.mdb", 0, []int{0}) != nil || c.get("db/a/1/x.mdb", 0, []int{0}) == nil {
+		t.Error("invalidateBucket removed the wrong blocks")
+	}
+
+	if stats := c.Stats(); stats.Blocks != 2 || stats.Invalidations != 4 || stats.Bytes != 160 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBlockCacheFlush(t *testing.T) {
+	// the last block is reused after a restart
+	s, dir := openTestSeries(t, testSeriesConfig+"reusemax: 4096\n")
+	defer os.RemoveAll(dir)
+
+	c := NewBlockCache(DefaultCacheSize)
+	s.useCache(c)
+
+	insertTestPoints(t, &s, 0, 100)
+	s.FlushAll()
+
+	if got := queryTestBucket(t, &s, 0); got.Len() != 100 {
+		t.Fatalf("queried %d points, expected 100", got.Len())
+	}
+
+	if got := queryTestBucket(t, &s, 0); got.Len() != 100 || c.Stats().Hits == 0 {
+		t.Fatalf("queried %d points, stats %+v", got.Len(), c.Stats())
+	}
+
+	// the reloaded last block is overwritten by the next flush
+	reopened, err := OpenSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.useCache(c)
+
+	if !reopened.Buckets[0].OverwriteLast {
+		t.Fatal("last block was not reloaded")
+	}
+
+	invalidations := c.Stats().Invalidations
+
+	insertTestPoints(t, &reopened, 100, 150)
+	reopened.FlushAll()
+
+	if c.Stats().Invalidations == invalidations {
+		t.Error("overwritten block was not invalidated")
+	}
+
+	if got := queryTestBucket(t, &reopened, 0); got.Len() != 150 {
+		t.Errorf("queried %d points after overwriting the last block, expected 150", got.Len())
+	}
+}
@@ -0,0 +1,372 @@
+package minitsdb
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// Problem describes an inconsistency found by CheckSeries
+type Problem struct {
+	// Path of the file or directory the problem was found in
+	Path        string
+	Description string
+	// Repaired is true if the problem was fixed
+	Repaired bool
+}
+
+// CheckReport summarizes the result of checking a database
+type CheckReport struct {
+	Series   int
+	Buckets  int
+	Files    int
+	Blocks   int64
+	Problems []Problem
+}
+
+// Unrepaired returns the number of problems that are left in the database
+func (r CheckReport) Unrepaired() int {
+	var n int
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *CheckReport) add(path string, repaired bool, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{
+		Path:        path,
+		Description: fmt.Sprintf(format, args...),
+		Repaired:    repaired,
+	})
+}
+
+// CheckDatabase verifies all series in a database directory without opening them
+// if repair is set, problems that can be fixed without losing intact data are repaired
+// the database must not be in use by a server while it is checked
+func CheckDatabase(databasePath string, repair bool) (CheckReport, error) {
+	var report CheckReport
+
+	files, err := ioutil.ReadDir(databasePath)
+
+	if err != nil {
+		return report, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		if err := CheckSeries(path.Join(databasePath, file.Name()), repair, &report); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// CheckSeries verifies the data files and write-ahead log of a single series and adds problems to report
+// returns an error only if the check could not be completed
+func CheckSeries(seriesPath string, repair bool, report *CheckReport) error {
+	conf, err := LoadSeriesYamlConfig(seriesPath)
+
+	if err != nil {
+		report.add(seriesPath, false, "could not load series config: %v", err)
+		return nil
+	}
+
+	s, err := NewSeries(seriesPath, conf)
+
+	if err != nil {
+		report.add(seriesPath, false, "invalid series config: %v", err)
+		return nil
+	}
+
+	schemas, err := LoadSchemas(seriesPath)
+
+	if err != nil {
+		report.add(path.Join(seriesPath, schemaFile), false, "could not load schema versions: %v", err)
+		return nil
+	}
+
+	// a changed config is only recorded as new schema version when the series is opened
+	if _, err := s.useSchemas(schemas); err != nil {
+		report.add(path.Join(seriesPath, schemaFile), false, "invalid schema: %v", err)
+		return nil
+	}
+
+	report.Series++
+
+	// time of the last point in each bucket
+	lastTimes := make([]int64, len(s.Buckets))
+
+	for i := range s.Buckets {
+		lastTimes[i], err = s.Buckets[i].check(repair, report)
+
+		if err != nil {
+			return err
+		}
+
+		report.Buckets++
+	}
+
+	// downsampled points can only exist once the source bucket contains data for the entire step
+	for i := 1; i < len(s.Buckets); i++ {
+		if lastTimes[i] != math.MinInt64 && lastTimes[i] > lastTimes[i-1] {
+			report.add(s.Buckets[i].Path, false, "last point at %d is newer than last point of bucket %s at %d",
+				lastTimes[i], path.Base(s.Buckets[i-1].Path), lastTimes[i-1])
+		}
+	}
+
+	if conf.Wal != nil {
+		log := storage.NewWriteAheadLog(path.Join(seriesPath, "wal"), s.PrimaryCount, storage.SyncNever, 0)
+
+		_, err := log.Replay(func(schema int, p storage.Point) error {
+			_, err := s.Buckets[0].layout(schema)
+			return err
+		})
+
+		if err != nil {
+			report.add(log.Path, false, "could not read write-ahead log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// check verifies all files in the bucket directory
+// returns the time of the last point stored in the bucket
+func (b *Bucket) check(repair bool, report *CheckReport) (int64, error) {
+	lastTime := int64(math.MinInt64)
+
+	fileInfos, err := ioutil.ReadDir(b.Path)
+
+	if os.IsNotExist(err) {
+		return lastTime, nil
+	} else if err != nil {
+		return lastTime, err
+	}
+
+	for _, info := range fileInfos {
+		filePath := path.Join(b.Path, info.Name())
+
+		switch {
+		case info.IsDir():
+			report.add(filePath, false, "unexpected directory in bucket")
+			continue
+		case strings.HasSuffix(filePath, ".corrupt"):
+			// backups made by earlier repairs
+			continue
+		case strings.HasSuffix(filePath, ".tmp"):
+			// left over by an interrupted compaction
+			report.add(filePath, repair && removeFile(filePath), "temporary file left over from interrupted compaction")
+			continue
+		case strings.HasSuffix(filePath, ".mdb.idx"):
+			// stale indices are rebuilt when they are used, only indices without data file are reported
+			if _, err := os.Stat(strings.TrimSuffix(filePath, ".idx")); os.IsNotExist(err) {
+				report.add(filePath, repair && removeFile(filePath), "index of missing data file")
+			}
+			continue
+		case path.Ext(filePath) != ".mdb":
+			report.add(filePath, false, "unknown file in bucket")
+			continue
+		case info.Size() == 0:
+			report.add(filePath, repair && removeFile(filePath), "data file is empty")
+			continue
+		}
+
+		// files too short for the first header are truncated to zero blocks
+		blockSize, err := storage.FileBlockSize(filePath)
+		if err != nil {
+			blockSize = encoding.DefaultBlockSize
+		}
+
+		// compressed files are checked when they are opened
+		compressed, err := storage.IsCompressed(filePath)
+		if err != nil {
+			return lastTime, err
+		}
+
+		if !compressed && info.Size()%blockSize != 0 {
+			if !repair {
+				report.add(filePath, false, "size %d is not a multiple of block size %d", info.Size(), blockSize)
+				continue
+			}
+
+			r, err := storage.RecoverDataFile(filePath, b.TimeStep*b.PointsPerFile)
+
+			if err != nil {
+				report.add(filePath, false, "could not truncate partial block: %v", err)
+				continue
+			}
+
+			report.add(filePath, true, "truncated %d bytes of partial block, dropped %d invalid blocks (backup %s)",
+				r.TruncatedBytes, r.DroppedBlocks, r.CorruptPath)
+
+			if info, err = os.Stat(filePath); err != nil {
+				return lastTime, err
+			}
+		}
+
+		df, err := storage.OpenDataFile(filePath, info, b.TimeStep*b.PointsPerFile)
+
+		if err != nil {
+			report.add(filePath, false, "%v", err)
+			continue
+		}
+
+		report.Files++
+
+		if df.TimeStart <= lastTime {
+			report.add(filePath, false, "file starts at %d before last point of previous file at %d", df.TimeStart, lastTime)
+		}
+
+		lastTime, err = b.checkFile(&df, lastTime, repair, report)
+
+		if err != nil {
+			return lastTime, err
+		}
+	}
+
+	return lastTime, nil
+}
+
+// checkFile verifies all blocks of a data file, lastTime is the time of the last point before this file
+// returns the time of the last point in this file
+func (b *Bucket) checkFile(df *storage.DataFile, lastTime int64, repair bool, report *CheckReport) (int64, error) {
+	var corrupt []int64
+	// index of the problem reported for each corrupted block
+	var corruptProblems []int
+
+	for n := int64(0); n < df.Blocks; n++ {
+		report.Blocks++
+
+		buf, err := df.ReadBlock(n)
+
+		if err != nil {
+			return lastTime, err
+		}
+
+		d := encoding.NewDecoder()
+		d.BlockSize = int(df.BlockSize)
+		d.SetReader(&buf)
+
+		header, err := d.DecodeHeader()
+
+		if err != nil {
+			corrupt = append(corrupt, n)
+			corruptProblems = append(corruptProblems, len(report.Problems))
+			report.add(df.Path, false, "block %d: %v", n, err)
+			continue
+		}
+
+		if _, err := b.headerLayout(header); err != nil {
+			report.add(df.Path, false, "block %d: %v", n, err)
+			continue
+		}
+
+		// only decode time and count columns, they are stored first in all schema versions
+		d.Need = make([]bool, header.NumColumns)
+		d.Need[0] = true
+		if !b.First {
+			d.Need[1] = true
+		}
+
+		if header.TimeFirst < df.TimeStart || header.TimeLast > df.TimeEnd {
+			report.add(df.Path, false, "block %d time range [%d, %d] is outside of file range [%d, %d]",
+				n, header.TimeFirst, header.TimeLast, df.TimeStart, df.TimeEnd)
+		}
+
+		if header.TimeFirst <= lastTime {
+			report.add(df.Path, false, "block %d starts at %d, overlapping previous data up to %d", n, header.TimeFirst, lastTime)
+		}
+
+		values, err := d.DecodeBlock()
+
+		if err != nil {
+			corrupt = append(corrupt, n)
+			corruptProblems = append(corruptProblems, len(report.Problems))
+			report.add(df.Path, false, "block %d: %v", n, err)
+			continue
+		}
+
+		if problem := b.checkValues(header, values); problem != "" {
+			report.add(df.Path, false, "block %d: %s", n, problem)
+		}
+
+		if header.TimeLast > lastTime {
+			lastTime = header.TimeLast
+		}
+	}
+
+	if repair && len(corrupt) > 0 {
+		r, err := storage.RemoveBlocks(df.Path, corrupt)
+
+		if err != nil {
+			report.add(df.Path, false, "could not remove corrupted blocks: %v", err)
+		} else {
+			for _, i := range corruptProblems {
+				report.Problems[i].Repaired = true
+			}
+			report.add(df.Path, true, "removed %d corrupted blocks (backup %s)", r.DroppedBlocks, r.CorruptPath)
+		}
+	}
+
+	return lastTime, nil
+}
+
+// removeFile deletes a file, returns true if the file no longer exists
+func removeFile(filePath string) bool {
+	err := os.Remove(filePath)
+	return err == nil || os.IsNotExist(err)
+}
+
+// checkValues verifies the decoded time and count columns of a block
+// returns a description of the first problem found
+func (b *Bucket) checkValues(header encoding.BlockHeader, values [][]uint64) string {
+	times, err := b.Transformers[0].Revert(values[0])
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if times[0] != header.TimeFirst || times[len(times)-1] != header.TimeLast {
+		return "time column does not match header"
+	}
+
+	for i := range times {
+		if i > 0 && times[i] <= times[i-1] {
+			return fmt.Sprintf("time %d is not after previous time %d", times[i], times[i-1])
+		}
+		if !b.First && times[i]%b.TimeStep != 0 {
+			return fmt.Sprintf("time %d is not a multiple of time step %d", times[i], b.TimeStep)
+		}
+	}
+
+	if b.First {
+		return ""
+	}
+
+	counts, err := b.Transformers[1].Revert(values[1])
+
+	if err != nil {
+		return err.Error()
+	}
+
+	// primary timestamps are unique seconds, so a step can't contain more than TimeStep points
+	for i, c := range counts {
+		if c < 1 || c > b.TimeStep {
+			return fmt.Sprintf("downsampled point at %d has invalid count %d", times[i], c)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,268 @@
+package minitsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+)
+
+// createTestCheckDatabase creates a database with a single series, whose first data file holds three blocks of 100 points
+// returns the database directory and the series, the caller must remove the directory
+func createTestCheckDatabase(t *testing.T) (string, Series) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seriesPath := path.Join(dir, "test")
+
+	if err := os.Mkdir(seriesPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(seriesPath, "series.yaml"), []byte(testSeriesConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSeries(seriesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 300; i += 100 {
+		insertTestPoints(t, &s, i, i+100)
+		s.FlushAll()
+	}
+
+	if blocks := s.Buckets[0].DataFiles[0].Blocks; blocks != 3 {
+		t.Fatalf("test data file has %d blocks, expected 3", blocks)
+	}
+
+	return dir, s
+}
+
+// checkTestDatabase checks the database and fails the test if the check could not be completed
+func checkTestDatabase(t *testing.T, dir string, repair bool) CheckReport {
+	report, err := CheckDatabase(dir, repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestCheckDatabase(t *testing.T) {
+	dir, _ := createTestCheckDatabase(t)
+	defer os.RemoveAll(dir)
+
+	report := checkTestDatabase(t, dir, false)
+
+	if len(report.Problems) != 0 {
+		t.Errorf("unexpected problems %+v", report.Problems)
+	}
+
+	// the downsampled bucket has no data file yet
+	if report.Series != 1 || report.Buckets != 2 || report.Files != 1 || report.Blocks != 3 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// directories without series config are reported, but don't stop the check
+	if err := os.Mkdir(path.Join(dir, "invalid"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report = checkTestDatabase(t, dir, true)
+
+	if len(report.Problems) != 1 || report.Problems[0].Path != path.Join(dir, "invalid") || report.Series != 1 {
+		t.Errorf("unexpected report for directory without series config %+v", report)
+	}
+}
+
+func TestCheckChecksum(t *testing.T) {
+	dir, s := createTestCheckDatabase(t)
+	defer os.RemoveAll(dir)
+
+	df := s.Buckets[0].DataFiles[0]
+
+	// flip a bit in the values of the second block
+	file, err := os.OpenFile(df.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1)
+	offset := df.BlockSize + 40
+
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+
+	b[0] ^= 0x10
+
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	report := checkTestDatabase(t, dir, false)
+
+	if len(report.Problems) != 1 || report.Problems[0].Path != df.Path || report.Problems[0].Repaired ||
+		!strings.HasPrefix(report.Problems[0].Description, "block 1: ") {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+
+	report = checkTestDatabase(t, dir, true)
+
+	if len(report.Problems) != 2 || report.Unrepaired() != 0 || !strings.HasPrefix(report.Problems[1].Description, "removed 1 corrupted blocks") {
+		t.Fatalf("unexpected problems after repair %+v", report.Problems)
+	}
+
+	if info, err := os.Stat(df.Path); err != nil || info.Size() != 2*df.BlockSize {
+		t.Errorf("repaired file should contain 2 blocks: %v", err)
+	}
+
+	if backups, err := filepath.Glob(df.Path + ".*.corrupt"); err != nil || len(backups) != 1 {
+		t.Errorf("expected one backup of the corrupted file, found %v", backups)
+	}
+
+	if report := checkTestDatabase(t, dir, false); len(report.Problems) != 0 {
+		t.Errorf("repaired database has problems %+v", report.Problems)
+	}
+
+	// only the points of the corrupted block are lost
+	repaired, err := OpenSeries(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := queryTestBucket(t, &repaired, 0)
+
+	if buffer.Len() != 200 || buffer.Values[0][99] != 99 || buffer.Values[0][100] != 200 {
+		t.Errorf("repaired bucket contains %d points", buffer.Len())
+	}
+}
+
+func TestCheckTruncated(t *testing.T) {
+	dir, s := createTestCheckDatabase(t)
+	defer os.RemoveAll(dir)
+
+	df := s.Buckets[0].DataFiles[0]
+
+	// the last block was only written partially
+	if err := os.Truncate(df.Path, 2*df.BlockSize+100); err != nil {
+		t.Fatal(err)
+	}
+
+	report := checkTestDatabase(t, dir, false)
+
+	if len(report.Problems) != 1 || report.Problems[0].Repaired || !strings.Contains(report.Problems[0].Description, "is not a multiple of block size") {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+
+	report = checkTestDatabase(t, dir, true)
+
+	if len(report.Problems) != 1 || !report.Problems[0].Repaired || !strings.HasPrefix(report.Problems[0].Description, "truncated 100 bytes of partial block") {
+		t.Fatalf("unexpected problems after repair %+v", report.Problems)
+	}
+
+	if info, err := os.Stat(df.Path); err != nil || info.Size() != 2*df.BlockSize {
+		t.Errorf("repaired file should contain 2 blocks: %v", err)
+	}
+
+	if report := checkTestDatabase(t, dir, false); len(report.Problems) != 0 {
+		t.Errorf("repaired database has problems %+v", report.Problems)
+	}
+}
+
+func TestCheckOrder(t *testing.T) {
+	dir, s := createTestCheckDatabase(t)
+	defer os.RemoveAll(dir)
+
+	b := &s.Buckets[0]
+	df := b.DataFiles[0]
+
+	// append a block whose timestamps are not in order
+	file, err := os.OpenFile(df.Path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := storage.PointBuffer{Values: [][]int64{{900, 800, 950}, {1, 2, 3}, {2, 4, 6}}}
+
+	if _, err := EncodeBuffer(file, buffer, b.Transformers, b.Schema, b.BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	before, err := ioutil.ReadFile(df.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// timestamps can't be repaired without losing data
+	report := checkTestDatabase(t, dir, true)
+
+	if len(report.Problems) != 1 || report.Unrepaired() != 1 || report.Problems[0].Description != "block 3: time 800 is not after previous time 900" {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+
+	if after, err := ioutil.ReadFile(df.Path); err != nil || string(after) != string(before) {
+		t.Errorf("repair modified the data file: %v", err)
+	}
+}
+
+func TestCheckValues(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		bucket int
+		values [][]int64
+		want   string
+	}{
+		{0, [][]int64{{1, 2, 3}, {0, 0, 0}, {0, 0, 0}}, ""},
+		{0, [][]int64{{1, 3, 2}, {0, 0, 0}, {0, 0, 0}}, "time 2 is not after previous time 3"},
+		{1, [][]int64{{10, 20}, {10, 5}, {0, 0}, {0, 0}}, ""},
+		{1, [][]int64{{10, 25}, {10, 5}, {0, 0}, {0, 0}}, "time 25 is not a multiple of time step 10"},
+		{1, [][]int64{{10, 20}, {10, 0}, {0, 0}, {0, 0}}, "downsampled point at 20 has invalid count 0"},
+		{1, [][]int64{{10, 20}, {11, 1}, {0, 0}, {0, 0}}, "downsampled point at 10 has invalid count 11"},
+	}
+
+	for _, tt := range tests {
+		b := &s.Buckets[tt.bucket]
+		values := tt.values
+
+		// downsampled buckets store one more column per aggregation
+		for len(values) < len(b.Transformers) {
+			values = append(values, make([]int64, len(values[0])))
+		}
+
+		transformed, _, err := transformValues(values, b.Transformers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		times := values[0]
+		header := encoding.BlockHeader{TimeFirst: times[0], TimeLast: times[len(times)-1]}
+
+		if got := b.checkValues(header, transformed); got != tt.want {
+			t.Errorf("bucket %d, %v: got %q, want %q", tt.bucket, values[:2], got, tt.want)
+		}
+	}
+
+	// the header must describe the time column
+	b := &s.Buckets[0]
+	transformed, _, err := transformValues([][]int64{{1, 2}, {0, 0}, {0, 0}}, b.Transformers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := b.checkValues(encoding.BlockHeader{TimeFirst: 1, TimeLast: 3}, transformed); got != "time column does not match header" {
+		t.Errorf("got %q for header that does not match the time column", got)
+	}
+}
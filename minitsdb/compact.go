@@ -0,0 +1,341 @@
+package minitsdb
+
+import (
+	"bytes"
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"github.com/martin2250/minitsdb/util/analyzedb"
+	"io"
+	"os"
+)
+
+// Compaction describes a data file that was rewritten with densely packed blocks
+type Compaction struct {
+	Path         string
+	BlocksBefore int64
+	BlocksAfter  int64
+	Points       int64
+}
+
+// errCompactionAborted indicates that the data file was modified while it was being compacted
+var errCompactionAborted = errors.New("data file modified during compaction")
+
+// errCompactionSchema indicates that the data file contains blocks of an older schema, which are never rewritten
+// so the data of removed columns is kept
+var errCompactionSchema = errors.New("data file contains blocks of an older schema")
+
+// errCompactionNoGain indicates that rewriting the data file would not reduce its size
+var errCompactionNoGain = errors.New("compaction would not reduce number of blocks")
+
+// EncodeBuffer encodes all points in buffer into as few blocks of blockSize bytes as possible and writes them to w
+// schema is the version of the series schema the buffer's columns belong to
+// returns the number of blocks written
+func EncodeBuffer(w io.Writer, buffer storage.PointBuffer, transformers []encoding.Transformer, schema int, blockSize int64) (int64, error) {
+	var blocks int64
+
+	for buffer.Len() > 0 {
+		transformed, missing, err := transformValues(buffer.Values, transformers)
+		if err != nil {
+			return blocks, err
+		}
+
+		var block bytes.Buffer
+		header, err := encoding.EncodeBlockSchema(&block, schema, int(blockSize), buffer.Values[0], transformed, missing)
+
+		if err != nil {
+			return blocks, err
+		}
+
+		if _, err := block.WriteTo(w); err != nil {
+			return blocks, err
+		}
+
+		buffer.Discard(header.NumPoints)
+		blocks++
+	}
+
+	return blocks, nil
+}
+
+// ReadDataFile decodes all blocks of a data file of the bucket and maps them to the current columns
+func (b *Bucket) ReadDataFile(df *storage.DataFile) (storage.PointBuffer, error) {
+	return b.readDataFile(df, false)
+}
+
+// readDataFile decodes all blocks of a data file, if current is set,
+// errCompactionSchema is returned for blocks that were written with an older schema
+func (b *Bucket) readDataFile(df *storage.DataFile, current bool) (storage.PointBuffer, error) {
+	need := make([]bool, len(b.Transformers))
+	for i := range need {
+		need[i] = true
+	}
+
+	reader := storage.NewFileDecoder([]*storage.DataFile{df}, need)
+	defer reader.Close()
+
+	buffer := storage.NewPointBuffer(len(b.Transformers))
+
+	for {
+		header, err := reader.Header()
+
+		if err == io.EOF {
+			return buffer, nil
+		} else if err != nil {
+			return storage.PointBuffer{}, err
+		}
+
+		if current && !b.currentLayout(header.Schema) {
+			return storage.PointBuffer{}, errCompactionSchema
+		}
+
+		layout, err := b.headerLayout(header)
+		if err != nil {
+			return storage.PointBuffer{}, err
+		}
+
+		reader.SetNeed(layout.need(need))
+
+		decoded, err := reader.DecodeBlock()
+		if err != nil {
+			return storage.PointBuffer{}, err
+		}
+
+		values, err := layout.revert(decoded, reader.Missing(), need, header.NumPoints)
+		if err != nil {
+			return storage.PointBuffer{}, err
+		}
+
+		for i := range values {
+			buffer.Values[i] = append(buffer.Values[i], values[i]...)
+		}
+	}
+}
+
+// WriteDataFile writes the buffer to a temporary file next to path and passes the number of blocks to replace,
+// which must rename the temporary file to path. If replace returns an error, the temporary file is removed
+// returns the number of blocks written
+func WriteDataFile(path string, buffer storage.PointBuffer, transformers []encoding.Transformer, schema int, blockSize int64, replace func(blocks int64) error) (int64, error) {
+	pathTemp := path + ".tmp"
+
+	file, err := os.OpenFile(pathTemp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	blocks, err := EncodeBuffer(file, buffer, transformers, schema, blockSize)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err == nil {
+		err = replace(blocks)
+	}
+
+	if err != nil {
+		os.Remove(pathTemp)
+		return 0, err
+	}
+
+	return blocks, nil
+}
+
+// fillRatio returns the fraction of bytes used in the blocks of a data file
+func fillRatio(df *storage.DataFile) (float64, error) {
+	file, err := os.Open(df.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	result, err := analyzedb.Analyze(file)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(result.BytesUsed) / float64(result.BytesTotal), nil
+}
+
+// compactFile rewrites a single data file, the file is swapped while holding the bucket mutex
+// the rewritten file uses the block size of the bucket
+func (b *Bucket) compactFile(df *storage.DataFile) (Compaction, error) {
+	b.rewriteMux.Lock()
+	defer b.rewriteMux.Unlock()
+
+	// prevent flushes while reading, queries may continue
+	b.Mux.RLock()
+	blocksBefore := df.Blocks
+	bytesBefore := df.Blocks * df.BlockSize
+	// the block size of the bucket may be changed by a reload
+	blockSize := b.BlockSize
+	buffer, err := b.readDataFile(df, true)
+	b.Mux.RUnlock()
+
+	if err != nil {
+		return Compaction{}, err
+	}
+
+	result := Compaction{
+		Path:         df.Path,
+		BlocksBefore: blocksBefore,
+		Points:       int64(buffer.Len()),
+	}
+
+	result.BlocksAfter, err = WriteDataFile(df.Path, buffer, b.Transformers, b.Schema, blockSize, func(blocks int64) error {
+		if blocks*blockSize >= bytesBefore {
+			return errCompactionNoGain
+		}
+
+		return b.swapCompacted(df, blocksBefore, blocks, blockSize)
+	})
+
+	return result, err
+}
+
+// swapCompacted renames the compacted copy of a data file to its path while holding the bucket mutex
+// returns errCompactionAborted if the file was written to or expired since its blocksBefore blocks were read
+func (b *Bucket) swapCompacted(df *storage.DataFile, blocksBefore, blocks, blockSize int64) error {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	// file was written to or expired in the meantime
+	if df.Blocks != blocksBefore || indexOfDataFile(b.DataFiles, df) == -1 {
+		return errCompactionAborted
+	}
+
+	if err := os.Rename(df.Path+".tmp", df.Path); err != nil {
+		return err
+	}
+
+	b.cache.invalidateFile(df.Path)
+
+	df.Blocks = blocks
+	df.BlockSize = blockSize
+	return nil
+}
+
+// checkedBlocks returns the number of blocks of a data file when it was last checked for compaction
+func (b *Bucket) checkedBlocks(df *storage.DataFile) int64 {
+	b.checkedMux.Lock()
+	defer b.checkedMux.Unlock()
+	return b.compactChecked[df]
+}
+
+func (b *Bucket) setChecked(df *storage.DataFile, blocks int64) {
+	b.checkedMux.Lock()
+	defer b.checkedMux.Unlock()
+	if b.compactChecked == nil {
+		b.compactChecked = make(map[*storage.DataFile]int64)
+	}
+	b.compactChecked[df] = blocks
+}
+
+// forgetChecked makes compaction check the data file again, e.g. after it was rewritten
+// a nil data file forgets all files
+func (b *Bucket) forgetChecked(df *storage.DataFile) {
+	b.checkedMux.Lock()
+	defer b.checkedMux.Unlock()
+	if df == nil {
+		b.compactChecked = nil
+		return
+	}
+	delete(b.compactChecked, df)
+}
+
+func indexOfDataFile(files []*storage.DataFile, df *storage.DataFile) int {
+	for i := range files {
+		if files[i] == df {
+			return i
+		}
+	}
+	return -1
+}
+
+// Compact rewrites all data files whose blocks use less than the fraction fill of their capacity
+// the file that is currently written to is never compacted
+func (b *Bucket) Compact(fill float64) ([]Compaction, error) {
+	b.Mux.RLock()
+	files := make([]*storage.DataFile, len(b.DataFiles))
+	copy(files, b.DataFiles)
+	b.Mux.RUnlock()
+
+	// forget about files that were expired
+	b.checkedMux.Lock()
+	checked := make(map[*storage.DataFile]int64, len(files))
+	for _, df := range files {
+		if blocks, ok := b.compactChecked[df]; ok {
+			checked[df] = blocks
+		}
+	}
+	b.compactChecked = checked
+	b.checkedMux.Unlock()
+
+	var compactions []Compaction
+
+	for _, df := range files {
+		b.Mux.RLock()
+		current := df.TimeEnd >= b.LastTimeOnDisk
+		blocks := df.Blocks
+		compressed := df.Compressed
+		b.Mux.RUnlock()
+
+		// skip files that are still written to, compressed files and files that were already checked
+		if current || compressed || blocks < 2 || b.checkedBlocks(df) == blocks {
+			continue
+		}
+
+		ratio, err := fillRatio(df)
+
+		if err != nil {
+			return compactions, err
+		}
+
+		if ratio >= fill {
+			b.setChecked(df, blocks)
+			continue
+		}
+
+		compaction, err := b.compactFile(df)
+
+		switch err {
+		case nil:
+			compactions = append(compactions, compaction)
+			b.setChecked(df, compaction.BlocksAfter)
+		case errCompactionNoGain, errCompactionSchema:
+			b.setChecked(df, blocks)
+		case errCompactionAborted:
+			continue
+		default:
+			return compactions, err
+		}
+	}
+
+	return compactions, nil
+}
+
+// Compact compacts the data files of all buckets
+// errors only abort the current bucket
+func (db *Database) Compact(fill float64) ([]Compaction, error) {
+	var compactions []Compaction
+	var errLast error
+
+	list := db.SeriesList()
+
+	for is := range list {
+		for ib := range list[is].Buckets {
+			c, err := list[is].Buckets[ib].Compact(fill)
+			compactions = append(compactions, c...)
+
+			if err != nil {
+				errLast = err
+			}
+		}
+	}
+
+	return compactions, errLast
+}
@@ -0,0 +1,138 @@
+package minitsdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/util"
+)
+
+// insertSparseTestBlocks flushes every 50 points, so the first data file of the series consists of nearly empty blocks
+func insertSparseTestBlocks(t *testing.T, s *Series, end int64) {
+	for i := int64(0); i < end; i += 50 {
+		insertTestPoints(t, s, i, i+50)
+		s.FlushAll()
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertSparseTestBlocks(t, &s, 500)
+
+	// points of the next file, so the first one is no longer written to
+	insertTestPoints(t, &s, 1000, 1010)
+	s.FlushAll()
+
+	b := &s.Buckets[0]
+	df := b.DataFiles[0]
+	blocks := df.Blocks
+
+	reference := queryTestBucket(t, &s, 0)
+
+	// files that are filled well enough are only checked
+	if compactions, err := b.Compact(0); err != nil || len(compactions) != 0 {
+		t.Fatalf("compacted %+v, %v", compactions, err)
+	}
+
+	if checked := b.checkedBlocks(df); checked != blocks {
+		t.Errorf("file with %d blocks checked at %d blocks", blocks, checked)
+	}
+
+	// checked files are skipped until they are forgotten
+	if compactions, err := b.Compact(1); err != nil || len(compactions) != 0 {
+		t.Fatalf("compacted checked file %+v, %v", compactions, err)
+	}
+
+	b.forgetChecked(nil)
+
+	// files that are no longer part of the bucket are forgotten
+	expired := &storage.DataFile{}
+	b.setChecked(expired, 1)
+
+	compactions, err := b.Compact(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(compactions) != 1 || compactions[0].BlocksBefore != blocks || compactions[0].BlocksAfter >= blocks || compactions[0].Points != 500 {
+		t.Fatalf("unexpected compactions %+v", compactions)
+	}
+
+	if checked := b.checkedBlocks(df); checked != df.Blocks || df.Blocks != compactions[0].BlocksAfter {
+		t.Errorf("compacted file with %d blocks checked at %d blocks", df.Blocks, checked)
+	}
+
+	if b.checkedBlocks(expired) != 0 {
+		t.Error("expired file is still checked")
+	}
+
+	if compactions, err := b.Compact(0.5); err != nil || len(compactions) != 0 {
+		t.Errorf("compacted file again %+v, %v", compactions, err)
+	}
+
+	if got := queryTestBucket(t, &s, 0); !util.Compare2DInt64(got.Values, reference.Values) {
+		t.Errorf("compacted bucket returns %d points, expected %d", got.Len(), reference.Len())
+	}
+
+	// the compacted file is read back identically after a restart
+	reopened, err := OpenSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := queryTestBucket(t, &reopened, 0); !util.Compare2DInt64(got.Values, reference.Values) {
+		t.Errorf("reopened bucket returns %d points, expected %d", got.Len(), reference.Len())
+	}
+}
+
+func TestCompactAborted(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertSparseTestBlocks(t, &s, 200)
+
+	b := &s.Buckets[0]
+	df := b.DataFiles[0]
+
+	// read the file like compactFile does
+	b.Mux.RLock()
+	blocksBefore := df.Blocks
+	buffer, err := b.readDataFile(df, true)
+	b.Mux.RUnlock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a flush writes to the file before it is swapped
+	insertTestPoints(t, &s, 200, 250)
+	s.FlushAll()
+
+	_, err = WriteDataFile(df.Path, buffer, b.Transformers, b.Schema, b.BlockSize, func(blocks int64) error {
+		return b.swapCompacted(df, blocksBefore, blocks, b.BlockSize)
+	})
+
+	if err != errCompactionAborted {
+		t.Fatalf("expected errCompactionAborted, got %v", err)
+	}
+
+	if _, err := os.Stat(df.Path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+
+	if got := queryTestBucket(t, &s, 0); got.Len() != 250 {
+		t.Errorf("bucket returns %d points after aborted compaction, expected 250", got.Len())
+	}
+
+	// the file expired before it was swapped
+	b.Mux.Lock()
+	b.DataFiles = nil
+	b.Mux.Unlock()
+
+	if err := b.swapCompacted(df, df.Blocks, 1, b.BlockSize); err != errCompactionAborted {
+		t.Errorf("expected errCompactionAborted for expired file, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package minitsdb
+
+import (
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"os"
+	"time"
+)
+
+// Compression describes a data file that was packed into a compressed container
+type Compression struct {
+	Path        string
+	Blocks      int64
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// errCompressionAborted indicates that the data file was modified while it was being compressed
+var errCompressionAborted = errors.New("data file modified during compression")
+
+// compressFile packs a single data file, the file is swapped while holding the bucket mutex
+func (b *Bucket) compressFile(df *storage.DataFile) (Compression, error) {
+	b.rewriteMux.Lock()
+	defer b.rewriteMux.Unlock()
+
+	b.Mux.RLock()
+	result := Compression{
+		Path:        df.Path,
+		Blocks:      df.Blocks,
+		BytesBefore: df.Blocks * df.BlockSize,
+	}
+	b.Mux.RUnlock()
+
+	var err error
+	result.BytesAfter, err = storage.CompressDataFile(df, func() error {
+		b.Mux.Lock()
+		defer b.Mux.Unlock()
+
+		// file was written to or expired in the meantime
+		if df.Blocks != result.Blocks || indexOfDataFile(b.DataFiles, df) == -1 {
+			return errCompressionAborted
+		}
+
+		if err := os.Rename(df.Path+".tmp", df.Path); err != nil {
+			return err
+		}
+
+		df.Compressed = true
+		return nil
+	})
+
+	return result, err
+}
+
+// Compress packs all data files that end more than age seconds before the last point on disk,
+// flushes never write to these files again. Backfills and deletions rewrite them uncompressed
+func (b *Bucket) Compress(age int64) ([]Compression, error) {
+	var files []*storage.DataFile
+
+	b.Mux.RLock()
+	for _, df := range b.DataFiles {
+		if !df.Compressed && df.TimeEnd+age < b.LastTimeOnDisk {
+			files = append(files, df)
+		}
+	}
+	b.Mux.RUnlock()
+
+	var compressions []Compression
+
+	for _, df := range files {
+		compression, err := b.compressFile(df)
+
+		switch err {
+		case nil:
+			compressions = append(compressions, compression)
+		case errCompressionAborted:
+			continue
+		default:
+			return compressions, err
+		}
+	}
+
+	return compressions, nil
+}
+
+// Compress compresses the cold data files of all buckets
+// errors only abort the current bucket
+func (db *Database) Compress(age time.Duration) ([]Compression, error) {
+	var compressions []Compression
+	var errLast error
+
+	list := db.SeriesList()
+
+	for is := range list {
+		for ib := range list[is].Buckets {
+			c, err := list[is].Buckets[ib].Compress(int64(age / time.Second))
+			compressions = append(compressions, c...)
+
+			if err != nil {
+				errLast = err
+			}
+		}
+	}
+
+	return compressions, errLast
+}
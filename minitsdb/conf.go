@@ -2,6 +2,9 @@ package minitsdb
 
 import (
 	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"github.com/martin2250/minitsdb/util"
 	"os"
 	"path"
 	"time"
@@ -9,18 +12,56 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// YamlDuration is a duration that also accepts days, weeks and years (e.g. 30d or 2y)
+type YamlDuration time.Duration
+
+// UnmarshalYAML parses the duration using util.ParseDuration
+func (d *YamlDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := util.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = YamlDuration(parsed)
+	return nil
+}
+
+// MarshalYAML writes the duration in a format accepted by UnmarshalYAML
+func (d YamlDuration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
 // YamlBucketConfig describes a downsampling bucket in SeriesConfig
 type YamlBucketConfig struct {
 	Factor int
+	// Retention is the time after which points are deleted, zero keeps points forever
+	Retention YamlDuration
+}
+
+// YamlWalConfig describes the write-ahead log of the primary bucket in SeriesConfig
+type YamlWalConfig struct {
+	// Sync is one of point, interval or never
+	Sync     string
+	Interval time.Duration
 }
 
 // YamlColumnConfig describes a column group (duplicate not applied yet) in SeriesConfig
 type YamlColumnConfig struct {
-	Decimals     int
-	Tags         map[string]string
-	Duplicate    []map[string]string
+	Decimals  int
+	Tags      map[string]string
+	Duplicate []map[string]string
+	// Transformer is one of D0 to D3 (default D1) for integers with Decimals or XOR for float values
 	Transformer  string
 	Aggregations []string
+	// Type is empty for numbers, bool or enum for columns that hold states, which are stored as their index in Values
+	Type string
+	// Values holds the labels of the states, required for enum and optional for bool (default false, true)
+	Values []string
 }
 
 // YamlSeriesConfig describes the YAML file for a series
@@ -32,9 +73,14 @@ type YamlSeriesConfig struct {
 
 	ReuseMax   int
 	PointsFile int64
+	// BlockSize is the size of new blocks in bytes, a power of two between 4k (default) and 64k
+	BlockSize int
 
 	Tags map[string]string
 
+	// Wal enables the write-ahead log when present
+	Wal *YamlWalConfig
+
 	Buckets []YamlBucketConfig
 	Columns []YamlColumnConfig
 }
@@ -81,14 +127,32 @@ func (c *YamlSeriesConfig) Check() error {
 		return errors.New("force flush count must be greater than or equal to flush count")
 	}
 
-	if c.ReuseMax < 0 || c.ReuseMax > 4096 {
-		return errors.New("reusemax must be between 0 and 4096 bytes")
+	if c.BlockSize == 0 {
+		c.BlockSize = encoding.DefaultBlockSize
+	}
+
+	if err := encoding.CheckBlockSize(c.BlockSize); err != nil {
+		return err
+	}
+
+	if c.ReuseMax < 0 || c.ReuseMax > c.BlockSize {
+		return errors.New("reusemax must be between 0 bytes and the block size")
 	}
 
 	if c.PointsFile < 1000 {
 		return errors.New("pointsfile must be between greater than or equal to 1000")
 	}
 
+	if c.Wal != nil {
+		sync, err := storage.ParseSyncPolicy(c.Wal.Sync)
+		if err != nil {
+			return err
+		}
+		if sync == storage.SyncInterval && c.Wal.Interval <= 0 {
+			return errors.New("wal sync interval must be greater than zero")
+		}
+	}
+
 	if _, ok := c.Tags["name"]; !ok {
 		return errors.New("series tag set must contain 'name'")
 	}
@@ -101,6 +165,10 @@ func (c *YamlSeriesConfig) Check() error {
 		if (i != 0 && b.Factor < 2) || b.Factor < 1 {
 			return errors.New("bucket downsampling factor must be greater than one")
 		}
+
+		if b.Retention < 0 || (b.Retention > 0 && time.Duration(b.Retention) < time.Hour) {
+			return errors.New("bucket retention must be at least one hour")
+		}
 	}
 
 	for _, col := range c.Columns {
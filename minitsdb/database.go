@@ -4,24 +4,45 @@ import (
 	"errors"
 	"github.com/martin2250/minitsdb/minitsdb/storage"
 	"github.com/martin2250/minitsdb/pkg/lineprotocol"
-	"math"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 )
 
 // Database holds series from a database directory
 type Database struct {
-	Path   string
+	Path string
+	// Series is replaced by a new slice when series are added or removed, published slices are not modified
+	// only the goroutine that inserts points may use it directly, other goroutines use SeriesList
 	Series []Series
+	// Mux guards replacing Series
+	Mux sync.RWMutex
+
+	// Cache holds recently queried blocks of all series
+	Cache *BlockCache
+}
+
+// SeriesList returns the current series of the database, safe to call from any goroutine
+func (db *Database) SeriesList() []Series {
+	db.Mux.RLock()
+	defer db.Mux.RUnlock()
+	return db.Series
+}
+
+// setSeries publishes a new slice of series, must be called from the goroutine that inserts points
+func (db *Database) setSeries(series []Series) {
+	db.Mux.Lock()
+	db.Series = series
+	db.Mux.Unlock()
 }
 
 // FindSeries finds all series that match the given set of tags
 // if useRegex is true, all tag values of format /.../ as treated as regexes
-func (db Database) FindSeries(tags map[string]string, useRegex bool) []*Series {
+func (db *Database) FindSeries(tags map[string]string, useRegex bool) []*Series {
 	matches := make([]*Series, 0)
+	list := db.SeriesList()
 
-	for i, series := range db.Series {
+	for i, series := range list {
 		isMatch := true
 
 		for queryKey, queryValue := range tags {
@@ -31,20 +52,14 @@ func (db Database) FindSeries(tags map[string]string, useRegex bool) []*Series {
 				break
 			}
 
-			if useRegex && strings.HasPrefix(queryValue, "/") && strings.HasSuffix(queryValue, "/") {
-				ok, _ = regexp.MatchString(queryValue[1:len(queryValue)-1], seriesValue)
-			} else {
-				ok = queryValue == seriesValue
-			}
-
-			if !ok {
+			if !matchPattern(queryValue, seriesValue, useRegex) {
 				isMatch = false
 				break
 			}
 		}
 
 		if isMatch {
-			matches = append(matches, &db.Series[i])
+			matches = append(matches, &list[i])
 		}
 	}
 
@@ -56,12 +71,27 @@ func (db *Database) FlushSeries() {
 		if s.CheckFlush() {
 			s.Flush()
 		}
+		s.SyncLog()
 	}
 }
 
+// isPattern checks if a tag value of format /.../ is a regex
+func isPattern(value string) bool {
+	return len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/")
+}
+
+// matchPattern checks if a tag value matches a pattern, which is a regex if useRegex is set and it has the format /.../
+func matchPattern(pattern, value string, useRegex bool) bool {
+	if useRegex && isPattern(pattern) {
+		ok, _ := regexp.MatchString(pattern[1:len(pattern)-1], value)
+		return ok
+	}
+	return pattern == value
+}
+
 var ErrSeriesAmbiguous = errors.New("series tags ambiguous")
 var ErrSeriesUnknown = errors.New("no matching series found")
-var ErrColumnsCount = errors.New("point has wrong number of values")
+var ErrColumnsCount = errors.New("point has more values than the series has columns")
 var ErrColumnUnknown = errors.New("no matching column found")
 
 func (db *Database) AssociatePoint(point lineprotocol.Point) (*Series, storage.Point, error) {
@@ -81,40 +111,74 @@ func (db *Database) AssociatePoint(point lineprotocol.Point) (*Series, storage.P
 		return nil, storage.Point{}, ErrSeriesUnknown
 	}
 
-	if len(point.Values) != len(s.Columns) {
-		return nil, storage.Point{}, ErrColumnsCount
+	p, err := s.ConvertPoint(point)
+
+	if err != nil {
+		return nil, storage.Point{}, err
+	}
+
+	return s, p, nil
+}
+
+// ConvertPoint assigns the values of a point to the columns of the series, the series tags of the point are ignored
+// columns without a value are storage.Missing. When values are omitted, every value must match exactly one column.
+// The point may be parsed by lineprotocol.ParseStates, labels are refused for columns that don't hold states
+func (s *Series) ConvertPoint(point lineprotocol.Point) (storage.Point, error) {
+	if len(point.Values) > len(s.Columns) {
+		return storage.Point{}, ErrColumnsCount
 	}
 
+	partial := len(point.Values) < len(s.Columns)
+
 	values := make([]int64, s.PrimaryCount)
 	filled := make([]bool, s.PrimaryCount)
 
+	for i := range values {
+		values[i] = storage.Missing
+	}
+
 	values[0] = point.Time
 
 	for _, v := range point.Values {
 		var c *Column
 
 		for i := range s.Columns {
-			if !filled[s.Columns[i].IndexPrimary] && lineprotocol.MatchKVPs(v.Tags, s.Columns[i].Tags) {
-				c = &s.Columns[i]
-				break // don't need to check for ambiguity as number of values must match
+			if filled[s.Columns[i].IndexPrimary] || !lineprotocol.MatchKVPs(v.Tags, s.Columns[i].Tags) {
+				continue
+			}
+
+			if c != nil {
+				return storage.Point{}, ErrColumnAmbiguous
+			}
+
+			c = &s.Columns[i]
+
+			// a complete point assigns every column, so the first match can't be ambiguous
+			if !partial {
+				break
 			}
 		}
 
 		if c == nil {
-			return nil, storage.Point{}, ErrColumnUnknown
+			return storage.Point{}, ErrColumnUnknown
+		}
+
+		// labels are only parsed for state columns, other values are rejected like by lineprotocol.Parse
+		if c.States == nil && !lineprotocol.IsNumber(v.Value) {
+			return storage.Point{}, lineprotocol.ErrInvalidFormat
 		}
 
-		val, err := strconv.ParseFloat(v.Value, 64)
+		val, err := c.ParseValue(v.Value)
 
 		if err != nil {
-			return nil, storage.Point{}, err
+			return storage.Point{}, err
 		}
 
 		filled[c.IndexPrimary] = true
-		values[c.IndexPrimary] = int64(math.Round(val * math.Pow10(c.Decimals)))
+		values[c.IndexPrimary] = val
 	}
 
-	return s, storage.Point{Values: values}, nil
+	return storage.Point{Values: values}, nil
 }
 
 func (db *Database) Downsample() {
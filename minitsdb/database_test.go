@@ -0,0 +1,82 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/pkg/lineprotocol"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConvertPoint(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		line string
+		want []int64
+		err  error
+	}{
+		{line: "name:test|name:a 1|name:b 2|10", want: []int64{10, 1, 2}},
+		{line: "name:test|name:b 2|name:a 1|10", want: []int64{10, 1, 2}},
+		{line: "name:test|name:b 4|10", want: []int64{10, storage.Missing, 4}},
+		{line: "name:test|name:c 4|10", err: ErrColumnUnknown},
+		{line: "name:test|name:a 1|name:a 2|10", err: ErrColumnUnknown},
+		{line: "name:test|name:a 1|name:b 2|name:a 3|10", err: ErrColumnsCount},
+		{line: "name:test|name:a 100000000000000000000|10", err: ErrValueRange},
+		// labels are only accepted for state columns
+		{line: "name:test|name:a NaN|10", err: lineprotocol.ErrInvalidFormat},
+		{line: "name:test|name:a -Inf|10", err: lineprotocol.ErrInvalidFormat},
+		{line: "name:test|name:a 1e300|10", err: lineprotocol.ErrInvalidFormat},
+		{line: "name:test|name:a on|10", err: lineprotocol.ErrInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		lp, err := lineprotocol.ParseStates(tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := s.ConvertPoint(lp)
+
+		if tt.err != nil {
+			if err != tt.err {
+				t.Errorf("%s: expected error %v, got %v", tt.line, tt.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+		} else if !reflect.DeepEqual(p.Values, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.line, tt.want, p.Values)
+		}
+	}
+}
+
+func TestConvertPointStates(t *testing.T) {
+	s, dir := openTestSeries(t, testStateSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		line string
+		want int64
+		err  error
+	}{
+		{line: "name:state|name:mode low|10", want: 1},
+		{line: "name:state|name:mode 2|10", want: 2},
+		{line: "name:state|name:mode heating|10", err: ErrUnknownState},
+	}
+
+	for _, tt := range tests {
+		lp, err := lineprotocol.ParseStates(tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := s.ConvertPoint(lp)
+
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.line, tt.err, err)
+		} else if err == nil && p.Values[1] != tt.want {
+			t.Errorf("%s: expected state %d, got %d", tt.line, tt.want, p.Values[1])
+		}
+	}
+}
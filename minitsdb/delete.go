@@ -0,0 +1,256 @@
+package minitsdb
+
+import (
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/martin2250/minitsdb/util"
+	"math"
+	"os"
+)
+
+// Deletion describes a data file that was rewritten to remove points
+type Deletion struct {
+	Path         string
+	BlocksBefore int64
+	BlocksAfter  int64
+	Points       int64
+}
+
+// removePoints removes all points in timeRange from buffer, if columns is not nil
+// only the values of these columns are replaced with storage.Missing
+// returns the number of affected points
+func removePoints(buffer *storage.PointBuffer, timeRange types.TimeRange, columns []int) int64 {
+	var affected int64
+	kept := 0
+
+	for i, t := range buffer.Values[0] {
+		if !timeRange.Contains(t) {
+			for j := range buffer.Values {
+				buffer.Values[j][kept] = buffer.Values[j][i]
+			}
+			kept++
+			continue
+		}
+
+		affected++
+
+		if columns != nil {
+			for _, c := range columns {
+				buffer.Values[c][i] = storage.Missing
+			}
+			for j := range buffer.Values {
+				buffer.Values[j][kept] = buffer.Values[j][i]
+			}
+			kept++
+		}
+	}
+
+	for j := range buffer.Values {
+		buffer.Values[j] = buffer.Values[j][:kept]
+	}
+
+	return affected
+}
+
+// dropLastBlock removes the reused last block from disk, its points are only held in the buffer afterwards
+// must be called while holding the bucket mutex
+func (b *Bucket) dropLastBlock() error {
+	df := b.DataFiles[len(b.DataFiles)-1]
+
+	if df.Blocks > 1 {
+		if err := os.Truncate(df.Path, (df.Blocks-1)*df.BlockSize); err != nil {
+			return err
+		}
+		b.cache.invalidateBlock(df.Path, df.Blocks-1)
+		df.Blocks--
+	} else {
+		if err := df.Remove(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b.cache.invalidateFile(df.Path)
+		b.DataFiles = b.DataFiles[:len(b.DataFiles)-1]
+	}
+
+	b.OverwriteLast = false
+	return nil
+}
+
+// remove removes the points in timeRange from the data files and the buffer of the bucket,
+// if columns is not nil, only the values of these columns are cleared
+// returns the rewritten data files and true if the reused last block was dropped
+func (b *Bucket) remove(timeRange types.TimeRange, columns []int) ([]Deletion, bool, error) {
+	b.rewriteMux.Lock()
+	defer b.rewriteMux.Unlock()
+
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	// otherwise the reused block would restore the deleted points on the next start
+	dropped := false
+	if b.OverwriteLast && timeRange.End > b.LastTimeOnDisk {
+		if err := b.dropLastBlock(); err != nil {
+			return nil, false, err
+		}
+		dropped = true
+	}
+
+	var deletions []Deletion
+
+	files := make([]*storage.DataFile, len(b.DataFiles))
+	copy(files, b.DataFiles)
+
+	for _, df := range files {
+		if df.TimeEnd < timeRange.Start || df.TimeStart > timeRange.End {
+			continue
+		}
+
+		deletion := Deletion{
+			Path: df.Path,
+		}
+
+		var err error
+		deletion.BlocksBefore, deletion.BlocksAfter, err = b.rewriteFile(df, false, func(existing storage.PointBuffer) (storage.PointBuffer, bool) {
+			deletion.Points = removePoints(&existing, timeRange, columns)
+			return existing, deletion.Points > 0
+		})
+
+		if err != nil {
+			return deletions, dropped, err
+		}
+
+		if deletion.Points > 0 {
+			deletions = append(deletions, deletion)
+		}
+	}
+
+	removePoints(&b.Buffer, timeRange, columns)
+
+	return deletions, dropped, nil
+}
+
+// ErrDeleteColumns indicates that the columns to be deleted do not belong to the series
+var ErrDeleteColumns = errors.New("column does not belong to series")
+
+// Delete removes all points in timeRange from the series, if columns is not nil, only the values of these columns
+// are removed and the points are kept. Affected data files are rewritten and the downsampled buckets are regenerated
+// for the time steps that overlap timeRange. Where the lower bucket no longer holds the points of a time step,
+// e.g. because of its retention, the downsampled values are removed instead
+func (s *Series) Delete(timeRange types.TimeRange, columns []*Column) ([]Deletion, error) {
+	var primary, secondary []int
+
+	if columns != nil {
+		primary = make([]int, 0, len(columns))
+		secondary = make([]int, 0)
+	}
+
+	for _, c := range columns {
+		found := false
+		for i := range s.Columns {
+			if &s.Columns[i] == c {
+				found = true
+			}
+		}
+		if !found {
+			return nil, ErrDeleteColumns
+		}
+
+		primary = append(primary, c.IndexPrimary)
+
+		for _, index := range c.IndexSecondary {
+			if index > 1 {
+				secondary = append(secondary, index)
+			}
+		}
+	}
+
+	// queries round the time range to entire time steps
+	if limit := int64(math.MaxInt64 - 100*s.Buckets[len(s.Buckets)-1].TimeStep); timeRange.End > limit {
+		timeRange.End = limit
+	}
+
+	deletions, dropped, err := s.Buckets[0].remove(timeRange, primary)
+
+	if err != nil {
+		return deletions, err
+	}
+
+	// the write-ahead log still contains the removed points
+	if dropped {
+		for s.Buckets[0].Flush(math.MaxInt64, true) {
+		}
+	}
+	s.resetLog()
+
+	for i := 1; i < len(s.Buckets); i++ {
+		b := &s.Buckets[i]
+
+		// downsampled points contain all columns, so the affected steps are regenerated entirely
+		timeRange = types.TimeRange{
+			Start: util.RoundDown(timeRange.Start, b.TimeStep),
+			End:   util.RoundDown(timeRange.End, b.TimeStep) + b.TimeStep - 1,
+		}
+
+		d, _, err := b.remove(timeRange, secondary)
+		deletions = append(deletions, d...)
+
+		if err != nil {
+			return deletions, err
+		}
+
+		downsampled, err := s.downsampleSteps(i, []types.TimeRange{timeRange})
+		if err != nil {
+			return deletions, err
+		}
+
+		if _, _, err := b.merge(downsampled, false); err != nil {
+			return deletions, err
+		}
+	}
+
+	return deletions, nil
+}
+
+// RemoveSeries deletes a series including its directory and removes it from the database
+// db.Series is replaced by a new slice, so pointers to series that are still used by running queries remain readable,
+// but all pointers to series of the database must be looked up again afterwards
+func (db *Database) RemoveSeries(s *Series) error {
+	index := -1
+	for i := range db.Series {
+		if db.Series[i].Path == s.Path {
+			index = i
+		}
+	}
+
+	if index == -1 {
+		return ErrSeriesUnknown
+	}
+
+	removed := db.detachSeries(index)
+
+	err := os.RemoveAll(removed.Path)
+
+	// a series created later at the same path must not see cached blocks of this series
+	removed.dropCache()
+
+	return err
+}
+
+// detachSeries closes the write-ahead log of a series and removes it from the database, its directory is not modified
+// db.Series is replaced by a new slice, see RemoveSeries
+func (db *Database) detachSeries(index int) Series {
+	s := db.Series[index]
+
+	// the published slice is not modified, readers on other goroutines may still hold it
+	if s.Log != nil {
+		s.Log.Close()
+		s.Log = nil
+	}
+
+	series := make([]Series, 0, len(db.Series)-1)
+	series = append(series, db.Series[:index]...)
+	series = append(series, db.Series[index+1:]...)
+	db.setSeries(series)
+
+	return s
+}
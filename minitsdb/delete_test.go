@@ -0,0 +1,158 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/martin2250/minitsdb/util"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// compareTestSeries checks that all buckets of s hold the same points as the buckets of reference
+func compareTestSeries(t *testing.T, s, reference *Series) {
+	for i := range s.Buckets {
+		got, want := queryTestBucket(t, s, i), queryTestBucket(t, reference, i)
+
+		if !util.Compare2DInt64(got.Values, want.Values) {
+			t.Errorf("bucket %d differs from the reference series, %d and %d points", i, got.Len(), want.Len())
+		}
+	}
+}
+
+func TestDeleteTimeRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeRange types.TimeRange
+		flushAll  bool
+	}{
+		// not aligned to the time steps of the downsampled bucket
+		{"archived", types.TimeRange{Start: 1005, End: 1994}, true},
+		{"entire files", types.TimeRange{Start: 1000, End: 2999}, true},
+		// reaches into the buffer and the reused last block
+		{"buffered", types.TimeRange{Start: 4503, End: math.MaxInt64}, false},
+	}
+
+	for _, tt := range tests {
+		s, dir := openTestSeries(t, testSeriesConfig)
+		defer os.RemoveAll(dir)
+
+		reference, dirReference := openTestSeries(t, testSeriesConfig)
+		defer os.RemoveAll(dirReference)
+
+		insertTestPoints(t, &s, 0, 5000)
+		if tt.flushAll {
+			s.FlushAll()
+		} else {
+			s.Flush()
+		}
+
+		for i := int64(0); i < 5000; i++ {
+			if !tt.timeRange.Contains(i) {
+				insertTestPoints(t, &reference, i, i+1)
+			}
+		}
+		reference.FlushAll()
+
+		deletions, err := s.Delete(tt.timeRange, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if len(deletions) == 0 && tt.flushAll {
+			t.Errorf("%s: no data files were rewritten", tt.name)
+		}
+
+		s.FlushAll()
+
+		compareTestSeries(t, &s, &reference)
+	}
+}
+
+func TestDeleteColumn(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	reference, dirReference := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirReference)
+
+	insertTestPoints(t, &s, 0, 5000)
+	s.FlushAll()
+
+	timeRange := types.TimeRange{Start: 1005, End: 1994}
+
+	for i := int64(0); i < 5000; i++ {
+		p := storage.Point{Values: []int64{i, i, 2 * i}}
+		if timeRange.Contains(i) {
+			p.Values[2] = storage.Missing
+		}
+
+		if err := reference.InsertPoint(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reference.FlushAll()
+
+	if _, err := s.Delete(timeRange, []*Column{&s.Columns[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	compareTestSeries(t, &s, &reference)
+
+	if _, err := s.Delete(timeRange, []*Column{&reference.Columns[1]}); err != ErrDeleteColumns {
+		t.Errorf("expected ErrDeleteColumns for a column of another series, got %v", err)
+	}
+}
+
+func TestRemoveSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		config := strings.Replace(testSeriesConfig, "name: test", "name: "+name, 1)
+		if err := ioutil.WriteFile(path.Join(dir, name, "series.yaml"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := db.FindSeries(map[string]string{"name": "a"}, false)
+	if len(matches) != 1 {
+		t.Fatalf("expected one series, got %d", len(matches))
+	}
+
+	insertTestPoints(t, matches[0], 0, 2500)
+	matches[0].FlushAll()
+
+	removed := matches[0].Path
+
+	if err := db.RemoveSeries(matches[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(removed); !os.IsNotExist(err) {
+		t.Errorf("series directory was not removed: %v", err)
+	}
+
+	if list := db.SeriesList(); len(list) != 1 || list[0].Tags["name"] != "b" {
+		t.Errorf("unexpected series after removal %v", list)
+	}
+
+	if err := db.RemoveSeries(matches[0]); err != ErrSeriesUnknown {
+		t.Errorf("expected ErrSeriesUnknown when removing twice, got %v", err)
+	}
+}
@@ -7,6 +7,166 @@ import (
 	. "github.com/martin2250/minitsdb/minitsdb/types"
 )
 
+// floatValues converts the values of a float column
+func floatValues(values []int64) []float64 {
+	floats := make([]float64, len(values))
+	for i, v := range values {
+		floats[i] = storage.ValueFloat(v)
+	}
+	return floats
+}
+
+// aggregatePrimary applies f to the values that are not storage.Missing
+// returns storage.Missing if no values are present, count always includes all points and present counts the values
+// if float is set, values hold float bit patterns and f must implement downsampling.FloatFunction
+func aggregatePrimary(f downsampling.Function, values []int64, times []int64, float bool) int64 {
+	if f == downsampling.Count {
+		return f.AggregatePrimary(values, times)
+	}
+
+	var present []int
+	for i, v := range values {
+		if v != storage.Missing {
+			present = append(present, i)
+		}
+	}
+
+	if f == downsampling.Present {
+		return int64(len(present))
+	}
+
+	if len(present) == 0 {
+		return storage.Missing
+	}
+
+	if len(present) < len(values) {
+		valuesPresent := make([]int64, len(present))
+		timesPresent := make([]int64, len(present))
+		for i, index := range present {
+			valuesPresent[i] = values[index]
+			timesPresent[i] = times[index]
+		}
+		values, times = valuesPresent, timesPresent
+	}
+
+	if float && !downsampling.CountsPoints(f) {
+		ff, ok := f.(downsampling.FloatFunction)
+		if !ok {
+			return storage.Missing
+		}
+		return storage.FloatValue(ff.AggregatePrimaryFloat(floatValues(values), times))
+	}
+
+	return f.AggregatePrimary(values, times)
+}
+
+// aggregateSecondary applies f to the downsampled points whose aggregations are not storage.Missing
+// all aggregations of a column are missing for the same points, except those added to the column later
+// count always includes all points
+func aggregateSecondary(f downsampling.Function, values [][]int64, times []int64, counts []int64, float bool) int64 {
+	var present []int
+	var reference []int64
+
+	if f == downsampling.Count {
+		return f.AggregateSecondary(values, times, counts)
+	}
+
+	// points of blocks written before the number of values was stored are weighted by the number of points
+	if p := values[downsampling.Present.GetIndex()]; p != nil {
+		weights := make([]int64, len(p))
+		for i, v := range p {
+			if v == storage.Missing {
+				v = counts[i]
+			}
+			weights[i] = v
+		}
+
+		valuesWeighted := make([][]int64, len(values))
+		copy(valuesWeighted, values)
+		valuesWeighted[downsampling.Present.GetIndex()] = weights
+		values = valuesWeighted
+	}
+
+	// points are skipped if the first aggregation needed by f is missing, e.g. in blocks written before it was stored
+	need := make([]bool, len(values))
+	f.Needs(need)
+
+	for a, v := range values {
+		if v != nil && need[a] && a != downsampling.Present.GetIndex() {
+			reference = v
+			break
+		}
+	}
+
+	// functions like count don't depend on column values
+	if reference == nil {
+		return f.AggregateSecondary(values, times, counts)
+	}
+
+	for i, v := range reference {
+		if v != storage.Missing {
+			present = append(present, i)
+		}
+	}
+
+	if len(present) == 0 && f == downsampling.Present {
+		return 0
+	} else if len(present) == 0 {
+		return storage.Missing
+	}
+
+	if len(present) < len(reference) {
+		valuesPresent := make([][]int64, len(values))
+		timesPresent := make([]int64, len(present))
+		countsPresent := make([]int64, len(present))
+
+		for i, index := range present {
+			timesPresent[i] = times[index]
+			countsPresent[i] = counts[index]
+		}
+
+		for a, v := range values {
+			if v == nil {
+				continue
+			}
+			valuesPresent[a] = make([]int64, len(present))
+			for i, index := range present {
+				valuesPresent[a][i] = v[index]
+			}
+		}
+
+		values, times, counts = valuesPresent, timesPresent, countsPresent
+	}
+
+	if float && !downsampling.CountsPoints(f) {
+		ff, ok := f.(downsampling.FloatFunction)
+		if !ok {
+			return storage.Missing
+		}
+
+		floats := make([][]float64, len(values))
+		for a, v := range values {
+			if v != nil {
+				floats[a] = floatValues(v)
+			}
+		}
+
+		// numbers of values and durations are integers in float columns too
+		for a, v := range values {
+			if v != nil && downsampling.CountsPoints(downsampling.AggregatorList[a]) {
+				floats[a] = make([]float64, len(v))
+				for i := range v {
+					floats[a][i] = float64(v[i])
+				}
+			}
+		}
+
+		return storage.FloatValue(ff.AggregateSecondaryFloat(floats, times, counts))
+	}
+
+	return f.AggregateSecondary(values, times, counts)
+}
+
 func DownsamplePoint(src storage.PointBuffer, columns []QueryColumn, timeRange TimeRange, primary bool) (storage.Point, error) {
 	indexStart := src.IndexOfTime(timeRange.Start)
 
@@ -35,7 +195,7 @@ func DownsamplePoint(src storage.PointBuffer, columns []QueryColumn, timeRange T
 	for i, qc := range columns {
 		var val int64
 		if primary {
-			val = qc.Function.AggregatePrimary(src.Values[qc.Column.IndexPrimary][indexStart:indexEnd], src.Values[0][indexStart:indexEnd])
+			val = aggregatePrimary(qc.Function, src.Values[qc.Column.IndexPrimary][indexStart:indexEnd], src.Values[0][indexStart:indexEnd], qc.Column.Float)
 		} else {
 			srcColSecondary := make([][]int64, downsampling.AggregatorCount)
 			for i, index := range qc.Column.IndexSecondary {
@@ -43,7 +203,7 @@ func DownsamplePoint(src storage.PointBuffer, columns []QueryColumn, timeRange T
 					srcColSecondary[i] = src.Values[index][indexStart:indexEnd]
 				}
 			}
-			val = qc.Function.AggregateSecondary(srcColSecondary, src.Values[0][indexStart:indexEnd], src.Values[1][indexStart:indexEnd])
+			val = aggregateSecondary(qc.Function, srcColSecondary, src.Values[0][indexStart:indexEnd], src.Values[1][indexStart:indexEnd], qc.Column.Float)
 		}
 		p.Values[i+1] = val
 	}
@@ -93,7 +253,7 @@ func DownsampleQuery(src storage.PointBuffer, queryColumns []QueryColumn, timeSt
 		for i, qc := range queryColumns {
 			var val int64
 			if primary {
-				val = qc.Function.AggregatePrimary(src.Values[qc.Column.IndexPrimary][*indexStart:indexEnd], src.Values[0][*indexStart:indexEnd])
+				val = aggregatePrimary(qc.Function, src.Values[qc.Column.IndexPrimary][*indexStart:indexEnd], src.Values[0][*indexStart:indexEnd], qc.Column.Float)
 			} else {
 				for i, index := range qc.Column.IndexSecondary {
 					if index > 1 && src.Need[index] {
@@ -102,7 +262,7 @@ func DownsampleQuery(src storage.PointBuffer, queryColumns []QueryColumn, timeSt
 						srcColSecondary[i] = nil
 					}
 				}
-				val = qc.Function.AggregateSecondary(srcColSecondary, src.Values[0][*indexStart:indexEnd], src.Values[1][*indexStart:indexEnd])
+				val = aggregateSecondary(qc.Function, srcColSecondary, src.Values[0][*indexStart:indexEnd], src.Values[1][*indexStart:indexEnd], qc.Column.Float)
 			}
 			output.Values[i+1] = append(output.Values[i+1], val)
 		}
@@ -0,0 +1,222 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestAggregatePrimaryMissing(t *testing.T) {
+	values := []int64{storage.Missing, 2, 4, storage.Missing}
+	times := []int64{0, 1, 2, 3}
+
+	tests := []struct {
+		f    downsampling.Function
+		want int64
+	}{
+		{downsampling.Mean, 3},
+		{downsampling.Min, 2},
+		{downsampling.First, 2},
+		{downsampling.Count, 4},
+		{downsampling.Present, 2},
+	}
+
+	for _, tt := range tests {
+		if got := aggregatePrimary(tt.f, values, times, false); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", downsampling.FunctionName(tt.f), tt.want, got)
+		}
+	}
+
+	missing := []int64{storage.Missing, storage.Missing}
+
+	if got := aggregatePrimary(downsampling.Mean, missing, times[:2], false); got != storage.Missing {
+		t.Errorf("expected missing mean, got %d", got)
+	}
+
+	if got := aggregatePrimary(downsampling.Present, missing, times[:2], false); got != 0 {
+		t.Errorf("expected no values, got %d", got)
+	}
+}
+
+func TestAggregateSecondaryMissing(t *testing.T) {
+	values := make([][]int64, downsampling.AggregatorCount)
+	values[downsampling.Mean.GetIndex()] = []int64{10, 20, storage.Missing}
+	// the first point was written before the number of values was stored
+	values[downsampling.Present.GetIndex()] = []int64{storage.Missing, 3, 0}
+	times := []int64{0, 10, 20}
+	counts := []int64{2, 10, 10}
+
+	if got := aggregateSecondary(downsampling.Mean, values, times, counts, false); got != 16 {
+		t.Errorf("expected mean 16, got %d", got)
+	}
+
+	if got := aggregateSecondary(downsampling.Present, values, times, counts, false); got != 5 {
+		t.Errorf("expected 5 values, got %d", got)
+	}
+
+	if got := aggregateSecondary(downsampling.Count, values, times, counts, false); got != 22 {
+		t.Errorf("expected 22 points, got %d", got)
+	}
+
+	values[downsampling.Mean.GetIndex()] = []int64{storage.Missing, storage.Missing, storage.Missing}
+	values[downsampling.Present.GetIndex()] = []int64{0, 0, 0}
+
+	if got := aggregateSecondary(downsampling.Mean, values, times, counts, false); got != storage.Missing {
+		t.Errorf("expected missing mean, got %d", got)
+	}
+
+	if got := aggregateSecondary(downsampling.Present, values, times, counts, false); got != 0 {
+		t.Errorf("expected no values, got %d", got)
+	}
+}
+
+func TestDownsamplePartialPoints(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	// column b only holds a value at time 0 in the first time step
+	for i := int64(0); i < 1000; i++ {
+		b := 2 * i
+		if i > 0 && i < 10 {
+			b = storage.Missing
+		}
+		if err := s.InsertPoint(storage.Point{Values: []int64{i, i, b}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.FlushAll()
+
+	columns := []QueryColumn{
+		{Column: &s.Columns[1], Function: downsampling.Mean},
+		{Column: &s.Columns[1], Function: downsampling.Present},
+		{Column: &s.Columns[1], Function: downsampling.Count},
+		{Column: &s.Columns[0], Function: downsampling.Mean},
+	}
+
+	// aggregate the points of the downsampled bucket
+	query := s.Buckets[1].Query(columns, types.TimeRange{Start: 0, End: 99}, 100)
+
+	buffer, err := query.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the mean of 0 and 20 to 198 is 9810 / 91
+	want := []int64{0, 107, 91, 100, 49}
+
+	for i, w := range want {
+		if buffer.Len() != 1 || buffer.Values[i][0] != w {
+			t.Fatalf("expected %v, got %v", want, buffer.Values)
+		}
+	}
+}
+
+// testStateSeriesConfig has an enum column with three states
+const testStateSeriesConfig = `
+tags:
+  name: state
+flushinterval: 10s
+flushcount: 50
+forceflushcount: 100
+pointsfile: 1000
+buckets:
+  - factor: 1
+  - factor: 10
+columns:
+  - type: enum
+    values: [off, low, high]
+    tags:
+      name: mode
+`
+
+func TestFractionTimeWeighted(t *testing.T) {
+	s, dir := openTestSeries(t, testStateSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	c := &s.Columns[0]
+
+	fraction := func(function string, values, times []int64) float64 {
+		f, err := c.FindFunction(function)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage.ValueFloat(aggregatePrimary(f, values, times, false))
+	}
+
+	// off for 1s, low for 5s, high for 1s, the last point lasts as long as the point before
+	values := []int64{0, 1, 1, 2}
+	times := []int64{0, 1, 5, 6}
+
+	tests := []struct {
+		function string
+		want     float64
+	}{
+		{"fraction", 6.0 / 7},
+		{"fraction state:off", 1.0 / 7},
+		{"fraction state:low", 5.0 / 7},
+		{"fraction state:2", 1.0 / 7},
+	}
+
+	for _, tt := range tests {
+		if got := fraction(tt.function, values, times); got != tt.want {
+			t.Errorf("%s: expected %f, got %f", tt.function, tt.want, got)
+		}
+	}
+
+	// the missing value doesn't count as a state, off lasts until low
+	if got := fraction("fraction state:off", []int64{0, storage.Missing, 1}, []int64{0, 5, 6}); got != 0.5 {
+		t.Errorf("expected 0.5 with missing value, got %f", got)
+	}
+
+	if _, err := c.FindFunction("fraction state:cooling"); err == nil {
+		t.Error("expected error for unknown state")
+	}
+}
+
+func TestFractionDownsampled(t *testing.T) {
+	s, dir := openTestSeries(t, testStateSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	// points every 2 seconds, high from 0 to 29, then off except for low every 20 seconds
+	for i := int64(0); i < 1000; i += 2 {
+		mode := int64(0)
+		if i < 30 {
+			mode = 2
+		} else if i%20 == 0 {
+			mode = 1
+		}
+		if err := s.InsertPoint(storage.Point{Values: []int64{i, mode}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.FlushAll()
+
+	functions := []string{"fraction state:off", "fraction state:low", "fraction state:high", "fraction"}
+
+	var columns []QueryColumn
+	for _, function := range functions {
+		f, err := s.Columns[0].FindFunction(function)
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, QueryColumn{Column: &s.Columns[0], Function: f})
+	}
+
+	query := s.Buckets[1].Query(columns, types.TimeRange{Start: 0, End: 99}, 100)
+
+	buffer, err := query.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []float64{0.64, 0.06, 0.3, 0.36}
+
+	for i, w := range want {
+		if got := storage.ValueFloat(buffer.Values[i+1][0]); buffer.Len() != 1 || math.Abs(got-w) > 1e-9 {
+			t.Errorf("%s: expected %f, got %f", functions[i], w, got)
+		}
+	}
+}
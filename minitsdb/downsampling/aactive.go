@@ -0,0 +1,29 @@
+package downsampling
+
+// activeAggregator counts the values that are not zero, e.g. the points in which a bool column is true
+// or an enum column is in any but its first state
+type activeAggregator struct {
+	index int
+}
+
+func (activeAggregator) GetIndex() int {
+	return Active.index
+}
+
+func (activeAggregator) Needs(indices []bool) {
+	indices[Active.index] = true
+}
+
+func (activeAggregator) AggregatePrimary(values []int64, times []int64) int64 {
+	var active int64
+	for _, v := range values {
+		if v != 0 {
+			active++
+		}
+	}
+	return active
+}
+
+func (activeAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	return Sum.AggregatePrimary(values[Active.index], nil)
+}
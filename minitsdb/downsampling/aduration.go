@@ -0,0 +1,87 @@
+package downsampling
+
+import "fmt"
+
+// MaxStates is the maximum number of states of bool and enum columns, the time in each state is stored separately
+const MaxStates = 16
+
+// pointDurations returns the time each point lasts, which is until the next point
+// the last point lasts as long as the point before it, or one second if it is the only point
+func pointDurations(times []int64) []int64 {
+	durations := make([]int64, len(times))
+
+	for i := 0; i < len(times)-1; i++ {
+		durations[i] = times[i+1] - times[i]
+	}
+
+	if l := len(times); l > 1 {
+		durations[l-1] = durations[l-2]
+	} else if l == 1 {
+		durations[0] = 1
+	}
+
+	return durations
+}
+
+// durationAggregator sums the time of all points with a value, e.g. the time the state of a relay is known
+type durationAggregator struct {
+	index int
+}
+
+func (durationAggregator) GetIndex() int {
+	return Duration.index
+}
+
+func (durationAggregator) Needs(indices []bool) {
+	indices[Duration.index] = true
+}
+
+func (durationAggregator) AggregatePrimary(values []int64, times []int64) int64 {
+	return Sum.AggregatePrimary(pointDurations(times), nil)
+}
+
+func (durationAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	return Sum.AggregatePrimary(values[Duration.index], nil)
+}
+
+// stateDurationAggregator sums the time a bool or enum column spent in one state
+type stateDurationAggregator struct {
+	index int
+	state int64
+}
+
+func (a stateDurationAggregator) GetIndex() int {
+	return a.index
+}
+
+func (a stateDurationAggregator) Needs(indices []bool) {
+	indices[a.index] = true
+}
+
+func (a stateDurationAggregator) AggregatePrimary(values []int64, times []int64) int64 {
+	var duration int64
+	for i, d := range pointDurations(times) {
+		if values[i] == a.state {
+			duration += d
+		}
+	}
+	return duration
+}
+
+func (a stateDurationAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	return Sum.AggregatePrimary(values[a.index], nil)
+}
+
+// stateDurations creates the aggregators of the time spent in each state, their indices start at index
+func stateDurations(index int) []stateDurationAggregator {
+	aggregators := make([]stateDurationAggregator, MaxStates)
+	for i := range aggregators {
+		aggregators[i] = stateDurationAggregator{index: index + i, state: int64(i)}
+	}
+	return aggregators
+}
+
+// stateDurationName returns the name of the aggregator of the time spent in state
+func stateDurationName(state int) string {
+	return fmt.Sprintf("duration%d", state)
+}
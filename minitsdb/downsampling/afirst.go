@@ -19,3 +19,11 @@ func (firstAggregator) AggregatePrimary(values []int64, times []int64) int64 {
 func (firstAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
 	return values[First.index][0]
 }
+
+func (firstAggregator) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	return values[0]
+}
+
+func (firstAggregator) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	return values[First.index][0]
+}
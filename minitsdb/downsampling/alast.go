@@ -19,3 +19,11 @@ func (lastAggregator) AggregatePrimary(values []int64, times []int64) int64 {
 func (lastAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
 	return values[Last.index][len(values[Last.index])-1]
 }
+
+func (lastAggregator) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	return values[len(values)-1]
+}
+
+func (lastAggregator) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	return values[Last.index][len(values[Last.index])-1]
+}
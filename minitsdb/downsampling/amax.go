@@ -25,3 +25,17 @@ func (maxAggregator) AggregatePrimary(values []int64, times []int64) int64 {
 func (maxAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
 	return Max.AggregatePrimary(values[Max.index], nil)
 }
+
+func (maxAggregator) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	max := values[0]
+	for _, c := range values[1:] {
+		if c > max {
+			max = c
+		}
+	}
+	return max
+}
+
+func (maxAggregator) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	return Max.AggregatePrimaryFloat(values[Max.index], nil)
+}
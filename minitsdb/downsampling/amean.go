@@ -10,6 +10,15 @@ func (meanAggregator) GetIndex() int {
 
 func (meanAggregator) Needs(indices []bool) {
 	indices[Mean.index] = true
+	indices[Present.index] = true
+}
+
+// weights returns the number of values in each downsampled point, or the number of points if it is not stored
+func (meanAggregator) weights(values [][]int64, counts []int64) []int64 {
+	if values[Present.index] != nil {
+		return values[Present.index]
+	}
+	return counts
 }
 
 func (meanAggregator) AggregatePrimary(values []int64, times []int64) int64 {
@@ -19,9 +28,27 @@ func (meanAggregator) AggregatePrimary(values []int64, times []int64) int64 {
 }
 
 func (meanAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	weights := Mean.weights(values, counts)
 	var sum int64
 	for i, v := range values[Mean.index] {
-		sum += v * counts[i]
+		sum += v * weights[i]
+	}
+	return sum / Sum.AggregatePrimary(weights, nil)
+}
+
+func (meanAggregator) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	return Sum.AggregatePrimaryFloat(values, nil) / float64(len(values))
+}
+
+func (meanAggregator) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	var sum, total float64
+	for i, v := range values[Mean.index] {
+		w := float64(counts[i])
+		if values[Present.index] != nil {
+			w = values[Present.index][i]
+		}
+		sum += v * w
+		total += w
 	}
-	return sum / Sum.AggregatePrimary(counts, nil)
+	return sum / total
 }
@@ -25,3 +25,17 @@ func (minAggregator) AggregatePrimary(values []int64, times []int64) int64 {
 func (minAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
 	return Min.AggregatePrimary(values[Min.index], nil)
 }
+
+func (minAggregator) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	min := values[0]
+	for _, c := range values[1:] {
+		if c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (minAggregator) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	return Min.AggregatePrimaryFloat(values[Min.index], nil)
+}
@@ -0,0 +1,23 @@
+package downsampling
+
+// presentAggregator counts the values of a column that are not missing, unlike count which counts all points
+// it is stored together with mean to weight the means of downsampled points
+type presentAggregator struct {
+	index int
+}
+
+func (presentAggregator) GetIndex() int {
+	return Present.index
+}
+
+func (presentAggregator) Needs(indices []bool) {
+	indices[Present.index] = true
+}
+
+func (presentAggregator) AggregatePrimary(values []int64, times []int64) int64 {
+	return int64(len(values))
+}
+
+func (presentAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	return Sum.AggregatePrimary(values[Present.index], nil)
+}
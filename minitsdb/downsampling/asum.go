@@ -23,3 +23,15 @@ func (sumAggregator) AggregatePrimary(values []int64, times []int64) int64 {
 func (sumAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
 	return Sum.AggregatePrimary(values[Sum.index], nil)
 }
+
+func (sumAggregator) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	var sum float64
+	for _, c := range values {
+		sum += c
+	}
+	return sum
+}
+
+func (sumAggregator) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	return Sum.AggregatePrimaryFloat(values[Sum.index], nil)
+}
@@ -0,0 +1,37 @@
+package downsampling
+
+// transitionsAggregator counts the changes of a value, e.g. how often a relay switched
+// changes between consecutive downsampled points are found by comparing their first and last values
+type transitionsAggregator struct {
+	index int
+}
+
+func (transitionsAggregator) GetIndex() int {
+	return Transitions.index
+}
+
+func (transitionsAggregator) Needs(indices []bool) {
+	indices[Transitions.index] = true
+	indices[First.index] = true
+	indices[Last.index] = true
+}
+
+func (transitionsAggregator) AggregatePrimary(values []int64, times []int64) int64 {
+	var transitions int64
+	for i := 1; i < len(values); i++ {
+		if values[i] != values[i-1] {
+			transitions++
+		}
+	}
+	return transitions
+}
+
+func (transitionsAggregator) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	transitions := Sum.AggregatePrimary(values[Transitions.index], nil)
+	for i := 1; i < len(values[First.index]); i++ {
+		if values[First.index][i] != values[Last.index][i-1] {
+			transitions++
+		}
+	}
+	return transitions
+}
@@ -34,6 +34,13 @@ type Aggregator interface {
 	AggregateSecondary(values [][]int64, times []int64, counts []int64) int64
 }
 
+// FloatFunction is implemented by functions that can also aggregate columns holding float values
+// values that are not present are removed before the functions are called, same as for integer values
+type FloatFunction interface {
+	AggregatePrimaryFloat(values []float64, times []int64) float64
+	AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64
+}
+
 type FunctionGenerator interface {
 	Create(args map[string]string) (Function, error)
 }
@@ -46,6 +53,14 @@ var (
 	Max   = maxAggregator{index: 3}
 	Sum   = sumAggregator{index: 4}
 	Mean  = meanAggregator{index: 5}
+
+	Transitions = transitionsAggregator{index: 6}
+	Active      = activeAggregator{index: 7}
+	Present     = presentAggregator{index: 8}
+	Duration    = durationAggregator{index: 9}
+
+	// StateDurations holds the aggregators of the time spent in each state, starting with the first state
+	StateDurations = stateDurations(10)
 )
 
 var Aggregators = map[string]Aggregator{
@@ -55,6 +70,11 @@ var Aggregators = map[string]Aggregator{
 	"max":   Max,
 	"sum":   Sum,
 	"mean":  Mean,
+
+	"transitions": Transitions,
+	"active":      Active,
+	"present":     Present,
+	"duration":    Duration,
 }
 
 var AggregatorList = []Aggregator{
@@ -64,25 +84,37 @@ var AggregatorList = []Aggregator{
 	Max,
 	Sum,
 	Mean,
+	Transitions,
+	Active,
+	Present,
+	Duration,
 }
 
-var AggregatorCount = len(Aggregators)
+var AggregatorCount int
 
 // functions
 var (
 	Count    countFunction
 	PeakPeak peakpeakFunction
+	Fraction = fractionFunction{state: -1}
 )
 
 var Functions = map[string]Function{
 	"count":    Count,
 	"peakpeak": PeakPeak,
+	"fraction": Fraction,
 }
 
 var FunctionCount int
 
 // add aggregators to functions
 func init() {
+	for i, agg := range StateDurations {
+		Aggregators[stateDurationName(i)] = agg
+		AggregatorList = append(AggregatorList, agg)
+	}
+	AggregatorCount = len(AggregatorList)
+
 	for name, agg := range Aggregators {
 		Functions[name] = agg
 	}
@@ -105,6 +137,33 @@ var FunctionGenerators = map[string]FunctionGenerator{
 	"accumulate": Accumulate,
 	"integrate":  Integrate,
 	"sincestart": SinceStart,
+	"fraction":   fractionFunctionGenerator{},
+}
+
+// FunctionName returns the name of a function from Functions, empty for generated functions
+func FunctionName(f Function) string {
+	for name, function := range Functions {
+		if function == f {
+			return name
+		}
+	}
+	return ""
+}
+
+// ReturnsFloat returns true if the results of f are float values for all columns, e.g. fraction
+func ReturnsFloat(f Function) bool {
+	_, ok := f.(fractionFunction)
+	return ok
+}
+
+// CountsPoints returns true if the results of f are numbers of points or seconds, which are not scaled like the values
+// of a column and are integers in float columns too
+func CountsPoints(f Function) bool {
+	switch f.(type) {
+	case countFunction, presentAggregator, durationAggregator, stateDurationAggregator:
+		return true
+	}
+	return false
 }
 
 // FindFunction tries to find a matching function
@@ -117,7 +176,8 @@ func FindFunction(s string) (Function, error) {
 		return nil, errors.New("function description empty")
 	}
 
-	if f, ok := Functions[parts[0]]; ok {
+	// functions like fraction can also be generated with arguments
+	if f, ok := Functions[parts[0]]; ok && len(parts) == 1 {
 		return f, nil
 	}
 
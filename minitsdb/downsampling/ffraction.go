@@ -0,0 +1,65 @@
+package downsampling
+
+import (
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"strconv"
+)
+
+// fractionFunction returns the fraction of time a bool or enum column spent in a state as float value,
+// e.g. the fraction of time a relay was switched on. state -1 is the time in any but the first state
+// the time of points without value is not included
+type fractionFunction struct {
+	state int64
+}
+
+// stateIndex returns the index of the duration aggregator the fraction is calculated from
+func (f fractionFunction) stateIndex() int {
+	if f.state < 0 {
+		return StateDurations[0].index
+	}
+	return StateDurations[f.state].index
+}
+
+func (f fractionFunction) Needs(indices []bool) {
+	Duration.Needs(indices)
+	indices[f.stateIndex()] = true
+}
+
+// fraction converts the time in the state (or the first state for state -1) and the total time to the result
+func (f fractionFunction) fraction(inState, total int64) int64 {
+	if f.state < 0 {
+		inState = total - inState
+	}
+	return storage.FloatValue(float64(inState) / float64(total))
+}
+
+func (f fractionFunction) AggregatePrimary(values []int64, times []int64) int64 {
+	state := StateDurations[0]
+	if f.state >= 0 {
+		state = StateDurations[f.state]
+	}
+	return f.fraction(state.AggregatePrimary(values, times), Duration.AggregatePrimary(values, times))
+}
+
+func (f fractionFunction) AggregateSecondary(values [][]int64, times []int64, counts []int64) int64 {
+	inState := Sum.AggregatePrimary(values[f.stateIndex()], nil)
+	return f.fraction(inState, Duration.AggregateSecondary(values, times, counts))
+}
+
+// fractionFunctionGenerator creates the fraction of time spent in the state with the index given as argument
+// labels of states are converted to indices by the column, see minitsdb.Column.FindFunction
+type fractionFunctionGenerator struct{}
+
+func (fractionFunctionGenerator) Create(args map[string]string) (Function, error) {
+	if len(args) != 1 {
+		return nil, errors.New("fraction requires the argument state")
+	}
+
+	state, err := strconv.ParseInt(args["state"], 10, 64)
+	if err != nil || state < 0 || state >= MaxStates {
+		return nil, errors.New("fraction requires the index of a state")
+	}
+
+	return fractionFunction{state: state}, nil
+}
@@ -18,3 +18,15 @@ func (peakpeakFunction) AggregateSecondary(values [][]int64, times []int64, coun
 	min := Min.AggregateSecondary(values, nil, nil)
 	return max - min
 }
+
+func (peakpeakFunction) AggregatePrimaryFloat(values []float64, times []int64) float64 {
+	max := Max.AggregatePrimaryFloat(values, nil)
+	min := Min.AggregatePrimaryFloat(values, nil)
+	return max - min
+}
+
+func (peakpeakFunction) AggregateSecondaryFloat(values [][]float64, times []int64, counts []int64) float64 {
+	max := Max.AggregateSecondaryFloat(values, nil, nil)
+	min := Min.AggregateSecondaryFloat(values, nil, nil)
+	return max - min
+}
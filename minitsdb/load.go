@@ -7,19 +7,33 @@ import (
 )
 
 // NewDatabase creates a new database instance
-func NewDatabase(databasePath string) (Database, error) {
-	db := Database{
+func NewDatabase(databasePath string) (*Database, error) {
+	db := &Database{
 		Path:   databasePath,
 		Series: make([]Series, 0),
+		Cache:  NewBlockCache(DefaultCacheSize),
 	}
 
-	err := db.loadSeries()
+	err := db.loadSeries(OpenSeries)
+
+	return db, err
+}
+
+// NewDatabaseReadOnly opens all series of a database with OpenSeriesReadOnly
+func NewDatabaseReadOnly(databasePath string) (*Database, error) {
+	db := &Database{
+		Path:   databasePath,
+		Series: make([]Series, 0),
+		Cache:  NewBlockCache(DefaultCacheSize),
+	}
+
+	err := db.loadSeries(OpenSeriesReadOnly)
 
 	return db, err
 }
 
 // LoadSeries loads all series in a database from the file system
-func (db *Database) loadSeries() error {
+func (db *Database) loadSeries(open func(string) (Series, error)) error {
 	if len(db.Series) != 0 {
 		return errors.New("series already loaded")
 	}
@@ -30,19 +44,25 @@ func (db *Database) loadSeries() error {
 		return err
 	}
 
+	series := make([]Series, 0, len(files))
+
 	for _, file := range files {
 		if !file.IsDir() {
 			continue
 		}
 
-		s, err := OpenSeries(path.Join(db.Path, file.Name()))
+		s, err := open(path.Join(db.Path, file.Name()))
 
 		if err != nil {
 			return err
 		}
 
-		db.Series = append(db.Series, s)
+		s.useCache(db.Cache)
+
+		series = append(series, s)
 	}
 
+	db.setSeries(series)
+
 	return nil
 }
@@ -0,0 +1,103 @@
+package minitsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestSeriesListConcurrent replaces the series while another goroutine reads them, run with -race
+func TestSeriesListConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(path.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "a", "series.yaml"), []byte(testSeriesConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			for _, s := range db.FindSeries(map[string]string{"name": "test"}, false) {
+				_ = s.Path
+			}
+
+			if _, err := db.Compact(0.5); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var reloads []Reload
+
+	for i := 0; i < 20; i++ {
+		if err := os.Mkdir(path.Join(dir, "b"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, "b", "series.yaml"), []byte(strings.Replace(testSeriesConfig, "name: test", "name: other", 1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		reloads, err = db.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range reloads {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+		}
+
+		if len(db.SeriesList()) != 2 {
+			t.Fatalf("got %d series after adding, want 2", len(db.SeriesList()))
+		}
+
+		if err := os.RemoveAll(path.Join(dir, "b")); err != nil {
+			t.Fatal(err)
+		}
+
+		reloads, err = db.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range reloads {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+		}
+
+		if len(db.SeriesList()) != 1 {
+			t.Fatalf("got %d series after removing, want 1", len(db.SeriesList()))
+		}
+	}
+
+	close(done)
+	<-stopped
+}
@@ -1,11 +1,13 @@
 package minitsdb
 
 import (
+	"errors"
 	"github.com/martin2250/minitsdb/minitsdb/downsampling"
 	"github.com/martin2250/minitsdb/minitsdb/storage"
 	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
 	. "github.com/martin2250/minitsdb/minitsdb/types"
 	"github.com/martin2250/minitsdb/util"
+	"github.com/sirupsen/logrus"
 	"io"
 	"math"
 )
@@ -17,6 +19,24 @@ type QueryColumn struct {
 	Factor   float64
 }
 
+// Float returns true if the results of the query column hold float values
+func (qc QueryColumn) Float() bool {
+	if downsampling.ReturnsFloat(qc.Function) {
+		return true
+	}
+	return qc.Column.Float && !downsampling.CountsPoints(qc.Function)
+}
+
+// States returns the labels of the results of the query column, nil if the results are numbers
+// only functions that select a value of the column return states, e.g. last, but not transitions
+func (qc QueryColumn) States() []string {
+	switch qc.Function {
+	case downsampling.First, downsampling.Last, downsampling.Min, downsampling.Max:
+		return qc.Column.States
+	}
+	return nil
+}
+
 // Query reads and aggregates points from a bucket of a series (both from disk and RAM)
 type Query struct {
 	timeRange TimeRange
@@ -28,9 +48,9 @@ type Query struct {
 
 	Bucket *Bucket
 
-	columns      []QueryColumn
-	needIndex    []int
-	transformers []encoding.Transformer
+	columns   []QueryColumn
+	need      []bool
+	needIndex []int
 
 	// SkipBlocks has been called yet
 	primed bool
@@ -48,6 +68,11 @@ func (q *Query) SkipBlocks() error {
 		var err error
 		header, err = q.reader.DecodeHeader()
 
+		if skipBlockError(err) {
+			header.TimeLast = math.MinInt64
+			continue
+		}
+
 		if err != nil {
 			return err
 		}
@@ -61,17 +86,87 @@ func (q *Query) SkipBlocks() error {
 	return nil
 }
 
-func (q *Query) readIntoBuffer() error {
+// skipBlockError logs errors that only affect a single block, queries continue with the next block
+func skipBlockError(err error) bool {
+	var blockErr storage.BlockError
+	if !errors.As(err, &blockErr) {
+		return false
+	}
+	logrus.WithError(err).Warning("skipping corrupted block")
+	return true
+}
+
+// decodeBlock reads and reverts the next block from disk and adds it to the cache
+// returns nil if the block was skipped
+func (q *Query) decodeBlock() ([][]int64, error) {
+	header, err := q.reader.Header()
+	if skipBlockError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a reused last block is also held in the buffer, which may contain additional points
+	if header.TimeFirst > q.Bucket.LastTimeOnDisk {
+		return nil, io.EOF
+	}
+
+	// the header may belong to a later file than the position checked before
+	filePath, block, err := q.reader.Position()
+	if err != nil {
+		return nil, err
+	}
+
+	// blocks written with an older schema have a different column layout
+	layout, err := q.Bucket.headerLayout(header)
+	if err != nil {
+		logrus.WithError(err).Warning("skipping block with unknown schema")
+		q.reader.SkipBlock()
+		return nil, nil
+	}
+
+	q.reader.SetNeed(layout.need(q.need))
+
 	decoded, err := q.reader.DecodeBlock()
+	if skipBlockError(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// transform values
-	transformed := make([][]int64, len(q.transformers))
-	for _, i := range q.needIndex {
-		transformed[i], err = q.transformers[i].Revert(decoded[i])
-		if err != nil {
+	transformed, err := layout.revert(decoded, q.reader.Missing(), q.need, header.NumPoints)
+	if err != nil {
+		return nil, err
+	}
+
+	q.Bucket.cache.put(filePath, block, transformed, q.needIndex)
+
+	return transformed, nil
+}
+
+func (q *Query) readIntoBuffer() error {
+	filePath, block, err := q.reader.Position()
+	if err != nil {
+		return err
+	}
+
+	// cached blocks are skipped without reading them from disk
+	transformed := q.Bucket.cache.get(filePath, block, q.needIndex)
+
+	if transformed != nil {
+		if err := q.reader.SkipBlock(); err != nil {
+			return err
+		}
+
+		if transformed[0][0] > q.Bucket.LastTimeOnDisk {
+			return io.EOF
+		}
+	} else {
+		transformed, err = q.decodeBlock()
+		if err != nil || transformed == nil {
 			return err
 		}
 	}
@@ -213,14 +308,15 @@ func (b *Bucket) Query(columns []QueryColumn, timeRange TimeRange, timeStep int6
 		buffer: storage.NewPointBuffer(b.Buffer.Cols()),
 		reader: storage.NewFileDecoder(relevantFiles, decoderNeed),
 
-		columns:      columns,
-		needIndex:    needIndex,
-		transformers: b.Transformers,
+		columns:   columns,
+		need:      decoderNeed,
+		needIndex: needIndex,
 
 		Bucket: b,
 	}
 
 	query.buffer.Need = decoderNeed
+	query.reader.SetTimeRange(timeRange.Start, timeRange.End)
 
 	return &query
 }
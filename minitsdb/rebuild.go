@@ -0,0 +1,241 @@
+package minitsdb
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/martin2250/minitsdb/util"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"os"
+)
+
+// Rebuild describes a downsampled bucket that was regenerated from the primary bucket
+type Rebuild struct {
+	Path   string
+	Points int64
+	// Kept is the number of points that were copied from the bucket, as the primary bucket no longer covers them
+	Kept  int64
+	Files int
+}
+
+// stagingPath returns the directory a rebuilt bucket is written to before it replaces the bucket
+func (b *Bucket) stagingPath() string {
+	return b.Path + ".rebuild"
+}
+
+// backupPath returns the directory the bucket is moved to while it is replaced by a rebuilt bucket
+func (b *Bucket) backupPath() string {
+	return b.Path + ".old"
+}
+
+// recoverRebuild finishes or discards a rebuild that was interrupted
+// the staging directory is only complete once the bucket directory was moved to the backup path
+func (b *Bucket) recoverRebuild() error {
+	if _, err := os.Stat(b.Path); err == nil {
+		// swap never started or completed, remove leftovers
+		if err := os.RemoveAll(b.stagingPath()); err != nil {
+			return err
+		}
+		return os.RemoveAll(b.backupPath())
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := os.Stat(b.backupPath()); os.IsNotExist(err) {
+		return os.RemoveAll(b.stagingPath())
+	} else if err != nil {
+		return err
+	}
+
+	logrus.WithField("path", b.Path).Warning("completing interrupted rebuild")
+
+	if err := os.Rename(b.stagingPath(), b.Path); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(b.backupPath())
+}
+
+// swapStaging replaces the bucket directory with the staging directory
+func (b *Bucket) swapStaging() error {
+	if err := os.RemoveAll(b.backupPath()); err != nil {
+		return err
+	}
+
+	if err := os.Rename(b.Path, b.backupPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(b.stagingPath(), b.Path); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(b.backupPath())
+}
+
+// timeSpan returns the times of the first and last point stored in the bucket, including the buffer
+// returns false if the bucket is empty
+func (b *Bucket) timeSpan() (first, last int64, ok bool) {
+	first, last = math.MaxInt64, b.LastTimeOnDisk
+
+	if len(b.DataFiles) > 0 {
+		first = b.DataFiles[0].TimeStart
+	}
+
+	if l := b.Buffer.Len(); l > 0 {
+		if b.Buffer.Values[0][0] < first {
+			first = b.Buffer.Values[0][0]
+		}
+		if b.Buffer.Values[0][l-1] > last {
+			last = b.Buffer.Values[0][l-1]
+		}
+	}
+
+	return first, last, first != math.MaxInt64
+}
+
+// copyQuery appends all points of a query to the staging bucket and writes full blocks
+// returns the number of points
+func copyQuery(staging *Bucket, query *Query) (int64, error) {
+	var points int64
+
+	for {
+		buffer, err := query.Next()
+
+		if err == io.EOF {
+			return points, nil
+		} else if err != nil {
+			return points, err
+		}
+
+		points += int64(buffer.Len())
+		staging.Buffer.AppendBuffer(buffer)
+
+		for staging.Flush(math.MaxInt64, false) {
+		}
+	}
+}
+
+// rebuildBucket downsamples the entire primary bucket into the staging directory of bucket i
+// only time steps that are complete are written, points of bucket i before the first time step
+// of the primary bucket are kept as they are, the primary bucket may have expired their source points
+func (s *Series) rebuildBucket(i int) (Rebuild, error) {
+	primary := &s.Buckets[0]
+	target := &s.Buckets[i]
+
+	result := Rebuild{
+		Path: target.Path,
+	}
+
+	staging := newBucket(s.Path, target.TimeStep, target.PointsPerFile, target.BlockSize)
+	staging.Path = target.stagingPath()
+	staging.Last = true
+	staging.Transformers = target.Transformers
+	staging.Schema = target.Schema
+	staging.layouts = target.layouts
+	staging.Buffer = storage.NewPointBuffer(s.SecondaryCount)
+
+	if err := os.RemoveAll(staging.Path); err != nil {
+		return result, err
+	}
+
+	if err := os.Mkdir(staging.Path, 0755); err != nil {
+		return result, err
+	}
+
+	first, last, ok := primary.timeSpan()
+
+	timeRange := types.TimeRange{
+		Start: util.RoundDown(first, target.TimeStep),
+		// the step containing the last point might still receive points
+		End: util.RoundDown(last+1, target.TimeStep) - 1,
+	}
+
+	if !ok {
+		timeRange.Start = math.MaxInt64 - target.TimeStep*100
+	}
+
+	// querying the bucket with its own time step returns the stored points
+	if targetFirst, _, targetOk := target.timeSpan(); targetOk && targetFirst < timeRange.Start {
+		query := target.Query(target.DownSampleColumns, types.TimeRange{
+			Start: targetFirst,
+			End:   timeRange.Start - 1,
+		}, target.TimeStep)
+
+		kept, err := copyQuery(&staging, query)
+		if err != nil {
+			os.RemoveAll(staging.Path)
+			return result, err
+		}
+
+		result.Kept = kept
+	}
+
+	if ok && timeRange.End > timeRange.Start {
+		query := primary.Query(primary.DownSampleColumns, timeRange, target.TimeStep)
+
+		points, err := copyQuery(&staging, query)
+		if err != nil {
+			os.RemoveAll(staging.Path)
+			return result, err
+		}
+
+		result.Points = points
+	}
+
+	for staging.Buffer.Len() > 0 {
+		staging.Flush(math.MaxInt64, true)
+	}
+
+	result.Files = len(staging.DataFiles)
+
+	return result, target.swapStaging()
+}
+
+// Rebuild regenerates the downsampled buckets first to last (inclusive) from the primary bucket,
+// e.g. after aggregations were changed. Each bucket is written to a staging directory and swapped in
+// once it is complete. Points must not be inserted into the series while it is rebuilt
+func (s *Series) Rebuild(first, last int) ([]Rebuild, error) {
+	if first < 1 || last >= len(s.Buckets) || first > last {
+		return nil, fmt.Errorf("invalid bucket range %d to %d, series has %d downsampled buckets", first, last, len(s.Buckets)-1)
+	}
+
+	var rebuilds []Rebuild
+
+	for i := first; i <= last; i++ {
+		b := &s.Buckets[i]
+
+		r, err := s.rebuildBucket(i)
+
+		if err != nil {
+			return rebuilds, err
+		}
+
+		rebuilds = append(rebuilds, r)
+
+		// reload the bucket and downsample the remaining points from the previous bucket
+		b.Mux.Lock()
+		b.cache.invalidateBucket(b.Path)
+		b.Buffer = storage.NewPointBuffer(s.SecondaryCount)
+		b.OverwriteLast = false
+		b.forgetChecked(nil)
+		err = b.open()
+		b.Mux.Unlock()
+
+		if err != nil {
+			return rebuilds, err
+		}
+
+		if err := b.reuseLastBlock(s.ReuseMax); err != nil {
+			logrus.WithError(err).WithField("path", b.Path).Warning("could not reuse last block")
+		}
+
+		if err := s.Buckets[i-1].DownsampleStartup(); err != nil {
+			return rebuilds, err
+		}
+	}
+
+	return rebuilds, nil
+}
@@ -0,0 +1,65 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/util"
+	"os"
+	"testing"
+)
+
+func TestRebuildKeepsExpiredPoints(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 5000)
+	s.FlushAll()
+
+	before := queryTestBucket(t, &s, 1)
+
+	// drop the primary files before 2000, the downsampled bucket still holds these points
+	if _, err := s.Buckets[0].Expire(2000); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilds, err := s.Rebuild(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rebuilds) != 1 || rebuilds[0].Kept != 200 {
+		t.Errorf("unexpected rebuilds %+v", rebuilds)
+	}
+
+	after := queryTestBucket(t, &s, 1)
+
+	if after.Len() != before.Len() || after.Len() < 490 {
+		t.Fatalf("expected %d points after rebuild, got %d", before.Len(), after.Len())
+	}
+
+	if !util.Compare2DInt64(before.Values, after.Values) {
+		t.Error("rebuild changed the points of the downsampled bucket")
+	}
+}
+
+func TestRebuildEmptyPrimary(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 5000)
+	s.FlushAll()
+
+	before := queryTestBucket(t, &s, 1)
+
+	if _, err := s.Buckets[0].Expire(10000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Rebuild(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	after := queryTestBucket(t, &s, 1)
+
+	if !util.Compare2DInt64(before.Values, after.Values) {
+		t.Errorf("expected %d points after rebuild, got %d", before.Len(), after.Len())
+	}
+}
@@ -0,0 +1,203 @@
+package minitsdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"time"
+)
+
+// ErrRestartRequired indicates that a changed setting of a series can only be applied by restarting the server
+var ErrRestartRequired = errors.New("restart required")
+
+// Reload describes a series that was opened, closed or updated by Database.Reload
+type Reload struct {
+	Path string
+	Tags map[string]string
+
+	Added   bool
+	Removed bool
+	Updated bool
+
+	// Err holds the reason why the series.yaml could not be applied, the series remains unchanged
+	Err error
+}
+
+// Reload rescans the database directory and applies changes to the series configuration files
+// new series are opened and series whose series.yaml was removed are flushed and closed. Changes to flush settings,
+// reusemax, blocksize and retention are applied in place, all other changes require a restart.
+// Must be called from the goroutine that inserts points, db.Series is replaced by a new slice if series are
+// added or removed, so all pointers to series of the database must be looked up again afterwards
+func (db *Database) Reload() ([]Reload, error) {
+	files, err := ioutil.ReadDir(db.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var reloads []Reload
+
+	loaded := make(map[string]bool, len(db.Series))
+	for i := range db.Series {
+		loaded[db.Series[i].Path] = true
+	}
+
+	// removed series are closed first, so their tags can be reused by new series
+	for i := 0; i < len(db.Series); i++ {
+		s := &db.Series[i]
+
+		if _, err := os.Stat(path.Join(s.Path, "series.yaml")); !os.IsNotExist(err) {
+			continue
+		}
+
+		reloads = append(reloads, db.closeSeries(i))
+		i--
+	}
+
+	for i := range db.Series {
+		s := &db.Series[i]
+
+		r := Reload{
+			Path: s.Path,
+			Tags: s.Tags,
+		}
+
+		conf, err := LoadSeriesYamlConfig(s.Path)
+
+		if err == nil {
+			r.Updated, err = s.applyConfig(conf)
+		}
+
+		if r.Err = err; r.Updated || r.Err != nil {
+			reloads = append(reloads, r)
+		}
+	}
+
+	for _, file := range files {
+		seriesPath := path.Join(db.Path, file.Name())
+
+		if !file.IsDir() || loaded[seriesPath] {
+			continue
+		}
+
+		// directories without configuration are not series
+		if _, err := os.Stat(path.Join(seriesPath, "series.yaml")); os.IsNotExist(err) {
+			continue
+		}
+
+		reloads = append(reloads, db.openSeries(seriesPath))
+	}
+
+	return reloads, nil
+}
+
+// closeSeries flushes a series whose configuration was removed and removes it from the database
+func (db *Database) closeSeries(index int) Reload {
+	s := &db.Series[index]
+
+	r := Reload{
+		Path:    s.Path,
+		Tags:    s.Tags,
+		Removed: true,
+	}
+
+	// the buffered points can't be written if the entire directory was removed
+	if _, err := os.Stat(s.Path); err == nil {
+		s.FlushAll()
+	} else {
+		logrus.WithField("series", s.Tags).Warning("series directory removed, discarding buffered points")
+	}
+
+	removed := db.detachSeries(index)
+	removed.dropCache()
+
+	return r
+}
+
+// openSeries opens a new series and adds it to the database
+func (db *Database) openSeries(seriesPath string) Reload {
+	r := Reload{
+		Path:  seriesPath,
+		Added: true,
+	}
+
+	conf, err := LoadSeriesYamlConfig(seriesPath)
+	if err != nil {
+		r.Added, r.Err = false, err
+		return r
+	}
+
+	r.Tags = conf.Tags
+
+	for i := range db.Series {
+		if reflect.DeepEqual(db.Series[i].Tags, conf.Tags) {
+			r.Added, r.Err = false, fmt.Errorf("series %s has the same tags", db.Series[i].Path)
+			return r
+		}
+	}
+
+	s, err := OpenSeries(seriesPath)
+	if err != nil {
+		r.Added, r.Err = false, err
+		return r
+	}
+
+	s.useCache(db.Cache)
+
+	series := make([]Series, 0, len(db.Series)+1)
+	series = append(series, db.Series...)
+	series = append(series, s)
+	db.setSeries(series)
+
+	return r
+}
+
+// applyConfig updates the settings of a series that can be changed while it is open
+// returns true if any setting was changed and ErrRestartRequired if other settings changed
+func (s *Series) applyConfig(conf YamlSeriesConfig) (bool, error) {
+	old := s.config
+
+	switch {
+	case !reflect.DeepEqual(old.Tags, conf.Tags):
+		return false, fmt.Errorf("%w: tags changed", ErrRestartRequired)
+	case !reflect.DeepEqual(old.Columns, conf.Columns):
+		return false, fmt.Errorf("%w: columns changed", ErrRestartRequired)
+	case old.PointsFile != conf.PointsFile:
+		return false, fmt.Errorf("%w: pointsfile changed", ErrRestartRequired)
+	case !reflect.DeepEqual(old.Wal, conf.Wal):
+		return false, fmt.Errorf("%w: wal changed", ErrRestartRequired)
+	case len(old.Buckets) != len(conf.Buckets):
+		return false, fmt.Errorf("%w: number of buckets changed", ErrRestartRequired)
+	}
+
+	for i := range conf.Buckets {
+		if old.Buckets[i].Factor != conf.Buckets[i].Factor {
+			return false, fmt.Errorf("%w: factor of bucket %d changed", ErrRestartRequired, i)
+		}
+	}
+
+	if reflect.DeepEqual(old, conf) {
+		return false, nil
+	}
+
+	s.FlushInterval = conf.FlushInterval
+	s.FlushCount = conf.FlushCount
+	s.ForceFlushCount = conf.ForceFlushCount
+	s.ReuseMax = conf.ReuseMax
+
+	for i := range s.Buckets {
+		b := &s.Buckets[i]
+
+		b.Mux.Lock()
+		b.BlockSize = int64(conf.BlockSize)
+		b.Retention = int64(time.Duration(conf.Buckets[i].Retention) / time.Second)
+		b.Mux.Unlock()
+	}
+
+	s.config = conf
+
+	return true, nil
+}
@@ -0,0 +1,107 @@
+package minitsdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig := func(name, config string) {
+		if err := os.MkdirAll(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name, "series.yaml"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configA := strings.Replace(testSeriesConfig, "name: test", "name: a", 1)
+	configB := strings.Replace(testSeriesConfig, "name: test", "name: b", 1)
+
+	writeConfig("a", configA)
+	writeConfig("b", configB)
+
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reloads, err := db.Reload(); err != nil || len(reloads) != 0 {
+		t.Errorf("unchanged database reloaded %+v, %v", reloads, err)
+	}
+
+	// settings are applied in place, structural changes are refused and new series with the same tags are not opened
+	writeConfig("a", strings.Replace(configA, "flushinterval: 10s", "flushinterval: 20s", 1))
+	writeConfig("b", configB+"  - tags:\n      name: c\n")
+	writeConfig("c", configA)
+
+	reloads, err := db.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reloads) != 3 || !reloads[0].Updated || reloads[0].Err != nil {
+		t.Fatalf("unexpected reloads %+v", reloads)
+	}
+
+	if !errors.Is(reloads[1].Err, ErrRestartRequired) || reloads[1].Updated {
+		t.Errorf("expected ErrRestartRequired for changed columns, got %+v", reloads[1])
+	}
+
+	if reloads[2].Added || reloads[2].Err == nil {
+		t.Errorf("series with duplicate tags was opened: %+v", reloads[2])
+	}
+
+	list := db.SeriesList()
+	if len(list) != 2 || list[0].FlushInterval != 20*time.Second || len(list[1].Columns) != 2 {
+		t.Fatalf("unexpected series after reload %v", list)
+	}
+
+	// removed series are flushed before they are closed
+	insertTestPoints(t, &list[0], 0, 100)
+
+	writeConfig("b", configB)
+	if err := os.RemoveAll(path.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(dir, "a", "series.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads, err = db.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reloads) != 1 || !reloads[0].Removed || reloads[0].Tags["name"] != "a" {
+		t.Fatalf("unexpected reloads %+v", reloads)
+	}
+
+	if list := db.SeriesList(); len(list) != 1 || list[0].Tags["name"] != "b" {
+		t.Errorf("unexpected series after removal %v", list)
+	}
+
+	writeConfig("a", configA)
+
+	s, err := OpenSeries(path.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if primary := queryTestBucket(t, &s, 0); primary.Len() != 100 {
+		t.Errorf("expected 100 flushed points, got %d", primary.Len())
+	}
+}
@@ -0,0 +1,497 @@
+package minitsdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// ReplicaSeries describes a series of the leader, followers create a series directory with the same name
+type ReplicaSeries struct {
+	Name string
+	// Config and Schemas hold the content of series.yaml and schema.yaml, Schemas is empty if the file does not exist
+	Config  string
+	Schemas string
+}
+
+// ReplicaFile describes a data file of the leader
+type ReplicaFile struct {
+	Name      string
+	BlockSize int64
+	Index     []storage.IndexEntry
+}
+
+// ReplicaBucket describes the data files and the buffered points of a bucket of the leader
+type ReplicaBucket struct {
+	Files []ReplicaFile
+
+	LastTimeOnDisk int64
+	OverwriteLast  bool
+	// Buffer holds the points that were not yet written to disk
+	Buffer storage.PointBuffer
+}
+
+// ReplicaUpdate holds the blocks of a bucket of the leader that differ from the follower, created by Bucket.FetchReplica
+type ReplicaUpdate struct {
+	Replica ReplicaBucket
+
+	files []replicaBlocks
+}
+
+// replicaBlocks holds the blocks of a data file of the leader starting at block first
+type replicaBlocks struct {
+	file   ReplicaFile
+	first  int64
+	blocks []byte
+}
+
+// ErrReplicaMismatch indicates that the state of the leader does not fit the series of the follower
+var ErrReplicaMismatch = errors.New("replica does not match leader")
+
+// replicaChunk is the maximum number of blocks fetched from the leader at once
+const replicaChunk = 256
+
+// Replicas returns the configuration of all series, so followers can create the same series
+func (db *Database) Replicas() ([]ReplicaSeries, error) {
+	list := db.SeriesList()
+	replicas := make([]ReplicaSeries, len(list))
+
+	for i := range list {
+		s := &list[i]
+
+		config, err := ioutil.ReadFile(path.Join(s.Path, "series.yaml"))
+		if err != nil {
+			return nil, err
+		}
+
+		schemas, err := ioutil.ReadFile(path.Join(s.Path, schemaFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		replicas[i] = ReplicaSeries{
+			Name:    path.Base(s.Path),
+			Config:  string(config),
+			Schemas: string(schemas),
+		}
+	}
+
+	return replicas, nil
+}
+
+// SeriesByDirectory returns the series stored in the directory name of the database, nil if there is none
+func (db *Database) SeriesByDirectory(name string) *Series {
+	list := db.SeriesList()
+
+	for i := range list {
+		if path.Base(list[i].Path) == name {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+// Replica returns the state of the bucket for followers
+func (b *Bucket) Replica() (ReplicaBucket, error) {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+
+	replica := ReplicaBucket{
+		Files:          make([]ReplicaFile, len(b.DataFiles)),
+		LastTimeOnDisk: b.LastTimeOnDisk,
+		OverwriteLast:  b.OverwriteLast,
+		Buffer: storage.PointBuffer{
+			Values: make([][]int64, len(b.Buffer.Values)),
+		},
+	}
+
+	if b.Buffer.Need != nil {
+		replica.Buffer.Need = append([]bool(nil), b.Buffer.Need...)
+	}
+
+	for i, df := range b.DataFiles {
+		index, err := df.Index()
+		if err != nil {
+			return ReplicaBucket{}, err
+		}
+
+		replica.Files[i] = ReplicaFile{
+			Name:      path.Base(df.Path),
+			BlockSize: df.BlockSize,
+			Index:     index,
+		}
+	}
+
+	// the buffer is modified by inserts once the mutex is released
+	for i, values := range b.Buffer.Values {
+		replica.Buffer.Values[i] = append([]int64(nil), values...)
+	}
+
+	return replica, nil
+}
+
+// ReplicaBlocks reads up to count blocks of the data file name starting at block first
+// compressed blocks are returned decompressed
+func (b *Bucket) ReplicaBlocks(name string, first, count int64) (bytes.Buffer, error) {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+
+	df := b.dataFileNamed(name)
+	if df == nil {
+		return bytes.Buffer{}, fmt.Errorf("data file %s not found", name)
+	}
+
+	if first < 0 || first > df.Blocks {
+		return bytes.Buffer{}, fmt.Errorf("data file %s has %d blocks", name, df.Blocks)
+	}
+
+	var blocks bytes.Buffer
+
+	for n := first; n < df.Blocks && n < first+count; n++ {
+		block, err := df.ReadBlock(n)
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+		block.WriteTo(&blocks)
+	}
+
+	return blocks, nil
+}
+
+func (b *Bucket) dataFileNamed(name string) *storage.DataFile {
+	for _, df := range b.DataFiles {
+		if path.Base(df.Path) == name {
+			return df
+		}
+	}
+	return nil
+}
+
+// ApplyReplicas creates, reopens and removes series so they match the series of the leader
+// series whose configuration changed are reopened, their data files are updated by the next call to ApplyReplica.
+// Must be called from the goroutine that modifies the database, db.Series is replaced by a new slice if series are
+// added or removed, so all pointers to series of the database must be looked up again afterwards
+func (db *Database) ApplyReplicas(replicas []ReplicaSeries) ([]Reload, error) {
+	names := make(map[string]bool, len(replicas))
+
+	for _, r := range replicas {
+		if r.Name == "" || r.Name == "." || r.Name == ".." || path.Base(r.Name) != r.Name {
+			return nil, fmt.Errorf("%w: invalid series directory %s", ErrReplicaMismatch, r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	var reloads []Reload
+
+	for i := 0; i < len(db.Series); i++ {
+		if names[path.Base(db.Series[i].Path)] {
+			continue
+		}
+
+		removed := db.detachSeries(i)
+		removed.dropCache()
+		i--
+
+		r := Reload{
+			Path:    removed.Path,
+			Tags:    removed.Tags,
+			Removed: true,
+			Err:     os.RemoveAll(removed.Path),
+		}
+
+		reloads = append(reloads, r)
+	}
+
+	for _, replica := range replicas {
+		if r, changed := db.applyReplica(replica); changed {
+			reloads = append(reloads, r)
+		}
+	}
+
+	return reloads, nil
+}
+
+// applyReplica writes the configuration of a series of the leader and opens the series
+// returns false if the configuration did not change
+func (db *Database) applyReplica(replica ReplicaSeries) (Reload, bool) {
+	dir := path.Join(db.Path, replica.Name)
+	s := db.SeriesByDirectory(replica.Name)
+
+	if s != nil && !replica.changed(dir) {
+		return Reload{}, false
+	}
+
+	r := Reload{
+		Path:    dir,
+		Added:   s == nil,
+		Updated: s != nil,
+	}
+
+	r.Err = replica.write(dir)
+
+	if r.Err == nil && s != nil {
+		for i := range db.Series {
+			if &db.Series[i] == s {
+				removed := db.detachSeries(i)
+				removed.dropCache()
+				break
+			}
+		}
+	}
+
+	var opened Series
+
+	if r.Err == nil {
+		opened, r.Err = OpenSeries(dir)
+	}
+
+	if r.Err != nil {
+		r.Added, r.Updated = false, false
+		return r, true
+	}
+
+	r.Tags = opened.Tags
+	opened.useCache(db.Cache)
+
+	series := make([]Series, 0, len(db.Series)+1)
+	series = append(series, db.Series...)
+	series = append(series, opened)
+	db.setSeries(series)
+
+	return r, true
+}
+
+// changed checks if series.yaml or schema.yaml in dir differ from the leader
+func (replica ReplicaSeries) changed(dir string) bool {
+	config, err := ioutil.ReadFile(path.Join(dir, "series.yaml"))
+	if err != nil || string(config) != replica.Config {
+		return true
+	}
+
+	schemas, err := ioutil.ReadFile(path.Join(dir, schemaFile))
+	if os.IsNotExist(err) {
+		return replica.Schemas != ""
+	}
+
+	return err != nil || string(schemas) != replica.Schemas
+}
+
+// write creates dir and replaces its series.yaml and schema.yaml
+func (replica ReplicaSeries) write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), []byte(replica.Config), 0644); err != nil {
+		return err
+	}
+
+	if replica.Schemas == "" {
+		if err := os.Remove(path.Join(dir, schemaFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return ioutil.WriteFile(path.Join(dir, schemaFile), []byte(replica.Schemas), 0644)
+}
+
+// ApplyReplica updates bucket i to match the leader, see Bucket.ApplyReplica
+// the write-ahead log is replaced with the replicated buffer of the first bucket, so a restart of the follower
+// does not replay points the leader has already written or discarded
+func (s *Series) ApplyReplica(i int, update ReplicaUpdate) (int64, error) {
+	written, err := s.Buckets[i].ApplyReplica(update)
+
+	if err == nil && i == 0 {
+		s.resetLog()
+	}
+
+	return written, err
+}
+
+// FetchReplica fetches the blocks of the leader that differ from the data files of the bucket
+// blocks are compared by their index entries, only the blocks following the first differing block are fetched.
+// fetch reads up to count blocks of a data file of the leader starting at block first.
+// The bucket is only read, so the blocks can be fetched on another goroutine and written with ApplyReplica
+func (b *Bucket) FetchReplica(replica ReplicaBucket, fetch func(name string, first, count int64) ([]byte, error)) (ReplicaUpdate, error) {
+	update := ReplicaUpdate{Replica: replica}
+
+	for _, rf := range replica.Files {
+		first, err := b.firstDiffering(rf)
+		if err != nil {
+			return ReplicaUpdate{}, err
+		}
+
+		if first < 0 {
+			continue
+		}
+
+		var blocks []byte
+
+		for n := first; n < int64(len(rf.Index)); n += replicaChunk {
+			data, err := fetch(rf.Name, n, replicaChunk)
+			if err != nil {
+				return ReplicaUpdate{}, err
+			}
+			blocks = append(blocks, data...)
+		}
+
+		// the file was modified by the leader after it was listed, it is updated again on the next call
+		if int64(len(blocks)) != (int64(len(rf.Index))-first)*rf.BlockSize {
+			return ReplicaUpdate{}, fmt.Errorf("%w: data file %s changed during replication", ErrReplicaMismatch, rf.Name)
+		}
+
+		update.files = append(update.files, replicaBlocks{file: rf, first: first, blocks: blocks})
+	}
+
+	return update, nil
+}
+
+// firstDiffering returns the first block of the data file that differs from the leader, -1 if the file is up to date
+func (b *Bucket) firstDiffering(rf ReplicaFile) (int64, error) {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+
+	df := b.dataFileNamed(rf.Name)
+	if df == nil || df.BlockSize != rf.BlockSize {
+		return 0, nil
+	}
+
+	index, err := df.Index()
+	if err != nil {
+		return 0, err
+	}
+
+	first := commonBlocks(index, rf.Index)
+
+	if first == df.Blocks && first == int64(len(rf.Index)) {
+		return -1, nil
+	}
+
+	// blocks can't be written to compressed files, they are replaced entirely
+	if df.Compressed {
+		return 0, nil
+	}
+
+	return first, nil
+}
+
+// ApplyReplica writes the blocks fetched by FetchReplica and updates the data files and the buffer to match the leader
+// Must be called from the goroutine that modifies the database, returns the number of blocks written
+func (b *Bucket) ApplyReplica(update ReplicaUpdate) (int64, error) {
+	replica := update.Replica
+
+	if len(replica.Buffer.Values) != len(b.Buffer.Values) {
+		return 0, fmt.Errorf("%w: leader buffers %d columns, follower %d", ErrReplicaMismatch, len(replica.Buffer.Values), len(b.Buffer.Values))
+	}
+
+	var written int64
+
+	for _, f := range update.files {
+		if err := b.replaceBlocks(f.file, f.first, f.blocks); err != nil {
+			return written, err
+		}
+
+		written += int64(len(f.file.Index)) - f.first
+	}
+
+	files := make(map[string]bool, len(replica.Files))
+	for _, rf := range replica.Files {
+		files[rf.Name] = true
+	}
+
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	kept := b.DataFiles[:0]
+
+	for _, df := range b.DataFiles {
+		if files[path.Base(df.Path)] {
+			kept = append(kept, df)
+			continue
+		}
+
+		if err := df.Remove(); err != nil && !os.IsNotExist(err) {
+			return written, err
+		}
+		b.cache.invalidateFile(df.Path)
+	}
+
+	b.DataFiles = kept
+
+	b.LastTimeOnDisk = replica.LastTimeOnDisk
+	b.OverwriteLast = replica.OverwriteLast
+	b.Buffer = replica.Buffer
+	b.Dirty = map[int64]struct{}{}
+
+	return written, nil
+}
+
+// replaceBlocks replaces all blocks of a data file starting at block first with blocks of the leader
+// the data file is created if it does not exist or its block size or compression differ
+func (b *Bucket) replaceBlocks(rf ReplicaFile, first int64, blocks []byte) error {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	timeRange := b.TimeStep * b.PointsPerFile
+	timeStart, ok := storage.ParseDataFileName(rf.Name)
+
+	if !ok || timeStart%timeRange != 0 || path.Base(rf.Name) != rf.Name {
+		return fmt.Errorf("%w: data file %s does not fit bucket", ErrReplicaMismatch, rf.Name)
+	}
+
+	df := b.dataFileNamed(rf.Name)
+
+	// the data file changed after the blocks were fetched, they are fetched again on the next call
+	if first > 0 && (df == nil || first > df.Blocks || df.BlockSize != rf.BlockSize || df.Compressed) {
+		return fmt.Errorf("%w: data file %s changed since its blocks were fetched", ErrReplicaMismatch, rf.Name)
+	}
+
+	switch {
+	case df != nil && first == 0:
+		if err := df.Remove(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b.cache.invalidateFile(df.Path)
+		df.Blocks = 0
+		df.BlockSize = rf.BlockSize
+		df.Compressed = false
+	case df != nil && first < df.Blocks:
+		if err := os.Truncate(df.Path, first*df.BlockSize); err != nil {
+			return err
+		}
+		b.cache.invalidateFile(df.Path)
+		df.Blocks = first
+	case df == nil:
+		df = storage.NewDataFile(b.Path, timeStart, timeRange, rf.BlockSize)
+
+		if path.Base(df.Path) != rf.Name {
+			return fmt.Errorf("%w: data file %s does not fit bucket", ErrReplicaMismatch, rf.Name)
+		}
+
+		b.DataFiles = append(b.DataFiles, df)
+		b.sortFiles()
+	}
+
+	for i := int64(0); i < int64(len(blocks)); i += rf.BlockSize {
+		if err := df.WriteBlock(*bytes.NewBuffer(blocks[i : i+rf.BlockSize]), false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commonBlocks returns the number of leading blocks whose index entries are equal
+// blocks before version 2 have no checksum, they are only compared by their time range and number of points
+func commonBlocks(local, leader []storage.IndexEntry) int64 {
+	n := 0
+	for n < len(local) && n < len(leader) && local[n] == leader[n] {
+		n++
+	}
+	return int64(n)
+}
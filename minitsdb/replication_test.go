@@ -0,0 +1,310 @@
+package minitsdb
+
+import (
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/util"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCommonBlocks(t *testing.T) {
+	a := storage.IndexEntry{TimeFirst: 0, TimeLast: 9, NumPoints: 10, Checksum: 1}
+	b := storage.IndexEntry{TimeFirst: 10, TimeLast: 19, NumPoints: 10, Checksum: 2}
+	c := storage.IndexEntry{TimeFirst: 20, TimeLast: 29, NumPoints: 10, Checksum: 3}
+	// same time range, rewritten by the leader
+	d := storage.IndexEntry{TimeFirst: 10, TimeLast: 19, NumPoints: 10, Checksum: 4}
+
+	tests := []struct {
+		local, leader []storage.IndexEntry
+		want          int64
+	}{
+		{nil, nil, 0},
+		{nil, []storage.IndexEntry{a, b}, 0},
+		{[]storage.IndexEntry{a, b}, []storage.IndexEntry{a, b, c}, 2},
+		{[]storage.IndexEntry{a, b, c}, []storage.IndexEntry{a, b}, 2},
+		{[]storage.IndexEntry{a, b, c}, []storage.IndexEntry{a, d, c}, 1},
+		{[]storage.IndexEntry{b}, []storage.IndexEntry{a, b}, 0},
+	}
+
+	for i, tt := range tests {
+		if got := commonBlocks(tt.local, tt.leader); got != tt.want {
+			t.Errorf("test %d: got %d common blocks, want %d", i, got, tt.want)
+		}
+	}
+}
+
+// fetchTestBlocks returns a fetch function for FetchReplica that reads the blocks of bucket b
+func fetchTestBlocks(b *Bucket) func(name string, first, count int64) ([]byte, error) {
+	return func(name string, first, count int64) ([]byte, error) {
+		blocks, err := b.ReplicaBlocks(name, first, count)
+		return blocks.Bytes(), err
+	}
+}
+
+func TestReplaceBlocks(t *testing.T) {
+	leader, dirLeader := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirLeader)
+
+	follower, dirFollower := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirFollower)
+
+	insertTestPoints(t, &leader, 0, 1000)
+	leader.FlushAll()
+
+	replica, err := leader.Buckets[0].Replica()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rf := replica.Files[0]
+	blocks, err := leader.Buckets[0].ReplicaBlocks(rf.Name, 0, int64(len(rf.Index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &follower.Buckets[0]
+
+	// a missing file is created
+	if err := b.replaceBlocks(rf, 0, blocks.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.DataFiles) != 1 || b.DataFiles[0].Blocks != int64(len(rf.Index)) {
+		t.Fatalf("unexpected data files after replacing blocks %v", b.DataFiles)
+	}
+
+	buffer, err := b.ReadDataFile(b.DataFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buffer.Len() != 1000 || buffer.Values[0][999] != 999 || buffer.Values[2][999] != 1998 {
+		t.Errorf("unexpected points after replacing blocks, %d points", buffer.Len())
+	}
+
+	// the blocks after the first are truncated and written again
+	if len(rf.Index) > 1 {
+		if err := b.replaceBlocks(rf, 1, blocks.Bytes()[rf.BlockSize:]); err != nil {
+			t.Fatal(err)
+		}
+
+		index, err := b.DataFiles[0].Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if commonBlocks(index, rf.Index) != int64(len(rf.Index)) || len(index) != len(rf.Index) {
+			t.Errorf("index after replacing blocks differs from the leader")
+		}
+	}
+
+	for _, name := range []string{"../" + rf.Name, "invalid"} {
+		invalid := rf
+		invalid.Name = name
+
+		if err := b.replaceBlocks(invalid, 0, blocks.Bytes()); !errors.Is(err, ErrReplicaMismatch) {
+			t.Errorf("%s: expected ErrReplicaMismatch, got %v", name, err)
+		}
+	}
+
+	// blocks fetched for a file that was truncated since don't follow its last block
+	if err := b.replaceBlocks(rf, b.DataFiles[0].Blocks+1, nil); !errors.Is(err, ErrReplicaMismatch) {
+		t.Errorf("expected ErrReplicaMismatch for blocks after the end of the file, got %v", err)
+	}
+}
+
+// applyTestReplica applies all buckets of leader to follower
+func applyTestReplica(t *testing.T, leader, follower *Series) int64 {
+	var written int64
+
+	for i := range leader.Buckets {
+		replica, err := leader.Buckets[i].Replica()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		update, err := follower.Buckets[i].FetchReplica(replica, fetchTestBlocks(&leader.Buckets[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := follower.ApplyReplica(i, update)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		written += n
+	}
+
+	return written
+}
+
+func TestApplyReplica(t *testing.T) {
+	leader, dirLeader := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirLeader)
+
+	follower, dirFollower := openTestSeries(t, testSeriesConfig+"wal:\n  sync: never\n")
+	defer os.RemoveAll(dirFollower)
+
+	// points of the follower from before it replicated the leader
+	insertTestPoints(t, &follower, 10000, 10010)
+
+	insertTestPoints(t, &leader, 0, 2500)
+	leader.Flush()
+
+	if written := applyTestReplica(t, &leader, &follower); written == 0 {
+		t.Error("no blocks were written")
+	}
+
+	compareTestSeries(t, &follower, &leader)
+
+	// only the blocks written since are fetched
+	insertTestPoints(t, &leader, 2500, 3000)
+	leader.Flush()
+
+	before := leader.Buckets[0].DataFiles[0].Blocks
+
+	if written := applyTestReplica(t, &leader, &follower); written >= before {
+		t.Errorf("wrote %d blocks, the first file with %d blocks did not change", written, before)
+	}
+
+	compareTestSeries(t, &follower, &leader)
+
+	// a restarted follower replays the replicated buffer
+	follower.Log.Close()
+
+	restarted, err := OpenSeries(dirFollower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Log.Close()
+
+	got, want := restarted.Buckets[0].Buffer, leader.Buckets[0].Buffer
+	if !util.Compare2DInt64(got.Values, want.Values) {
+		t.Errorf("restarted follower buffers %d points, leader %d", got.Len(), want.Len())
+	}
+}
+
+func TestApplyReplicas(t *testing.T) {
+	dirLeader, err := ioutil.TempDir("", "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirLeader)
+
+	dirFollower, err := ioutil.TempDir("", "follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirFollower)
+
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(path.Join(dirLeader, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		config := strings.Replace(testSeriesConfig, "name: test", "name: "+name, 1)
+		if err := ioutil.WriteFile(path.Join(dirLeader, name, "series.yaml"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leader, err := NewDatabase(dirLeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	follower, err := NewDatabase(dirFollower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicas, err := leader.Replicas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloads, err := follower.ApplyReplicas(replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reloads) != 2 || !reloads[0].Added || !reloads[1].Added || len(follower.SeriesList()) != 2 {
+		t.Fatalf("unexpected reloads %+v", reloads)
+	}
+
+	// unchanged series are kept
+	if reloads, err := follower.ApplyReplicas(replicas); err != nil || len(reloads) != 0 {
+		t.Errorf("unexpected reloads %+v, %v", reloads, err)
+	}
+
+	// a changed configuration reopens the series, removed series are deleted
+	replicas[0].Config += "reusemax: 0\n"
+
+	reloads, err = follower.ApplyReplicas(replicas[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reloads) != 2 || !reloads[0].Removed || !reloads[1].Updated || reloads[1].Err != nil {
+		t.Errorf("unexpected reloads %+v", reloads)
+	}
+
+	if list := follower.SeriesList(); len(list) != 1 || list[0].Tags["name"] != "a" {
+		t.Errorf("unexpected series after replication %v", list)
+	}
+
+	if _, err := os.Stat(path.Join(dirFollower, "b")); !os.IsNotExist(err) {
+		t.Errorf("removed series directory still exists: %v", err)
+	}
+
+	for _, name := range []string{"", ".", "..", "../a", "a/b"} {
+		invalid := []ReplicaSeries{{Name: name, Config: replicas[0].Config}}
+
+		if _, err := follower.ApplyReplicas(invalid); !errors.Is(err, ErrReplicaMismatch) {
+			t.Errorf("%q: expected ErrReplicaMismatch, got %v", name, err)
+		}
+	}
+}
+
+// TestReplicaConcurrent copies the buffers while the series rebuilds them, run with -race
+func TestReplicaConcurrent(t *testing.T) {
+	// the rebuilt bucket reuses its last block
+	s, dir := openTestSeries(t, testSeriesConfig+"reusemax: 4096\n")
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 2550)
+	s.Flush()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, err := s.Buckets[1].Replica(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.Rebuild(1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+	<-stopped
+}
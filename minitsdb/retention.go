@@ -0,0 +1,92 @@
+package minitsdb
+
+import (
+	"os"
+	"time"
+)
+
+// ExpiredFile describes a data file that was deleted because it exceeded the retention of its bucket
+type ExpiredFile struct {
+	Path      string
+	TimeStart int64
+	TimeEnd   int64
+	Blocks    int64
+}
+
+// ExpiryStats summarizes the data files a bucket has deleted since the database was opened
+type ExpiryStats struct {
+	Files  int
+	Blocks int64
+	// Last is the time of the last deletion
+	Last time.Time
+}
+
+// Expire deletes all data files that only contain points older than horizon
+// the files are removed from DataFiles while holding the bucket mutex, so running queries are not affected
+func (b *Bucket) Expire(horizon int64) ([]ExpiredFile, error) {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+
+	var expired []ExpiredFile
+
+	// DataFiles are sorted by time, stop at the first file that is still in use
+	for len(b.DataFiles) > 0 && b.DataFiles[0].TimeEnd < horizon {
+		df := b.DataFiles[0]
+
+		if err := df.Remove(); err != nil && !os.IsNotExist(err) {
+			return expired, err
+		}
+
+		b.cache.invalidateFile(df.Path)
+
+		b.DataFiles = b.DataFiles[1:]
+
+		expired = append(expired, ExpiredFile{
+			Path:      df.Path,
+			TimeStart: df.TimeStart,
+			TimeEnd:   df.TimeEnd,
+			Blocks:    df.Blocks,
+		})
+
+		b.Expired.Files++
+		b.Expired.Blocks += df.Blocks
+		b.Expired.Last = time.Now()
+	}
+
+	if len(expired) > 0 {
+		// drop buffered points that belong to deleted files, e.g. from a reused block
+		b.Buffer.TrimStart(expired[len(expired)-1].TimeEnd + 1)
+
+		if len(b.DataFiles) == 0 {
+			b.OverwriteLast = false
+		}
+	}
+
+	return expired, nil
+}
+
+// Expire deletes the data files of all buckets that exceed the bucket's retention
+// returns the deleted files, errors only abort the current bucket
+func (db *Database) Expire(now time.Time) ([]ExpiredFile, error) {
+	var expired []ExpiredFile
+	var errLast error
+
+	for is := range db.Series {
+		for ib := range db.Series[is].Buckets {
+			b := &db.Series[is].Buckets[ib]
+
+			if b.Retention == 0 {
+				continue
+			}
+
+			files, err := b.Expire(now.Unix() - b.Retention)
+			expired = append(expired, files...)
+
+			if err != nil {
+				errLast = err
+			}
+		}
+	}
+
+	return expired, errLast
+}
@@ -0,0 +1,63 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"io"
+	"os"
+	"testing"
+)
+
+// TestQueryExpireConcurrent queries a bucket while its files expire, run with -race
+func TestQueryExpireConcurrent(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 6000)
+	s.FlushAll()
+
+	columns := []QueryColumn{{Column: &s.Columns[0], Function: downsampling.First}}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			b := s.QueryBucket(1)
+			b.Mux.RLock()
+
+			query := b.Query(columns, types.TimeRange{Start: 0, End: 3000}, 1)
+			var err error
+			for err == nil {
+				_, err = query.Next()
+			}
+
+			b.Mux.RUnlock()
+
+			if err != io.EOF {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// the series keeps a window of 5000 points
+	for end := int64(7000); end <= 10000; end += 1000 {
+		insertTestPoints(t, &s, end-1000, end)
+		s.FlushAll()
+
+		if _, err := s.Buckets[0].Expire(end - 5000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+	<-stopped
+}
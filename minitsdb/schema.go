@@ -0,0 +1,490 @@
+package minitsdb
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SchemaColumn describes a column as it is stored in the blocks of a schema version
+type SchemaColumn struct {
+	Tags         map[string]string
+	Decimals     int
+	Transformer  string
+	Aggregations []string
+}
+
+// Schema is a version of the column layout of a series
+// the version is stored in every block, so blocks written with older layouts can be mapped to the current columns
+type Schema struct {
+	Version int
+	Columns []SchemaColumn
+}
+
+// schemaFile is the name of the file in the series directory that holds all schema versions
+const schemaFile = "schema.yaml"
+
+// blockLayout maps the columns of blocks written with a schema version to the current columns of a bucket
+type blockLayout struct {
+	// index holds the block column of every current column, -1 if the block does not contain the column
+	index []int
+	// convert holds the conversion from the stored to the current column
+	convert []conversion
+	// transformers of the block columns
+	transformers []encoding.Transformer
+}
+
+// conversion converts the values of a stored column to the representation of the current column
+type conversion struct {
+	// shift holds the difference in decimals between the current and the stored column
+	shift int
+	// toFloat and fromFloat convert between integers with decimals and float values
+	toFloat, fromFloat bool
+	decimals           int
+}
+
+// isFloat returns true if the transformer stores float values
+func isFloat(t encoding.Transformer) bool {
+	_, ok := t.(encoding.XORTransformer)
+	return ok
+}
+
+// needed returns false if the values can be used as is
+func (c conversion) needed() bool {
+	return c.shift != 0 || c.toFloat || c.fromFloat
+}
+
+// apply converts values in place
+func (c conversion) apply(values []int64) {
+	switch {
+	case c.toFloat:
+		factor := math.Pow10(-c.decimals)
+		for i, v := range values {
+			if v != storage.Missing {
+				values[i] = storage.FloatValue(float64(v) * factor)
+			}
+		}
+	case c.fromFloat:
+		factor := math.Pow10(c.decimals)
+		for i, v := range values {
+			if v != storage.Missing {
+				values[i] = int64(math.Round(storage.ValueFloat(v) * factor))
+			}
+		}
+	case c.shift != 0:
+		shiftDecimals(values, c.shift)
+	}
+}
+
+// schemaSlot identifies a column of a block independent of its position
+type schemaSlot struct {
+	// column holds the canonical tags of the series column, empty for time and count
+	column string
+	// aggregator is empty in primary buckets
+	aggregator string
+}
+
+func aggregatorName(index int) string {
+	for name, a := range downsampling.Aggregators {
+		if a.GetIndex() == index {
+			return name
+		}
+	}
+	return ""
+}
+
+func transformerName(t encoding.Transformer) string {
+	if s, ok := t.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprint(t)
+}
+
+// canonicalTags formats a tag set independent of map order
+func canonicalTags(tags map[string]string) string {
+	parts := make([]string, 0, len(tags))
+	for k, v := range tags {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// currentSchema describes the columns of the series as configured in series.yaml
+func (s *Series) currentSchema() Schema {
+	var schema Schema
+
+	for _, c := range s.Columns {
+		sc := SchemaColumn{
+			Tags:        c.Tags,
+			Decimals:    c.Decimals,
+			Transformer: transformerName(c.Transformer),
+		}
+
+		for i, index := range c.IndexSecondary {
+			if index > 1 {
+				sc.Aggregations = append(sc.Aggregations, aggregatorName(i))
+			}
+		}
+
+		schema.Columns = append(schema.Columns, sc)
+	}
+
+	return schema
+}
+
+// slots lists the block columns of the schema in the order they are stored
+// together with their transformers and decimals
+func (schema Schema) slots(primary bool) ([]schemaSlot, []encoding.Transformer, []int, error) {
+	slots := []schemaSlot{{}}
+	transformers := []encoding.Transformer{encoding.TimeTransformer}
+	decimals := []int{0}
+
+	if !primary {
+		slots = append(slots, schemaSlot{aggregator: "count"})
+		transformers = append(transformers, encoding.CountTransformer)
+		decimals = append(decimals, 0)
+	}
+
+	for _, c := range schema.Columns {
+		t, err := encoding.FindTransformer(c.Transformer)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		column := canonicalTags(c.Tags)
+
+		if primary {
+			slots = append(slots, schemaSlot{column: column})
+			transformers = append(transformers, t)
+			decimals = append(decimals, c.Decimals)
+			continue
+		}
+
+		// secondary columns are stored in the order of the aggregator indices
+		for _, a := range downsampling.AggregatorList {
+			name := aggregatorName(a.GetIndex())
+			for _, stored := range c.Aggregations {
+				if stored == name && downsampling.CountsPoints(a) {
+					// numbers of values and durations are stored like the count
+					slots = append(slots, schemaSlot{column: column, aggregator: name})
+					transformers = append(transformers, encoding.CountTransformer)
+					decimals = append(decimals, 0)
+					break
+				} else if stored == name {
+					slots = append(slots, schemaSlot{column: column, aggregator: name})
+					transformers = append(transformers, t)
+					decimals = append(decimals, c.Decimals)
+					break
+				}
+			}
+		}
+	}
+
+	return slots, transformers, decimals, nil
+}
+
+// newBlockLayout maps blocks written with schema stored to the columns of schema current
+func newBlockLayout(current, stored Schema, primary bool) (blockLayout, error) {
+	slotsCurrent, transformersCurrent, decimalsCurrent, err := current.slots(primary)
+	if err != nil {
+		return blockLayout{}, err
+	}
+
+	slotsStored, transformers, decimalsStored, err := stored.slots(primary)
+	if err != nil {
+		return blockLayout{}, err
+	}
+
+	indices := make(map[schemaSlot]int, len(slotsStored))
+	for i, slot := range slotsStored {
+		indices[slot] = i
+	}
+
+	l := blockLayout{
+		index:        make([]int, len(slotsCurrent)),
+		convert:      make([]conversion, len(slotsCurrent)),
+		transformers: transformers,
+	}
+
+	for i, slot := range slotsCurrent {
+		j, ok := indices[slot]
+		if !ok {
+			l.index[i] = -1
+			continue
+		}
+		l.index[i] = j
+
+		floatCurrent, floatStored := isFloat(transformersCurrent[i]), isFloat(transformers[j])
+
+		switch {
+		case floatCurrent && !floatStored:
+			l.convert[i] = conversion{toFloat: true, decimals: decimalsStored[j]}
+		case !floatCurrent && floatStored:
+			l.convert[i] = conversion{fromFloat: true, decimals: decimalsCurrent[i]}
+		case !floatCurrent:
+			l.convert[i] = conversion{shift: decimalsCurrent[i] - decimalsStored[j]}
+		}
+	}
+
+	return l, nil
+}
+
+// need converts the current columns required by a query to the block columns that must be decoded
+func (l blockLayout) need(need []bool) []bool {
+	blockNeed := make([]bool, len(l.transformers))
+	for i, n := range need {
+		if n && l.index[i] >= 0 {
+			blockNeed[l.index[i]] = true
+		}
+	}
+	return blockNeed
+}
+
+// shiftDecimals scales values from one number of decimals to another
+func shiftDecimals(values []int64, shift int) {
+	factor := int64(1)
+	for i := 0; i < shift || i < -shift; i++ {
+		factor *= 10
+	}
+
+	for i, v := range values {
+		if v == storage.Missing {
+			continue
+		}
+		if shift > 0 {
+			values[i] = v * factor
+		} else {
+			values[i] = v / factor
+		}
+	}
+}
+
+// transformValues applies the transformers to the columns of values
+// missing values are replaced by the previous value of their column, as the transformers can't encode storage.Missing
+// returns the transformed columns and the positions (point * columns + column) of missing values
+func transformValues(values [][]int64, transformers []encoding.Transformer) ([][]uint64, []int, error) {
+	transformed := make([][]uint64, len(values))
+	var missing []int
+
+	for i, t := range transformers {
+		column := values[i]
+		copied := false
+
+		for j, v := range values[i] {
+			if v != storage.Missing {
+				continue
+			}
+
+			// copy column before replacing values, else the buffer gets modified
+			if !copied {
+				column = make([]int64, len(values[i]))
+				copy(column, values[i])
+				copied = true
+			}
+
+			if j > 0 {
+				column[j] = column[j-1]
+			} else {
+				column[j] = 0
+			}
+
+			missing = append(missing, j*len(values)+i)
+		}
+
+		var err error
+		transformed[i], err = t.Apply(column)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sort.Ints(missing)
+
+	return transformed, missing, nil
+}
+
+// revert reverts the transformations of the decoded block columns and orders them like the current columns
+// only columns in need are reverted, columns that are not stored in the block are filled with storage.Missing,
+// as are the values at the positions in missing
+func (l blockLayout) revert(decoded [][]uint64, missing []int, need []bool, points int) ([][]int64, error) {
+	values := make([][]int64, len(l.index))
+
+	for i, j := range l.index {
+		if !need[i] {
+			continue
+		}
+
+		if j < 0 {
+			values[i] = make([]int64, points)
+			for k := range values[i] {
+				values[i][k] = storage.Missing
+			}
+			continue
+		}
+
+		var err error
+		values[i], err = l.transformers[j].Revert(decoded[j])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, position := range missing {
+			if position%len(l.transformers) == j {
+				values[i][position/len(l.transformers)] = storage.Missing
+			}
+		}
+
+		if l.convert[i].needed() {
+			l.convert[i].apply(values[i])
+		}
+	}
+
+	return values, nil
+}
+
+// mapPoint converts a point written with the layout's schema to the current columns
+func (l blockLayout) mapPoint(p storage.Point) storage.Point {
+	mapped := storage.Point{Values: make([]int64, len(l.index))}
+
+	for i, j := range l.index {
+		if j < 0 || j >= len(p.Values) {
+			mapped.Values[i] = storage.Missing
+			continue
+		}
+
+		mapped.Values[i] = p.Values[j]
+
+		if l.convert[i].needed() {
+			l.convert[i].apply(mapped.Values[i : i+1])
+		}
+	}
+
+	return mapped
+}
+
+// layout returns the mapping of blocks written with a schema version to the current columns of the bucket
+func (b *Bucket) layout(version int) (blockLayout, error) {
+	// blocks written before schemas were recorded use the first schema
+	if version == 0 {
+		version = 1
+	}
+
+	l, ok := b.layouts[version]
+
+	if !ok {
+		return blockLayout{}, fmt.Errorf("unknown schema version %d", version)
+	}
+
+	return l, nil
+}
+
+// headerLayout returns the layout of a block and checks that the block has the columns of its schema version
+// blocks written before schemas were recorded are refused if the columns changed before the first version was recorded
+func (b *Bucket) headerLayout(header encoding.BlockHeader) (blockLayout, error) {
+	l, err := b.layout(header.Schema)
+	if err != nil {
+		return l, err
+	}
+
+	if header.NumColumns != len(l.transformers) {
+		if header.Schema == 0 {
+			return blockLayout{}, fmt.Errorf("block without schema version has %d columns, schema version 1 has %d",
+				header.NumColumns, len(l.transformers))
+		}
+		return blockLayout{}, fmt.Errorf("block has %d columns, schema version %d has %d",
+			header.NumColumns, header.Schema, len(l.transformers))
+	}
+
+	return l, nil
+}
+
+// currentLayout returns true if blocks of the schema version don't need to be mapped
+func (b *Bucket) currentLayout(version int) bool {
+	return version == b.Schema || (version == 0 && b.Schema == 1)
+}
+
+// LoadSchemas reads all schema versions of a series, a missing file returns no versions
+func LoadSchemas(seriesPath string) ([]Schema, error) {
+	data, err := ioutil.ReadFile(path.Join(seriesPath, schemaFile))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var schemas []Schema
+
+	if err := yaml.UnmarshalStrict(data, &schemas); err != nil {
+		return nil, err
+	}
+
+	for i, schema := range schemas {
+		if schema.Version != i+1 {
+			return nil, fmt.Errorf("schema versions in %s are not consecutive", schemaFile)
+		}
+	}
+
+	return schemas, nil
+}
+
+// writeSchemas replaces the schema file of the series
+func writeSchemas(seriesPath string, schemas []Schema) error {
+	data, err := yaml.Marshal(schemas)
+	if err != nil {
+		return err
+	}
+
+	filePath := path.Join(seriesPath, schemaFile)
+
+	if err := ioutil.WriteFile(filePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// useSchemas adds the current columns as a new schema version if they differ from the latest version
+// and prepares all buckets to read blocks of every version
+// returns true if a new version was added
+func (s *Series) useSchemas(schemas []Schema) (bool, error) {
+	current := s.currentSchema()
+	added := false
+
+	if len(schemas) == 0 || !reflect.DeepEqual(schemas[len(schemas)-1].Columns, current.Columns) {
+		current.Version = len(schemas) + 1
+		schemas = append(schemas, current)
+		added = true
+	} else {
+		current = schemas[len(schemas)-1]
+	}
+
+	s.Schemas = schemas
+
+	for i := range s.Buckets {
+		b := &s.Buckets[i]
+		b.Schema = current.Version
+		b.layouts = make(map[int]blockLayout, len(schemas))
+
+		for _, schema := range schemas {
+			l, err := newBlockLayout(current, schema, b.First)
+			if err != nil {
+				return added, fmt.Errorf("schema version %d: %v", schema.Version, err)
+			}
+			b.layouts[schema.Version] = l
+		}
+	}
+
+	return added, nil
+}
@@ -0,0 +1,135 @@
+package minitsdb
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaSlots(t *testing.T) {
+	schema := Schema{
+		Version: 1,
+		Columns: []SchemaColumn{
+			{Tags: map[string]string{"name": "a", "phase": "1"}, Decimals: 2, Transformer: "D1", Aggregations: []string{"present", "min", "mean"}},
+			{Tags: map[string]string{"name": "b"}, Decimals: 1, Transformer: "XOR", Aggregations: []string{"max"}},
+		},
+	}
+
+	slots, transformers, decimals, err := schema.slots(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSlots := []schemaSlot{{}, {column: "name=a,phase=1"}, {column: "name=b"}}
+	wantTransformers := []encoding.Transformer{encoding.TimeTransformer, encoding.DiffTransformer{N: 1}, encoding.XORTransformer{}}
+
+	if !reflect.DeepEqual(slots, wantSlots) || !reflect.DeepEqual(transformers, wantTransformers) || !reflect.DeepEqual(decimals, []int{0, 2, 1}) {
+		t.Errorf("unexpected primary slots %v %v %v", slots, transformers, decimals)
+	}
+
+	slots, transformers, decimals, err = schema.slots(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// aggregations are stored in the order of the aggregator indices, present is stored like the count
+	wantSlots = []schemaSlot{
+		{},
+		{aggregator: "count"},
+		{column: "name=a,phase=1", aggregator: "min"},
+		{column: "name=a,phase=1", aggregator: "mean"},
+		{column: "name=a,phase=1", aggregator: "present"},
+		{column: "name=b", aggregator: "max"},
+	}
+	wantTransformers = []encoding.Transformer{
+		encoding.TimeTransformer,
+		encoding.CountTransformer,
+		encoding.DiffTransformer{N: 1},
+		encoding.DiffTransformer{N: 1},
+		encoding.CountTransformer,
+		encoding.XORTransformer{},
+	}
+
+	if !reflect.DeepEqual(slots, wantSlots) || !reflect.DeepEqual(transformers, wantTransformers) || !reflect.DeepEqual(decimals, []int{0, 0, 2, 2, 0, 1}) {
+		t.Errorf("unexpected secondary slots %v %v %v", slots, transformers, decimals)
+	}
+
+	schema.Columns[0].Transformer = "D7"
+	if _, _, _, err := schema.slots(true); err == nil {
+		t.Error("expected error for invalid transformer")
+	}
+}
+
+func TestBlockLayout(t *testing.T) {
+	stored := Schema{
+		Version: 1,
+		Columns: []SchemaColumn{
+			{Tags: map[string]string{"name": "a"}, Decimals: 1, Transformer: "D1"},
+			{Tags: map[string]string{"name": "b"}, Decimals: 2, Transformer: "D1"},
+			{Tags: map[string]string{"name": "c"}, Decimals: 0, Transformer: "D1"},
+		},
+	}
+
+	// b was converted to float, a gained a decimal, c was removed and d added
+	current := Schema{
+		Version: 2,
+		Columns: []SchemaColumn{
+			{Tags: map[string]string{"name": "d"}, Decimals: 0, Transformer: "D1"},
+			{Tags: map[string]string{"name": "b"}, Decimals: 2, Transformer: "XOR"},
+			{Tags: map[string]string{"name": "a"}, Decimals: 2, Transformer: "D1"},
+		},
+	}
+
+	l, err := newBlockLayout(current, stored, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(l.index, []int{0, -1, 2, 1}) {
+		t.Errorf("unexpected index %v", l.index)
+	}
+
+	p := l.mapPoint(storage.Point{Values: []int64{10, 15, 314, 7}})
+	want := []int64{10, storage.Missing, storage.FloatValue(3.14), 150}
+
+	if !reflect.DeepEqual(p.Values, want) {
+		t.Errorf("mapped point %v, want %v", p.Values, want)
+	}
+
+	if need := l.need([]bool{true, true, false, true}); !reflect.DeepEqual(need, []bool{true, true, false, false}) {
+		t.Errorf("unexpected block columns needed %v", need)
+	}
+}
+
+func TestHeaderLayout(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dir)
+
+	b := &s.Buckets[0]
+
+	tests := []struct {
+		schema, columns int
+		ok              bool
+	}{
+		{1, 3, true},
+		// blocks written before schemas were recorded
+		{0, 3, true},
+		{0, 4, false},
+		{0, 2, false},
+		{1, 4, false},
+		{2, 3, false},
+	}
+
+	for _, tt := range tests {
+		_, err := b.headerLayout(encoding.BlockHeader{Schema: tt.schema, NumColumns: tt.columns})
+		if (err == nil) != tt.ok {
+			t.Errorf("schema %d with %d columns: unexpected error %v", tt.schema, tt.columns, err)
+		}
+	}
+
+	if !b.currentLayout(0) || !b.currentLayout(1) || b.currentLayout(2) {
+		t.Error("unexpected current layouts")
+	}
+}
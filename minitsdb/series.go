@@ -7,12 +7,16 @@ import (
 	"github.com/martin2250/minitsdb/minitsdb/storage"
 	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
 	. "github.com/martin2250/minitsdb/minitsdb/types"
+	"github.com/martin2250/minitsdb/pkg/lineprotocol"
 	"math"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/martin2250/minitsdb/util"
+	"github.com/sirupsen/logrus"
 )
 
 // Column holds the json structure that describes a column in a series
@@ -20,6 +24,8 @@ type Column struct {
 	Tags        map[string]string
 	Decimals    int
 	Transformer encoding.Transformer
+	// Float is true if the column holds float values, stored as their bit pattern (see storage.FloatValue)
+	Float bool
 
 	// IndexPrimary holds the index of this column in the primary bucket
 	// IndexPrimary starts at one to account for the time column
@@ -31,9 +37,16 @@ type Column struct {
 	IndexSecondary []int
 
 	DefaultFunction downsampling.Function
+
+	// States holds the labels of the values of bool and enum columns, nil for numeric columns
+	States []string
 }
 
 func (c Column) Supports(f downsampling.Function) bool {
+	if _, ok := f.(downsampling.FloatFunction); c.Float && !ok && !downsampling.CountsPoints(f) {
+		return false
+	}
+
 	need := make([]bool, downsampling.AggregatorCount)
 	f.Needs(need)
 	for i, n := range need {
@@ -44,11 +57,82 @@ func (c Column) Supports(f downsampling.Function) bool {
 	return true
 }
 
+// FindFunction finds a function like downsampling.FindFunction, the argument state of fraction may also be a state label
+func (c Column) FindFunction(s string) (downsampling.Function, error) {
+	parts := strings.Split(s, " ")
+
+	for i, part := range parts[1:] {
+		if !strings.HasPrefix(part, "state:") {
+			continue
+		}
+		for index, label := range c.States {
+			if part == "state:"+label {
+				parts[i+1] = "state:" + strconv.Itoa(index)
+			}
+		}
+	}
+
+	return downsampling.FindFunction(strings.Join(parts, " "))
+}
+
+// ParseValue converts the text representation of a value to the value stored in the column
+func (c Column) ParseValue(text string) (int64, error) {
+	if c.States != nil {
+		return c.parseState(text)
+	}
+
+	val, err := strconv.ParseFloat(text, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// NaN is written for missing values in binary queries
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, ErrValueRange
+	}
+
+	if c.Float {
+		return storage.FloatValue(val), nil
+	}
+
+	val = math.Round(val * math.Pow10(c.Decimals))
+
+	// storage.Missing is the smallest int64, so it can't be the result of a valid conversion
+	if val <= math.MinInt64 || val >= math.MaxInt64 {
+		return 0, ErrValueRange
+	}
+
+	return int64(val), nil
+}
+
+// parseState converts the label or index of a state to the index
+func (c Column) parseState(text string) (int64, error) {
+	for i, label := range c.States {
+		if label == text {
+			return int64(i), nil
+		}
+	}
+
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil && i >= 0 && i < int64(len(c.States)) {
+		return i, nil
+	}
+
+	return 0, ErrUnknownState
+}
+
+// StateLabel returns the label of a state, or its index if the state was removed from the configuration
+func (c Column) StateLabel(v int64) string {
+	if v >= 0 && v < int64(len(c.States)) {
+		return c.States[v]
+	}
+	return strconv.FormatInt(v, 10)
+}
+
 // Series describes a time series, id'd by a name and tags
 type Series struct {
-	OverwriteLast bool // data buffer contains last block on disk, overwrite
-	Path          string
-	Columns       []Column
+	Path    string
+	Columns []Column
 
 	Buckets []Bucket
 
@@ -64,8 +148,20 @@ type Series struct {
 
 	ReuseMax int
 
+	// Log holds all points of the primary bucket's buffer and the queued backfill points, nil if the write-ahead log is disabled
+	Log *storage.WriteAheadLog
+
+	// backfill holds the points queued by QueueBackfill
+	backfill []storage.Point
+
+	// Schemas holds all versions of the column layout, the last version matches Columns
+	Schemas []Schema
+
 	PrimaryCount   int
 	SecondaryCount int
+
+	// config is the configuration the series was created with, updated when settings are reloaded
+	config YamlSeriesConfig
 }
 
 // ErrColumnMismatch indicates that the insert failed because point values could not be assigned to series columns unambiguously
@@ -77,6 +173,12 @@ var ErrInsertAtEnd = errors.New("time already archived")
 // ErrColumnAmbiguous indicates that the insert failed because point value tags match two columns
 var ErrColumnAmbiguous = errors.New("point values matches two columns")
 
+// ErrValueRange indicates that a value is not finite or can't be stored in an integer column with the configured decimals
+var ErrValueRange = errors.New("value out of range")
+
+// ErrUnknownState indicates that a value of a bool or enum column is neither the label nor the index of a state
+var ErrUnknownState = errors.New("unknown state")
+
 // ErrUnknownColumn indicates that the insert failed because one of the values could not be assigned to a column
 var ErrUnknownColumn = errors.New("value doesn't match any columns")
 
@@ -92,6 +194,13 @@ func (s *Series) InsertPoint(p storage.Point) error {
 		return ErrInsertAtEnd
 	}
 
+	// write to log first, so the point is never acknowledged without being persisted
+	if s.Log != nil {
+		if err := s.Log.Append(p); err != nil {
+			return err
+		}
+	}
+
 	if p.Values[0] < s.OldestValue {
 		s.OldestValue = p.Values[0]
 	}
@@ -177,25 +286,67 @@ func (s *Series) addColumn(conf YamlColumnConfig) error {
 		}
 	}
 
+	_, col.Float = col.Transformer.(encoding.XORTransformer)
+
+	if col.Float && col.Decimals != 0 {
+		return errors.New("float columns can't have decimals")
+	}
+
+	var err error
+	if col.States, err = columnStates(conf); err != nil {
+		return err
+	}
+
+	if col.States != nil && (col.Float || col.Decimals != 0) {
+		return fmt.Errorf("%s columns can't have decimals or float values", conf.Type)
+	}
+
 	// find aggregations
 	needs := make([]bool, downsampling.AggregatorCount)
 
-	if len(conf.Aggregations) == 0 {
+	if len(conf.Aggregations) == 0 && col.States != nil {
+		// default to the last state, the time spent in each state and the number of state changes
+		downsampling.Last.Needs(needs)
+		downsampling.Fraction.Needs(needs)
+		downsampling.Transitions.Needs(needs)
+		col.DefaultFunction = downsampling.Last
+	} else if len(conf.Aggregations) == 0 {
 		// default to storing the mean
 		downsampling.Mean.Needs(needs)
 		col.DefaultFunction = downsampling.Mean
 	} else {
+		// functions like fraction store the aggregations they need
 		for _, as := range conf.Aggregations {
-			a, ok := downsampling.Aggregators[as]
+			f, ok := downsampling.Functions[as]
 			if !ok {
 				return fmt.Errorf("aggregator %s not found", as)
 			}
-			a.Needs(needs)
+			f.Needs(needs)
 		}
-		col.DefaultFunction = downsampling.Aggregators[conf.Aggregations[0]]
+		col.DefaultFunction = downsampling.Functions[conf.Aggregations[0]]
+	}
+
+	durations := false
+	for i, a := range downsampling.StateDurations {
+		if needs[a.GetIndex()] && i >= len(col.States) && col.States != nil {
+			return fmt.Errorf("column has no state %d", i)
+		}
+		durations = durations || needs[a.GetIndex()]
+	}
+
+	// counting states or values other than zero is only meaningful for states, values of other columns are scaled
+	if col.States == nil && (needs[downsampling.Transitions.GetIndex()] || needs[downsampling.Active.GetIndex()] || durations) {
+		return errors.New("transitions, active and fraction require a bool or enum column")
 	}
 
-	if conf.Duplicate == nil {
+	// the time in every state is stored, so the fraction of all states can be queried
+	if durations {
+		for i := range col.States {
+			needs[downsampling.StateDurations[i].GetIndex()] = true
+		}
+	}
+
+	if len(conf.Duplicate) == 0 {
 		conf.Duplicate = []map[string]string{{}}
 	}
 
@@ -227,6 +378,54 @@ func (s *Series) addColumn(conf YamlColumnConfig) error {
 	return nil
 }
 
+// columnStates returns the labels of the states of bool and enum columns, nil for numeric columns
+func columnStates(conf YamlColumnConfig) ([]string, error) {
+	var states []string
+
+	switch conf.Type {
+	case "":
+		if len(conf.Values) > 0 {
+			return nil, errors.New("values require a bool or enum column")
+		}
+		return nil, nil
+	case "bool":
+		states = []string{"false", "true"}
+		if len(conf.Values) > 0 {
+			states = conf.Values
+		}
+		if len(states) != 2 {
+			return nil, errors.New("bool columns must have two values")
+		}
+	case "enum":
+		states = conf.Values
+		if len(states) < 1 {
+			return nil, errors.New("enum columns must have values")
+		}
+		if len(states) > downsampling.MaxStates {
+			return nil, fmt.Errorf("enum columns can't have more than %d values", downsampling.MaxStates)
+		}
+	default:
+		return nil, fmt.Errorf("unknown column type %s", conf.Type)
+	}
+
+	// labels must be valid line protocol values and are written as is in text query results
+	for i, label := range states {
+		if !lineprotocol.IsValue(label) || label == "null" {
+			return nil, fmt.Errorf("invalid state %q, labels may contain letters, digits and .-+_", label)
+		}
+		if _, err := strconv.ParseInt(label, 10, 64); err == nil {
+			return nil, fmt.Errorf("state %s can't be a number", label)
+		}
+		for _, other := range states[:i] {
+			if label == other {
+				return nil, fmt.Errorf("duplicate state %s", label)
+			}
+		}
+	}
+
+	return states, nil
+}
+
 // OpenSeries opens series from file
 func OpenSeries(seriespath string) (Series, error) {
 	// load config file
@@ -236,6 +435,111 @@ func OpenSeries(seriespath string) (Series, error) {
 		return Series{}, err
 	}
 
+	s, err := NewSeries(seriespath, conf)
+
+	if err != nil {
+		return Series{}, err
+	}
+
+	schemas, err := LoadSchemas(seriespath)
+
+	if err != nil {
+		return Series{}, err
+	}
+
+	added, err := s.useSchemas(schemas)
+
+	if err != nil {
+		return Series{}, err
+	}
+
+	if added {
+		if err := writeSchemas(seriespath, s.Schemas); err != nil {
+			return Series{}, err
+		}
+		logrus.WithFields(logrus.Fields{"series": s.Tags, "version": s.Buckets[0].Schema}).Info("recorded new schema version")
+	}
+
+	for i := range s.Buckets {
+		if err := s.Buckets[i].open(); err != nil {
+			return Series{}, err
+		}
+	}
+
+	for i := range s.Buckets {
+		// reusing blocks only saves space, failure is not fatal
+		if err := s.Buckets[i].reuseLastBlock(s.ReuseMax); err != nil {
+			logrus.WithError(err).WithField("path", s.Buckets[i].Path).Warning("could not reuse last block")
+		}
+	}
+
+	if conf.Wal != nil {
+		if err := s.openLog(*conf.Wal); err != nil {
+			return Series{}, err
+		}
+	}
+
+	for i := range s.Buckets {
+		if err := s.Buckets[i].DownsampleStartup(); err != nil {
+			return Series{}, err
+		}
+	}
+
+	// points that were queued for a backfill when the series was closed
+	if len(s.backfill) > 0 {
+		if _, err := s.RunBackfill(); err != nil {
+			return Series{}, err
+		}
+	}
+
+	return s, nil
+}
+
+// OpenSeriesReadOnly opens a series without modifying its directory, e.g. to export its points
+// data files are not repaired, the write-ahead log is ignored and no points are downsampled
+// points must not be inserted into the series
+func OpenSeriesReadOnly(seriespath string) (Series, error) {
+	conf, err := LoadSeriesYamlConfig(seriespath)
+
+	if err != nil {
+		return Series{}, err
+	}
+
+	s, err := NewSeries(seriespath, conf)
+
+	if err != nil {
+		return Series{}, err
+	}
+
+	schemas, err := LoadSchemas(seriespath)
+
+	if err != nil {
+		return Series{}, err
+	}
+
+	// a changed config is only recorded as new schema version when the series is opened
+	if _, err := s.useSchemas(schemas); err != nil {
+		return Series{}, err
+	}
+
+	for i := range s.Buckets {
+		if err := s.Buckets[i].loadFiles(true); err != nil {
+			return Series{}, err
+		}
+
+		if err := s.Buckets[i].checkTimeLast(); err != nil {
+			return Series{}, err
+		}
+	}
+
+	return s, nil
+}
+
+// NewSeries creates a series and its buckets from a configuration
+// data files are not accessed, the buckets must be opened before use
+func NewSeries(seriespath string, conf YamlSeriesConfig) (Series, error) {
+	var err error
+
 	// create series struct
 	s := Series{
 		FlushCount:      conf.FlushCount,
@@ -252,6 +556,8 @@ func OpenSeries(seriespath string) (Series, error) {
 
 		Path: seriespath,
 
+		config: conf,
+
 		PrimaryCount:   1,
 		SecondaryCount: 2,
 	}
@@ -297,7 +603,11 @@ func OpenSeries(seriespath string) (Series, error) {
 					Column:   &s.Columns[indexColumn],
 					Function: downsampling.AggregatorList[indexAggregator],
 				}
-				transformersSecondary = append(transformersSecondary, c.Transformer)
+				if downsampling.CountsPoints(downsampling.AggregatorList[indexAggregator]) {
+					transformersSecondary = append(transformersSecondary, encoding.CountTransformer)
+				} else {
+					transformersSecondary = append(transformersSecondary, c.Transformer)
+				}
 			}
 		}
 		transformersPrimary = append(transformersPrimary, c.Transformer)
@@ -309,12 +619,9 @@ func OpenSeries(seriespath string) (Series, error) {
 	for i, bc := range conf.Buckets {
 		timeStep *= int64(bc.Factor)
 
-		s.Buckets[i], err = OpenBucket(s.Path, timeStep, conf.PointsFile)
-
-		if err != nil {
-			return Series{}, err
-		}
+		s.Buckets[i] = newBucket(s.Path, timeStep, conf.PointsFile, int64(conf.BlockSize))
 
+		s.Buckets[i].Retention = int64(time.Duration(bc.Retention) / time.Second)
 		s.Buckets[i].DownSampleColumns = downsampleColumns
 		if i == 0 {
 			s.Buckets[i].First = true
@@ -332,13 +639,95 @@ func OpenSeries(seriespath string) (Series, error) {
 		}
 	}
 
-	for i := range s.Buckets {
-		if err := s.Buckets[i].DownsampleStartup(); err != nil {
-			return Series{}, err
+	return s, nil
+}
+
+// openLog replays the points in the write-ahead log into the primary bucket
+// and starts a new log that contains only these points
+func (s *Series) openLog(conf YamlWalConfig) error {
+	sync, err := storage.ParseSyncPolicy(conf.Sync)
+	if err != nil {
+		return err
+	}
+
+	log := storage.NewWriteAheadLog(path.Join(s.Path, "wal"), s.PrimaryCount, sync, conf.Interval)
+	log.Schema = s.Buckets[0].Schema
+
+	n, err := log.Replay(func(schema int, p storage.Point) error {
+		// the columns of the series changed since the point was logged
+		if !s.Buckets[0].currentLayout(schema) {
+			l, err := s.Buckets[0].layout(schema)
+			if err != nil {
+				return err
+			}
+			p = l.mapPoint(p)
+		}
+
+		// queued backfill points, or points that were written to disk before the log was reset,
+		// backfilling those again doesn't change the data files
+		if p.Values[0] <= s.Buckets[0].LastTimeOnDisk {
+			s.backfill = append(s.backfill, p)
+			return nil
 		}
+
+		return s.InsertPoint(p)
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not replay write-ahead log of %s: %v", s.Path, err)
 	}
 
-	return s, nil
+	if n > 0 {
+		logrus.WithFields(logrus.Fields{"series": s.Tags, "points": n}).Info("replayed write-ahead log")
+	}
+
+	if err := log.Reset(s.logBuffer()); err != nil {
+		return err
+	}
+
+	s.Log = log
+
+	return nil
+}
+
+// resetLog removes all points from the write-ahead log that were written to disk
+func (s *Series) resetLog() {
+	if s.Log == nil {
+		return
+	}
+
+	s.Buckets[0].Mux.RLock()
+	defer s.Buckets[0].Mux.RUnlock()
+
+	if err := s.Log.Reset(s.logBuffer()); err != nil {
+		logrus.WithError(err).WithField("series", s.Tags).Error("could not reset write-ahead log")
+	}
+}
+
+// logBuffer returns the points that must be kept in the write-ahead log, the primary buffer and the queued backfill points
+func (s *Series) logBuffer() storage.PointBuffer {
+	if len(s.backfill) == 0 {
+		return s.Buckets[0].Buffer
+	}
+
+	buffer := storage.NewPointBuffer(s.PrimaryCount)
+	for _, p := range s.backfill {
+		buffer.AppendPoint(p)
+	}
+	buffer.AppendBuffer(s.Buckets[0].Buffer)
+
+	return buffer
+}
+
+// SyncLog syncs the write-ahead log if it is due according to the sync policy
+func (s *Series) SyncLog() {
+	if s.Log == nil {
+		return
+	}
+
+	if err := s.Log.SyncDue(); err != nil {
+		logrus.WithError(err).WithField("series", s.Tags).Error("could not sync write-ahead log")
+	}
 }
 
 // CheckFlush checks if the series is due for a regular flush
@@ -371,7 +760,12 @@ func (s *Series) Flush() {
 	timeLimit := int64(math.MaxInt64)
 	for i := range s.Buckets {
 		// todo: may also force flush first bucket after flushinterval
+		flushed := false
 		for s.Buckets[i].Flush(timeLimit, false) {
+			flushed = true
+		}
+		if i == 0 && flushed {
+			s.resetLog()
 		}
 		timeLimit = s.Buckets[i].LastTimeOnDisk
 	}
@@ -383,12 +777,15 @@ func (s *Series) FlushAll() {
 	for i := range s.Buckets {
 		for s.Buckets[i].Flush(timeLimit, i == 0) {
 		}
+		if i == 0 {
+			s.resetLog()
+		}
 		timeLimit = s.Buckets[i].LastTimeOnDisk
 	}
 }
 
-func (s *Series) Query(columns []QueryColumn, timeRange TimeRange, timeStep int64) *Query {
-	// find first bucket with timeStep smaller or equal to query
+// QueryBucket returns the bucket Query reads for timeStep, the last bucket with a time step smaller or equal to timeStep
+func (s *Series) QueryBucket(timeStep int64) *Bucket {
 	i := len(s.Buckets) - 1
 	for i > 0 {
 		if s.Buckets[i].TimeStep <= timeStep {
@@ -397,5 +794,11 @@ func (s *Series) Query(columns []QueryColumn, timeRange TimeRange, timeStep int6
 		i--
 	}
 
-	return s.Buckets[i].Query(columns, timeRange, timeStep)
+	return &s.Buckets[i]
+}
+
+// Query reads the bucket returned by QueryBucket, the data files are listed when the query is created,
+// so callers on other goroutines must hold the bucket's read lock before, else retention may remove the files
+func (s *Series) Query(columns []QueryColumn, timeRange TimeRange, timeStep int64) *Query {
+	return s.QueryBucket(timeStep).Query(columns, timeRange, timeStep)
 }
@@ -0,0 +1,261 @@
+package minitsdb
+
+import (
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb/downsampling"
+	"github.com/martin2250/minitsdb/minitsdb/storage"
+	"github.com/martin2250/minitsdb/minitsdb/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSeriesConfig has a primary bucket with files of 1000 points and a downsampled bucket with a factor of 10
+const testSeriesConfig = `
+tags:
+  name: test
+flushinterval: 10s
+flushcount: 50
+forceflushcount: 100
+pointsfile: 1000
+buckets:
+  - factor: 1
+  - factor: 10
+columns:
+  - decimals: 0
+    tags:
+      name: a
+  - decimals: 0
+    tags:
+      name: b
+`
+
+// openTestSeries creates a series with config in a temporary directory, the caller must remove the directory
+func openTestSeries(t *testing.T, config string) (Series, string) {
+	dir, err := ioutil.TempDir("", "series")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), []byte(config), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	s, err := OpenSeries(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, dir
+}
+
+// insertTestPoints inserts points from start to end (exclusive) with the values time and 2 * time
+func insertTestPoints(t *testing.T, s *Series, start, end int64) {
+	for i := start; i < end; i++ {
+		if err := s.InsertPoint(storage.Point{Values: []int64{i, i, 2 * i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// queryTestBucket returns all points of bucket i at its own time step, with the stored values of all columns
+func queryTestBucket(t *testing.T, s *Series, i int) storage.PointBuffer {
+	b := &s.Buckets[i]
+
+	columns := b.DownSampleColumns
+	if b.First {
+		columns = make([]QueryColumn, len(s.Columns))
+		for j := range s.Columns {
+			columns[j] = QueryColumn{Column: &s.Columns[j], Function: downsampling.First}
+		}
+	}
+
+	query := b.Query(columns, types.TimeRange{Start: 0, End: 1 << 40}, b.TimeStep)
+	result := storage.NewPointBuffer(len(columns) + 1)
+
+	for {
+		buffer, err := query.Next()
+		if err == io.EOF {
+			return result
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		result.AppendBuffer(buffer)
+	}
+}
+
+func TestOpenSeriesReadOnly(t *testing.T) {
+	s, dir := openTestSeries(t, testSeriesConfig+"wal:\n  sync: never\n")
+	defer os.RemoveAll(dir)
+
+	insertTestPoints(t, &s, 0, 2500)
+	s.Flush()
+	insertTestPoints(t, &s, 2500, 2600)
+	s.Log.Close()
+
+	// the changed config is not recorded as a new schema version
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), []byte(testSeriesConfig+"  - tags:\n      name: c\nwal:\n  sync: never\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := listTestFiles(t, dir)
+
+	r, err := OpenSeriesReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Log != nil || r.Buckets[0].LastTimeOnDisk != s.Buckets[0].LastTimeOnDisk || r.Buckets[0].Buffer.Len() != 0 {
+		t.Errorf("unexpected state of read-only series, last time %d", r.Buckets[0].LastTimeOnDisk)
+	}
+
+	if after := listTestFiles(t, dir); !reflect.DeepEqual(before, after) {
+		t.Errorf("read-only open modified the series directory:\n%v\n%v", before, after)
+	}
+}
+
+// listTestFiles returns the sizes and modification times of all files in dir and its subdirectories
+func listTestFiles(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[p] = fmt.Sprint(info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestStateColumnConfig(t *testing.T) {
+	tests := []struct {
+		column string
+		ok     bool
+	}{
+		{"type: enum\n    values: [off, low, high]\n    aggregations: [last, fraction]", true},
+		{"type: bool\n    aggregations: [duration1]", true},
+		{"type: bool\n    aggregations: [duration2]", false},
+		{"aggregations: [mean, fraction]", false},
+		{"type: enum\n    values: [heat-1, heat.2, Heat_3]", true},
+		{"type: enum\n    values: [heat/cool, heat]", false},
+		{"type: bool\n    values: [null, set]", false},
+		{"type: enum\n    values: [a, b, c, d, e, f, g, h, i, j, k, l, m, n, o, p, q]", false},
+	}
+
+	for _, tt := range tests {
+		config := testSeriesConfig + "  - tags:\n      name: c\n    " + tt.column + "\n"
+
+		conf, err := parseTestConfig(t, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = NewSeries("", conf)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: unexpected error %v", tt.column, err)
+		}
+	}
+}
+
+// parseTestConfig parses a series config from a temporary directory
+func parseTestConfig(t *testing.T, config string) (YamlSeriesConfig, error) {
+	dir, err := ioutil.TempDir("", "series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return LoadSeriesYamlConfig(dir)
+}
+
+func TestReuseLastBlock(t *testing.T) {
+	config := testSeriesConfig + "reusemax: 4096\nwal:\n  sync: never\n"
+
+	s, dir := openTestSeries(t, config)
+	defer os.RemoveAll(dir)
+
+	reference, dirReference := openTestSeries(t, testSeriesConfig)
+	defer os.RemoveAll(dirReference)
+
+	insertTestPoints(t, &reference, 0, 1500)
+	reference.FlushAll()
+
+	// the forced flush leaves a partially filled last block
+	insertTestPoints(t, &s, 0, 1500)
+	s.FlushAll()
+	s.Log.Close()
+
+	df := s.Buckets[0].DataFiles[1]
+	index, err := df.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := index[len(index)-1]
+
+	s, err = OpenSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Log.Close()
+
+	b := &s.Buckets[0]
+
+	if !b.OverwriteLast || b.LastTimeOnDisk != last.TimeFirst-1 {
+		t.Fatalf("last block not reused, last time on disk %d, first time of the block %d", b.LastTimeOnDisk, last.TimeFirst)
+	}
+
+	if b.Buffer.Len() != int(last.NumPoints) || b.Buffer.Values[0][0] != last.TimeFirst {
+		t.Errorf("buffer does not hold the points of the last block, %d points", b.Buffer.Len())
+	}
+
+	// queries don't return the reused points twice
+	compareTestSeries(t, &s, &reference)
+
+	insertTestPoints(t, &s, 1500, 1600)
+	s.FlushAll()
+
+	insertTestPoints(t, &reference, 1500, 1600)
+	reference.FlushAll()
+
+	if b.OverwriteLast {
+		t.Error("OverwriteLast still set after flushing")
+	}
+
+	if b.DataFiles[1].Blocks != df.Blocks {
+		t.Errorf("last block was not overwritten, %d blocks before and %d after", df.Blocks, b.DataFiles[1].Blocks)
+	}
+
+	compareTestSeries(t, &s, &reference)
+
+	// blocks using more than reusemax bytes are left on disk
+	s.Log.Close()
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), []byte(testSeriesConfig+"reusemax: 0\nwal:\n  sync: never\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Log.Close()
+
+	if s.Buckets[0].OverwriteLast || s.Buckets[0].Buffer.Len() != 0 {
+		t.Errorf("last block reused with reusemax 0")
+	}
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/martin2250/minitsdb/util"
+	"io"
+	"os"
+)
+
+// compressedMagic starts compressed data files, the first byte can't be mistaken for a block version
+const compressedMagic = "MDBZ"
+
+// compressedVersion is the version of the compressed container written by CompressDataFile
+const compressedVersion = 1
+
+// compressedHeaderRaw is the header of compressed data files
+// it is followed by Blocks+1 offsets (relative to the start of the file) and a gzip frame for every block,
+// the frame of block n spans from offset n to offset n+1
+type compressedHeaderRaw struct {
+	Magic     [4]byte
+	Version   uint16
+	Reserved  uint16
+	BlockSize uint32
+	Blocks    uint32
+}
+
+// compressedHeaderSize is the size of compressedHeaderRaw in bytes
+const compressedHeaderSize = 16
+
+// errCompressed indicates that a block was written to a compressed data file
+var errCompressed = errors.New("data file is compressed")
+
+// readCompressedHeader reads the header of a compressed data file
+// returns false if the file is not compressed
+func readCompressedHeader(r io.ReaderAt) (compressedHeaderRaw, bool, error) {
+	var header compressedHeaderRaw
+
+	err := binary.Read(io.NewSectionReader(r, 0, compressedHeaderSize), binary.LittleEndian, &header)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return header, false, nil
+	} else if err != nil {
+		return header, false, err
+	}
+
+	if string(header.Magic[:]) != compressedMagic {
+		return header, false, nil
+	}
+
+	if header.Version != compressedVersion {
+		return header, true, fmt.Errorf("unknown compressed data file version %d", header.Version)
+	}
+
+	return header, true, nil
+}
+
+// IsCompressed checks if a data file was packed by CompressDataFile
+func IsCompressed(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	_, compressed, err := readCompressedHeader(file)
+	return compressed, err
+}
+
+// readFrameOffsets reads the offsets of the frames of blocks n to n+count-1 and the offset following them
+func readFrameOffsets(r io.ReaderAt, n int64, count int64) ([]int64, error) {
+	raw := make([]uint64, count+1)
+
+	section := io.NewSectionReader(r, compressedHeaderSize+8*n, 8*(count+1))
+	if err := binary.Read(section, binary.LittleEndian, raw); err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int64, len(raw))
+	for i, o := range raw {
+		offsets[i] = int64(o)
+		if i > 0 && offsets[i] < offsets[i-1] {
+			return nil, errors.New("frame offsets are not in order")
+		}
+	}
+
+	return offsets, nil
+}
+
+// readFrame decompresses the block stored between two offsets
+func readFrame(r io.ReaderAt, start, end int64, blockSize int64) (bytes.Buffer, error) {
+	gz, err := gzip.NewReader(io.NewSectionReader(r, start, end-start))
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	defer gz.Close()
+
+	buf, err := util.ReadBlock(gz, blockSize)
+
+	// a frame holding less than a block is damaged, not the end of the file
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return buf, err
+}
+
+// compressedReader reads the blocks of a compressed data file in order
+type compressedReader struct {
+	file      io.ReaderAt
+	offsets   []int64
+	blockSize int64
+	// next is the index of the next frame to decompress
+	next  int
+	block bytes.Buffer
+}
+
+func newCompressedReader(file io.ReaderAt, blockSize int64, blocks int64) (*compressedReader, error) {
+	offsets, err := readFrameOffsets(file, 0, blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressedReader{
+		file:      file,
+		offsets:   offsets,
+		blockSize: blockSize,
+	}, nil
+}
+
+func (r *compressedReader) Read(p []byte) (int, error) {
+	if r.block.Len() == 0 {
+		if r.next >= len(r.offsets)-1 {
+			return 0, io.EOF
+		}
+
+		var err error
+		r.block, err = readFrame(r.file, r.offsets[r.next], r.offsets[r.next+1], r.blockSize)
+		if err != nil {
+			return 0, err
+		}
+		r.next++
+	}
+
+	return r.block.Read(p)
+}
+
+// CompressDataFile packs the blocks of an uncompressed data file into a temporary file next to it,
+// every block is compressed separately, so single blocks can still be read without decompressing the entire file.
+// replace must rename the temporary file to the path of the data file, if it returns an error the temporary file is removed
+// returns the size of the compressed file
+func CompressDataFile(df *DataFile, replace func() error) (int64, error) {
+	if df.Compressed {
+		return 0, errCompressed
+	}
+
+	src, err := os.Open(df.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	var frames bytes.Buffer
+	offsets := make([]uint64, 0, df.Blocks+1)
+	start := uint64(compressedHeaderSize + 8*(df.Blocks+1))
+
+	gz, err := gzip.NewWriterLevel(&frames, gzip.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+
+	for n := int64(0); n < df.Blocks; n++ {
+		block, err := util.ReadBlock(src, df.BlockSize)
+		if err != nil {
+			return 0, err
+		}
+
+		offsets = append(offsets, start+uint64(frames.Len()))
+
+		gz.Reset(&frames)
+		if _, err := block.WriteTo(gz); err != nil {
+			return 0, err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	offsets = append(offsets, start+uint64(frames.Len()))
+
+	header := compressedHeaderRaw{
+		Version:   compressedVersion,
+		BlockSize: uint32(df.BlockSize),
+		Blocks:    uint32(df.Blocks),
+	}
+	copy(header.Magic[:], compressedMagic)
+
+	pathTemp := df.Path + ".tmp"
+
+	dst, err := os.OpenFile(pathTemp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Write(dst, binary.LittleEndian, header)
+
+	if err == nil {
+		err = binary.Write(dst, binary.LittleEndian, offsets)
+	}
+
+	if err == nil {
+		_, err = frames.WriteTo(dst)
+	}
+
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+
+	if err == nil {
+		err = replace()
+	}
+
+	if err != nil {
+		os.Remove(pathTemp)
+		return 0, err
+	}
+
+	return int64(offsets[len(offsets)-1]), nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompressDataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	df := NewDataFile(dir, 0, 1000, encoding.DefaultBlockSize)
+
+	writeTestBlock(t, df, 0)
+	writeTestBlock(t, df, 10)
+	writeTestBlock(t, df, 20)
+
+	size, err := CompressDataFile(df, func() error {
+		return os.Rename(df.Path+".tmp", df.Path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(df.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != size || size >= 3*df.BlockSize {
+		t.Errorf("compressed file has %d bytes, expected %d", info.Size(), size)
+	}
+
+	opened, err := OpenDataFile(df.Path, info, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opened.Compressed || opened.Blocks != 3 || opened.BlockSize != df.BlockSize {
+		t.Fatalf("opened compressed file as %+v", opened)
+	}
+
+	// single blocks
+	buf, err := opened.ReadBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := encoding.NewDecoder()
+	d.SetReader(&buf)
+
+	if header, err := d.DecodeHeader(); err != nil || header.TimeFirst != 10 {
+		t.Errorf("block 1 starts at %d (%v), expected 10", header.TimeFirst, err)
+	}
+
+	// all blocks in order
+	reader := NewFileDecoder([]*DataFile{&opened}, []bool{true})
+	defer reader.Close()
+
+	for _, timeStart := range []int64{0, 10, 20} {
+		values, err := reader.DecodeBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.decoder.Header.TimeFirst != timeStart || len(values[0]) != 10 {
+			t.Errorf("decoded block starting at %d, expected %d", reader.decoder.Header.TimeFirst, timeStart)
+		}
+	}
+
+	if _, err := reader.DecodeHeader(); err != io.EOF {
+		t.Errorf("expected EOF after last block, got %v", err)
+	}
+
+	if err := opened.WriteBlock(buf, false); err == nil {
+		t.Error("wrote block to compressed file")
+	}
+
+	// removing blocks decompresses the file
+	if _, err := RemoveBlocks(df.Path, []int64{0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err = os.Stat(df.Path); err != nil || info.Size() != 2*df.BlockSize {
+		t.Errorf("file with removed blocks has wrong size")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"sync"
 )
 
@@ -22,6 +23,12 @@ type DataFile struct {
 	// TimeStart and TimeEnd hold the time range stored in this file
 	TimeStart int64
 	TimeEnd   int64
+	// BlockSize is the size of the blocks in the file in bytes
+	BlockSize int64
+	// Compressed is true if the blocks were packed by CompressDataFile, no blocks can be written to the file
+	Compressed bool
+	// index caches the index of the file, shared by all copies of the DataFile
+	index *blockIndex
 }
 
 // ReadBlock reads the n-th block of a file
@@ -34,29 +41,58 @@ func (f *DataFile) ReadBlock(n int64) (bytes.Buffer, error) {
 
 	defer file.Close()
 
-	if _, err = file.Seek(n*encoding.BlockSize, io.SeekStart); err != nil {
+	if f.Compressed {
+		offsets, err := readFrameOffsets(file, n, 1)
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+		return readFrame(file, offsets[0], offsets[1], f.BlockSize)
+	}
+
+	if _, err = file.Seek(n*f.BlockSize, io.SeekStart); err != nil {
 		return bytes.Buffer{}, err
 	}
 
-	buf, err := util.ReadBlock(file)
+	buf, err := util.ReadBlock(file, f.BlockSize)
 
 	return buf, err
 }
 
 // Write a block to the data file,
+// if overwrite is set, the last block of the file is replaced
 func (f *DataFile) WriteBlock(buffer bytes.Buffer, overwrite bool) error {
 	var file *os.File
 	var err error
 
-	if buffer.Len() != encoding.BlockSize {
+	if int64(buffer.Len()) != f.BlockSize {
 		return errors.New("buffer length does not equal block size")
 	}
 
+	if f.Compressed {
+		return errCompressed
+	}
+
 	// can't overwrite when file has no blocks
 	if f.Blocks == 0 {
 		overwrite = false
 	}
 
+	// don't wear out the disk rewriting a block with identical content
+	if overwrite {
+		last, err := f.ReadBlock(f.Blocks - 1)
+		if err == nil && bytes.Equal(last.Bytes(), buffer.Bytes()) {
+			return nil
+		}
+	}
+
+	// the index is only updated if it matches the file before the write
+	before, _ := statKey(f.Path)
+
+	block := f.Blocks
+	if overwrite {
+		block--
+	}
+
 	// only use seek when overwriting
 	if overwrite {
 		file, err = os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY, 0644)
@@ -71,7 +107,7 @@ func (f *DataFile) WriteBlock(buffer bytes.Buffer, overwrite bool) error {
 	defer file.Close()
 
 	if overwrite {
-		_, err = file.Seek((f.Blocks-1)*encoding.BlockSize, io.SeekStart)
+		_, err = file.Seek(block*f.BlockSize, io.SeekStart)
 		if err != nil {
 			return err
 		}
@@ -80,7 +116,7 @@ func (f *DataFile) WriteBlock(buffer bytes.Buffer, overwrite bool) error {
 	n, err := file.Write(buffer.Bytes())
 
 	if err != nil {
-		if n%4096 != 0 {
+		if int64(n)%f.BlockSize != 0 {
 			log.Panicf("ERROR: wrote incomplete block to %s (%d bytes) because of %s", f.Path, n, err.Error())
 		}
 		return err
@@ -90,6 +126,8 @@ func (f *DataFile) WriteBlock(buffer bytes.Buffer, overwrite bool) error {
 		f.Blocks++
 	}
 
+	f.indexBlock(block, buffer.Bytes(), before)
+
 	return nil
 }
 
@@ -113,13 +151,87 @@ func (r *DataFileReader) Close() error {
 	return r.f.Close()
 }
 
-func NewDataFile(basePath string, timeStart int64, timeRange int64) *DataFile {
+func NewDataFile(basePath string, timeStart int64, timeRange int64, blockSize int64) *DataFile {
 	return &DataFile{
 		Path:      path.Join(basePath, fmt.Sprintf("%011d.mdb", timeStart)),
 		Blocks:    0,
 		TimeStart: timeStart,
 		TimeEnd:   timeStart + timeRange - 1,
+		BlockSize: blockSize,
+		index:     &blockIndex{},
+	}
+}
+
+// FileBlockSize reads the block size of a data file from the header of its first block
+// or the header of compressed data files
+func FileBlockSize(filePath string) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header, compressed, err := readCompressedHeader(file)
+	if err != nil {
+		return 0, err
+	}
+
+	if compressed {
+		return int64(header.BlockSize), encoding.CheckBlockSize(int(header.BlockSize))
+	}
+
+	size, err := encoding.ReadBlockSize(file)
+	return int64(size), err
+}
+
+// readCompressedLayout fills in the block size and number of blocks of a compressed data file
+// returns false if the file is not compressed
+func (f *DataFile) readCompressedLayout(size int64) (bool, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header, compressed, err := readCompressedHeader(file)
+	if err != nil || !compressed {
+		return compressed, err
+	}
+
+	if err := encoding.CheckBlockSize(int(header.BlockSize)); err != nil {
+		return true, err
+	}
+
+	f.Compressed = true
+	f.BlockSize = int64(header.BlockSize)
+	f.Blocks = int64(header.Blocks)
+
+	// the last offset marks the end of the last frame
+	offsets, err := readFrameOffsets(file, f.Blocks, 0)
+	if err != nil {
+		return true, err
+	}
+
+	if offsets[0] != size {
+		return true, fmt.Errorf("compressed data file ends at %d, expected %d", size, offsets[0])
+	}
+
+	return true, nil
+}
+
+// ParseDataFileName reads the start time from the name of a data file
+// returns false if the name does not match the format of data files
+func ParseDataFileName(name string) (int64, bool) {
+	if !strings.HasSuffix(name, ".mdb") {
+		return 0, false
+	}
+
+	var timeStart int64
+	if n, err := fmt.Sscanf(name, "%d.mdb", &timeStart); err != nil || n != 1 {
+		return 0, false
 	}
+
+	return timeStart, true
 }
 
 // OpenDataFile loads an existing data file
@@ -128,6 +240,7 @@ func OpenDataFile(filePath string, info os.FileInfo, timeRange int64) (DataFile,
 	df := DataFile{
 		Path:   filePath,
 		Blocks: 0,
+		index:  &blockIndex{},
 	}
 
 	// check if info is file
@@ -136,7 +249,8 @@ func OpenDataFile(filePath string, info os.FileInfo, timeRange int64) (DataFile,
 	}
 
 	// check if file name matches format and read start time
-	if n, err := fmt.Sscanf(info.Name(), "%d.mdb", &df.TimeStart); err != nil || n != 1 {
+	var ok bool
+	if df.TimeStart, ok = ParseDataFileName(info.Name()); !ok {
 		return DataFile{}, fmt.Errorf("file %s is not a data file", filePath)
 	}
 
@@ -150,15 +264,32 @@ func OpenDataFile(filePath string, info os.FileInfo, timeRange int64) (DataFile,
 	// read size of file and calculate number of blocks
 	size := info.Size()
 
-	if size%encoding.BlockSize != 0 {
-		return DataFile{}, fmt.Errorf("size %d of %s is not a multiple of block size", size, filePath)
+	if size == 0 {
+		return DataFile{}, fmt.Errorf("file %s is empty", filePath)
 	}
 
-	df.Blocks = size / encoding.BlockSize
+	compressed, err := df.readCompressedLayout(size)
 
-	if df.Blocks == 0 {
-		return DataFile{}, fmt.Errorf("file %s is empty", filePath)
+	if err != nil {
+		return DataFile{}, fmt.Errorf("invalid compressed data file %s: %v", filePath, err)
 	}
 
+	if compressed {
+		if df.Blocks == 0 {
+			return DataFile{}, fmt.Errorf("file %s is empty", filePath)
+		}
+		return df, nil
+	}
+
+	if df.BlockSize, err = FileBlockSize(filePath); err != nil {
+		return DataFile{}, fmt.Errorf("could not read block size of %s: %v", filePath, err)
+	}
+
+	if size%df.BlockSize != 0 {
+		return DataFile{}, fmt.Errorf("size %d of %s is not a multiple of block size %d", size, filePath, df.BlockSize)
+	}
+
+	df.Blocks = size / df.BlockSize
+
 	return df, nil
 }
@@ -0,0 +1,483 @@
+package encoding
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/jwilder/encoding/simple8b"
+)
+
+// Codec packs the transformed values of a column into the words of a block
+type Codec uint8
+
+const (
+	// CodecSimple8b packs multiple small values into each word
+	CodecSimple8b Codec = iota
+	// CodecWindow stores only the bits between the leading and trailing zeros of each value,
+	// as proposed for XORed floats in Facebook's Gorilla paper. Values may span word boundaries
+	//   '0': value is zero
+	//   '10': the bits fit into the window of the previous value and follow
+	//   '11': 6 bits number of leading zeros, 6 bits window length (0 means 64), then the bits
+	CodecWindow
+	// CodecFrameOfReference stores the smallest value in the first word, followed by 7 bits width and
+	// the difference of each value to the smallest value with the same number of bits
+	CodecFrameOfReference
+	// CodecRunLength stores runs of equal values, one word per run with the value in the upper 40 bits
+	// and the length of the run minus one in the lower 24 bits
+	CodecRunLength
+	codecCount
+)
+
+// CodecError indicates that a block uses an unknown codec
+type CodecError struct {
+	Codec Codec
+}
+
+func (e CodecError) Error() string {
+	return fmt.Sprintf("unknown codec %d", e.Codec)
+}
+
+// columnEncoder calculates the size of a column for a growing number of values and encodes it
+type columnEncoder interface {
+	// size returns the number of words required to store the first n values, n must not decrease between calls
+	size(n int) (int, error)
+	// encode returns the words that store the first n values, n must not exceed the last n passed to size
+	encode(n int) []uint64
+}
+
+func newColumnEncoder(c Codec, values []uint64) (columnEncoder, error) {
+	switch c {
+	case CodecSimple8b:
+		return &prefixEncoder{next: &simple8bEncoder{values: values, encoded: make([]uint64, 0, 64)}}, nil
+	case CodecWindow:
+		return &prefixEncoder{next: &windowEncoder{values: values, w: bitWriter{words: make([]uint64, 0, 64)}}}, nil
+	case CodecFrameOfReference:
+		return &forEncoder{values: values}, nil
+	case CodecRunLength:
+		return &runLengthEncoder{values: values}, nil
+	}
+	return nil, CodecError{Codec: c}
+}
+
+// wordEncoder encodes the values of a column one word at a time
+type wordEncoder interface {
+	// next encodes another word, returns the number of values contained entirely in all words encoded so far
+	next() (int, error)
+	// words returns the words encoded so far
+	words() []uint64
+}
+
+// prefixEncoder implements columnEncoder for codecs whose words for n values are a prefix of the words for more values
+type prefixEncoder struct {
+	next wordEncoder
+	// counts holds the number of complete values after each word
+	counts []int
+}
+
+func (e *prefixEncoder) size(n int) (int, error) {
+	for len(e.counts) == 0 || e.counts[len(e.counts)-1] < n {
+		count, err := e.next.next()
+		if err != nil {
+			return 0, err
+		}
+		e.counts = append(e.counts, count)
+	}
+	return sort.SearchInts(e.counts, n) + 1, nil
+}
+
+func (e *prefixEncoder) encode(n int) []uint64 {
+	words, _ := e.size(n)
+	return e.next.words()[:words]
+}
+
+type simple8bEncoder struct {
+	values  []uint64
+	count   int
+	encoded []uint64
+}
+
+func (e *simple8bEncoder) next() (int, error) {
+	word, count, err := simple8b.Encode(e.values[e.count:])
+	if err != nil {
+		return e.count, err
+	}
+	e.encoded = append(e.encoded, word)
+	e.count += count
+	return e.count, nil
+}
+
+func (e *simple8bEncoder) words() []uint64 {
+	return e.encoded
+}
+
+// bitWriter appends bits to a list of words, starting at the most significant bit
+type bitWriter struct {
+	words []uint64
+	bits  int
+}
+
+// write appends the n least significant bits of v
+func (w *bitWriter) write(v uint64, n int) {
+	for n > 0 {
+		free := 64 - w.bits%64
+		if free == 64 {
+			w.words = append(w.words, 0)
+		}
+
+		c := n
+		if c > free {
+			c = free
+		}
+
+		chunk := (v >> uint(n-c)) & (1<<uint(c) - 1)
+		w.words[len(w.words)-1] |= chunk << uint(free-c)
+
+		w.bits += c
+		n -= c
+	}
+}
+
+type windowEncoder struct {
+	values []uint64
+	pos    int
+	w      bitWriter
+	// number of words requested through next
+	count int
+	// window of the previous value, length is zero if no window was written yet
+	leading, length int
+}
+
+func (e *windowEncoder) writeValue(v uint64) {
+	if v == 0 {
+		e.w.write(0, 1)
+		return
+	}
+
+	leading := bits.LeadingZeros64(v)
+	trailing := bits.TrailingZeros64(v)
+
+	if e.length > 0 && leading >= e.leading && 64-trailing <= e.leading+e.length {
+		e.w.write(2, 2)
+		e.w.write(v>>uint(64-e.leading-e.length), e.length)
+		return
+	}
+
+	e.leading = leading
+	e.length = 64 - leading - trailing
+
+	e.w.write(3, 2)
+	e.w.write(uint64(e.leading), 6)
+	e.w.write(uint64(e.length%64), 6)
+	e.w.write(v>>uint(trailing), e.length)
+}
+
+func (e *windowEncoder) next() (int, error) {
+	e.count++
+	target := 64 * e.count
+
+	for e.w.bits < target && e.pos < len(e.values) {
+		e.writeValue(e.values[e.pos])
+		e.pos++
+	}
+
+	for len(e.w.words) < e.count {
+		e.w.words = append(e.w.words, 0)
+	}
+
+	// only the last value written can extend past the current word
+	if e.w.bits > target {
+		return e.pos - 1, nil
+	}
+	return e.pos, nil
+}
+
+func (e *windowEncoder) words() []uint64 {
+	return e.w.words
+}
+
+type forEncoder struct {
+	values   []uint64
+	n        int
+	min, max uint64
+}
+
+// forSize returns the number of words used by n values with the given width
+func forSize(n int, width int) int {
+	return 1 + (7+n*width+63)/64
+}
+
+func (e *forEncoder) size(n int) (int, error) {
+	for ; e.n < n; e.n++ {
+		v := e.values[e.n]
+		if e.n == 0 || v < e.min {
+			e.min = v
+		}
+		if e.n == 0 || v > e.max {
+			e.max = v
+		}
+	}
+	return forSize(n, bits.Len64(e.max-e.min)), nil
+}
+
+func (e *forEncoder) encode(n int) []uint64 {
+	min, max := e.values[0], e.values[0]
+	for _, v := range e.values[:n] {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	width := bits.Len64(max - min)
+
+	w := bitWriter{words: make([]uint64, 0, forSize(n, width)-1)}
+	w.write(uint64(width), 7)
+	for _, v := range e.values[:n] {
+		w.write(v-min, width)
+	}
+
+	return append([]uint64{min}, w.words...)
+}
+
+const (
+	runLengthBits = 24
+	runLengthMax  = 1 << runLengthBits
+)
+
+// errRunLengthValue indicates that a value is too large to be stored with CodecRunLength
+var errRunLengthValue = errors.New("value too large for run length encoding")
+
+type runLengthEncoder struct {
+	values []uint64
+	n      int
+	runs   int
+	// length of the current run
+	length int
+}
+
+func (e *runLengthEncoder) size(n int) (int, error) {
+	for ; e.n < n; e.n++ {
+		v := e.values[e.n]
+		if v >= 1<<(64-runLengthBits) {
+			return 0, errRunLengthValue
+		}
+		if e.n == 0 || v != e.values[e.n-1] || e.length == runLengthMax {
+			e.runs++
+			e.length = 0
+		}
+		e.length++
+	}
+	return e.runs, nil
+}
+
+func (e *runLengthEncoder) encode(n int) []uint64 {
+	var words []uint64
+
+	for i := 0; i < n; {
+		length := 1
+		for i+length < n && e.values[i+length] == e.values[i] && length < runLengthMax {
+			length++
+		}
+		words = append(words, e.values[i]<<runLengthBits|uint64(length-1))
+		i += length
+	}
+
+	return words
+}
+
+// decodeColumn decodes n values of a column from the start of words into dst, values are skipped if dst is nil
+// returns the words following the column
+func decodeColumn(c Codec, words []uint64, n int, dst []uint64, buffer *[240]uint64) ([]uint64, error) {
+	switch c {
+	case CodecSimple8b:
+		return decodeSimple8b(words, n, dst, buffer)
+	case CodecWindow:
+		return decodeWindow(words, n, dst)
+	case CodecFrameOfReference:
+		return decodeFrameOfReference(words, n, dst)
+	case CodecRunLength:
+		return decodeRunLength(words, n, dst)
+	}
+	return nil, CodecError{Codec: c}
+}
+
+var errColumnIncomplete = errors.New("column not complete at end of block")
+
+func decodeSimple8b(words []uint64, n int, dst []uint64, buffer *[240]uint64) ([]uint64, error) {
+	var pointsRead int
+	for pointsRead < n {
+		// check if there are words left in this block
+		if len(words) == 0 {
+			return nil, errColumnIncomplete
+		}
+		var encoded uint64
+		encoded, words = words[0], words[1:]
+
+		// skipped columns only need the number of values in each word
+		if dst == nil {
+			c, err := simple8b.Count(encoded)
+			if err != nil {
+				return nil, err
+			}
+			pointsRead += c
+			continue
+		}
+
+		c, err := simple8b.Decode(buffer, encoded)
+		if err != nil {
+			return nil, err
+		}
+		// copy decoded raw values to output, values beyond n are discarded
+		copy(dst[pointsRead:n], buffer[:c])
+		pointsRead += c
+	}
+	return words, nil
+}
+
+// bitReader reads bits from a list of words, starting at the most significant bit
+type bitReader struct {
+	words []uint64
+	bits  int
+}
+
+func (r *bitReader) read(n int) (uint64, error) {
+	if r.bits+n > 64*len(r.words) {
+		return 0, errColumnIncomplete
+	}
+
+	var v uint64
+	for n > 0 {
+		free := 64 - r.bits%64
+
+		c := n
+		if c > free {
+			c = free
+		}
+
+		chunk := (r.words[r.bits/64] >> uint(free-c)) & (1<<uint(c) - 1)
+		v = v<<uint(c) | chunk
+
+		r.bits += c
+		n -= c
+	}
+	return v, nil
+}
+
+func decodeWindow(words []uint64, n int, dst []uint64) ([]uint64, error) {
+	r := bitReader{words: words}
+	var leading, length int
+
+	for i := 0; i < n; i++ {
+		control, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		var v uint64
+
+		if control == 1 {
+			reuse, err := r.read(1)
+			if err != nil {
+				return nil, err
+			}
+
+			if reuse == 0 {
+				if length == 0 {
+					return nil, errors.New("value refers to window before it was defined")
+				}
+			} else {
+				l, err := r.read(6)
+				if err != nil {
+					return nil, err
+				}
+				m, err := r.read(6)
+				if err != nil {
+					return nil, err
+				}
+				leading, length = int(l), int(m)
+				if length == 0 {
+					length = 64
+				}
+				if leading+length > 64 {
+					return nil, errors.New("window exceeds value size")
+				}
+			}
+
+			v, err = r.read(length)
+			if err != nil {
+				return nil, err
+			}
+			v <<= uint(64 - leading - length)
+		}
+
+		if dst != nil {
+			dst[i] = v
+		}
+	}
+
+	return words[(r.bits+63)/64:], nil
+}
+
+func decodeFrameOfReference(words []uint64, n int, dst []uint64) ([]uint64, error) {
+	if len(words) == 0 {
+		return nil, errColumnIncomplete
+	}
+
+	min := words[0]
+	r := bitReader{words: words[1:]}
+
+	width, err := r.read(7)
+	if err != nil {
+		return nil, err
+	}
+	if width > 64 {
+		return nil, errors.New("bit width exceeds value size")
+	}
+
+	used := forSize(n, int(width))
+	if used > len(words) {
+		return nil, errColumnIncomplete
+	}
+
+	if dst != nil {
+		for i := 0; i < n; i++ {
+			v, err := r.read(int(width))
+			if err != nil {
+				return nil, err
+			}
+			dst[i] = min + v
+		}
+	}
+
+	return words[used:], nil
+}
+
+func decodeRunLength(words []uint64, n int, dst []uint64) ([]uint64, error) {
+	var pointsRead int
+	for pointsRead < n {
+		if len(words) == 0 {
+			return nil, errColumnIncomplete
+		}
+		var encoded uint64
+		encoded, words = words[0], words[1:]
+
+		v := encoded >> runLengthBits
+		length := int(encoded&(runLengthMax-1)) + 1
+
+		if pointsRead+length > n {
+			return nil, errors.New("run exceeds number of points")
+		}
+
+		if dst != nil {
+			for i := pointsRead; i < pointsRead+length; i++ {
+				dst[i] = v
+			}
+		}
+		pointsRead += length
+	}
+	return words, nil
+}
@@ -24,17 +24,22 @@ type Decoder struct {
 	reader io.Reader
 	s      decoderState
 	// need is true for every column that should be decoded
-	Need        []bool
+	Need []bool
+	// Missing holds the positions (point * columns + column) of missing values in the last decoded block
+	Missing []int
+	// BlockSize is the size of the blocks read from the reader, all blocks of a file have the same size
+	BlockSize   int
 	block       []byte
 	blockReader bytes.Reader
+	headerWords int
 
 	buffer [240]uint64
 }
 
 func NewDecoder() Decoder {
 	return Decoder{
-		s:     stateError,
-		block: make([]byte, BlockSize),
+		s:         stateError,
+		BlockSize: DefaultBlockSize,
 	}
 }
 
@@ -63,8 +68,12 @@ func (d *Decoder) DecodeHeader() (BlockHeader, error) {
 		return BlockHeader{}, errors.New("decoder is in error state")
 	}
 
+	if len(d.block) != d.BlockSize {
+		d.block = make([]byte, d.BlockSize)
+	}
+
 	// read next block from file
-	_, err := d.reader.Read(d.block)
+	_, err := io.ReadFull(d.reader, d.block)
 	if err != nil {
 		d.s = stateError
 		return BlockHeader{}, err
@@ -80,7 +89,62 @@ func (d *Decoder) DecodeHeader() (BlockHeader, error) {
 		return BlockHeader{}, err
 	}
 
-	d.Header = header.Nice()
+	// the entire block was read, so the next header can be decoded
+	// even if this block turns out to be corrupted
+	d.s = stateHeader
+
+	d.headerWords, err = headerWords(int(header.BlockVersion), int(header.NumColumns))
+
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	var checksum blockChecksumRaw
+	nice := header.Nice()
+
+	if header.BlockVersion >= 2 {
+		err = binary.Read(&d.blockReader, binary.LittleEndian, &checksum)
+
+		if err != nil {
+			d.s = stateError
+			return BlockHeader{}, err
+		}
+
+		nice.BlockSize = blockSize(header.BlockVersion, checksum.Flags)
+
+		if nice.BlockSize != d.BlockSize {
+			return BlockHeader{}, BlockSizeError{Expected: d.BlockSize, Stored: nice.BlockSize}
+		}
+
+		if nice.BytesUsed < 8*d.headerWords || nice.BytesUsed > d.BlockSize {
+			return BlockHeader{}, ChecksumError{Stored: checksum.Checksum}
+		}
+
+		computed := blockChecksum(d.block, nice.BytesUsed)
+
+		if computed != checksum.Checksum {
+			return BlockHeader{}, ChecksumError{Stored: checksum.Checksum, Computed: computed}
+		}
+	}
+
+	d.Header = nice
+	d.Header.Schema = int(checksum.Schema)
+	d.Header.Checksum = checksum.Checksum
+	d.Header.Missing = checksum.Flags&flagMissing != 0
+	d.Header.Codecs = make([]Codec, d.Header.NumColumns)
+
+	// blocks before version 3 only use simple8b
+	if header.BlockVersion >= 3 {
+		codecBytes := make([]uint8, 8*codecWords(d.Header.NumColumns))
+		if _, err := io.ReadFull(&d.blockReader, codecBytes); err != nil {
+			d.s = stateError
+			return BlockHeader{}, err
+		}
+		for i := range d.Header.Codecs {
+			d.Header.Codecs[i] = Codec(codecBytes[i])
+		}
+	}
+
 	d.s = stateBody
 	return d.Header, err
 }
@@ -92,9 +156,9 @@ func (d *Decoder) DecodeBlock() ([][]uint64, error) {
 	case stateError:
 		return nil, errors.New("decoder is in error state")
 	case stateHeader:
+		// DecodeHeader sets the state according to the error
 		_, err := d.DecodeHeader()
 		if err != nil {
-			d.s = stateError
 			return nil, err
 		}
 	}
@@ -105,7 +169,7 @@ func (d *Decoder) DecodeBlock() ([][]uint64, error) {
 	}
 
 	// read the data into words
-	words := make([]uint64, 512-3)
+	words := make([]uint64, d.BlockSize/8-d.headerWords)
 	if err := binary.Read(&d.blockReader, binary.LittleEndian, words); err != nil {
 		d.s = stateError
 		return nil, err
@@ -115,54 +179,63 @@ func (d *Decoder) DecodeBlock() ([][]uint64, error) {
 	values := make([][]uint64, d.Header.NumColumns)
 
 	for i, need := range d.Need {
-		// skip columns that are not required
-		if !need {
-			var pointsRead int
-			for pointsRead < d.Header.NumPoints {
-				// check if there are words left in this block
-				if len(words) == 0 {
-					d.s = stateError
-					return nil, errors.New("column not complete at end of block")
-				}
-				var encoded uint64
-				encoded, words = words[0], words[1:]
-				// check how many values this word contains
-				c, err := simple8b.Count(encoded)
-				if err != nil {
-					d.s = stateError
-					return nil, err
-				}
-				pointsRead += c
-			}
-			continue
+		// columns that are not required are skipped
+		if need {
+			values[i] = make([]uint64, d.Header.NumPoints)
+		}
+
+		var err error
+		words, err = decodeColumn(d.Header.Codecs[i], words, d.Header.NumPoints, values[i], &d.buffer)
+		if err != nil {
+			d.s = stateError
+			return nil, err
 		}
+	}
 
-		values[i] = make([]uint64, d.Header.NumPoints)
+	d.Missing = d.Missing[:0]
 
-		// read points into output array
-		var pointsRead int
-		for pointsRead < d.Header.NumPoints {
-			// check if there are words left in this block
-			if len(words) == 0 {
-				d.s = stateError
-				return nil, errors.New("column not complete at end of block")
-			}
-			// read word
-			var encoded uint64
-			encoded, words = words[0], words[1:]
-			// decode word
-			c, err := simple8b.Decode(&d.buffer, encoded)
-			if err != nil {
-				d.s = stateError
-				return nil, err
-			}
-			// copy decoded raw values to buffer
-			copy(values[i][pointsRead:], d.buffer[:c])
-			// add c to pointsRead after copy
-			pointsRead += c
+	if d.Header.Missing {
+		if err := d.decodeMissing(words); err != nil {
+			d.s = stateError
+			return nil, err
 		}
 	}
 
 	d.s = stateHeader
 	return values, nil
 }
+
+// decodeMissing reads the list of missing values that follows the columns
+func (d *Decoder) decodeMissing(words []uint64) error {
+	count := -1
+	position := 0
+
+	for count != 0 {
+		if len(words) == 0 {
+			return errors.New("missing values not complete at end of block")
+		}
+
+		var encoded uint64
+		encoded, words = words[0], words[1:]
+
+		c, err := simple8b.Decode(&d.buffer, encoded)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range d.buffer[:c] {
+			if count < 0 {
+				count = int(v)
+				continue
+			}
+			if count == 0 {
+				break
+			}
+			position += int(v)
+			d.Missing = append(d.Missing, position)
+			count--
+		}
+	}
+
+	return nil
+}
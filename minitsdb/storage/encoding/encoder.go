@@ -1,38 +1,95 @@
 package encoding
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/jwilder/encoding/simple8b"
 	"io"
 )
 
-// EncodeBlock encodes as many values into a 4k block as it can possibly fit
+// EncodeBlock encodes as many values into a block of DefaultBlockSize as it can possibly fit
 // returns the number of data points written
-// if err == nil, exactly 4096 bytes were written to writer
+// if err == nil, exactly DefaultBlockSize bytes were written to writer
 // values must have 255 or fewer entries
 // times is only used to fill the block header TimeFirst and TimeLast, must also be stored in values (in transformed form)
 func EncodeBlock(writer io.Writer, times []int64, values [][]uint64) (BlockHeader, error) {
+	return EncodeBlockSchema(writer, 0, DefaultBlockSize, times, values, nil)
+}
+
+// encodeMissing encodes the positions of missing values that belong to the first points of a block
+// as their number followed by the differences between consecutive positions
+func encodeMissing(missing []int, columns int, points int) ([]uint64, error) {
+	list := []uint64{0}
+	last := 0
+
+	for _, position := range missing {
+		if position >= points*columns {
+			break
+		}
+		list = append(list, uint64(position-last))
+		last = position
+	}
+
+	list[0] = uint64(len(list) - 1)
+
+	return simple8b.EncodeAll(list)
+}
+
+// EncodeBlockSchema works like EncodeBlock and records the schema version of values in the block header
+// exactly blockSize bytes are written, it must be a valid block size (see CheckBlockSize)
+// missing holds the positions (point * columns + column) of values that are not stored in ascending order,
+// the transformed values at these positions should be chosen to compress well, e.g. by repeating the previous value
+func EncodeBlockSchema(writer io.Writer, schema int, blockSize int, times []int64, values [][]uint64, missing []int) (BlockHeader, error) {
+	return encodeBlock(writer, schema, blockSize, times, values, nil, missing)
+}
+
+// encodeBlock encodes every column with the codec that needs the fewest words for the values that fit into the block
+// if codecs is not nil, it restricts the codec of each column
+func encodeBlock(writer io.Writer, schema int, blockSize int, times []int64, values [][]uint64, codecs []Codec, missing []int) (BlockHeader, error) {
+	if err := CheckBlockSize(blockSize); err != nil {
+		return BlockHeader{}, err
+	}
+
 	valuesAvailable := len(times)
-	encoded := make([][]uint64, len(values))
+	wordsMax := blockSize / 8
+
+	// candidates of each column, nil once a codec can't store a value
+	encoders := make([][]columnEncoder, len(values))
 
 	for i, val := range values {
 		if len(val) != valuesAvailable {
 			panic("input slices have different lengths")
 		}
-		// pre-allocate some words to make appends faster
-		encoded[i] = make([]uint64, 0, 64)
+
+		encoders[i] = make([]columnEncoder, codecCount)
+
+		for c := range encoders[i] {
+			if codecs != nil && Codec(c) != codecs[i] {
+				continue
+			}
+
+			var err error
+			if encoders[i][c], err = newColumnEncoder(Codec(c), val); err != nil {
+				return BlockHeader{}, err
+			}
+		}
 	}
 
-	// try to fit as many values into 512 words as possible
+	// try to fit as many values into wordsMax words as possible
 	// used to keep track of how many encoded words each column needs so all have the same number of values
 	columns := make([]struct {
-		words     int // number of words (confirmed to fit in last loop)
-		wordsNext int // number of words (tested in current loop iteration)
-		values    int // number of values contained
+		words     int   // number of words (confirmed to fit in last loop)
+		wordsNext int   // number of words (tested in current loop iteration)
+		codec     Codec // codec using the fewest words (confirmed to fit in last loop)
+		codecNext Codec // codec using the fewest words (tested in current loop iteration)
 	}, len(values))
 
 	valuesTotal := 0
-	wordsTotal := 3 // 3 words occupied by header
+	wordsHeader, _ := headerWords(BlockVersion, len(values)) // words occupied by header
+	wordsTotal := wordsHeader
+
+	// words occupied by the list of missing values
+	var missingEncoded []uint64
 
 	// increase numbers of values until total number of words exceeds block size
 	for {
@@ -40,29 +97,58 @@ func EncodeBlock(writer io.Writer, times []int64, values [][]uint64) (BlockHeade
 		valuesTotal++
 		// total number of words after this round, checked to be smaller
 		// than wordsMax at the end of the loop iteration
-		wordsTotalNext := wordsTotal
-		// give every column with less values one more word
+		wordsTotalNext := wordsHeader
+		// find the smallest encoding of every column
 		for i := range columns {
-			if columns[i].values < valuesTotal {
-				// count number of values in the next word
-				encodedWord, count, err := simple8b.Encode(values[i][columns[i].values:])
+			var errLast error
+			columns[i].wordsNext = -1
+
+			for c, e := range encoders[i] {
+				if e == nil {
+					continue
+				}
 
+				words, err := e.size(valuesTotal)
+
+				// the values may still fit into the words confirmed earlier
 				if err != nil {
-					return BlockHeader{}, err
+					if Codec(c) != columns[i].codec || valuesTotal == 1 {
+						encoders[i][c] = nil
+					}
+					errLast = err
+					continue
 				}
 
-				encoded[i] = append(encoded[i], encodedWord)
+				if columns[i].wordsNext == -1 || words < columns[i].wordsNext {
+					columns[i].wordsNext = words
+					columns[i].codecNext = Codec(c)
+				}
+			}
 
-				wordsTotalNext++
-				columns[i].wordsNext++
-				columns[i].values += count
+			if columns[i].wordsNext == -1 {
+				if valuesTotal == 1 {
+					return BlockHeader{}, errLast
+				}
+				// no codec can store the next value, so the block ends before it
+				columns[i].wordsNext = wordsMax
+			}
+
+			wordsTotalNext += columns[i].wordsNext
+		}
+
+		var missingNext []uint64
+		if len(missing) > 0 {
+			var err error
+			missingNext, err = encodeMissing(missing, len(values), valuesTotal)
+			if err != nil {
+				return BlockHeader{}, err
 			}
 		}
 
 		// valuesTotal exceeds block capacity
 		// do not update columns.words
 		// use last valid number of values
-		if wordsTotalNext > 512 {
+		if wordsTotalNext+len(missingNext) > wordsMax {
 			valuesTotal--
 			break
 		}
@@ -71,8 +157,10 @@ func EncodeBlock(writer io.Writer, times []int64, values [][]uint64) (BlockHeade
 		// update number of words allocated to each column
 		for i := range columns {
 			columns[i].words = columns[i].wordsNext
+			columns[i].codec = columns[i].codecNext
 		}
 		wordsTotal = wordsTotalNext
+		missingEncoded = missingNext
 
 		// no more values left to store
 		if valuesTotal == valuesAvailable {
@@ -80,33 +168,73 @@ func EncodeBlock(writer io.Writer, times []int64, values [][]uint64) (BlockHeade
 		}
 	}
 
+	// only mark blocks that actually contain missing values
+	var flags uint16
+	if len(missingEncoded) > 0 && missingEncoded[0] != 0 {
+		flags |= flagMissing
+		wordsTotal += len(missingEncoded)
+	} else {
+		missingEncoded = nil
+	}
+
 	header := blockHeaderRaw{
-		BlockVersion: 1,
+		BlockVersion: BlockVersion,
 		NumPoints:    uint32(valuesTotal),
 		NumColumns:   uint8(len(values)),
 		TimeFirst:    times[0],
 		TimeLast:     times[valuesTotal-1],
-		BytesUsed:    uint16(8 * wordsTotal),
+		BytesUsed:    uint16(wordsTotal),
 	}
 
-	// write header
-	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
+	// assemble block in memory, the checksum can only be calculated once all columns are written
+	block := bytes.NewBuffer(make([]byte, 0, blockSize))
+
+	// write header, checksum is filled in later
+	if err := binary.Write(block, binary.LittleEndian, header); err != nil {
 		return BlockHeader{}, err
 	}
 
+	if err := binary.Write(block, binary.LittleEndian, blockChecksumRaw{Schema: uint16(schema), Flags: flags | blockSizeFlags(blockSize)}); err != nil {
+		return BlockHeader{}, err
+	}
+
+	codecBytes := make([]uint8, 8*codecWords(len(values)))
+	for i := range columns {
+		codecBytes[i] = uint8(columns[i].codec)
+	}
+	block.Write(codecBytes)
+
 	// write columns
 	for i := range columns {
-		if err := binary.Write(writer, binary.LittleEndian, encoded[i][:columns[i].words]); err != nil {
+		if err := binary.Write(block, binary.LittleEndian, encoders[i][columns[i].codec].encode(valuesTotal)); err != nil {
 			return BlockHeader{}, err
 		}
 	}
 
-	// ensure that 512 words are written
-	if _, err := writer.Write(make([]uint8, 8*(512-wordsTotal))); err != nil {
+	if err := binary.Write(block, binary.LittleEndian, missingEncoded); err != nil {
+		return BlockHeader{}, err
+	}
+
+	// ensure that the entire block is written
+	block.Write(make([]uint8, 8*(wordsMax-wordsTotal)))
+
+	raw := block.Bytes()
+	binary.LittleEndian.PutUint32(raw[checksumOffset:], blockChecksum(raw, 8*wordsTotal))
+
+	if _, err := writer.Write(raw); err != nil {
 		return BlockHeader{}, err
 	}
 
-	return header.Nice(), nil
+	nice := header.Nice()
+	nice.Schema = schema
+	nice.BlockSize = blockSize
+	nice.Missing = flags&flagMissing != 0
+	nice.Codecs = make([]Codec, len(columns))
+	for i := range columns {
+		nice.Codecs[i] = columns[i].codec
+	}
+
+	return nice, nil
 }
 
 func EncodeAll(writer io.Writer, times []int64, values [][]uint64) error {
@@ -2,8 +2,10 @@ package encoding
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/martin2250/minitsdb/util"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"testing"
 	"time"
@@ -68,9 +70,9 @@ func BenchmarkDecoder(b *testing.B) {
 	}
 
 	d := NewDecoder()
-	d.Columns = make([]int, len(values))
-	for i := range d.Columns {
-		d.Columns[i] = i
+	d.Need = make([]bool, len(values))
+	for i := range d.Need {
+		d.Need[i] = true
 	}
 	d.SetReader(&buffer)
 
@@ -119,9 +121,9 @@ func TestEncoder(t *testing.T) {
 	}
 
 	d := NewDecoder()
-	d.Columns = make([]int, len(values))
-	for i := range d.Columns {
-		d.Columns[i] = i
+	d.Need = make([]bool, len(values))
+	for i := range d.Need {
+		d.Need[i] = true
 	}
 	d.SetReader(&b)
 
@@ -147,3 +149,295 @@ func TestEncoder(t *testing.T) {
 		n += len(decoded[0])
 	}
 }
+
+func TestChecksum(t *testing.T) {
+	values, times := createData(3, 100, 500)
+
+	var b bytes.Buffer
+
+	if _, err := EncodeBlock(&b, times, values); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit in the data section
+	block := b.Bytes()
+	block[100] ^= 0x04
+
+	d := NewDecoder()
+	d.Need = []bool{true, true, true}
+	d.SetReader(bytes.NewReader(block))
+
+	_, err := d.DecodeBlock()
+
+	if _, ok := err.(ChecksumError); !ok {
+		t.Fatalf("expected ChecksumError, got %v", err)
+	}
+}
+
+func TestDecodeVersion1(t *testing.T) {
+	values, times := createData(3, 100, 500)
+
+	var b bytes.Buffer
+
+	// blocks before version 3 only use simple8b
+	codecs := []Codec{CodecSimple8b, CodecSimple8b, CodecSimple8b}
+
+	header, err := encodeBlock(&b, 0, DefaultBlockSize, times, values, codecs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// convert to version 1 block by removing the checksum and codec words
+	encoded := b.Bytes()
+	v1 := make([]byte, 0, DefaultBlockSize)
+	v1 = append(v1, encoded[:checksumOffset]...)
+	v1 = append(v1, encoded[checksumOffset+16:]...)
+	v1 = append(v1, make([]byte, 16)...)
+	v1[0] = 1
+	binary.LittleEndian.PutUint16(v1[6:], uint16(header.BytesUsed-16))
+
+	d := NewDecoder()
+	d.Need = []bool{true, true, true}
+	d.SetReader(bytes.NewReader(v1))
+
+	decoded, err := d.DecodeBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Header.BlockVersion != 1 {
+		t.Errorf("decoded block version %d", d.Header.BlockVersion)
+	}
+
+	for i := range decoded {
+		for j := range decoded[i] {
+			if values[i][j] != decoded[i][j] {
+				t.Fatalf("decoded value incorrect %d (expected %d) at pos (%d, %d)", decoded[i][j], values[i][j], i, j)
+			}
+		}
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	values, times := createData(3, 100, 500)
+	missing := []int{4, 5, 31, 3*499 + 2}
+
+	var b bytes.Buffer
+
+	if _, err := EncodeBlockSchema(&b, 7, DefaultBlockSize, times, values, missing); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder()
+	d.SetReader(&b)
+
+	header, err := d.DecodeHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Schema != 7 {
+		t.Errorf("decoded schema version %d, expected 7", header.Schema)
+	}
+
+	d.Need = []bool{true, false, true}
+	if _, err := d.DecodeBlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only missing values of points contained in the block are stored
+	var expected []int
+	for _, position := range missing {
+		if position < 3*header.NumPoints {
+			expected = append(expected, position)
+		}
+	}
+
+	if !header.Missing || len(d.Missing) != len(expected) {
+		t.Fatalf("decoded missing values %v, expected %v", d.Missing, expected)
+	}
+
+	for i := range expected {
+		if d.Missing[i] != expected[i] {
+			t.Errorf("decoded missing values %v, expected %v", d.Missing, expected)
+		}
+	}
+}
+
+func TestCodecWindow(t *testing.T) {
+	n := 3000
+	times := make([]int64, n)
+	values := make([][]uint64, 3)
+
+	floats := make([][]int64, 2)
+	for i := range floats {
+		floats[i] = make([]int64, n)
+	}
+
+	v := 20.0
+	for j := 0; j < n; j++ {
+		times[j] = int64(j)
+		v += rand.NormFloat64()
+		floats[0][j] = int64(math.Float64bits(v))
+		// repeated values and full 64 bit windows
+		floats[1][j] = int64(math.Float64bits(float64(j / 10)))
+		if j%100 == 0 {
+			floats[1][j] = int64(rand.Uint64())
+		}
+	}
+
+	values[0], _ = TimeTransformer.Apply(times)
+	values[1], _ = XORTransformer{}.Apply(floats[0])
+	values[2], _ = XORTransformer{}.Apply(floats[1])
+
+	codecs := []Codec{CodecSimple8b, CodecWindow, CodecWindow}
+
+	var b bytes.Buffer
+
+	for j := 0; j < n; {
+		header, err := encodeBlock(&b, 0, DefaultBlockSize, times[j:], [][]uint64{values[0][j:], values[1][j:], values[2][j:]}, codecs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j += header.NumPoints
+	}
+
+	d := NewDecoder()
+	d.Need = []bool{true, false, true}
+	d.SetReader(&b)
+
+	for j := 0; j < n; {
+		decoded, err := d.DecodeBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, c := range d.Header.Codecs {
+			if c != codecs[i] {
+				t.Fatalf("decoded codec %d for column %d, expected %d", c, i, codecs[i])
+			}
+		}
+
+		for k := range decoded[2] {
+			if decoded[2][k] != values[2][j+k] {
+				t.Fatalf("decoded value incorrect %d (expected %d) at pos %d", decoded[2][k], values[2][j+k], j+k)
+			}
+		}
+
+		j += d.Header.NumPoints
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	n := 5000
+	times := make([]int64, n)
+	for j := range times {
+		times[j] = int64(j)
+	}
+
+	// large values, runs and small values
+	columns := [][]uint64{make([]uint64, n), make([]uint64, n), make([]uint64, n)}
+	for j := 0; j < n; j++ {
+		columns[0][j] = 1<<62 + uint64(rand.Int63n(1<<20))
+		columns[1][j] = uint64(j / 700)
+		columns[2][j] = uint64(rand.Int63n(100))
+	}
+
+	for c := Codec(0); c < codecCount; c++ {
+		var b bytes.Buffer
+		codecs := []Codec{c, c, c}
+
+		header, err := encodeBlock(&b, 0, DefaultBlockSize, times, columns, codecs, nil)
+
+		// simple8b and run length encoding can't store the first column
+		if err != nil {
+			if c == CodecSimple8b || c == CodecRunLength {
+				codecs[0] = CodecFrameOfReference
+				header, err = encodeBlock(&b, 0, DefaultBlockSize, times, columns, codecs, nil)
+			}
+			if err != nil {
+				t.Fatal(c, err)
+			}
+		}
+
+		d := NewDecoder()
+		d.Need = []bool{true, false, true}
+		d.SetReader(&b)
+
+		decoded, err := d.DecodeBlock()
+		if err != nil {
+			t.Fatal(c, err)
+		}
+
+		for _, i := range []int{0, 2} {
+			if d.Header.Codecs[i] != codecs[i] {
+				t.Fatalf("decoded codec %d for column %d, expected %d", d.Header.Codecs[i], i, codecs[i])
+			}
+			for j := 0; j < header.NumPoints; j++ {
+				if decoded[i][j] != columns[i][j] {
+					t.Fatalf("codec %d: decoded value incorrect %d (expected %d) at pos (%d, %d)", c, decoded[i][j], columns[i][j], i, j)
+				}
+			}
+		}
+	}
+
+	// the smallest codec is chosen for every column
+	var b bytes.Buffer
+	header, err := EncodeBlock(&b, times, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Codec{CodecFrameOfReference, CodecRunLength, CodecFrameOfReference}
+	for i := range expected {
+		if header.Codecs[i] != expected[i] {
+			t.Errorf("column %d encoded with codec %d, expected %d", i, header.Codecs[i], expected[i])
+		}
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	values, times := createData(3, 10000, 500)
+
+	var b bytes.Buffer
+
+	header, err := EncodeBlockSchema(&b, 0, MaxBlockSize, times, values, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Len() != MaxBlockSize || header.BlockSize != MaxBlockSize || header.NumPoints <= 1000 {
+		t.Fatalf("encoded %d points into %d bytes", header.NumPoints, b.Len())
+	}
+
+	if size, err := ReadBlockSize(bytes.NewReader(b.Bytes())); err != nil || size != MaxBlockSize {
+		t.Errorf("read block size %d (%v), expected %d", size, err, MaxBlockSize)
+	}
+
+	// blocks of a different size are rejected
+	d := NewDecoder()
+	d.Need = []bool{true, true, true}
+	d.SetReader(bytes.NewReader(b.Bytes()))
+
+	if _, err := d.DecodeBlock(); err == nil {
+		t.Fatal("decoded block with wrong block size")
+	}
+
+	d = NewDecoder()
+	d.BlockSize = MaxBlockSize
+	d.Need = []bool{true, true, true}
+	d.SetReader(&b)
+
+	decoded, err := d.DecodeBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range decoded {
+		for j := range decoded[i] {
+			if values[i][j] != decoded[i][j] {
+				t.Fatalf("decoded value incorrect %d (expected %d) at pos (%d, %d)", decoded[i][j], values[i][j], i, j)
+			}
+		}
+	}
+}
@@ -1,5 +1,50 @@
 package encoding
 
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// BlockVersion is the version written by EncodeBlock
+// version 1: 3 word header without checksum
+// version 2: 4 word header with CRC32C over the used bytes of the block
+// version 3: header followed by the codec of each column, one byte per column padded to whole words
+// version 4: block size recorded in the flags, BytesUsed holds the number of used words to allow 64k blocks
+const BlockVersion = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError indicates that the checksum stored in a block header does not match its content
+type ChecksumError struct {
+	Stored   uint32
+	Computed uint32
+}
+
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("block checksum mismatch (stored %08x, computed %08x)", e.Stored, e.Computed)
+}
+
+// BlockSizeError indicates that a block header records a different block size than the blocks of its file
+type BlockSizeError struct {
+	Expected int
+	Stored   int
+}
+
+func (e BlockSizeError) Error() string {
+	return fmt.Sprintf("block size %d does not match expected size %d", e.Stored, e.Expected)
+}
+
+// VersionError indicates that a block was written with an unknown block version
+type VersionError struct {
+	Version int
+}
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("unknown block version %d", e.Version)
+}
+
 // BlockHeader is a more usable version of the header stored at the beginning of each block
 type BlockHeader struct {
 	// specifies the Encoder used to encode the Block
@@ -14,6 +59,16 @@ type BlockHeader struct {
 	TimeFirst int64
 	// timestamp of the last data point
 	TimeLast int64
+	// version of the series schema the block was written with, zero if unknown
+	Schema int
+	// Checksum is the CRC32C stored in the header, zero for blocks before version 2
+	Checksum uint32
+	// Missing is true if the block contains a list of missing values
+	Missing bool
+	// Codecs holds the codec of each column
+	Codecs []Codec
+	// BlockSize is the size of the block in bytes
+	BlockSize int
 }
 
 // blockHeaderRaw specifies the binary structure of
@@ -33,13 +88,121 @@ type blockHeaderRaw struct {
 	TimeLast int64
 }
 
+// blockChecksumRaw follows blockHeaderRaw in blocks of version 2 and up
+type blockChecksumRaw struct {
+	// CRC32C over the first BytesUsed bytes of the block, with this field set to zero
+	Checksum uint32
+	// version of the series schema the block was written with
+	Schema uint16
+	Flags  uint16
+}
+
+// flagMissing indicates that the columns are followed by the list of missing values
+const flagMissing = 1
+
+// bits 8 to 11 of the flags hold log2(block size / DefaultBlockSize) in blocks of version 4 and up
+const (
+	flagBlockSizeShift = 8
+	flagBlockSizeMask  = 0xf << flagBlockSizeShift
+)
+
+const (
+	// DefaultBlockSize is the size of blocks written by EncodeBlock and of all blocks before version 4
+	DefaultBlockSize = 4096
+	// MaxBlockSize is the largest block size supported
+	MaxBlockSize = 65536
+)
+
+// CheckBlockSize returns an error if size is not a power of two between DefaultBlockSize and MaxBlockSize
+func CheckBlockSize(size int) error {
+	if size < DefaultBlockSize || size > MaxBlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("block size must be a power of two between %d and %d bytes", DefaultBlockSize, MaxBlockSize)
+	}
+	return nil
+}
+
+// blockSizeFlags returns the flags that record the block size
+func blockSizeFlags(size int) uint16 {
+	var shift uint16
+	for DefaultBlockSize<<shift < size {
+		shift++
+	}
+	return shift << flagBlockSizeShift
+}
+
+// blockSize returns the block size recorded in the flags of a block
+func blockSize(version uint8, flags uint16) int {
+	if version < 4 {
+		return DefaultBlockSize
+	}
+	return DefaultBlockSize << ((flags & flagBlockSizeMask) >> flagBlockSizeShift)
+}
+
+// ReadBlockSize reads the size of the block at the current position of r from its header
+func ReadBlockSize(r io.Reader) (int, error) {
+	var header blockHeaderRaw
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return 0, err
+	}
+
+	if header.BlockVersion < 4 {
+		return DefaultBlockSize, nil
+	}
+
+	var checksum blockChecksumRaw
+	if err := binary.Read(r, binary.LittleEndian, &checksum); err != nil {
+		return 0, err
+	}
+
+	size := blockSize(header.BlockVersion, checksum.Flags)
+	if err := CheckBlockSize(size); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// offset of blockChecksumRaw.Checksum from the start of the block
+const checksumOffset = 24
+
+// headerWords returns the number of words occupied by the header of a block version
+func headerWords(version int, columns int) (int, error) {
+	switch version {
+	case 1:
+		return 3, nil
+	case 2:
+		return 4, nil
+	case 3, 4:
+		return 4 + codecWords(columns), nil
+	}
+	return 0, VersionError{Version: version}
+}
+
+// codecWords returns the number of words occupied by the codecs of a block
+func codecWords(columns int) int {
+	return (columns + 7) / 8
+}
+
+// blockChecksum calculates the checksum of the used bytes of a block
+func blockChecksum(block []byte, bytesUsed int) uint32 {
+	crc := crc32.Update(0, crcTable, block[:checksumOffset])
+	crc = crc32.Update(crc, crcTable, make([]byte, 4))
+	return crc32.Update(crc, crcTable, block[checksumOffset+4:bytesUsed])
+}
+
 func (b blockHeaderRaw) Nice() BlockHeader {
+	bytesUsed := int(b.BytesUsed)
+	if b.BlockVersion >= 4 {
+		bytesUsed *= 8
+	}
+
 	return BlockHeader{
 		BlockVersion: int(b.BlockVersion),
 		NumColumns:   int(b.NumColumns),
 		NumPoints:    int(b.NumPoints),
-		BytesUsed:    int(b.BytesUsed),
+		BytesUsed:    bytesUsed,
 		TimeFirst:    b.TimeFirst,
 		TimeLast:     b.TimeLast,
+		BlockSize:    DefaultBlockSize,
 	}
 }
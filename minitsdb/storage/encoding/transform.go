@@ -18,6 +18,11 @@ type DiffTransformer struct {
 var TimeTransformer = DiffTransformer{N: 2}
 var CountTransformer = DiffTransformer{N: 1}
 
+// String returns the name of the transformer as accepted by FindTransformer
+func (t DiffTransformer) String() string {
+	return fmt.Sprintf("D%d", t.N)
+}
+
 func (t DiffTransformer) Apply(input []int64) ([]uint64, error) {
 	// make a copy of input array, else input gets modified in the calling method
 	d := make([]int64, len(input))
@@ -66,7 +71,46 @@ func (t DiffTransformer) Revert(input []uint64) ([]int64, error) {
 	return d, nil
 }
 
+// XORTransformer XORs the bit pattern of every value with the previous one, as consecutive float64 values
+// mostly share their sign, exponent and leading mantissa bits, the result has many leading and trailing zeros
+type XORTransformer struct{}
+
+// String returns the name of the transformer as accepted by FindTransformer
+func (XORTransformer) String() string {
+	return "XOR"
+}
+
+func (XORTransformer) Apply(input []int64) ([]uint64, error) {
+	o := make([]uint64, len(input))
+
+	var last uint64
+
+	for i, v := range input {
+		o[i] = uint64(v) ^ last
+		last = uint64(v)
+	}
+
+	return o, nil
+}
+
+func (XORTransformer) Revert(input []uint64) ([]int64, error) {
+	o := make([]int64, len(input))
+
+	var last uint64
+
+	for i, v := range input {
+		last ^= v
+		o[i] = int64(last)
+	}
+
+	return o, nil
+}
+
 func FindTransformer(s string) (Transformer, error) {
+	if s == "XOR" {
+		return XORTransformer{}, nil
+	}
+
 	var arg int
 	if _, err := fmt.Sscanf(s, "D%d", &arg); err == nil {
 		if arg < 0 || arg > 3 {
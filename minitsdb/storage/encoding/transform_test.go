@@ -12,7 +12,7 @@ func testTransform(t *testing.T, tr Transformer) {
 	copy(inputCopy, input)
 
 	// apply transformation
-	encoded, err := Apply(inputCopy)
+	encoded, err := tr.Apply(inputCopy)
 
 	if err != nil {
 		t.Error(err)
@@ -28,7 +28,7 @@ func testTransform(t *testing.T, tr Transformer) {
 	}
 
 	// revert transformation
-	decoded, err := Revert(encoded)
+	decoded, err := tr.Revert(encoded)
 
 	if err != nil {
 		t.Error(err)
@@ -51,3 +51,7 @@ func TestDiffTransform(t *testing.T) {
 	testTransform(t, DiffTransformer{N: 2})
 	testTransform(t, DiffTransformer{N: 50})
 }
+
+func TestXORTransform(t *testing.T) {
+	testTransform(t, XORTransformer{})
+}
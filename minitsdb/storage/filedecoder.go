@@ -2,8 +2,10 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
 	"io"
+	"math"
 	"os"
 )
 
@@ -15,14 +17,58 @@ const (
 	stateBody
 )
 
+// BlockError indicates that a single block of a data file could not be decoded
+// the FileDecoder remains usable and continues with the next block
+type BlockError struct {
+	Path  string
+	Block int64
+	Err   error
+}
+
+func (e BlockError) Error() string {
+	return fmt.Sprintf("block %d of %s: %v", e.Block, e.Path, e.Err)
+}
+
+func (e BlockError) Unwrap() error {
+	return e.Err
+}
+
+// isBlockError checks if the decoder can skip over a block that returned this error
+func isBlockError(err error) bool {
+	switch err.(type) {
+	case encoding.ChecksumError, encoding.VersionError, encoding.BlockSizeError:
+		return true
+	}
+	return false
+}
+
 // FileDecoder decodes blocks from multiple files and handles opening / closing files
 type FileDecoder struct {
 	files       []*DataFile // files to be read
 	decoder     encoding.Decoder
 	currentFile *os.File // file that is currently being read (only held for closing)
+	currentPath string
+	compressed  *compressedReader // reader of the current file, nil if it is not compressed
+	block       int64             // index of the block of the last header
+	nextBlock   int64             // index of the next block in the current file
+	lastBlock   int64             // index of the last block of the current file that is read
 	state       decoderState
+
+	// only blocks that may contain points in this time range are read if ranged is set
+	ranged             bool
+	timeStart, timeEnd int64
+}
+
+// SetTimeRange restricts the decoder to the blocks that may contain points between start and end,
+// the index of each file is used to skip the other blocks
+// must be called before the first block is decoded
+func (d *FileDecoder) SetTimeRange(start, end int64) {
+	d.ranged = true
+	d.timeStart = start
+	d.timeEnd = end
 }
 
+// nextFile opens the next file, the current file remains nil if no block of the file is in the time range
 func (d *FileDecoder) nextFile() error {
 	if len(d.files) == 0 {
 		return io.EOF
@@ -30,19 +76,82 @@ func (d *FileDecoder) nextFile() error {
 
 	d.Close()
 
+	df := d.files[0]
+	d.files = d.files[1:]
+
 	var err error
-	d.currentFile, err = os.Open(d.files[0].Path)
+	d.currentFile, err = os.Open(df.Path)
 
 	if err != nil {
 		return err
 	}
 
-	d.decoder.SetReader(d.currentFile)
-	d.files = d.files[1:]
+	d.currentPath = df.Path
+	d.nextBlock = 0
+	d.lastBlock = math.MaxInt64
+	d.decoder.BlockSize = int(df.BlockSize)
+
+	// the layout is read from the opened file, as it may have been compressed since the file list was made
+	header, compressed, err := readCompressedHeader(d.currentFile)
+
+	var r *compressedReader
+	if err == nil && compressed {
+		if r, err = newCompressedReader(d.currentFile, int64(header.BlockSize), int64(header.Blocks)); err == nil {
+			d.decoder.BlockSize = int(header.BlockSize)
+		}
+	}
+
+	if err == nil && d.ranged {
+		err = d.seekRange(df, r)
+	}
+
+	if err != nil || d.currentFile == nil {
+		d.Close()
+		return err
+	}
+
+	d.compressed = r
+
+	if r != nil {
+		d.decoder.SetReader(r)
+	} else {
+		d.decoder.SetReader(d.currentFile)
+	}
 
 	return nil
 }
 
+// seekRange moves to the first block of the current file that is in the time range,
+// the file is closed if it contains no such block. Files without a valid index are read entirely
+func (d *FileDecoder) seekRange(df *DataFile, r *compressedReader) error {
+	entries, err := df.Index()
+	if err != nil {
+		return nil
+	}
+
+	first, last, ok := blockRange(entries, d.timeStart, d.timeEnd)
+
+	if !ok {
+		d.Close()
+		return nil
+	}
+
+	// blocks appended after the index was read may also be in range
+	if last < int64(len(entries))-1 {
+		d.lastBlock = last
+	}
+
+	d.nextBlock = first
+
+	if r != nil {
+		r.next = int(first)
+		return nil
+	}
+
+	_, err = d.currentFile.Seek(first*int64(d.decoder.BlockSize), io.SeekStart)
+	return err
+}
+
 func (d *FileDecoder) DecodeHeader() (encoding.BlockHeader, error) {
 	for len(d.files) > 0 || d.currentFile != nil {
 		if d.currentFile == nil {
@@ -50,16 +159,31 @@ func (d *FileDecoder) DecodeHeader() (encoding.BlockHeader, error) {
 			if err != nil {
 				return encoding.BlockHeader{}, err
 			}
+			if d.currentFile == nil {
+				continue
+			}
 		}
 
+		if d.nextBlock > d.lastBlock {
+			d.Close()
+			continue
+		}
+
+		block := d.nextBlock
+		d.nextBlock++
+
 		header, err := d.decoder.DecodeHeader()
 
 		switch {
 		case err == nil:
+			d.block = block
 			d.state = stateBody
 			return header, nil
 		case err == io.EOF:
 			d.Close()
+		case isBlockError(err):
+			d.state = stateHeader
+			return encoding.BlockHeader{}, BlockError{Path: d.currentPath, Block: block, Err: err}
 		case err != io.EOF:
 			d.state = stateError
 			return encoding.BlockHeader{}, err
@@ -69,14 +193,73 @@ func (d *FileDecoder) DecodeHeader() (encoding.BlockHeader, error) {
 	return encoding.BlockHeader{}, io.EOF
 }
 
+// Header returns the header of the block that is decoded by the next call to DecodeBlock,
+// the next header is read if necessary
+func (d *FileDecoder) Header() (encoding.BlockHeader, error) {
+	if d.state == stateBody {
+		return d.decoder.Header, nil
+	}
+	return d.DecodeHeader()
+}
+
+// SetNeed changes the columns that are decoded from the following blocks
+func (d *FileDecoder) SetNeed(need []bool) {
+	d.decoder.Need = need
+}
+
+// Position returns the path and index of the block that is decoded by the next call to DecodeBlock
+// the next file is opened if necessary, but the block itself is not read, so it may lie beyond the end of the file
+func (d *FileDecoder) Position() (string, int64, error) {
+	if d.state == stateBody {
+		return d.currentPath, d.block, nil
+	}
+
+	for d.currentFile == nil || d.nextBlock > d.lastBlock {
+		d.Close()
+
+		if len(d.files) == 0 {
+			d.state = stateError
+			return "", 0, io.EOF
+		}
+
+		if err := d.nextFile(); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return d.currentPath, d.nextBlock, nil
+}
+
+// SkipBlock skips the block of the last header without decoding it
+// if the header was not read yet, the block returned by Position is skipped without reading it
+func (d *FileDecoder) SkipBlock() error {
+	switch {
+	case d.state == stateBody:
+		d.state = stateHeader
+		return nil
+	case d.state != stateHeader || d.currentFile == nil:
+		return nil
+	}
+
+	d.nextBlock++
+
+	if d.compressed != nil {
+		d.compressed.next++
+		return nil
+	}
+
+	_, err := d.currentFile.Seek(int64(d.decoder.BlockSize), io.SeekCurrent)
+	return err
+}
+
 func (d *FileDecoder) DecodeBlock() ([][]uint64, error) {
 	switch d.state {
 	case stateError:
 		return nil, errors.New("decoder is in error state")
 	case stateHeader:
+		// DecodeHeader sets the state according to the error
 		_, err := d.DecodeHeader()
 		if err != nil {
-			d.state = stateError
 			return nil, err
 		}
 	}
@@ -97,10 +280,16 @@ func (d *FileDecoder) DecodeBlock() ([][]uint64, error) {
 	return values, nil
 }
 
+// Missing returns the positions (point * columns + column) of missing values in the last decoded block
+func (d *FileDecoder) Missing() []int {
+	return d.decoder.Missing
+}
+
 func (d *FileDecoder) Close() {
 	if d.currentFile != nil {
 		d.currentFile.Close()
 		d.currentFile = nil
+		d.compressed = nil
 	}
 }
 
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+)
+
+// IndexEntry describes a block of a data file
+type IndexEntry struct {
+	TimeFirst int64
+	TimeLast  int64
+	NumPoints int
+	// Checksum is the checksum stored in the block header, zero for blocks before version 2 and invalid blocks
+	Checksum uint32
+}
+
+// indexMagic starts the index file of a data file
+const indexMagic = "MDBI"
+
+// indexVersion is the version of the index files written by DataFile.Index
+const indexVersion = 2
+
+// indexHeaderRaw is the header of index files, followed by an indexEntryRaw for every block
+// the index is only valid while the size and modification time of the data file match
+type indexHeaderRaw struct {
+	Magic   [4]byte
+	Version uint32
+	Blocks  uint64
+	Size    int64
+	ModTime int64
+}
+
+const indexHeaderSize = 32
+
+type indexEntryRaw struct {
+	TimeFirst int64
+	TimeLast  int64
+	NumPoints uint32
+	Checksum  uint32
+}
+
+const indexEntrySize = 24
+
+// errIndexStale indicates that an index file does not match its data file
+var errIndexStale = errors.New("index does not match data file")
+
+// fileKey identifies the content of a data file
+type fileKey struct {
+	size    int64
+	modTime int64
+}
+
+func statKey(filePath string) (fileKey, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fileKey{}, err
+	}
+	return fileKey{size: info.Size(), modTime: info.ModTime().UnixNano()}, nil
+}
+
+// blockIndex holds the index of a data file in memory
+type blockIndex struct {
+	mux sync.Mutex
+	// key of the data file the entries belong to, entries are only valid if valid is set
+	key     fileKey
+	valid   bool
+	entries []IndexEntry
+}
+
+// IndexPath returns the path of the index file of the data file
+func (f *DataFile) IndexPath() string {
+	return f.Path + ".idx"
+}
+
+// Index returns the time range and number of points of every block in the data file
+// the index is read from the index file next to the data file, which is rebuilt if it is missing or stale
+func (f *DataFile) Index() ([]IndexEntry, error) {
+	// data files that were not created by NewDataFile or OpenDataFile don't cache their index
+	index := f.index
+	if index == nil {
+		index = &blockIndex{}
+	}
+
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	key, err := statKey(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if index.valid && index.key == key {
+		return index.entries, nil
+	}
+
+	entries, err := readIndexFile(f.IndexPath(), key)
+
+	if err != nil {
+		if entries, err = f.buildIndex(); err != nil {
+			return nil, err
+		}
+
+		// the data file was modified while the index was built
+		if after, err := statKey(f.Path); err != nil || after != key {
+			index.valid = false
+			return entries, nil
+		}
+
+		// the index file only saves time, errors are not fatal
+		if writeIndexFile(f.IndexPath(), key, entries) != nil {
+			os.Remove(f.IndexPath())
+		}
+	}
+
+	index.key = key
+	index.entries = entries
+	index.valid = true
+
+	return entries, nil
+}
+
+// buildIndex reads the headers of all blocks in the data file
+// blocks with invalid headers cover the entire time range, so they are never skipped
+func (f *DataFile) buildIndex() ([]IndexEntry, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	d := encoding.NewDecoder()
+	d.BlockSize = int(f.BlockSize)
+
+	header, compressed, err := readCompressedHeader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if compressed {
+		r, err := newCompressedReader(file, int64(header.BlockSize), int64(header.Blocks))
+		if err != nil {
+			return nil, err
+		}
+		d.BlockSize = int(header.BlockSize)
+		d.SetReader(r)
+	} else {
+		d.SetReader(file)
+	}
+
+	var entries []IndexEntry
+
+	for {
+		header, err := d.DecodeHeader()
+
+		switch {
+		case err == io.EOF:
+			return entries, nil
+		case isBlockError(err):
+			entries = append(entries, IndexEntry{TimeFirst: math.MinInt64, TimeLast: math.MaxInt64})
+		case err != nil:
+			return nil, err
+		default:
+			entries = append(entries, IndexEntry{
+				TimeFirst: header.TimeFirst,
+				TimeLast:  header.TimeLast,
+				NumPoints: header.NumPoints,
+				Checksum:  header.Checksum,
+			})
+		}
+	}
+}
+
+// readIndexFile reads an index file, errIndexStale is returned if it does not belong to the data file with key
+func readIndexFile(indexPath string, key fileKey) ([]IndexEntry, error) {
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(data)
+
+	var header indexHeaderRaw
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if string(header.Magic[:]) != indexMagic || header.Version != indexVersion ||
+		header.Size != key.size || header.ModTime != key.modTime ||
+		int64(len(data)) != indexHeaderSize+indexEntrySize*int64(header.Blocks) {
+		return nil, errIndexStale
+	}
+
+	raw := make([]indexEntryRaw, header.Blocks)
+	if err := binary.Read(r, binary.LittleEndian, raw); err != nil {
+		return nil, err
+	}
+
+	entries := make([]IndexEntry, len(raw))
+	for i, e := range raw {
+		entries[i] = IndexEntry{
+			TimeFirst: e.TimeFirst,
+			TimeLast:  e.TimeLast,
+			NumPoints: int(e.NumPoints),
+			Checksum:  e.Checksum,
+		}
+	}
+
+	return entries, nil
+}
+
+func indexHeader(key fileKey, blocks int) indexHeaderRaw {
+	header := indexHeaderRaw{
+		Version: indexVersion,
+		Blocks:  uint64(blocks),
+		Size:    key.size,
+		ModTime: key.modTime,
+	}
+	copy(header.Magic[:], indexMagic)
+	return header
+}
+
+func indexEntry(e IndexEntry) indexEntryRaw {
+	return indexEntryRaw{
+		TimeFirst: e.TimeFirst,
+		TimeLast:  e.TimeLast,
+		NumPoints: uint32(e.NumPoints),
+		Checksum:  e.Checksum,
+	}
+}
+
+// writeIndexFile replaces the index file of a data file
+func writeIndexFile(indexPath string, key fileKey, entries []IndexEntry) error {
+	var b bytes.Buffer
+
+	if err := binary.Write(&b, binary.LittleEndian, indexHeader(key, len(entries))); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := binary.Write(&b, binary.LittleEndian, indexEntry(e)); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(indexPath, b.Bytes(), 0644)
+}
+
+// writeIndexEntry updates the entry of block n and the header of an index file that holds all previous entries
+// the header is written last, so the index is stale if the update is interrupted
+func writeIndexEntry(indexPath string, key fileKey, entries []IndexEntry, n int) error {
+	file, err := os.OpenFile(indexPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() < indexHeaderSize+indexEntrySize*int64(n) {
+		err = errIndexStale
+	}
+
+	var b bytes.Buffer
+
+	if err == nil {
+		err = binary.Write(&b, binary.LittleEndian, indexEntry(entries[n]))
+	}
+
+	if err == nil {
+		_, err = file.WriteAt(b.Bytes(), indexHeaderSize+indexEntrySize*int64(n))
+	}
+
+	if err == nil {
+		b.Reset()
+		err = binary.Write(&b, binary.LittleEndian, indexHeader(key, len(entries)))
+	}
+
+	if err == nil {
+		_, err = file.WriteAt(b.Bytes(), 0)
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// indexBlock records block n, which was just written by WriteBlock, in the index
+// the index is dropped if it did not match the data file before the write, it is rebuilt on the next call to Index
+func (f *DataFile) indexBlock(n int64, block []byte, before fileKey) {
+	if f.index == nil {
+		return
+	}
+
+	f.index.mux.Lock()
+	defer f.index.mux.Unlock()
+
+	// the first block starts a new index
+	if n == 0 {
+		f.index.valid = true
+		f.index.key = before
+		f.index.entries = nil
+	}
+
+	err := errIndexStale
+
+	if f.index.valid && f.index.key == before && int64(len(f.index.entries)) >= n {
+		err = f.updateIndex(n, block)
+	}
+
+	if err != nil {
+		f.index.valid = false
+		os.Remove(f.IndexPath())
+	}
+}
+
+// updateIndex replaces or appends entry n of the index, must be called while holding the index mutex
+func (f *DataFile) updateIndex(n int64, block []byte) error {
+	d := encoding.NewDecoder()
+	d.BlockSize = int(f.BlockSize)
+	d.SetReader(bytes.NewReader(block))
+
+	header, err := d.DecodeHeader()
+	if err != nil {
+		return err
+	}
+
+	entry := IndexEntry{
+		TimeFirst: header.TimeFirst,
+		TimeLast:  header.TimeLast,
+		NumPoints: header.NumPoints,
+		Checksum:  header.Checksum,
+	}
+
+	// the previous entries may still be used by a reader
+	entries := make([]IndexEntry, n, n+1)
+	copy(entries, f.index.entries)
+	f.index.entries = append(entries, entry)
+
+	if f.index.key, err = statKey(f.Path); err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return writeIndexFile(f.IndexPath(), f.index.key, f.index.entries)
+	}
+	return writeIndexEntry(f.IndexPath(), f.index.key, f.index.entries, int(n))
+}
+
+// Remove deletes the data file and its index file
+func (f *DataFile) Remove() error {
+	os.Remove(f.IndexPath())
+	return os.Remove(f.Path)
+}
+
+// blockRange returns the first and last block of the index that may contain points between start and end
+// returns false if no block contains points in this range
+func blockRange(entries []IndexEntry, start, end int64) (int64, int64, bool) {
+	first := int64(-1)
+	last := int64(-1)
+
+	for i, e := range entries {
+		if first == -1 && e.TimeLast >= start {
+			first = int64(i)
+		}
+		if e.TimeFirst <= end {
+			last = int64(i)
+		}
+	}
+
+	if first == -1 || last < first {
+		return 0, 0, false
+	}
+
+	return first, last, true
+}
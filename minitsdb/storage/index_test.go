@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	df := NewDataFile(dir, 0, 1000, encoding.DefaultBlockSize)
+
+	writeTestBlock(t, df, 0)
+	writeTestBlock(t, df, 10)
+
+	// blocks written after the index was created are added to the index file
+	if _, err := df.Index(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestBlock(t, df, 20)
+	writeTestBlock(t, df, 30)
+
+	key, err := statKey(df.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readIndexFile(df.IndexPath(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 4 || entries[3].TimeFirst != 30 || entries[3].TimeLast != 39 || entries[3].NumPoints != 10 {
+		t.Fatalf("index file holds %+v", entries)
+	}
+
+	// missing index files are rebuilt
+	os.Remove(df.IndexPath())
+
+	info, err := os.Stat(df.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenDataFile(df.Path, info, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err = opened.Index(); err != nil || len(entries) != 4 || entries[2].TimeFirst != 20 {
+		t.Fatalf("rebuilt index %+v (%v)", entries, err)
+	}
+
+	if _, err := os.Stat(df.IndexPath()); err != nil {
+		t.Errorf("index file was not rebuilt: %v", err)
+	}
+
+	// only blocks in the time range are decoded
+	reader := NewFileDecoder([]*DataFile{&opened}, []bool{true})
+	reader.SetTimeRange(15, 25)
+	defer reader.Close()
+
+	for _, timeStart := range []int64{10, 20} {
+		header, err := reader.DecodeHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.TimeFirst != timeStart {
+			t.Errorf("decoded block starting at %d, expected %d", header.TimeFirst, timeStart)
+		}
+	}
+
+	if _, err := reader.DecodeHeader(); err != io.EOF {
+		t.Errorf("expected EOF after last block in range, got %v", err)
+	}
+}
+
+func TestSkipUnread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	df := NewDataFile(dir, 0, 1000, encoding.DefaultBlockSize)
+
+	writeTestBlock(t, df, 0)
+	writeTestBlock(t, df, 10)
+	writeTestBlock(t, df, 20)
+
+	reader := NewFileDecoder([]*DataFile{df}, []bool{true})
+	defer reader.Close()
+
+	// the first block is skipped without reading its header
+	if filePath, block, err := reader.Position(); err != nil || filePath != df.Path || block != 0 {
+		t.Fatalf("position %s:%d (%v), expected %s:0", filePath, block, err, df.Path)
+	}
+
+	if err := reader.SkipBlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := reader.DecodeHeader()
+	if err != nil || header.TimeFirst != 10 {
+		t.Fatalf("decoded block starting at %d (%v), expected 10", header.TimeFirst, err)
+	}
+
+	if _, block, err := reader.Position(); err != nil || block != 1 {
+		t.Errorf("position of decoded block %d (%v), expected 1", block, err)
+	}
+}
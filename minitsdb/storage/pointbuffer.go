@@ -2,8 +2,26 @@ package storage
 
 import (
 	"github.com/martin2250/minitsdb/util"
+	"math"
 )
 
+// Missing marks a value that is not stored, e.g. in blocks written before the column was added to the series
+const Missing = math.MinInt64
+
+// FloatValue converts a float to the value stored in float columns, which hold the bit pattern of the float
+// negative zero is stored as zero, as its bit pattern equals Missing
+func FloatValue(f float64) int64 {
+	if f == 0 {
+		return 0
+	}
+	return int64(math.Float64bits(f))
+}
+
+// ValueFloat converts a value of a float column back to the float
+func ValueFloat(v int64) float64 {
+	return math.Float64frombits(uint64(v))
+}
+
 type PointBuffer struct {
 	Values [][]int64
 	Need   []bool
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// Repair describes the changes RecoverDataFile made to a data file
+type Repair struct {
+	// Path of the repaired file
+	Path string
+	// TruncatedBytes is the size of the partial block that was removed from the end of the file
+	TruncatedBytes int64
+	// DroppedBlocks is the number of invalid blocks that were removed from the end of the file
+	DroppedBlocks int64
+	// Reasons lists why each of the dropped blocks was considered invalid
+	Reasons []string
+	// CorruptPath is the path of the copy of the file before it was modified
+	CorruptPath string
+}
+
+// Modified returns true if the file was changed
+func (r Repair) Modified() bool {
+	return r.TruncatedBytes != 0 || r.DroppedBlocks != 0
+}
+
+// backup copies the file before the first modification
+func (r *Repair) backup() error {
+	if r.CorruptPath != "" {
+		return nil
+	}
+
+	corruptPath := fmt.Sprintf("%s.%d.corrupt", r.Path, time.Now().Unix())
+
+	src, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(corruptPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+
+	r.CorruptPath = corruptPath
+	return nil
+}
+
+// checkBlock validates the header of a block
+// returns nil if the block looks intact
+func (f *DataFile) checkBlock(n int64) error {
+	buf, err := f.ReadBlock(n)
+	if err != nil {
+		return err
+	}
+
+	d := encoding.NewDecoder()
+	d.BlockSize = int(f.BlockSize)
+	d.SetReader(&buf)
+
+	header, err := d.DecodeHeader()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case header.NumPoints < 1:
+		return fmt.Errorf("block contains no points")
+	case header.NumColumns < 1:
+		return fmt.Errorf("block contains no columns")
+	case int64(header.BytesUsed) > f.BlockSize:
+		return fmt.Errorf("block uses %d bytes", header.BytesUsed)
+	case header.TimeFirst > header.TimeLast:
+		return fmt.Errorf("block times are not in order")
+	case header.TimeFirst < f.TimeStart || header.TimeLast > f.TimeEnd:
+		return fmt.Errorf("block times are outside of file time range")
+	}
+
+	return nil
+}
+
+// RecoverDataFile repairs the damage a crash during WriteBlock can leave at the end of a data file
+// a trailing partial block is truncated and trailing blocks with invalid headers are dropped,
+// a copy of the original file is kept with the suffix .corrupt
+// compressed data files are never written to and left unchanged
+// must be called before the file is opened with OpenDataFile
+func RecoverDataFile(filePath string, timeRange int64) (Repair, error) {
+	repair := Repair{
+		Path: filePath,
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return repair, err
+	}
+
+	timeStart, ok := ParseDataFileName(path.Base(filePath))
+	if !ok || info.IsDir() {
+		return repair, fmt.Errorf("file %s is not a data file", filePath)
+	}
+
+	df := DataFile{
+		Path:      filePath,
+		TimeStart: timeStart,
+		TimeEnd:   timeStart + timeRange - 1,
+	}
+
+	size := info.Size()
+
+	if compressed, err := IsCompressed(filePath); err != nil || compressed {
+		return repair, err
+	}
+
+	// a file too short for the first header only consists of a partial block
+	if df.BlockSize, err = FileBlockSize(filePath); err != nil {
+		df.BlockSize = encoding.DefaultBlockSize
+	}
+
+	if partial := size % df.BlockSize; partial != 0 {
+		if err := repair.backup(); err != nil {
+			return repair, err
+		}
+		size -= partial
+		if err := os.Truncate(filePath, size); err != nil {
+			return repair, err
+		}
+		repair.TruncatedBytes = partial
+	}
+
+	df.Blocks = size / df.BlockSize
+
+	for df.Blocks > 0 {
+		err := df.checkBlock(df.Blocks - 1)
+
+		if err == nil {
+			break
+		}
+
+		if err := repair.backup(); err != nil {
+			return repair, err
+		}
+
+		df.Blocks--
+		if err := os.Truncate(filePath, df.Blocks*df.BlockSize); err != nil {
+			return repair, err
+		}
+
+		repair.DroppedBlocks++
+		repair.Reasons = append(repair.Reasons, fmt.Sprintf("block %d: %v", df.Blocks, err))
+	}
+
+	return repair, nil
+}
+
+// RemoveBlocks rewrites a data file without the blocks listed in drop,
+// a copy of the original file is kept with the suffix .corrupt, compressed files are rewritten uncompressed
+func RemoveBlocks(filePath string, drop []int64) (Repair, error) {
+	repair := Repair{
+		Path: filePath,
+	}
+
+	if len(drop) == 0 {
+		return repair, nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return repair, err
+	}
+
+	if err := repair.backup(); err != nil {
+		return repair, err
+	}
+
+	src := DataFile{Path: repair.CorruptPath}
+
+	compressed, err := src.readCompressedLayout(info.Size())
+	if err != nil {
+		return repair, err
+	}
+
+	if !compressed {
+		if src.BlockSize, err = FileBlockSize(src.Path); err != nil {
+			return repair, err
+		}
+		src.Blocks = info.Size() / src.BlockSize
+	}
+
+	skip := make(map[int64]bool, len(drop))
+	for _, n := range drop {
+		skip[n] = true
+	}
+
+	pathTemp := filePath + ".tmp"
+
+	dst, err := os.OpenFile(pathTemp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return repair, err
+	}
+
+	for n := int64(0); n < src.Blocks; n++ {
+		if skip[n] {
+			repair.DroppedBlocks++
+			continue
+		}
+
+		var block bytes.Buffer
+		if block, err = src.ReadBlock(n); err != nil {
+			break
+		}
+
+		if _, err = dst.Write(block.Bytes()); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+
+	if err == nil {
+		err = os.Rename(pathTemp, filePath)
+	}
+
+	if err != nil {
+		os.Remove(pathTemp)
+		repair.DroppedBlocks = 0
+		return repair, err
+	}
+
+	return repair, nil
+}
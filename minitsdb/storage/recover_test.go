@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/martin2250/minitsdb/minitsdb/storage/encoding"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTestBlock(t *testing.T, df *DataFile, timeStart int64) {
+	times := make([]int64, 10)
+	for i := range times {
+		times[i] = timeStart + int64(i)
+	}
+
+	transformed, err := encoding.TimeTransformer.Apply(times)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var block bytes.Buffer
+	if _, err := encoding.EncodeBlockSchema(&block, 0, int(df.BlockSize), times, [][]uint64{transformed}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := df.WriteBlock(block, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverDataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	df := NewDataFile(dir, 0, 1000, 16384)
+
+	writeTestBlock(t, df, 0)
+	writeTestBlock(t, df, 10)
+	writeTestBlock(t, df, 20)
+
+	// corrupt last block and append a partial block
+	file, err := os.OpenFile(df.Path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xff, 0xff}, 2*df.BlockSize+33)
+	file.WriteAt(make([]byte, 123), 3*df.BlockSize)
+	file.Close()
+
+	repair, err := RecoverDataFile(df.Path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repair.TruncatedBytes != 123 || repair.DroppedBlocks != 1 {
+		t.Errorf("unexpected repair %+v", repair)
+	}
+
+	if info, err := os.Stat(repair.CorruptPath); err != nil || info.Size() != 3*df.BlockSize+123 {
+		t.Errorf("backup of original file missing or incomplete")
+	}
+
+	info, err := os.Stat(df.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenDataFile(df.Path, info, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opened.Blocks != 2 || opened.BlockSize != df.BlockSize {
+		t.Errorf("repaired file has %d blocks of %d bytes, expected 2 blocks of %d bytes", opened.Blocks, opened.BlockSize, df.BlockSize)
+	}
+
+	// intact files must not be modified
+	repair, err = RecoverDataFile(df.Path, 1000)
+	if err != nil || repair.Modified() {
+		t.Errorf("intact file was modified: %+v %v", repair, err)
+	}
+}
+
+func TestRemoveBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	df := NewDataFile(dir, 0, 1000, encoding.DefaultBlockSize)
+
+	writeTestBlock(t, df, 0)
+	writeTestBlock(t, df, 10)
+	writeTestBlock(t, df, 20)
+
+	repair, err := RemoveBlocks(df.Path, []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repair.DroppedBlocks != 1 || repair.CorruptPath == "" {
+		t.Errorf("unexpected repair %+v", repair)
+	}
+
+	df.Blocks = 2
+	for n, timeStart := range []int64{0, 20} {
+		buf, err := df.ReadBlock(int64(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := encoding.NewDecoder()
+		d.SetReader(&buf)
+
+		header, err := d.DecodeHeader()
+		if err != nil || header.TimeFirst != timeStart {
+			t.Errorf("block %d starts at %d (%v), expected %d", n, header.TimeFirst, err, timeStart)
+		}
+	}
+
+	if info, err := os.Stat(df.Path); err != nil || info.Size() != 2*df.BlockSize {
+		t.Errorf("repaired file has wrong size")
+	}
+}
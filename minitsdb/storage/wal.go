@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// SyncPolicy determines when the write-ahead log is synced to disk
+type SyncPolicy int
+
+const (
+	// SyncNever leaves syncing to the operating system
+	SyncNever SyncPolicy = iota
+	// SyncPoint syncs the log after every point
+	SyncPoint
+	// SyncInterval syncs the log when the sync interval has elapsed since the last sync
+	SyncInterval
+)
+
+// ParseSyncPolicy converts the policy names used in series.yaml to a SyncPolicy
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "never":
+		return SyncNever, nil
+	case "point":
+		return SyncPoint, nil
+	case "interval":
+		return SyncInterval, nil
+	}
+	return SyncNever, fmt.Errorf("unknown wal sync policy %s", s)
+}
+
+// ErrLogColumns indicates that the write-ahead log was written with a different number of columns
+var ErrLogColumns = errors.New("write-ahead log has different number of columns than series")
+
+var walMagic = [4]byte{'M', 'W', 'A', 'L'}
+
+// walVersion is the version of the log format written by Reset
+// version 1: header without schema
+// version 2: header followed by the schema version of the points
+const walVersion = 2
+
+// walHeaderRaw specifies the binary structure of the header stored at the beginning of the log
+type walHeaderRaw struct {
+	Magic   [4]byte
+	Version uint8
+	Columns uint8
+}
+
+// WriteAheadLog is an append-only log of points inserted into a primary bucket
+// that have not been written to a data file yet. Every record holds the values of one point,
+// followed by a CRC32 of these values to detect records that were only partially written
+type WriteAheadLog struct {
+	// Path to log file (absolute)
+	Path string
+	// Columns is the number of values per point, including time
+	Columns int
+	// Schema is the version of the series schema of the points appended to the log
+	Schema int
+
+	Sync     SyncPolicy
+	Interval time.Duration
+
+	file     *os.File
+	record   []byte
+	lastSync time.Time
+	unsynced bool
+}
+
+// NewWriteAheadLog creates a log struct, the file is not opened until Reset is called
+func NewWriteAheadLog(path string, columns int, sync SyncPolicy, interval time.Duration) *WriteAheadLog {
+	return &WriteAheadLog{
+		Path:     path,
+		Columns:  columns,
+		Sync:     sync,
+		Interval: interval,
+		record:   make([]byte, 8*columns+4),
+	}
+}
+
+// Replay reads all intact points from the log file and passes them to insert together with the schema version
+// they were written with, the points can have a different number of columns than the log if the schema changed
+// a missing log file is not an error, a partially written record at the end of the file is ignored
+// returns the number of points read
+func (l *WriteAheadLog) Replay(insert func(schema int, p Point) error) (int, error) {
+	file, err := os.Open(l.Path)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	var header walHeaderRaw
+	var schema uint32
+
+	err = binary.Read(r, binary.LittleEndian, &header)
+
+	if err == nil && header.Version >= 2 {
+		err = binary.Read(r, binary.LittleEndian, &schema)
+	}
+
+	if err != nil {
+		// crashed before the header was written
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if header.Magic != walMagic || header.Version < 1 || header.Version > walVersion {
+		return 0, fmt.Errorf("%s is not a write-ahead log", l.Path)
+	}
+
+	columns := int(header.Columns)
+	record := make([]byte, 8*columns+4)
+
+	var n int
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		data := record[:8*columns]
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(record[8*columns:]) {
+			// torn write, everything after this is garbage
+			return n, nil
+		}
+
+		p := Point{Values: make([]int64, columns)}
+		for i := range p.Values {
+			p.Values[i] = int64(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+
+		if err := insert(int(schema), p); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func (l *WriteAheadLog) encodeRecord(p Point) []byte {
+	for i, v := range p.Values {
+		binary.LittleEndian.PutUint64(l.record[8*i:], uint64(v))
+	}
+	binary.LittleEndian.PutUint32(l.record[8*l.Columns:], crc32.ChecksumIEEE(l.record[:8*l.Columns]))
+	return l.record
+}
+
+// Append writes a point to the end of the log and syncs it according to the sync policy
+func (l *WriteAheadLog) Append(p Point) error {
+	if l.file == nil {
+		return errors.New("write-ahead log is not open")
+	}
+
+	if len(p.Values) != l.Columns {
+		return ErrLogColumns
+	}
+
+	if _, err := l.file.Write(l.encodeRecord(p)); err != nil {
+		return err
+	}
+
+	l.unsynced = true
+
+	if l.Sync == SyncPoint {
+		return l.syncNow()
+	}
+
+	return l.SyncDue()
+}
+
+// SyncDue syncs the log if the sync policy is SyncInterval and the interval has elapsed
+// should be called regularly so the last points are synced even when no new points arrive
+func (l *WriteAheadLog) SyncDue() error {
+	if l.Sync != SyncInterval || !l.unsynced {
+		return nil
+	}
+
+	if time.Since(l.lastSync) < l.Interval {
+		return nil
+	}
+
+	return l.syncNow()
+}
+
+func (l *WriteAheadLog) syncNow() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.lastSync = time.Now()
+	l.unsynced = false
+	return nil
+}
+
+// Reset replaces the log with one that only contains the points in buffer
+// this is called after points were written to a data file, so the log does not grow indefinitely
+// the new log is written to a temporary file and renamed, so a crash never leaves the log empty
+func (l *WriteAheadLog) Reset(buffer PointBuffer) error {
+	if buffer.Cols() != l.Columns {
+		return ErrLogColumns
+	}
+
+	pathTemp := l.Path + ".tmp"
+
+	file, err := os.OpenFile(pathTemp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+
+	header := walHeaderRaw{
+		Magic:   walMagic,
+		Version: walVersion,
+		Columns: uint8(l.Columns),
+	}
+
+	err = binary.Write(w, binary.LittleEndian, header)
+
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, uint32(l.Schema))
+	}
+
+	for i := 0; err == nil && i < buffer.Len(); i++ {
+		_, err = w.Write(l.encodeRecord(buffer.At(i)))
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	// the log is replaced by the rename, so the new file must be complete on disk regardless of the sync policy
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := os.Rename(pathTemp, l.Path); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := syncDir(path.Dir(l.Path)); err != nil {
+		file.Close()
+		return err
+	}
+
+	// keep appending to the new file
+	l.Close()
+	l.file = file
+	l.lastSync = time.Now()
+	l.unsynced = false
+
+	return nil
+}
+
+// syncDir syncs a directory, so a file renamed into it persists
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+
+	if errClose := d.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Close closes the log file, the log can be re-opened with Reset
+func (l *WriteAheadLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := NewWriteAheadLog(path.Join(dir, "wal"), 3, SyncPoint, 0)
+	l.Schema = 3
+
+	// start with a single buffered point
+	buffer := NewPointBuffer(3)
+	buffer.AppendPoint(Point{Values: []int64{1, 10, 100}})
+
+	if err := l.Reset(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(2); i < 5; i++ {
+		if err := l.Append(Point{Values: []int64{i, 10 * i, 100 * i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.Close()
+
+	// simulate torn write of the last record
+	info, err := os.Stat(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(l.Path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []Point
+	n, err := l.Replay(func(schema int, p Point) error {
+		replayed = append(replayed, p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 || len(replayed) != 3 {
+		t.Fatalf("replayed %d points, expected 3", n)
+	}
+
+	for i, p := range replayed {
+		time := int64(i + 1)
+		if p.Values[0] != time || p.Values[1] != 10*time || p.Values[2] != 100*time {
+			t.Errorf("replayed point %d incorrect: %v", i, p.Values)
+		}
+	}
+
+	// points are replayed with the columns and schema they were written with
+	other := NewWriteAheadLog(l.Path, 2, SyncNever, 0)
+	if _, err := other.Replay(func(schema int, p Point) error {
+		if schema != 3 || len(p.Values) != 3 {
+			t.Errorf("replayed point with schema %d and %d columns, expected 3 and 3", schema, len(p.Values))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
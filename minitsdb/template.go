@@ -0,0 +1,189 @@
+package minitsdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/martin2250/minitsdb/pkg/lineprotocol"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SeriesTemplate describes the series that are created for incoming points that don't match any series
+type SeriesTemplate struct {
+	// Tags must all be present in the series tags of a point, values of format /.../ are treated as regexes
+	Tags map[string]string
+	// Series is the configuration of created series, tags and columns are taken from the point
+	Series YamlSeriesConfig
+	// Column is the configuration of every column, the tags of each value of the point are added
+	Column YamlColumnConfig
+}
+
+// ErrTemplateColumns indicates that a template sets tags or duplicates, which are taken from the point
+var ErrTemplateColumns = errors.New("template must not declare columns, column tags or duplicates")
+
+// Check checks the template for errors, using placeholder tags for the series and columns
+func (t SeriesTemplate) Check() error {
+	for _, pattern := range t.Tags {
+		if isPattern(pattern) {
+			if _, err := regexp.Compile(pattern[1 : len(pattern)-1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(t.Series.Tags) > 0 || len(t.Series.Columns) > 0 || len(t.Column.Tags) > 0 || len(t.Column.Duplicate) > 0 {
+		return ErrTemplateColumns
+	}
+
+	_, err := t.config(lineprotocol.Point{
+		Series: []lineprotocol.KVP{{Key: "name", Value: "template"}},
+		Values: []lineprotocol.Value{{Tags: []lineprotocol.KVP{{Key: "name", Value: "template"}}}},
+	})
+
+	return err
+}
+
+// Matches checks if the series tags of a point match all tags of the template
+func (t SeriesTemplate) Matches(point lineprotocol.Point) bool {
+Tags:
+	for key, pattern := range t.Tags {
+		for _, kvp := range point.Series {
+			if kvp.Key == key && matchPattern(pattern, kvp.Value, true) {
+				continue Tags
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// config creates the configuration of the series for a point
+func (t SeriesTemplate) config(point lineprotocol.Point) (YamlSeriesConfig, error) {
+	conf := t.Series
+
+	conf.Tags = kvpMap(point.Series)
+	conf.Columns = make([]YamlColumnConfig, len(point.Values))
+
+	for i, v := range point.Values {
+		conf.Columns[i] = t.Column
+		conf.Columns[i].Tags = kvpMap(v.Tags)
+	}
+
+	if err := conf.Check(); err != nil {
+		return YamlSeriesConfig{}, err
+	}
+
+	return conf, nil
+}
+
+func kvpMap(kvps []lineprotocol.KVP) map[string]string {
+	m := make(map[string]string, len(kvps))
+	for _, kvp := range kvps {
+		m[kvp.Key] = kvp.Value
+	}
+	return m
+}
+
+// seriesDirectory returns an unused directory for a series, named after its name followed by its other tag values
+func (db *Database) seriesDirectory(tags map[string]string) (string, error) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		if key != "name" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := []string{tags["name"]}
+	for _, key := range keys {
+		parts = append(parts, tags[key])
+	}
+
+	for i := range parts {
+		parts[i] = strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+				return r
+			}
+			return '_'
+		}, parts[i])
+	}
+
+	name := strings.Join(parts, ".")
+
+	// tag values that only differ in replaced characters get numbered directories
+	for i := 0; i < 100; i++ {
+		dir := name
+		if i > 0 {
+			dir = fmt.Sprintf("%s.%d", name, i)
+		}
+
+		dir = path.Join(db.Path, dir)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return dir, nil
+		}
+	}
+
+	return "", fmt.Errorf("no unused directory for series %s", name)
+}
+
+// CreateSeries creates a series for a point from the first matching template and adds it to the database
+// returns ErrSeriesUnknown if no template matches the point. db.Series is replaced by a new slice,
+// so all pointers to series of the database must be looked up again afterwards
+func (db *Database) CreateSeries(point lineprotocol.Point, templates []SeriesTemplate) (*Series, error) {
+	var template *SeriesTemplate
+	for i := range templates {
+		if templates[i].Matches(point) {
+			template = &templates[i]
+			break
+		}
+	}
+
+	if template == nil {
+		return nil, ErrSeriesUnknown
+	}
+
+	conf, err := template.config(point)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := db.seriesDirectory(conf.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "series.yaml"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s, err := OpenSeries(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s.useCache(db.Cache)
+
+	series := make([]Series, 0, len(db.Series)+1)
+	series = append(series, db.Series...)
+	series = append(series, s)
+	db.setSeries(series)
+
+	return &db.Series[len(db.Series)-1], nil
+}
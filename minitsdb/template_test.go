@@ -0,0 +1,176 @@
+package minitsdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/martin2250/minitsdb/pkg/lineprotocol"
+	"gopkg.in/yaml.v2"
+)
+
+const testTemplate = `
+tags:
+  name: /sensor.*/
+series:
+  flushinterval: 10s
+  flushcount: 50
+  forceflushcount: 100
+  pointsfile: 1000
+  buckets:
+    - factor: 1
+    - factor: 10
+column:
+  decimals: 1
+`
+
+func parseTestTemplate(t *testing.T, template string) SeriesTemplate {
+	var st SeriesTemplate
+	if err := yaml.UnmarshalStrict([]byte(template), &st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func parseTestPoint(t *testing.T, line string) lineprotocol.Point {
+	point, err := lineprotocol.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return point
+}
+
+func TestSeriesTemplateMatches(t *testing.T) {
+	st := parseTestTemplate(t, testTemplate)
+	st.Tags["loc"] = "garage"
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"name:sensor1 loc:garage|name:temp 1.5|1000", true},
+		{"name:sensor loc:garage room:a|name:temp 1.5|1000", true},
+		{"name:sensor1 loc:kitchen|name:temp 1.5|1000", false},
+		{"name:sensor1|name:temp 1.5|1000", false},
+		{"name:meter loc:garage|name:temp 1.5|1000", false},
+	}
+
+	for _, tt := range tests {
+		if got := st.Matches(parseTestPoint(t, tt.line)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSeriesTemplateCheck(t *testing.T) {
+	if err := parseTestTemplate(t, testTemplate).Check(); err != nil {
+		t.Errorf("valid template: %v", err)
+	}
+
+	columns := parseTestTemplate(t, testTemplate+"  tags:\n    name: a\n")
+	if err := columns.Check(); !errors.Is(err, ErrTemplateColumns) {
+		t.Errorf("expected ErrTemplateColumns for column tags, got %v", err)
+	}
+
+	regex := parseTestTemplate(t, testTemplate)
+	regex.Tags["name"] = "/(/"
+	if err := regex.Check(); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+
+	// the series configuration is checked with placeholder tags
+	invalid := parseTestTemplate(t, testTemplate)
+	invalid.Series.PointsFile = 10
+	if err := invalid.Check(); err == nil {
+		t.Error("expected error for invalid series configuration")
+	}
+}
+
+func TestSeriesDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other tags are sorted by key, characters other than letters, digits, - and _ are replaced
+	got, err := db.seriesDirectory(map[string]string{"name": "sensor", "room": "a/b", "loc": "garage 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := path.Join(dir, "sensor.garage_1.a_b"); got != want {
+		t.Errorf("got directory %s, want %s", got, want)
+	}
+
+	if err := os.Mkdir(got, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// tag values that sanitize to the same directory are numbered
+	got, err = db.seriesDirectory(map[string]string{"name": "sensor", "room": "a_b", "loc": "garage.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := path.Join(dir, "sensor.garage_1.a_b.1"); got != want {
+		t.Errorf("got directory %s, want %s", got, want)
+	}
+}
+
+func TestCreateSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates := []SeriesTemplate{parseTestTemplate(t, testTemplate)}
+
+	if _, err := db.CreateSeries(parseTestPoint(t, "name:meter|name:power 1.5|1000"), templates); err != ErrSeriesUnknown {
+		t.Errorf("expected ErrSeriesUnknown for point without matching template, got %v", err)
+	}
+
+	point := parseTestPoint(t, "name:sensor loc:garage|name:temp 1.5|name:hum 40|1000")
+
+	s, err := db.CreateSeries(point, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Path != path.Join(dir, "sensor.garage") || len(db.Series) != 1 {
+		t.Fatalf("created series %s, database has %d series", s.Path, len(db.Series))
+	}
+
+	if _, p, err := db.AssociatePoint(point); err != nil {
+		t.Errorf("point does not match created series: %v", err)
+	} else if err := s.InsertPoint(p); err != nil {
+		t.Error(err)
+	}
+
+	// the generated configuration is loaded again when the database is opened
+	reopened, err := OpenSeries(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened.Tags["name"] != "sensor" || reopened.Tags["loc"] != "garage" || len(reopened.Columns) != 2 {
+		t.Errorf("unexpected reopened series tags %v with %d columns", reopened.Tags, len(reopened.Columns))
+	}
+
+	if reopened.Columns[0].Tags["name"] != "temp" || reopened.Columns[1].Decimals != 1 || len(reopened.Buckets) != 2 {
+		t.Errorf("unexpected reopened columns %+v", reopened.Columns)
+	}
+}
@@ -57,7 +57,18 @@ func (p Point) String() string {
 
 var ErrInvalidFormat = errors.New("invalid format")
 
+// Parse parses a line with numeric values
 func Parse(line string) (Point, error) {
+	return parse(line, IsNumber)
+}
+
+// ParseStates parses a line whose values may also be labels of states, e.g. on or heating
+// labels are only valid for state columns, the consumer must check the values of all other columns with IsNumber
+func ParseStates(line string) (Point, error) {
+	return parse(line, IsValue)
+}
+
+func parse(line string, isValue func(string) bool) (Point, error) {
 	parts := strings.Split(line, "|")
 
 	for i := range parts {
@@ -99,7 +110,7 @@ func Parse(line string) (Point, error) {
 	values := make([]Value, len(parts))
 
 	for i := range parts {
-		values[i], err = parseValue(parts[i])
+		values[i], err = parseValue(parts[i], isValue)
 
 		if err != nil {
 			return Point{}, err
@@ -113,7 +124,28 @@ func Parse(line string) (Point, error) {
 	}, nil
 }
 
-func parseValue(text string) (Value, error) {
+// IsNumber returns true if text only contains characters allowed in numeric values
+func IsNumber(text string) bool {
+	for _, c := range text {
+		if (c < '0' || c > '9') && c != '.' && c != '-' && c != '+' {
+			return false
+		}
+	}
+	return text != ""
+}
+
+// IsValue returns true if text only contains characters allowed in values
+// values are numbers or labels of states, e.g. on or heating
+func IsValue(text string) bool {
+	for _, c := range text {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != '.' && c != '-' && c != '+' && c != '_' {
+			return false
+		}
+	}
+	return text != ""
+}
+
+func parseValue(text string, isValue func(string) bool) (Value, error) {
 	parts := strings.Fields(strings.TrimSpace(text))
 
 	// need at least name and value
@@ -123,10 +155,8 @@ func parseValue(text string) (Value, error) {
 
 	parts, valueString := parts[:len(parts)-1], parts[len(parts)-1]
 
-	for _, c := range valueString {
-		if (c < '0' || c > '9') && c != '.' && c != '-' && c != '+' {
-			return Value{}, ErrInvalidFormat
-		}
+	if !isValue(valueString) {
+		return Value{}, ErrInvalidFormat
 	}
 
 	tags, err := parseKVPs(parts)
@@ -34,6 +34,32 @@ func TestParse(t *testing.T) {
 				Time: 3453453,
 			},
 		},
+		// labels of states are only parsed by ParseStates
+		{
+			name:    "label",
+			args:    args{line: "name:main|name:mode heating|3453453"},
+			wantErr: true,
+		},
+		{
+			name:    "exponent",
+			args:    args{line: "name:main|name:a 1e3|3453453"},
+			wantErr: true,
+		},
+		{
+			name:    "not a number",
+			args:    args{line: "name:main|name:a NaN|3453453"},
+			wantErr: true,
+		},
+		{
+			name:    "underscore",
+			args:    args{line: "name:main|name:a 1_000|3453453"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			args:    args{line: "name:main|name:mode heat/cool|3453453"},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -48,3 +74,33 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestParseStates(t *testing.T) {
+	got, err := lineprotocol.ParseStates("name:main|name:mode heating|name:a 1.2|3453453")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := lineprotocol.Point{
+		Series: []lineprotocol.KVP{{Key: "name", Value: "main"}},
+		Values: []lineprotocol.Value{
+			{Tags: []lineprotocol.KVP{{Key: "name", Value: "mode"}}, Value: "heating"},
+			{Tags: []lineprotocol.KVP{{Key: "name", Value: "a"}}, Value: "1.2"},
+		},
+		Time: 3453453,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseStates() got = %v, want %v", got, want)
+	}
+
+	for _, line := range []string{"name:main|name:mode heat/cool|3453453", "name:main|name:mode on off|3453453", "name:main|name:mode |3453453"} {
+		if _, err := lineprotocol.ParseStates(line); err == nil {
+			t.Errorf("ParseStates(%q) expected error", line)
+		}
+	}
+
+	if !lineprotocol.IsNumber("-1.5") || lineprotocol.IsNumber("on") || lineprotocol.IsNumber("") {
+		t.Error("unexpected result of IsNumber")
+	}
+}
@@ -19,11 +19,26 @@ type AnalyzeResult struct {
 	NumPoints, PointsMin, PointsMax int64
 	PointsMean, PointsStdev         float64
 	BytesUsed, BytesTotal           int64
+	BlockSize                       int
 }
 
 // Analyze reads all blocks from a file, decodes the headers and calculates statistics
 func Analyze(r io.ReadSeeker) (result AnalyzeResult, err error) {
+	result.BlockSize, err = encoding.ReadBlockSize(r)
+
+	if err != nil {
+		if err == io.EOF {
+			err = ErrFileEmpty
+		}
+		return
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
 	dec := encoding.NewDecoder()
+	dec.BlockSize = result.BlockSize
 	dec.SetReader(r)
 	header, err := dec.DecodeHeader()
 
@@ -42,7 +57,7 @@ func Analyze(r io.ReadSeeker) (result AnalyzeResult, err error) {
 	result.PointsMax = int64(header.NumPoints)
 
 	result.BytesUsed = int64(header.BytesUsed)
-	result.BytesTotal = 4096
+	result.BytesTotal = int64(result.BlockSize)
 
 	var pointsSquared = result.NumPoints * result.NumPoints
 
@@ -86,7 +101,7 @@ func Analyze(r io.ReadSeeker) (result AnalyzeResult, err error) {
 		result.NumBlocks++
 
 		result.BytesUsed += int64(header.BytesUsed)
-		result.BytesTotal += 4096
+		result.BytesTotal += int64(result.BlockSize)
 	}
 
 	result.PointsMean = float64(result.NumPoints) / float64(result.NumBlocks)
@@ -53,9 +53,9 @@ func IsSubset(a map[string]string, b map[string]string) bool {
 	return true
 }
 
-// ReadBlock reads a 4k block from a reader and returns it as bytes.Buffer
-func ReadBlock(r io.Reader) (bytes.Buffer, error) {
-	lr := io.LimitReader(r, 4096)
+// ReadBlock reads a block of size bytes from a reader and returns it as bytes.Buffer
+func ReadBlock(r io.Reader, size int64) (bytes.Buffer, error) {
+	lr := io.LimitReader(r, size)
 	var b bytes.Buffer
 
 	n, err := b.ReadFrom(lr)
@@ -68,7 +68,7 @@ func ReadBlock(r io.Reader) (bytes.Buffer, error) {
 		return bytes.Buffer{}, io.EOF
 	}
 
-	if n != 4096 {
+	if n != size {
 		return bytes.Buffer{}, io.ErrUnexpectedEOF
 	}
 